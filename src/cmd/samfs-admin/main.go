@@ -0,0 +1,179 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/src/samfs"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: samfs-admin [flags] command
+commands:
+  clients               list the clients connected to the server
+  stats                 print the server's state and metrics
+  evict <address>       revoke the state of a client and refuse its connection
+  read-only <on|off>    stop or resume accepting changes to the export
+  reload                read the server's config file again and apply it
+  drain                 wait for requests in flight and stop the server
+  health                check whether the server is serving
+flags:
+`)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func unixTime(sec int64) string {
+	return time.Unix(sec, 0).Format(time.RFC3339)
+}
+
+func main() {
+	flag.Usage = usage
+	server := flag.String("server", "127.0.0.1", "server IP or name")
+	port := flag.String("port", "24100", "server port")
+	useTLS := flag.Bool("tls", false, "connect to the server over tls")
+	tlsCA := flag.String("tls-ca", "",
+		"CA that signed the server certificate, system roots if empty")
+	tlsCert := flag.String("tls-cert", "", "client certificate for mutual tls")
+	tlsKey := flag.String("tls-key", "", "client certificate key")
+	tokenFile := flag.String("token-file", "",
+		"file holding the token of an admin identity")
+	drainTimeout := flag.Duration("drain-timeout", 0,
+		"stop the server anyway once drain has waited this long, never if 0")
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+	}
+
+	var tlsOpts *samfs.TLSOptions
+	if *useTLS {
+		tlsOpts = &samfs.TLSOptions{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsCA,
+		}
+	}
+	var token string
+	if *tokenFile != "" {
+		var err error
+		token, err = samfs.LoadToken(*tokenFile)
+		if err != nil {
+			glog.Errorf("failed to read token : %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	conn, err := samfs.Dial(*server, *port, tlsOpts, token)
+	if err != nil {
+		glog.Errorf("connection failed : %s", err.Error())
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	timeout := 10 * time.Second
+	if flag.Arg(0) == "drain" {
+		timeout += *drainTimeout
+		if *drainTimeout == 0 {
+			timeout = 24 * time.Hour
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := run(ctx, conn, flag.Args(), *drainTimeout); err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed : %s\n", flag.Arg(0), err.Error())
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, conn *grpc.ClientConn, args []string,
+	drainTimeout time.Duration) error {
+
+	admin := pb.NewAdminClient(conn)
+	switch args[0] {
+	case "clients":
+		resp, err := admin.ListClients(ctx, &pb.ListClientsRequest{})
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w,
+			"ADDRESS\tIDENTITY\tMOUNTS\tCONNECTED\tLAST ACTIVE\tIN FLIGHT\tREQUESTS\t")
+		for _, c := range resp.Clients {
+			address := c.Address
+			if c.Evicted {
+				address += " (evicted)"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t\n", address, c.Identity,
+				strings.Join(c.Mounts, ","), unixTime(c.ConnectedAt),
+				unixTime(c.LastActivity), c.InFlight, c.Requests)
+		}
+		return w.Flush()
+	case "stats":
+		resp, err := admin.GetStats(ctx, &pb.GetStatsRequest{})
+		if err != nil {
+			return err
+		}
+		fmt.Printf("session %d started %s\n", resp.ServerSessionID,
+			unixTime(resp.StartedAt))
+		fmt.Printf("read-only %t, draining %t\n", resp.ReadOnly, resp.Draining)
+		fmt.Printf("%d clients, %d requests in flight\n", resp.Clients,
+			resp.InFlight)
+		hitRate := 0.0
+		if lookups := resp.FdCacheHits + resp.FdCacheMisses; lookups > 0 {
+			hitRate = 100 * float64(resp.FdCacheHits) / float64(lookups)
+		}
+		fmt.Printf("open file cache: %d hits, %d misses, %.1f%% hit rate\n\n",
+			resp.FdCacheHits, resp.FdCacheMisses, hitRate)
+		fmt.Print(resp.Metrics)
+		return nil
+	case "evict":
+		if len(args) != 2 {
+			usage()
+		}
+		_, err := admin.EvictClient(ctx, &pb.EvictClientRequest{Address: args[1]})
+		return err
+	case "read-only":
+		if len(args) != 2 || (args[1] != "on" && args[1] != "off") {
+			usage()
+		}
+		_, err := admin.SetReadOnly(ctx,
+			&pb.SetReadOnlyRequest{ReadOnly: args[1] == "on"})
+		return err
+	case "reload":
+		_, err := admin.Reload(ctx, &pb.ReloadRequest{})
+		return err
+	case "drain":
+		resp, err := admin.Drain(ctx, &pb.DrainRequest{
+			TimeoutMillis: int64(drainTimeout / time.Millisecond),
+		})
+		if err != nil {
+			return err
+		}
+		if resp.Abandoned > 0 {
+			fmt.Printf("stopped with %d requests still in flight\n",
+				resp.Abandoned)
+		}
+		return nil
+	case "health":
+		resp, err := pb.NewHealthClient(conn).Check(ctx,
+			&pb.HealthCheckRequest{})
+		if err != nil {
+			return err
+		}
+		fmt.Println(resp.Status)
+		if resp.Status != pb.HealthCheckResponse_SERVING {
+			os.Exit(1)
+		}
+		return nil
+	default:
+		usage()
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/src/samfs"
+	"golang.org/x/net/context"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: samfs-quota [-path path] [-uid uid] [-all]\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func limit(n int64) string {
+	if n == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d", n)
+}
+
+func main() {
+	flag.Usage = usage
+	server := flag.String("server", "127.0.0.1", "server IP or name")
+	port := flag.String("port", "24100", "server port")
+	fsPath := flag.String("path", "/",
+		"report the quotas of the trees above this path in the export")
+	uid := flag.Int64("uid", int64(os.Getuid()), "report the usage of this uid")
+	all := flag.Bool("all", false, "report every quota and the usage of every uid")
+	useTLS := flag.Bool("tls", false, "connect to the server over tls")
+	tlsCA := flag.String("tls-ca", "",
+		"CA that signed the server certificate, system roots if empty")
+	tlsCert := flag.String("tls-cert", "", "client certificate for mutual tls")
+	tlsKey := flag.String("tls-key", "", "client certificate key")
+	tokenFile := flag.String("token-file", "",
+		"file holding the token to authenticate with")
+	flag.Parse()
+
+	var tlsOpts *samfs.TLSOptions
+	if *useTLS {
+		tlsOpts = &samfs.TLSOptions{
+			CertFile: *tlsCert,
+			KeyFile:  *tlsKey,
+			CAFile:   *tlsCA,
+		}
+	}
+	var token string
+	if *tokenFile != "" {
+		var err error
+		token, err = samfs.LoadToken(*tokenFile)
+		if err != nil {
+			glog.Errorf("failed to read token : %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	conn, err := samfs.Dial(*server, *port, tlsOpts, token)
+	if err != nil {
+		glog.Errorf("connection failed : %s", err.Error())
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := pb.NewNFSClient(conn).GetQuota(ctx, &pb.GetQuotaRequest{
+		Path: *fsPath,
+		Uid:  *uid,
+		All:  *all,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get quotas : %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tTARGET\tBYTES\tLIMIT\tINODES\tLIMIT")
+	for _, q := range resp.Quotas {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%d\t%s\n", q.Kind, q.Target,
+			q.BytesUsed, limit(q.BytesLimit), q.InodesUsed, limit(q.InodesLimit))
+	}
+	w.Flush()
+}
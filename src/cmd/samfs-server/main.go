@@ -1,18 +1,39 @@
 package main
 
 import (
-	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/golang/glog"
 	"github.com/smihir/samfs/src/samfs"
 )
 
 var (
+	configFile    *string
 	rootDirectory *string
 	port          *string
+	compression   *bool
+	tlsCert       *string
+	tlsKey        *string
+	tlsClientCA   *string
+	tlsSubjects   *string
+	authSecret    *string
+	authPolicy    *string
+	mintToken     *string
+	tokenTTL      *time.Duration
+	quotaFile     *string
+	quotaDB       *string
+	auditLog      *string
+	auditMaxSize  *int64
+	auditMaxFiles *int
+	metricsAddr   *string
+	slowThreshold *time.Duration
+	shutdownTime  *time.Duration
 )
 
 func usage() {
@@ -22,18 +43,179 @@ func usage() {
 }
 
 func init() {
+	defaults := samfs.DefaultExportConfig()
 	flag.Usage = usage
+	configFile = flag.String("config", "",
+		"json file describing the exports, the flags below override its "+
+			"settings if it has a single export")
 	rootDirectory = flag.String("root", "", "this is root of the FS")
-	port = flag.String("port", "24100", "this is port of communication")
+	port = flag.String("port", strings.TrimPrefix(defaults.Listen, ":"),
+		"this is port of communication")
+	compression = flag.Bool("compression", defaults.Compression,
+		"let clients compress read and write data")
+	tlsCert = flag.String("tls-cert", "", "server certificate, enables tls")
+	tlsKey = flag.String("tls-key", "", "server certificate key")
+	tlsClientCA = flag.String("tls-client-ca", "",
+		"CA client certificates must be signed by, enables mutual tls")
+	tlsSubjects = flag.String("tls-allowed-subjects", "",
+		"comma separated common names of the client certificates allowed")
+	authSecret = flag.String("auth-secret-file", "",
+		"file holding the secret tokens are signed with, enables tokens")
+	authPolicy = flag.String("auth-policy-file", "",
+		`file listing the identities allowed to use the export, one per line `+
+			`followed by "ro", "rw" or "admin"`)
+	mintToken = flag.String("mint-token", "",
+		"print a token for this identity signed with -auth-secret-file and exit")
+	tokenTTL = flag.Duration("token-ttl", 0,
+		"validity of the token printed by -mint-token, forever if 0")
+	quotaFile = flag.String("quota-file", "",
+		`file with one quota per line: "uid <uid> <bytes> <inodes>" or `+
+			`"dir <directory> <bytes> <inodes>", 0 for no limit`)
+	quotaDB = flag.String("quota-db", "",
+		"file quota usage is kept in, -quota-file with .usage appended if empty")
+	auditLog = flag.String("audit-log", "",
+		"file to record every change made through the export in")
+	auditMaxSize = flag.Int64("audit-log-max-size", defaults.AuditLog.MaxSize,
+		"size in bytes after which the audit log is rotated, never if 0")
+	auditMaxFiles = flag.Int("audit-log-max-files", defaults.AuditLog.MaxFiles,
+		"number of rotated audit logs kept")
+	metricsAddr = flag.String("metrics-addr", "",
+		"address to serve prometheus metrics and pprof on over http, "+
+			"e.g. :9100")
+	slowThreshold = flag.Duration("slow-request-threshold", 0,
+		"log requests that take at least this long, never if 0")
+	shutdownTime = flag.Duration("shutdown-timeout", 30*time.Second,
+		"how long requests in flight get to finish when stopping or upgrading")
 	flag.Parse()
 }
 
-func main() {
-	if *rootDirectory == "" {
+// overrides sets what a flag configures on an export.
+var overrides = map[string]func(e *samfs.ExportConfig){
+	"root":        func(e *samfs.ExportConfig) { e.Root = *rootDirectory },
+	"port":        func(e *samfs.ExportConfig) { e.Listen = ":" + *port },
+	"compression": func(e *samfs.ExportConfig) { e.Compression = *compression },
+	"tls-cert":    func(e *samfs.ExportConfig) { e.TLS.Cert = *tlsCert },
+	"tls-key":     func(e *samfs.ExportConfig) { e.TLS.Key = *tlsKey },
+	"tls-client-ca": func(e *samfs.ExportConfig) {
+		e.TLS.ClientCA = *tlsClientCA
+	},
+	"tls-allowed-subjects": func(e *samfs.ExportConfig) {
+		e.TLS.AllowedSubjects = nil
+		if *tlsSubjects != "" {
+			e.TLS.AllowedSubjects = strings.Split(*tlsSubjects, ",")
+		}
+	},
+	"auth-secret-file": func(e *samfs.ExportConfig) {
+		e.Auth.SecretFile = *authSecret
+	},
+	"auth-policy-file": func(e *samfs.ExportConfig) {
+		e.Auth.PolicyFile = *authPolicy
+	},
+	"quota-file": func(e *samfs.ExportConfig) { e.Quotas.File = *quotaFile },
+	"quota-db":   func(e *samfs.ExportConfig) { e.Quotas.DB = *quotaDB },
+	"audit-log":  func(e *samfs.ExportConfig) { e.AuditLog.File = *auditLog },
+	"audit-log-max-size": func(e *samfs.ExportConfig) {
+		e.AuditLog.MaxSize = *auditMaxSize
+	},
+	"audit-log-max-files": func(e *samfs.ExportConfig) {
+		e.AuditLog.MaxFiles = *auditMaxFiles
+	},
+	"metrics-addr": func(e *samfs.ExportConfig) {
+		e.Metrics.Listen = *metricsAddr
+	},
+	"slow-request-threshold": func(e *samfs.ExportConfig) {
+		e.Metrics.SlowRequestThreshold = samfs.Duration(*slowThreshold)
+	},
+}
+
+// loadConfig reads -config, or starts from the defaults, and applies the
+// flags given on the command line.
+func loadConfig() (*samfs.Config, error) {
+	cfg := &samfs.Config{
+		Exports: []samfs.ExportConfig{samfs.DefaultExportConfig()},
+	}
+	if *configFile != "" {
+		var err error
+		if cfg, err = samfs.LoadConfig(*configFile); err != nil {
+			return nil, err
+		}
+	} else if *rootDirectory == "" {
 		usage()
 	}
-	s, _ := samfs.NewServer(*rootDirectory, *port)
-	s.Run()
-	e := errors.New("samfs server stub")
-	glog.Errorf(e.Error())
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		override, ok := overrides[f.Name]
+		if !ok || err != nil {
+			return
+		}
+		if len(cfg.Exports) != 1 {
+			err = fmt.Errorf("-%s cannot override %s, it has %d exports",
+				f.Name, *configFile, len(cfg.Exports))
+			return
+		}
+		override(&cfg.Exports[0])
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfg, cfg.Validate()
+}
+
+func main() {
+	if *mintToken != "" {
+		secret, err := samfs.LoadSecret(*authSecret)
+		if err != nil {
+			glog.Errorf("failed to read secret : %s", err.Error())
+			os.Exit(1)
+		}
+		var expiry time.Time
+		if *tokenTTL > 0 {
+			expiry = time.Now().Add(*tokenTTL)
+		}
+		fmt.Println(samfs.NewToken(secret, *mintToken, expiry))
+		return
+	}
+	group := samfs.NewServerGroup(loadConfig)
+	if err := group.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to start : %s\n", err.Error())
+		os.Exit(2)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			glog.Infof("reloading %s on SIGHUP", *configFile)
+			//failures are logged by the group, the old config stays in use
+			group.Reload()
+		}
+	}()
+
+	upgrade := make(chan os.Signal, 1)
+	signal.Notify(upgrade, syscall.SIGUSR2)
+	go func() {
+		for range upgrade {
+			glog.Infof("upgrading to %s on SIGUSR2", os.Args[0])
+			if err := group.Upgrade(os.Args, *shutdownTime); err != nil {
+				glog.Errorf("upgrade failed, still serving : %s", err.Error())
+			}
+		}
+	}()
+
+	stop := make(chan os.Signal, 2)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		glog.Infof("draining on %v, send it again to exit at once", sig)
+		go group.Shutdown(*shutdownTime)
+		sig = <-stop
+		glog.Warningf("exiting on %v without draining", sig)
+		glog.Flush()
+		os.Exit(1)
+	}()
+
+	group.Wait()
+	glog.Infof("samfs server stopped")
+	glog.Flush()
 }
@@ -20,11 +20,59 @@ func main() {
 	server := flag.String("server", "127.0.0.1", "server IP or name")
 	port := flag.String("port", "24100", "server port")
 	mountDir := flag.String("mount", "test", "mount directory")
+	checksum := flag.String("checksum", "crc32c",
+		"checksum of read and write data: none, crc32c or sha256")
+	compression := flag.Bool("compression", true,
+		"compress read and write data if the server allows it")
+	useTLS := flag.Bool("tls", false, "connect to the server over tls")
+	tlsCA := flag.String("tls-ca", "",
+		"CA that signed the server certificate, system roots if empty")
+	tlsCert := flag.String("tls-cert", "", "client certificate for mutual tls")
+	tlsKey := flag.String("tls-key", "", "client certificate key")
+	tlsServerName := flag.String("tls-server-name", "",
+		"name to verify the server certificate against, -server if empty")
+	tokenFile := flag.String("token-file", "",
+		"file holding the token to authenticate with")
+	debugAddr := flag.String("debug-addr", "",
+		"address to serve request traces and pprof on over http, e.g. "+
+			"localhost:6060")
+	slowThreshold := flag.Duration("slow-request-threshold", 0,
+		"log file system operations that take at least this long, never if 0")
+	syncWrites := flag.Bool("sync", false,
+		"make every write stable before it returns, as with O_SYNC")
 	flag.Parse()
-	client, err := samfs.NewClient(server, port, mountDir)
+
+	var tlsOpts *samfs.TLSOptions
+	if *useTLS {
+		tlsOpts = &samfs.TLSOptions{
+			CertFile:   *tlsCert,
+			KeyFile:    *tlsKey,
+			CAFile:     *tlsCA,
+			ServerName: *tlsServerName,
+		}
+	}
+	var token string
+	if *tokenFile != "" {
+		var err error
+		token, err = samfs.LoadToken(*tokenFile)
+		if err != nil {
+			glog.Errorf("failed to read token : %s", err.Error())
+			os.Exit(1)
+		}
+	}
+	client, err := samfs.NewClient(server, port, mountDir, checksum,
+		compression, tlsOpts, token)
 	if err != nil {
 		glog.Errorf("connection failed : %s", err.Error())
 		os.Exit(1)
 	}
+	client.SetSlowRequestThreshold(*slowThreshold)
+	client.SetSync(*syncWrites)
+	if *debugAddr != "" {
+		if err := client.ServeDebug(*debugAddr); err != nil {
+			glog.Errorf("failed to serve debug pages : %s", err.Error())
+			os.Exit(1)
+		}
+	}
 	client.Run()
 }
@@ -0,0 +1,216 @@
+package samfs
+
+import (
+	"bytes"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	adminMethodPrefix = "/messages.Admin/"
+	healthCheckMethod = "/grpc.health.v1.Health/Check"
+)
+
+// services health checks can ask about
+var servedServices = map[string]bool{
+	"messages.NFS":   true,
+	"messages.Admin": true,
+}
+
+var (
+	errNotAdmin = grpc.Errorf(codes.PermissionDenied,
+		"administration is not allowed")
+	errExportReadOnly = grpc.Errorf(codes.PermissionDenied,
+		"export is read-only")
+	errDraining = grpc.Errorf(codes.Unavailable, "server is draining")
+)
+
+var _ pb.AdminServer = &SamFSServer{}
+var _ pb.HealthServer = &SamFSServer{}
+
+func isLoopback(address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// authorizeAdmin lets admin identities manage the server, or anyone
+// connecting from the server's own host if it does not require tokens.
+func (s *SamFSServer) authorizeAdmin(ctx context.Context,
+	method string) error {
+	if secret, policy := s.auth(); secret != nil {
+		identity := identityFromContext(ctx)
+		if accessFor(policy, identity) == adminAccess {
+			return nil
+		}
+		glog.Warningf("rejecting %s by %s, not an admin", method, identity)
+		return errNotAdmin
+	}
+	if address := peerAddress(ctx); !isLoopback(address) {
+		glog.Warningf("rejecting %s from %s, not a local connection", method,
+			address)
+		return errNotAdmin
+	}
+	return nil
+}
+
+func (s *SamFSServer) isReadOnly() bool {
+	return atomic.LoadInt32(&s.readOnly) != 0
+}
+
+func (s *SamFSServer) isDraining() bool {
+	return atomic.LoadInt32(&s.draining) != 0
+}
+
+func (s *SamFSServer) ListClients(ctx context.Context,
+	req *pb.ListClientsRequest) (*pb.ListClientsReply, error) {
+	return &pb.ListClientsReply{Clients: s.clients.list()}, nil
+}
+
+func (s *SamFSServer) GetStats(ctx context.Context,
+	req *pb.GetStatsRequest) (*pb.GetStatsReply, error) {
+	clients, inFlight := s.clients.count()
+	var metrics bytes.Buffer
+	s.metrics.write(&metrics)
+	return &pb.GetStatsReply{
+		ServerSessionID: s.sessionID,
+		StartedAt:       s.started.Unix(),
+		ReadOnly:        s.isReadOnly(),
+		Draining:        s.isDraining(),
+		Clients:         int64(clients),
+		InFlight:        int64(inFlight),
+		Metrics:         metrics.String(),
+		FdCacheHits:     atomic.LoadUint64(&s.metrics.fdCacheHits),
+		FdCacheMisses:   atomic.LoadUint64(&s.metrics.fdCacheMisses),
+	}, nil
+}
+
+// EvictClient drops the locks and delegations of the client at the address
+// and refuses its connection from then on; it has to reconnect and mount
+// again.
+func (s *SamFSServer) EvictClient(ctx context.Context,
+	req *pb.EvictClientRequest) (*pb.StatusReply, error) {
+	ids, ok := s.clients.evict(req.Address)
+	if !ok {
+		return nil, grpc.Errorf(codes.NotFound, "no client at %s", req.Address)
+	}
+	for _, id := range ids {
+		s.locks.releaseClient(id)
+		s.delegations.evict(id)
+	}
+	glog.Infof("evicted client %s by %s, revoked the state of %d client ids",
+		req.Address, identityFromContext(ctx), len(ids))
+
+	return &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+	}, nil
+}
+
+func (s *SamFSServer) SetReadOnly(ctx context.Context,
+	req *pb.SetReadOnlyRequest) (*pb.StatusReply, error) {
+	var readOnly int32
+	if req.ReadOnly {
+		readOnly = 1
+	}
+	atomic.StoreInt32(&s.readOnly, readOnly)
+	glog.Infof("export set read-only=%t by %s", req.ReadOnly,
+		identityFromContext(ctx))
+
+	return &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+	}, nil
+}
+
+// Drain refuses new requests, ends watch and callback streams and waits for
+// the requests in flight to finish, then stops the server.
+func (s *SamFSServer) Drain(ctx context.Context,
+	req *pb.DrainRequest) (*pb.DrainReply, error) {
+	glog.Infof("draining server for %s", identityFromContext(ctx))
+	abandoned, err := s.drain(ctx,
+		time.Duration(req.TimeoutMillis)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return &pb.DrainReply{Abandoned: int64(abandoned)}, nil
+}
+
+// drain stops the server once the requests in flight are done, or timeout
+// has passed if it is not 0, and returns how many were not.
+func (s *SamFSServer) drain(ctx context.Context,
+	timeout time.Duration) (int, error) {
+	if !atomic.CompareAndSwapInt32(&s.draining, 0, 1) {
+		return 0, grpc.Errorf(codes.FailedPrecondition,
+			"server is already draining")
+	}
+	inFlight := s.quiesce(ctx, timeout)
+
+	// stopping waits for the request that asked for the drain to return
+	go func() {
+		if inFlight > 0 {
+			s.grpcServer.Stop()
+		}
+		s.Stop()
+	}()
+	return inFlight, nil
+}
+
+// quiesce ends the streams of every client and waits for the requests in
+// flight to finish, until timeout if it is not 0, and returns how many did
+// not. New requests must already be refused.
+func (s *SamFSServer) quiesce(ctx context.Context, timeout time.Duration) int {
+	s.clients.cancelStreams()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+	var inFlight int
+wait:
+	for {
+		if _, inFlight = s.clients.count(); inFlight == 0 {
+			break
+		}
+		select {
+		case <-poll.C:
+		case <-expired:
+			break wait
+		case <-ctx.Done():
+			break wait
+		}
+	}
+	if inFlight > 0 {
+		glog.Warningf("stopping with %d requests still in flight", inFlight)
+	}
+	return inFlight
+}
+
+// Check implements the standard grpc health check; the server is healthy
+// until it starts draining.
+func (s *SamFSServer) Check(ctx context.Context,
+	req *pb.HealthCheckRequest) (*pb.HealthCheckResponse, error) {
+	if req.Service != "" && !servedServices[req.Service] {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service %s",
+			req.Service)
+	}
+	status := pb.HealthCheckResponse_SERVING
+	if s.isDraining() {
+		status = pb.HealthCheckResponse_NOT_SERVING
+	}
+	return &pb.HealthCheckResponse{Status: status}, nil
+}
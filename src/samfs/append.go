@@ -0,0 +1,100 @@
+package samfs
+
+import (
+	"path"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+)
+
+// appendLocks serializes the appends to a file, so that each finds the end
+// of file where the one before left it, and the other changes of its size
+// that have to see it settled, see lockGrowth.
+type appendLocks struct {
+	sync.Mutex
+	files map[fileKey]*appendLock
+}
+
+type appendLock struct {
+	sync.Mutex
+	// appends holding or waiting for the lock
+	refs int
+}
+
+func newAppendLocks() *appendLocks {
+	return &appendLocks{files: make(map[fileKey]*appendLock)}
+}
+
+// lock returns once the caller is the only one appending to the file. The
+// returned func unlocks it.
+func (a *appendLocks) lock(key fileKey) func() {
+	a.Lock()
+	l, ok := a.files[key]
+	if !ok {
+		l = &appendLock{}
+		a.files[key] = l
+	}
+	l.refs++
+	a.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		a.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(a.files, key)
+		}
+		a.Unlock()
+	}
+}
+
+// Append writes at the end of the file, wherever other clients appending to
+// it have left it, and returns where the data went.
+func (s *SamFSServer) Append(ctx context.Context,
+	req *pb.WriteRequest) (*pb.AppendReply, error) {
+	glog.V(3).Infof(`received append request for "%s"`, req.FileHandle.Path)
+
+	fd, err := s.openHandle(ctx, req.FileHandle, true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.fds.release(fd)
+
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	err = s.checkWrite(req)
+	if err != nil {
+		return nil, err
+	}
+
+	unlock := s.appends.lock(fd.key)
+	var stat syscall.Stat_t
+	err = syscall.Fstat(int(fd.Fd()), &stat)
+	if err != nil {
+		unlock()
+		glog.Errorf("could not get stat on file %s :: %v\n", req.FileHandle.Path,
+			err)
+		return nil, err
+	}
+	// the audit log records where the data went
+	req.Offset = stat.Size
+	before, err := s.writeAt(ctx, fd, req)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	err = s.finishWrite(ctx, fd, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.AppendReply{
+		Offset:          req.Offset,
+		ServerSessionID: s.sessionID,
+		Wcc:             wccData(before, filePath),
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,429 @@
+package samfs
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// records waiting to be written; when the log falls further behind new
+	// records are dropped rather than holding up requests
+	auditQueueLength = 8192
+	// writes to a file are summarized until the client commits or closes
+	// it, or stops writing for this long
+	auditWriteIdle = time.Minute
+)
+
+// auditRecord is one line of the audit log.
+type auditRecord struct {
+	Time       time.Time `json:"time"`
+	Op         string    `json:"op"`
+	Client     string    `json:"client,omitempty"`
+	Identity   string    `json:"identity,omitempty"`
+	Path       string    `json:"path,omitempty"`
+	ToPath     string    `json:"toPath,omitempty"`
+	Source     string    `json:"source,omitempty"`
+	Inode      uint64    `json:"inode,omitempty"`
+	Generation uint32    `json:"generation,omitempty"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+
+	// range of the file written or allocated, and for write summaries the
+	// number of writes and when the first one arrived
+	Offset int64      `json:"offset,omitempty"`
+	Bytes  int64      `json:"bytes,omitempty"`
+	Writes uint64     `json:"writes,omitempty"`
+	Failed uint64     `json:"failedWrites,omitempty"`
+	Since  *time.Time `json:"since,omitempty"`
+
+	// records lost before this one because the log could not keep up
+	Dropped uint64 `json:"dropped,omitempty"`
+
+	end time.Time
+}
+
+// auditWriteKey identifies the writes summarized into one record.
+type auditWriteKey struct {
+	client   string
+	identity string
+	file     fileKey
+}
+
+// auditLog appends a JSON line for every mutating request to a file,
+// rotating it when it grows past maxSize. Records are written by a
+// goroutine of their own so that a slow disk never delays requests.
+//
+// There is no SetAttr RPC yet; clients cannot change attributes on the
+// server, so there is nothing to record for it.
+type auditLog struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+
+	records chan *auditRecord
+	dropped uint64
+	done    chan struct{}
+	reopen  chan *auditSettings
+
+	sync.Mutex
+	writes map[auditWriteKey]*auditRecord
+
+	// owned by run, as are file, maxSize and maxFiles
+	fd   *os.File
+	w    *bufio.Writer
+	size int64
+}
+
+func newAuditLog(file string, maxSize int64, maxFiles int) (*auditLog, error) {
+	l := &auditLog{
+		file:     file,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		records:  make(chan *auditRecord, auditQueueLength),
+		done:     make(chan struct{}),
+		reopen:   make(chan *auditSettings),
+		writes:   make(map[auditWriteKey]*auditRecord),
+	}
+	if err := l.open(os.O_APPEND); err != nil {
+		return nil, err
+	}
+	go l.run()
+	return l, nil
+}
+
+func (l *auditLog) open(flag int) error {
+	fd, size, err := openAuditFile(l.file, flag)
+	if err != nil {
+		return err
+	}
+	l.fd = fd
+	l.w = bufio.NewWriter(fd)
+	l.size = size
+	return nil
+}
+
+func openAuditFile(file string, flag int) (*os.File, int64, error) {
+	fd, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|flag, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, 0, err
+	}
+	return fd, info.Size(), nil
+}
+
+// auditSettings changes where and how a running audit log is written.
+type auditSettings struct {
+	file     string
+	maxSize  int64
+	maxFiles int
+	// already opened file, nil to keep writing the current one
+	fd   *os.File
+	size int64
+}
+
+// update applies settings once the records queued so far are written.
+func (l *auditLog) update(settings *auditSettings) {
+	select {
+	case l.reopen <- settings:
+	case <-l.done:
+		if settings.fd != nil {
+			settings.fd.Close()
+		}
+	}
+}
+
+// Close writes out pending write summaries and everything queued. It must
+// not be called while requests are still being served.
+func (l *auditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	close(l.records)
+	<-l.done
+	return nil
+}
+
+func (l *auditLog) run() {
+	tick := time.NewTicker(auditWriteIdle / 2)
+	defer tick.Stop()
+	defer close(l.done)
+
+	for {
+		select {
+		case rec, ok := <-l.records:
+			if !ok {
+				for _, rec := range l.takeWrites(time.Time{}) {
+					l.write(rec)
+				}
+				l.w.Flush()
+				l.fd.Close()
+				return
+			}
+			l.write(rec)
+		case settings := <-l.reopen:
+			l.apply(settings)
+		case now := <-tick.C:
+			for _, rec := range l.takeWrites(now.Add(-auditWriteIdle)) {
+				l.write(rec)
+			}
+		}
+		if len(l.records) == 0 {
+			if err := l.w.Flush(); err != nil {
+				glog.Errorf("failed to write audit log %s :: %v", l.file, err)
+			}
+		}
+	}
+}
+
+func (l *auditLog) apply(settings *auditSettings) {
+	for len(l.records) > 0 {
+		l.write(<-l.records)
+	}
+	l.maxSize = settings.maxSize
+	l.maxFiles = settings.maxFiles
+	if settings.fd == nil {
+		return
+	}
+	if err := l.w.Flush(); err != nil {
+		glog.Errorf("failed to write audit log %s :: %v", l.file, err)
+	}
+	l.fd.Close()
+	glog.Infof("audit log moved from %s to %s", l.file, settings.file)
+	l.file = settings.file
+	l.fd = settings.fd
+	l.w = bufio.NewWriter(settings.fd)
+	l.size = settings.size
+}
+
+func (l *auditLog) write(rec *auditRecord) {
+	rec.Dropped = atomic.SwapUint64(&l.dropped, 0)
+	line, err := json.Marshal(rec)
+	if err != nil {
+		glog.Errorf("failed to encode audit record %+v :: %v", rec, err)
+		return
+	}
+	line = append(line, '\n')
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			glog.Errorf("failed to rotate audit log %s :: %v", l.file, err)
+		}
+	}
+	n, err := l.w.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		glog.Errorf("failed to write audit log %s :: %v", l.file, err)
+	}
+}
+
+// rotate moves the log to file.1, file.1 to file.2 and so on, dropping the
+// oldest beyond maxFiles, and starts a new one.
+func (l *auditLog) rotate() error {
+	l.w.Flush()
+	l.fd.Close()
+	for i := l.maxFiles; i > 0; i-- {
+		from := l.file
+		if i > 1 {
+			from = fmt.Sprintf("%s.%d", l.file, i-1)
+		}
+		err := os.Rename(from, fmt.Sprintf("%s.%d", l.file, i))
+		if err != nil && !os.IsNotExist(err) {
+			glog.Warningf("failed to rotate audit log %s :: %v", from, err)
+		}
+	}
+	return l.open(os.O_TRUNC)
+}
+
+func (l *auditLog) send(rec *auditRecord) {
+	select {
+	case l.records <- rec:
+	default:
+		if atomic.AddUint64(&l.dropped, 1) == 1 {
+			glog.Warning("audit log is falling behind, dropping records")
+		}
+	}
+}
+
+// takeWrites removes the write summaries last written to before idle, or
+// all of them if idle is zero.
+func (l *auditLog) takeWrites(idle time.Time) []*auditRecord {
+	l.Lock()
+	defer l.Unlock()
+	var recs []*auditRecord
+	for key, rec := range l.writes {
+		if idle.IsZero() || rec.end.Before(idle) {
+			recs = append(recs, rec)
+			delete(l.writes, key)
+		}
+	}
+	return recs
+}
+
+func (l *auditLog) addWrite(key auditWriteKey, rec *auditRecord,
+	req *pb.WriteRequest, err error) {
+	l.Lock()
+	defer l.Unlock()
+	sum, ok := l.writes[key]
+	if !ok {
+		sum = rec
+		since := rec.Time
+		sum.Since = &since
+		sum.Offset = req.Offset
+		l.writes[key] = sum
+	}
+	sum.Path = rec.Path
+	sum.end = rec.Time
+	sum.Writes++
+	if err != nil {
+		sum.Failed++
+		sum.Result = grpc.Code(err).String()
+		sum.Error = grpc.ErrorDesc(err)
+		return
+	}
+	if req.Offset < sum.Offset {
+		sum.Bytes += sum.Offset - req.Offset
+		sum.Offset = req.Offset
+	}
+	if end := req.Offset + req.Size; end > sum.Offset+sum.Bytes {
+		sum.Bytes = end - sum.Offset
+	}
+}
+
+func (l *auditLog) flushWrites(key auditWriteKey) {
+	l.Lock()
+	sum, ok := l.writes[key]
+	delete(l.writes, key)
+	l.Unlock()
+	if ok {
+		sum.Time = time.Now()
+		l.send(sum)
+	}
+}
+
+// setHandle fills in which file rec is about; fileHandle may be nil for
+// requests that failed validation.
+func (rec *auditRecord) setHandle(fileHandle *pb.FileHandle, name string) {
+	if fileHandle == nil {
+		rec.Path = name
+		return
+	}
+	rec.Path = path.Join(fileHandle.Path, name)
+	rec.Inode = fileHandle.InodeNumber
+	rec.Generation = fileHandle.GenerationNumber
+}
+
+func writeKey(rec *auditRecord, fileHandle *pb.FileHandle) auditWriteKey {
+	key := auditWriteKey{client: rec.Client, identity: rec.Identity}
+	if fileHandle != nil {
+		key.file = handleKey(fileHandle)
+	}
+	return key
+}
+
+// record logs the outcome of method if it changes the exported tree. Writes
+// are summarized per file until the client commits or closes it.
+func (l *auditLog) record(ctx context.Context, method string,
+	req interface{}, resp interface{}, err error) {
+	if l == nil {
+		return
+	}
+
+	rec := &auditRecord{
+		Time:     time.Now(),
+		Op:       path.Base(method),
+		Identity: identityFromContext(ctx),
+		Result:   "OK",
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		rec.Client = p.Addr.String()
+	}
+	if err != nil {
+		rec.Result = grpc.Code(err).String()
+		rec.Error = grpc.ErrorDesc(err)
+	}
+
+	switch r := req.(type) {
+	case *pb.WriteRequest:
+		rec.setHandle(r.FileHandle, "")
+		key := writeKey(rec, r.FileHandle)
+		l.addWrite(key, rec, r, err)
+		if r.ShouldCommit {
+			l.flushWrites(key)
+		}
+		return
+	case *pb.CommitRequest:
+		l.flushWrites(writeKey(rec, r.FileHandle))
+		return
+	case *pb.OpenRequest:
+		if rec.Op == "Close" {
+			l.flushWrites(writeKey(rec, r.FileHandle))
+		}
+		return
+	case *pb.LocalDirectoryRequest:
+		switch rec.Op {
+		case "Create", "Mkdir":
+			rec.setHandle(r.DirectoryFileHandle, r.Name)
+			if reply, ok := resp.(*pb.FileHandleReply); ok && reply != nil {
+				rec.setHandle(reply.FileHandle, "")
+			}
+		case "Remove", "Rmdir":
+			rec.setHandle(r.DirectoryFileHandle, r.Name)
+		default:
+			return
+		}
+	case *pb.RenameRequest:
+		rec.setHandle(r.FromDirHandle, r.FromName)
+		if r.ToDirHandle != nil {
+			rec.ToPath = path.Join(r.ToDirHandle.Path, r.ToName)
+		}
+	case *pb.CopyRangeRequest:
+		rec.setHandle(r.DstFileHandle, "")
+		rec.Offset = r.DstOffset
+		rec.Bytes = r.Length
+		if reply, ok := resp.(*pb.CopyRangeReply); ok && reply != nil {
+			rec.Bytes = reply.Size
+		}
+		if r.SrcFileHandle != nil {
+			rec.Source = r.SrcFileHandle.Path
+		}
+	case *pb.AllocateRequest:
+		rec.setHandle(r.FileHandle, "")
+		rec.Offset = r.Offset
+		rec.Bytes = r.Length
+	case *pb.TruncateRequest:
+		rec.setHandle(r.FileHandle, "")
+		rec.Offset = r.Size
+	default:
+		return
+	}
+	l.send(rec)
+}
+
+// SetAuditLog records every change made through the export in file,
+// keeping up to maxFiles older logs of maxSize bytes each.
+func (s *SamFSServer) SetAuditLog(file string, maxSize int64,
+	maxFiles int) error {
+	l, err := newAuditLog(file, maxSize, maxFiles)
+	if err != nil {
+		return err
+	}
+	s.audit.Close()
+	s.audit = l
+	return nil
+}
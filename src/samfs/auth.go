@@ -0,0 +1,315 @@
+package samfs
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// metadata key the client sends its token in, as "Bearer <token>"
+const authMetadataKey = "authorization"
+
+// policy entry matching every identity with a valid token
+const anyIdentity = "*"
+
+type access int
+
+const (
+	noAccess access = iota
+	readOnly
+	readWrite
+	// read-write access that may also use the Admin service
+	adminAccess
+)
+
+var (
+	errUnauthenticated = grpc.Errorf(codes.Unauthenticated,
+		"missing or invalid token")
+	errReadOnly = grpc.Errorf(codes.PermissionDenied, "read-only access")
+)
+
+// requests that change the export, denied to read-only identities and while
+// the export is read-only
+var mutatingMethods = map[string]bool{
+	"/messages.NFS/Write":     true,
+	"/messages.NFS/Append":    true,
+	"/messages.NFS/Commit":    true,
+	"/messages.NFS/Create":    true,
+	"/messages.NFS/Remove":    true,
+	"/messages.NFS/Mkdir":     true,
+	"/messages.NFS/Rmdir":     true,
+	"/messages.NFS/Rename":    true,
+	"/messages.NFS/CopyRange": true,
+	"/messages.NFS/Allocate":  true,
+	"/messages.NFS/Truncate":  true,
+}
+
+type identityKey struct{}
+
+// isMutation returns whether a request to method changes the export.
+func isMutation(method string, req interface{}) bool {
+	open, isOpen := req.(*pb.OpenRequest)
+	return mutatingMethods[method] || (isOpen && open.Write)
+}
+
+// identityFromContext returns who made the request in ctx, empty when the
+// export does not require tokens.
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityKey{}).(string)
+	return identity
+}
+
+// NewToken returns a bearer token for identity signed with secret. It never
+// expires if expiry is zero.
+func NewToken(secret []byte, identity string, expiry time.Time) string {
+	var exp int64
+	if !expiry.IsZero() {
+		exp = expiry.Unix()
+	}
+	payload := base64.RawURLEncoding.EncodeToString([]byte(identity)) + "." +
+		strconv.FormatInt(exp, 10)
+	return payload + "." + tokenSignature(secret, payload)
+}
+
+func tokenSignature(secret []byte, payload string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyToken returns the identity token was issued for.
+func verifyToken(secret []byte, token string, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed token")
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(tokenSignature(secret, payload))) {
+		return "", fmt.Errorf("bad token signature")
+	}
+	exp, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed token expiry")
+	}
+	if exp != 0 && now.Unix() > exp {
+		return "", fmt.Errorf("token expired")
+	}
+	identity, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed token identity")
+	}
+	return string(identity), nil
+}
+
+// LoadSecret reads a token signing secret from file.
+func LoadSecret(file string) ([]byte, error) {
+	secret, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	secret = []byte(strings.TrimSpace(string(secret)))
+	if len(secret) < 16 {
+		return nil, fmt.Errorf("secret in %s is shorter than 16 bytes", file)
+	}
+	return secret, nil
+}
+
+// loadPolicy reads the identities allowed to use the export, one per line
+// followed by "ro", "rw" or "admin" and optionally the uid[:gid] the files
+// it creates belong to, gid defaulting to uid. "*" stands for any identity.
+func loadPolicy(file string) (map[string]access, map[string]*pb.FileOwner,
+	error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	policy := make(map[string]access)
+	owners := make(map[string]*pb.FileOwner)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 && len(fields) != 3 {
+			return nil, nil, fmt.Errorf("%s:%d: expected identity, access "+
+				"and optionally owner", file, line)
+		}
+		switch fields[1] {
+		case "ro":
+			policy[fields[0]] = readOnly
+		case "rw":
+			policy[fields[0]] = readWrite
+		case "admin":
+			policy[fields[0]] = adminAccess
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: access must be ro, rw or "+
+				"admin, not %q", file, line, fields[1])
+		}
+		if len(fields) == 3 {
+			owner, err := parseOwner(fields[2])
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			owners[fields[0]] = owner
+		}
+	}
+	return policy, owners, scanner.Err()
+}
+
+// parseOwner parses uid[:gid], gid defaults to uid.
+func parseOwner(s string) (*pb.FileOwner, error) {
+	ids := strings.SplitN(s, ":", 2)
+	uid, err := strconv.ParseUint(ids[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad uid %q", ids[0])
+	}
+	gid := uid
+	if len(ids) == 2 {
+		if gid, err = strconv.ParseUint(ids[1], 10, 32); err != nil {
+			return nil, fmt.Errorf("bad gid %q", ids[1])
+		}
+	}
+	return &pb.FileOwner{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// SetAuth makes the server require a token signed with the secret in
+// secretFile on every request, and restricts the export to the identities
+// in policyFile. It has to be called before Run.
+func (s *SamFSServer) SetAuth(secretFile string, policyFile string) error {
+	secret, err := LoadSecret(secretFile)
+	if err != nil {
+		return err
+	}
+	policy, owners, err := loadPolicy(policyFile)
+	if err != nil {
+		return err
+	}
+	s.setAuth(secret, policy, owners)
+	return nil
+}
+
+func (s *SamFSServer) setAuth(secret []byte, policy map[string]access,
+	owners map[string]*pb.FileOwner) {
+	s.settingsLock.Lock()
+	s.authSecret = secret
+	s.authPolicy = policy
+	s.authOwners = owners
+	s.settingsLock.Unlock()
+}
+
+// auth returns the secret and policy requests are checked against, a
+// reload replaces both at once.
+func (s *SamFSServer) auth() ([]byte, map[string]access) {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.authSecret, s.authPolicy
+}
+
+// creator returns who files created by the request in ctx belong to. When
+// the server requires tokens that is the owner the policy gives the
+// identity, or nil for the server's own user if it gives none; owner, which
+// the client fills in, is only trusted when it does not.
+func (s *SamFSServer) creator(ctx context.Context,
+	owner *pb.FileOwner) *pb.FileOwner {
+
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	if s.authSecret == nil {
+		return owner
+	}
+	identity := identityFromContext(ctx)
+	if o, ok := s.authOwners[identity]; ok {
+		return o
+	}
+	return s.authOwners[anyIdentity]
+}
+
+func accessFor(policy map[string]access, identity string) access {
+	if a, ok := policy[identity]; ok {
+		return a
+	}
+	return policy[anyIdentity]
+}
+
+// authenticate checks the token of the request in ctx and whether its
+// identity may call method, and returns ctx with the identity attached. req
+// is nil for streams.
+func (s *SamFSServer) authenticate(ctx context.Context, method string,
+	req interface{}) (context.Context, error) {
+
+	secret, policy := s.auth()
+	if secret == nil {
+		return ctx, nil
+	}
+
+	md, _ := metadata.FromContext(ctx)
+	var token string
+	if values := md[authMetadataKey]; len(values) > 0 {
+		token = strings.TrimPrefix(values[0], "Bearer ")
+	}
+	identity, err := verifyToken(secret, token, time.Now())
+	if err != nil {
+		glog.Warningf("rejecting %s from %s :: %v", method, peerAddress(ctx),
+			err)
+		return nil, errUnauthenticated
+	}
+
+	a := accessFor(policy, identity)
+	if a == noAccess {
+		glog.Warningf("rejecting %s by %s, not allowed on the export", method,
+			identity)
+		return nil, grpc.Errorf(codes.PermissionDenied,
+			"%s may not mount the export", identity)
+	}
+	if a == readOnly && isMutation(method, req) {
+		return nil, errReadOnly
+	}
+
+	return context.WithValue(ctx, identityKey{}, identity), nil
+}
+
+// tokenCredentials sends a bearer token with every request.
+type tokenCredentials struct {
+	token string
+}
+
+// LoadToken reads the token samfsc authenticates with from file.
+func LoadToken(file string) (string, error) {
+	token, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(token)), nil
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context,
+	uri ...string) (map[string]string, error) {
+
+	return map[string]string{authMetadataKey: "Bearer " + t.token}, nil
+}
+
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	// tokens can be sniffed off plaintext connections, but they are still
+	// useful on trusted networks
+	return false
+}
@@ -0,0 +1,168 @@
+package samfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"sync/atomic"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// data is checksummed in chunks of this size
+	checksumChunkSize = 64 * 1024
+	// attempts at a read or write whose checksums keep failing
+	checksumRetries = 3
+)
+
+var (
+	errChecksum = grpc.Errorf(codes.DataLoss, "data checksum mismatch")
+	errDataSize = grpc.Errorf(codes.DataLoss, "reply data does not match its size")
+)
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+func parseChecksumType(name string) (pb.ChecksumType, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return pb.ChecksumType_NO_CHECKSUM, nil
+	case "", "crc32c":
+		return pb.ChecksumType_CRC32C, nil
+	case "sha256":
+		return pb.ChecksumType_SHA256, nil
+	}
+	return pb.ChecksumType_NO_CHECKSUM, fmt.Errorf("unknown checksum %q", name)
+}
+
+func checksum(typ pb.ChecksumType, chunk []byte) []byte {
+	switch typ {
+	case pb.ChecksumType_CRC32C:
+		sum := make([]byte, 4)
+		binary.BigEndian.PutUint32(sum, crc32.Checksum(chunk, crc32cTable))
+		return sum
+	case pb.ChecksumType_SHA256:
+		sum := sha256.Sum256(chunk)
+		return sum[:]
+	}
+	return nil
+}
+
+func computeChecksums(typ pb.ChecksumType, data []byte) [][]byte {
+	if typ == pb.ChecksumType_NO_CHECKSUM {
+		return nil
+	}
+	var sums [][]byte
+	for off := 0; off < len(data); off += checksumChunkSize {
+		end := off + checksumChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sums = append(sums, checksum(typ, data[off:end]))
+	}
+	return sums
+}
+
+// verifyChecksums returns whether data matches sums. Data sent without
+// checksums always matches.
+func verifyChecksums(typ pb.ChecksumType, data []byte, sums [][]byte) bool {
+	if typ == pb.ChecksumType_NO_CHECKSUM {
+		return true
+	}
+	want := computeChecksums(typ, data)
+	if len(want) != len(sums) {
+		return false
+	}
+	for i := range want {
+		if !bytes.Equal(want[i], sums[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func addChecksums(req *pb.ReadRequest, resp *pb.ReadReply) {
+	resp.ChecksumType = req.ChecksumType
+	resp.Checksums = computeChecksums(req.ChecksumType, resp.Data)
+}
+
+func (c *SamFs) countChecksumError(op string, fh *pb.FileHandle) {
+	n := atomic.AddUint64(&c.checksumErrors, 1)
+	glog.Warningf("checksum mismatch on %s of %s, %d so far", op, fh.Path, n)
+}
+
+// writeChecked sends a write along with checksums of its data, and sends it
+// again if the data got corrupted on the way to the server.
+func (c *SamFs) writeChecked(ctx context.Context,
+	req *pb.WriteRequest) (*pb.StatusReply, error) {
+	c.checksumWrite(req)
+
+	for i := 1; ; i++ {
+		resp, err := c.nfsClient.Write(ctx, req,
+			grpc.FailFast(false))
+		if grpc.Code(err) != codes.DataLoss || i == checksumRetries {
+			return resp, err
+		}
+		c.countChecksumError("write", req.FileHandle)
+	}
+}
+
+// appendChecked is writeChecked for appends, which the server refuses
+// before writing anything when the data got corrupted.
+func (c *SamFs) appendChecked(ctx context.Context,
+	req *pb.WriteRequest) (*pb.AppendReply, error) {
+	c.checksumWrite(req)
+
+	for i := 1; ; i++ {
+		resp, err := c.nfsClient.Append(ctx, req,
+			grpc.FailFast(false))
+		if grpc.Code(err) != codes.DataLoss || i == checksumRetries {
+			return resp, err
+		}
+		c.countChecksumError("append", req.FileHandle)
+	}
+}
+
+// checksumWrite adds checksums of its data to a write and compresses it.
+func (c *SamFs) checksumWrite(req *pb.WriteRequest) {
+	req.ChecksumType = c.checksumType
+	req.Checksums = computeChecksums(c.checksumType, req.Data[:req.Size])
+	c.compressWrite(req)
+}
+
+// readChecked reads with checksums on the reply data, and reads again if the
+// data got corrupted on the way to us.
+func (c *SamFs) readChecked(ctx context.Context,
+	req *pb.ReadRequest) (*pb.ReadReply, error) {
+	req.ChecksumType = c.checksumType
+	req.Compression = c.compression
+
+	for i := 1; ; i++ {
+		resp, err := c.nfsClient.Read(ctx, req,
+			grpc.FailFast(false))
+		if err != nil {
+			return nil, err
+		}
+		data, err := decompressData(resp.Compression, resp.Data, req.Size)
+		if err == nil && !req.Sparse && int64(len(data)) != resp.Size {
+			err = errDataSize
+		}
+		if err == nil &&
+			verifyChecksums(resp.ChecksumType, data, resp.Checksums) {
+			resp.Data = data
+			resp.Compression = pb.Compression_NO_COMPRESSION
+			return resp, nil
+		}
+		c.countChecksumError("read", req.FileHandle)
+		if i == checksumRetries {
+			return nil, errChecksum
+		}
+	}
+}
@@ -1,9 +1,16 @@
 package samfs
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/nodefs"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/pathfs"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 type SamFSClient struct {
@@ -11,10 +18,18 @@ type SamFSClient struct {
 	fuseServer *fuse.Server
 }
 
-func NewClient(server, port, mountDir *string) (*SamFSClient, error) {
+// NewClient connects to the server, tlsOpts may be nil for a plaintext
+// connection and token empty if the server does not require one.
+func NewClient(server, port, mountDir, checksum *string, compression *bool,
+	tlsOpts *TLSOptions, token string) (*SamFSClient, error) {
+
 	samFS, fsErr := NewSamFs(&SamFsOptions{
-		server: *server,
-		port:   *port,
+		server:      *server,
+		port:        *port,
+		checksum:    *checksum,
+		compression: *compression,
+		tls:         tlsOpts,
+		token:       token,
 	})
 	if fsErr != nil {
 		return nil, fsErr
@@ -31,6 +46,7 @@ func NewClient(server, port, mountDir *string) (*SamFSClient, error) {
 	mountOpts := &fuse.MountOptions{
 		AllowOther:    true,
 		DisableXAttrs: true,
+		EnableLocks:   true,
 		Name:          "samfs://" + *server + ":" + *port,
 	}
 	fuseServer, err := fuse.NewServer(connector.RawFS(), *mountDir, mountOpts)
@@ -44,6 +60,60 @@ func NewClient(server, port, mountDir *string) (*SamFSClient, error) {
 	}, nil
 }
 
+// Dial connects to a samfs server, tlsOpts may be nil for a plaintext
+// connection and token empty if the server does not require one.
+func Dial(server string, port string, tlsOpts *TLSOptions,
+	token string) (*grpc.ClientConn, error) {
+
+	security := grpc.WithInsecure()
+	if tlsOpts != nil {
+		creds, err := tlsOpts.clientCredentials()
+		if err != nil {
+			return nil, err
+		}
+		security = grpc.WithTransportCredentials(creds)
+	}
+	dialOpts := []grpc.DialOption{security,
+		grpc.WithBackoffMaxDelay(120 * time.Second),
+		grpc.WithUnaryInterceptor(retryRefusedCall)}
+	if token != "" {
+		if tlsOpts == nil {
+			glog.Warning("sending token over a plaintext connection")
+		}
+		dialOpts = append(dialOpts,
+			grpc.WithPerRPCCredentials(tokenCredentials{token}))
+	}
+	return grpc.DialContext(context.Background(), server+":"+port,
+		dialOpts...)
+}
+
+// SetSlowRequestThreshold logs FUSE operations that take at least
+// threshold, 0 turns the log off.
+func (c *SamFSClient) SetSlowRequestThreshold(threshold time.Duration) {
+	c.samFS.slowLog.setThreshold(threshold)
+}
+
+// SetSync makes every write stable before it returns, as if every file was
+// opened with O_SYNC. It has to be called before Run.
+func (c *SamFSClient) SetSync(sync bool) {
+	c.samFS.options.sync = sync
+}
+
+// ServeDebug serves request traces at /debug/requests, the slow request log
+// settings at /debug/slowlog and the Go profiler at /debug/pprof/, over http
+// on addr.
+func (c *SamFSClient) ServeDebug(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		err := http.Serve(lis, debugHandler(c.samFS.slowLog))
+		glog.V(2).Infof("stopped serving debug pages on %s :: %v", addr, err)
+	}()
+	return nil
+}
+
 func (c *SamFSClient) Run() {
 	c.fuseServer.Serve()
 }
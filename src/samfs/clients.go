@@ -0,0 +1,291 @@
+package samfs
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// grpc does not tell the server when a connection goes away, so clients are
+// forgotten once they have been idle this long
+const clientIdleExpiry = 10 * time.Minute
+
+var errEvicted = grpc.Errorf(codes.PermissionDenied,
+	"client was evicted by an administrator")
+
+var errClientIDOwner = grpc.Errorf(codes.PermissionDenied,
+	"client id is in use by another identity")
+
+// connectedClient is what the server knows about one client connection.
+type connectedClient struct {
+	address   string
+	identity  string
+	clientIDs map[int64]bool
+	mounts    []string
+	connected time.Time
+	lastSeen  time.Time
+	requests  uint64
+	evicted   bool
+	// requests and streams being handled
+	calls map[*clientCall]bool
+}
+
+// clientCall is a request or stream of a client being handled.
+type clientCall struct {
+	client *connectedClient
+	// ends the stream, nil for requests
+	cancel context.CancelFunc
+}
+
+// clientRegistry keeps track of the clients using the export, by the
+// address of their connection.
+type clientRegistry struct {
+	sync.Mutex
+	clients  map[string]*connectedClient
+	inFlight int
+	// identity that first used each client id, so that locks and
+	// delegations can only be released by the identity that holds them
+	owners map[int64]string
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		clients: make(map[string]*connectedClient),
+		owners:  make(map[int64]string),
+	}
+}
+
+// begin records a call of the client of ctx, req is nil for streams and
+// cancel nil for requests. end has to be called with the returned call when
+// it is done.
+func (r *clientRegistry) begin(ctx context.Context, req interface{},
+	cancel context.CancelFunc) (*clientCall, error) {
+
+	address := peerAddress(ctx)
+	now := time.Now()
+
+	r.Lock()
+	defer r.Unlock()
+	c, ok := r.clients[address]
+	if !ok {
+		c = &connectedClient{
+			address:   address,
+			clientIDs: make(map[int64]bool),
+			connected: now,
+			calls:     make(map[*clientCall]bool),
+		}
+		r.clients[address] = c
+	}
+	// evicted clients stay known for as long as they keep trying
+	c.lastSeen = now
+	if c.evicted {
+		return nil, errEvicted
+	}
+	identity := identityFromContext(ctx)
+	if err := r.claim(identity, requestClientID(req)); err != nil {
+		return nil, err
+	}
+	c.requests++
+	if identity != "" {
+		c.identity = identity
+	}
+	switch req := req.(type) {
+	case *pb.MountRequest:
+		c.addMount(req.RootDirectory)
+	case *pb.OpenRequest:
+		c.clientIDs[req.ClientID] = true
+	case *pb.LockRequest:
+		if req.Lock != nil {
+			c.clientIDs[req.Lock.ClientID] = true
+		}
+	}
+
+	call := &clientCall{client: c, cancel: cancel}
+	c.calls[call] = true
+	r.inFlight++
+	return call, nil
+}
+
+func (c *connectedClient) addMount(root string) {
+	if root == "" {
+		root = "/"
+	}
+	for _, m := range c.mounts {
+		if m == root {
+			return
+		}
+	}
+	c.mounts = append(c.mounts, root)
+}
+
+func (r *clientRegistry) end(call *clientCall) {
+	r.Lock()
+	defer r.Unlock()
+	call.client.lastSeen = time.Now()
+	delete(call.client.calls, call)
+	r.inFlight--
+}
+
+// addClientID records that the client of ctx goes by clientID, for streams
+// that only learn it after they start.
+func (r *clientRegistry) addClientID(ctx context.Context,
+	clientID int64) error {
+
+	r.Lock()
+	defer r.Unlock()
+	if err := r.claim(identityFromContext(ctx), clientID); err != nil {
+		return err
+	}
+	if c, ok := r.clients[peerAddress(ctx)]; ok {
+		c.clientIDs[clientID] = true
+	}
+	return nil
+}
+
+// claim binds clientID to identity the first time it is used and refuses it
+// to every other identity after that. Without authentication there are no
+// identities and any client may use any id. Must be called with the registry
+// locked.
+func (r *clientRegistry) claim(identity string, clientID int64) error {
+	if identity == "" || clientID == 0 {
+		return nil
+	}
+	owner, ok := r.owners[clientID]
+	if !ok {
+		r.owners[clientID] = identity
+		return nil
+	}
+	if owner != identity {
+		return errClientIDOwner
+	}
+	return nil
+}
+
+// requestClientID returns the client id req is made on behalf of, 0 if it
+// has none.
+func requestClientID(req interface{}) int64 {
+	switch req := req.(type) {
+	case *pb.OpenRequest:
+		return req.ClientID
+	case *pb.LockRequest:
+		if req.Lock != nil {
+			return req.Lock.ClientID
+		}
+	case *pb.WriteRequest:
+		return req.ClientID
+	case *pb.CopyRangeRequest:
+		return req.ClientID
+	case *pb.TruncateRequest:
+		return req.ClientID
+	case *pb.AllocateRequest:
+		return req.ClientID
+	}
+	return 0
+}
+
+// expire forgets clients that have been idle since before idle.
+func (r *clientRegistry) expire(idle time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for address, c := range r.clients {
+		if len(c.calls) == 0 && c.lastSeen.Before(idle) {
+			delete(r.clients, address)
+		}
+	}
+}
+
+// active returns the client ids of clients that have a request or stream
+// open or have been seen since idle.
+func (r *clientRegistry) active(idle time.Time) map[int64]bool {
+	r.Lock()
+	defer r.Unlock()
+	ids := make(map[int64]bool)
+	for _, c := range r.clients {
+		if len(c.calls) == 0 && c.lastSeen.Before(idle) {
+			continue
+		}
+		for id := range c.clientIDs {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// evict refuses further requests from the client at address and ends its
+// streams, and returns the client ids it used.
+func (r *clientRegistry) evict(address string) ([]int64, bool) {
+	r.Lock()
+	defer r.Unlock()
+	c, ok := r.clients[address]
+	if !ok {
+		return nil, false
+	}
+	c.evicted = true
+	c.cancelStreams()
+	var ids []int64
+	for id := range c.clientIDs {
+		ids = append(ids, id)
+	}
+	return ids, true
+}
+
+// cancelStreams ends the streams of the client. Must be called with the
+// registry locked.
+func (c *connectedClient) cancelStreams() {
+	for call := range c.calls {
+		if call.cancel != nil {
+			call.cancel()
+		}
+	}
+}
+
+// cancelStreams ends the streams of every client; they never finish on their
+// own.
+func (r *clientRegistry) cancelStreams() {
+	r.Lock()
+	defer r.Unlock()
+	for _, c := range r.clients {
+		c.cancelStreams()
+	}
+}
+
+func (r *clientRegistry) count() (clients int, inFlight int) {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.clients), r.inFlight
+}
+
+func (r *clientRegistry) list() []*pb.ClientInfo {
+	r.Lock()
+	defer r.Unlock()
+	var infos []*pb.ClientInfo
+	for _, c := range r.clients {
+		info := &pb.ClientInfo{
+			Address:      c.address,
+			Identity:     c.identity,
+			Mounts:       append([]string(nil), c.mounts...),
+			ConnectedAt:  c.connected.Unix(),
+			LastActivity: c.lastSeen.Unix(),
+			InFlight:     int64(len(c.calls)),
+			Requests:     c.requests,
+			Evicted:      c.evicted,
+		}
+		for id := range c.clientIDs {
+			info.ClientIDs = append(info.ClientIDs, id)
+		}
+		infos = append(infos, info)
+	}
+	sort.Sort(clientsByAddress(infos))
+	return infos
+}
+
+type clientsByAddress []*pb.ClientInfo
+
+func (c clientsByAddress) Len() int           { return len(c) }
+func (c clientsByAddress) Less(i, j int) bool { return c[i].Address < c[j].Address }
+func (c clientsByAddress) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
@@ -0,0 +1,134 @@
+package samfs
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const (
+	// smaller payloads are not worth compressing
+	minCompressSize = 512
+	// compressed data larger than this share of the original is sent as is
+	maxCompressRatio = 0.9
+)
+
+// compressData compresses data with typ if that makes it noticeably smaller,
+// and returns the data to send along with how it is encoded.
+func compressData(typ pb.Compression, data []byte) ([]byte, pb.Compression) {
+	if typ != pb.Compression_FLATE || len(data) < minCompressSize {
+		return data, pb.Compression_NO_COMPRESSION
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestSpeed)
+	if err != nil {
+		return data, pb.Compression_NO_COMPRESSION
+	}
+	if _, err := w.Write(data); err != nil {
+		return data, pb.Compression_NO_COMPRESSION
+	}
+	if err := w.Close(); err != nil {
+		return data, pb.Compression_NO_COMPRESSION
+	}
+
+	if float64(buf.Len()) > maxCompressRatio*float64(len(data)) {
+		return data, pb.Compression_NO_COMPRESSION
+	}
+	return buf.Bytes(), pb.Compression_FLATE
+}
+
+// decompressData returns the original of data encoded with typ, which must
+// not be longer than limit bytes.
+func decompressData(typ pb.Compression, data []byte, limit int64) ([]byte,
+	error) {
+	switch typ {
+	case pb.Compression_NO_COMPRESSION:
+	case pb.Compression_FLATE:
+		r := flate.NewReader(bytes.NewReader(data))
+		defer r.Close()
+		// a small message may inflate to any size, stop one byte past limit
+		out, err := ioutil.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil {
+			// the data got mangled on the way, same as a checksum mismatch
+			return nil, grpc.Errorf(codes.DataLoss,
+				"failed to decompress data :: %v", err)
+		}
+		data = out
+	default:
+		return nil, grpc.Errorf(codes.InvalidArgument, "unknown compression %v",
+			typ)
+	}
+	if int64(len(data)) > limit {
+		return nil, grpc.Errorf(codes.DataLoss, "data is longer than %d bytes",
+			limit)
+	}
+	return data, nil
+}
+
+// SetCompression allows clients to compress data sent to and from this
+// export.
+func (s *SamFSServer) SetCompression(enabled bool) {
+	s.settingsLock.Lock()
+	s.compression = enabled
+	s.settingsLock.Unlock()
+}
+
+// negotiateCompression returns the codec to use with a client that asked for
+// typ at mount time.
+func (s *SamFSServer) negotiateCompression(typ pb.Compression) pb.Compression {
+	s.settingsLock.RLock()
+	enabled := s.compression
+	s.settingsLock.RUnlock()
+	if !enabled || typ != pb.Compression_FLATE {
+		return pb.Compression_NO_COMPRESSION
+	}
+	return typ
+}
+
+func (s *SamFSServer) compressReply(req *pb.ReadRequest, resp *pb.ReadReply) {
+	raw := len(resp.Data)
+	resp.Data, resp.Compression = compressData(
+		s.negotiateCompression(req.Compression), resp.Data)
+	if resp.Compression != pb.Compression_NO_COMPRESSION {
+		s.metrics.countCompression(raw, len(resp.Data))
+	}
+}
+
+// decompressWrite replaces compressed write data with the original.
+func (s *SamFSServer) decompressWrite(req *pb.WriteRequest) error {
+	if req.Compression == pb.Compression_NO_COMPRESSION {
+		return nil
+	}
+	wire := len(req.Data)
+	data, err := decompressData(req.Compression, req.Data, req.Size)
+	if err != nil {
+		return err
+	}
+	if int64(len(data)) != req.Size {
+		return grpc.Errorf(codes.DataLoss, "decompressed %d bytes, expected %d",
+			len(data), req.Size)
+	}
+	req.Data = data
+	req.Compression = pb.Compression_NO_COMPRESSION
+	s.metrics.countCompression(len(data), wire)
+	return nil
+}
+
+// compressWrite compresses write data with the codec agreed on at mount
+// time. Checksums are computed on the original data, so they are checked
+// after decompression on the server.
+func (c *SamFs) compressWrite(req *pb.WriteRequest) {
+	req.Data, req.Compression = compressData(c.compression,
+		req.Data[:req.Size])
+	if req.Compression != pb.Compression_NO_COMPRESSION {
+		glog.V(3).Infof("compressed write of %d bytes to %d", req.Size,
+			len(req.Data))
+	}
+}
@@ -0,0 +1,547 @@
+package samfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+const defaultFlushInterval = 10 * time.Second
+
+// Config is what samfs-server reads from its -config file, a JSON document
+// with one entry per export, e.g.
+//
+//	{"exports": [{"root": "/export", "listen": ":24100",
+//	              "auth": {"secretFile": "secret", "policyFile": "policy"}}]}
+//
+// Each export is served by a server of its own. Settings left out take the
+// values of DefaultExportConfig.
+type Config struct {
+	Exports []ExportConfig `json:"exports"`
+}
+
+type ExportConfig struct {
+	Root   string `json:"root"`
+	Listen string `json:"listen"`
+	// whether clients may compress read and write data
+	Compression bool `json:"compression"`
+	// refuse changes until an admin makes the export writable
+	ReadOnly bool `json:"readOnly"`
+	// permissions of the files and directories clients create
+	CreateMode FileMode `json:"createMode"`
+	// where databases are kept when their location is not set
+	StateDirectory string `json:"stateDirectory"`
+	// how often quota usage is persisted and idle clients forgotten
+	FlushInterval Duration `json:"flushInterval"`
+
+	TLS      TLSConfig     `json:"tls"`
+	Auth     AuthConfig    `json:"auth"`
+	Quotas   QuotaConfig   `json:"quotas"`
+	AuditLog AuditConfig   `json:"auditLog"`
+	Metrics  MetricsConfig `json:"metrics"`
+	Limits   LimitsConfig  `json:"limits"`
+}
+
+type TLSConfig struct {
+	Cert            string   `json:"cert"`
+	Key             string   `json:"key"`
+	ClientCA        string   `json:"clientCA"`
+	AllowedSubjects []string `json:"allowedSubjects"`
+}
+
+type AuthConfig struct {
+	SecretFile string `json:"secretFile"`
+	PolicyFile string `json:"policyFile"`
+}
+
+type QuotaConfig struct {
+	File string `json:"file"`
+	// usage database, StateDirectory/samfs.db or File with .usage appended
+	// if empty
+	DB string `json:"db"`
+}
+
+type AuditConfig struct {
+	File     string `json:"file"`
+	MaxSize  int64  `json:"maxSize"`
+	MaxFiles int    `json:"maxFiles"`
+}
+
+type MetricsConfig struct {
+	Listen               string   `json:"listen"`
+	SlowRequestThreshold Duration `json:"slowRequestThreshold"`
+}
+
+type LimitsConfig struct {
+	// concurrent requests per client connection, unlimited if 0
+	MaxConcurrentStreams uint32 `json:"maxConcurrentStreams"`
+	// size of the largest request, grpc's default if 0
+	MaxMessageSize  int      `json:"maxMessageSize"`
+	LockGracePeriod Duration `json:"lockGracePeriod"`
+	RecallTimeout   Duration `json:"recallTimeout"`
+	// rate limits of each client and of the export as a whole
+	Client RateConfig `json:"client"`
+	Export RateConfig `json:"export"`
+	// requests handled at once, unlimited if 0; the others wait their turn,
+	// clients taking turns and metadata going before bulk I/O
+	Workers int `json:"workers"`
+	// requests a client may have waiting for a worker before more are
+	// throttled, unlimited if 0
+	MaxQueuedPerClient int `json:"maxQueuedPerClient"`
+	// files kept open between requests, none if 0
+	FdCacheSize int `json:"fdCacheSize"`
+}
+
+// RateConfig limits requests and bytes read or written per second,
+// unlimited if 0.
+type RateConfig struct {
+	OpsPerSecond   float64 `json:"opsPerSecond"`
+	BytesPerSecond int64   `json:"bytesPerSecond"`
+}
+
+func (e *ExportConfig) schedulerLimits() schedulerLimits {
+	return schedulerLimits{
+		client: rateLimits{
+			ops:   e.Limits.Client.OpsPerSecond,
+			bytes: e.Limits.Client.BytesPerSecond,
+		},
+		export: rateLimits{
+			ops:   e.Limits.Export.OpsPerSecond,
+			bytes: e.Limits.Export.BytesPerSecond,
+		},
+		workers:   e.Limits.Workers,
+		maxQueued: e.Limits.MaxQueuedPerClient,
+	}
+}
+
+// Duration is a time.Duration written as a string, e.g. "45s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf(`expected a duration such as "10s"`)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// FileMode is an os.FileMode written as an octal string, e.g. "0755".
+type FileMode os.FileMode
+
+func (m *FileMode) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf(`expected an octal mode such as "0755"`)
+	}
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || os.FileMode(v)&^os.ModePerm != 0 {
+		return fmt.Errorf("invalid mode %q", s)
+	}
+	*m = FileMode(v)
+	return nil
+}
+
+// DefaultExportConfig returns the settings of an export that the config file
+// and flags do not change.
+func DefaultExportConfig() ExportConfig {
+	return ExportConfig{
+		Listen:        ":24100",
+		Compression:   true,
+		CreateMode:    FileMode(defaultPermission),
+		FlushInterval: Duration(defaultFlushInterval),
+		AuditLog: AuditConfig{
+			MaxSize:  100 << 20,
+			MaxFiles: 10,
+		},
+		Limits: LimitsConfig{
+			LockGracePeriod: Duration(defaultLockGracePeriod),
+			RecallTimeout:   Duration(defaultRecallTimeout),
+			FdCacheSize:     defaultFdCacheSize,
+		},
+	}
+}
+
+// LoadConfig reads and validates the config in file.
+func LoadConfig(file string) (*Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var syntax json.RawMessage
+	if err := json.Unmarshal(data, &syntax); err != nil {
+		if serr, ok := err.(*json.SyntaxError); ok {
+			// the offset is just past the offending character
+			line, col := position(data, serr.Offset-1)
+			return nil, fmt.Errorf("%s:%d:%d: %v", file, line, col, err)
+		}
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+
+	cfg := &Config{}
+	if err := decodeConfig(data, reflect.ValueOf(cfg).Elem(), ""); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return cfg, nil
+}
+
+// position returns the line and column of offset in data.
+func position(data []byte, offset int64) (int, int) {
+	line, col := 1, 1
+	if offset < 0 {
+		offset = 0
+	}
+	for _, c := range data[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// decodeConfig decodes data into v like json.Unmarshal, but rejects settings
+// v does not have and reports where in the document a value is wrong.
+// Exports in a list start out with the default settings.
+func decodeConfig(data []byte, v reflect.Value, where string) error {
+	fail := func(format string, args ...interface{}) error {
+		if where == "" {
+			return fmt.Errorf(format, args...)
+		}
+		return fmt.Errorf(where+": "+format, args...)
+	}
+
+	switch {
+	case v.Kind() == reflect.Struct:
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return fail("expected an object")
+		}
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			f, ok := fieldByTag(v, name)
+			if !ok {
+				return fail("unknown setting %q", name)
+			}
+			err := decodeConfig(fields[name], f, joinPath(where, name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Struct:
+		var elems []json.RawMessage
+		if err := json.Unmarshal(data, &elems); err != nil {
+			return fail("expected a list")
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(elems), len(elems)))
+		for i, raw := range elems {
+			if export, ok := v.Index(i).Addr().Interface().(*ExportConfig); ok {
+				*export = DefaultExportConfig()
+			}
+			err := decodeConfig(raw, v.Index(i), fmt.Sprintf("%s[%d]", where, i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v.Addr().Interface()); err != nil {
+		if terr, ok := err.(*json.UnmarshalTypeError); ok {
+			return fail("expected %v, not %s", terr.Type, terr.Value)
+		}
+		return fail("%v", err)
+	}
+	return nil
+}
+
+func fieldByTag(v reflect.Value, name string) (reflect.Value, bool) {
+	for i := 0; i < v.NumField(); i++ {
+		tag := strings.Split(v.Type().Field(i).Tag.Get("json"), ",")[0]
+		if tag == name {
+			return v.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func joinPath(where string, name string) string {
+	if where == "" {
+		return name
+	}
+	return where + "." + name
+}
+
+// Validate checks that the exports can be served, it returns the first
+// problem found along with the setting it is about.
+func (c *Config) Validate() error {
+	if len(c.Exports) == 0 {
+		return fmt.Errorf("exports: at least one export is required")
+	}
+	used := make(map[string]string)
+	claim := func(kind string, value string, where string) error {
+		if value == "" {
+			return nil
+		}
+		if other, ok := used[kind+" "+value]; ok {
+			return fmt.Errorf("%s: %s %q is already used by %s", where, kind,
+				value, other)
+		}
+		used[kind+" "+value] = where
+		return nil
+	}
+
+	for i := range c.Exports {
+		e := &c.Exports[i]
+		where := fmt.Sprintf("exports[%d]", i)
+		if err := e.validate(where); err != nil {
+			return err
+		}
+		if err := claim("address", e.Listen, where+".listen"); err != nil {
+			return err
+		}
+		err := claim("address", e.Metrics.Listen, where+".metrics.listen")
+		if err != nil {
+			return err
+		}
+		if err := claim("file", e.AuditLog.File, where+".auditLog.file"); err != nil {
+			return err
+		}
+		if err := claim("file", e.quotaDB(), where+".quotas.db"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ExportConfig) validate(where string) error {
+	fail := func(setting string, format string, args ...interface{}) error {
+		return fmt.Errorf(where+"."+setting+": "+format, args...)
+	}
+	isDir := func(setting string, dir string) error {
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fail(setting, "%v", err)
+		}
+		if !info.IsDir() {
+			return fail(setting, "%s is not a directory", dir)
+		}
+		return nil
+	}
+	exists := func(setting string, file string) error {
+		if file == "" {
+			return nil
+		}
+		if _, err := os.Stat(file); err != nil {
+			return fail(setting, "%v", err)
+		}
+		return nil
+	}
+
+	if e.Root == "" {
+		return fail("root", "the directory to export is required")
+	}
+	if err := isDir("root", e.Root); err != nil {
+		return err
+	}
+	if _, _, err := net.SplitHostPort(e.Listen); err != nil {
+		return fail("listen", "%v", err)
+	}
+	if e.StateDirectory != "" {
+		if err := isDir("stateDirectory", e.StateDirectory); err != nil {
+			return err
+		}
+	}
+	if e.FlushInterval <= 0 {
+		return fail("flushInterval", "must be positive")
+	}
+
+	if e.TLS.Cert == "" && (e.TLS.Key != "" || e.TLS.ClientCA != "" ||
+		len(e.TLS.AllowedSubjects) > 0) {
+		return fail("tls.cert", "required by the other tls settings")
+	}
+	if e.TLS.Cert != "" && e.TLS.Key == "" {
+		return fail("tls.key", "required with tls.cert")
+	}
+	if len(e.TLS.AllowedSubjects) > 0 && e.TLS.ClientCA == "" {
+		return fail("tls.clientCA", "required with tls.allowedSubjects")
+	}
+	if err := exists("tls.cert", e.TLS.Cert); err != nil {
+		return err
+	}
+	if err := exists("tls.key", e.TLS.Key); err != nil {
+		return err
+	}
+	if err := exists("tls.clientCA", e.TLS.ClientCA); err != nil {
+		return err
+	}
+
+	if e.Auth.SecretFile == "" && e.Auth.PolicyFile != "" {
+		return fail("auth.secretFile", "required with auth.policyFile")
+	}
+	if e.Auth.SecretFile != "" && e.Auth.PolicyFile == "" {
+		return fail("auth.policyFile", "required with auth.secretFile")
+	}
+	if err := exists("auth.secretFile", e.Auth.SecretFile); err != nil {
+		return err
+	}
+	if err := exists("auth.policyFile", e.Auth.PolicyFile); err != nil {
+		return err
+	}
+
+	if e.Quotas.File == "" && e.Quotas.DB != "" {
+		return fail("quotas.file", "required with quotas.db")
+	}
+	if err := exists("quotas.file", e.Quotas.File); err != nil {
+		return err
+	}
+
+	if e.AuditLog.MaxSize < 0 {
+		return fail("auditLog.maxSize", "must not be negative")
+	}
+	if e.AuditLog.MaxFiles < 0 {
+		return fail("auditLog.maxFiles", "must not be negative")
+	}
+
+	if e.Metrics.Listen != "" {
+		if _, _, err := net.SplitHostPort(e.Metrics.Listen); err != nil {
+			return fail("metrics.listen", "%v", err)
+		}
+	}
+	if e.Metrics.SlowRequestThreshold < 0 {
+		return fail("metrics.slowRequestThreshold", "must not be negative")
+	}
+
+	if e.Limits.MaxMessageSize < 0 {
+		return fail("limits.maxMessageSize", "must not be negative")
+	}
+	if e.Limits.LockGracePeriod < 0 {
+		return fail("limits.lockGracePeriod", "must not be negative")
+	}
+	if e.Limits.RecallTimeout <= 0 {
+		return fail("limits.recallTimeout", "must be positive")
+	}
+	rates := []struct {
+		name string
+		rate RateConfig
+	}{{"client", e.Limits.Client}, {"export", e.Limits.Export}}
+	for _, r := range rates {
+		if r.rate.OpsPerSecond < 0 {
+			return fail("limits."+r.name+".opsPerSecond", "must not be negative")
+		}
+		if r.rate.BytesPerSecond < 0 {
+			return fail("limits."+r.name+".bytesPerSecond",
+				"must not be negative")
+		}
+	}
+	if e.Limits.Workers < 0 {
+		return fail("limits.workers", "must not be negative")
+	}
+	if e.Limits.MaxQueuedPerClient < 0 {
+		return fail("limits.maxQueuedPerClient", "must not be negative")
+	}
+	if e.Limits.FdCacheSize < 0 {
+		return fail("limits.fdCacheSize", "must not be negative")
+	}
+	return nil
+}
+
+func (e *ExportConfig) quotaDB() string {
+	switch {
+	case e.Quotas.File == "":
+		return ""
+	case e.Quotas.DB != "":
+		return e.Quotas.DB
+	case e.StateDirectory != "":
+		return path.Join(e.StateDirectory, dbFileName)
+	}
+	return e.Quotas.File + ".usage"
+}
+
+// NewServer creates a server for the export; the config has to have been
+// validated.
+func (e *ExportConfig) NewServer() (*SamFSServer, error) {
+	s, err := NewServer(e.Root, "")
+	if err != nil {
+		return nil, err
+	}
+	s.listenAddress = e.Listen
+	s.SetCompression(e.Compression)
+	if e.ReadOnly {
+		s.readOnly = 1
+	}
+	s.createMode = os.FileMode(e.CreateMode)
+	s.flushInterval = time.Duration(e.FlushInterval)
+	s.locks.gracePeriod = time.Duration(e.Limits.LockGracePeriod)
+	s.delegations.recallTimeout = time.Duration(e.Limits.RecallTimeout)
+	s.scheduler.setLimits(e.schedulerLimits())
+	s.fds.setCapacity(e.Limits.FdCacheSize)
+	if e.Limits.MaxConcurrentStreams > 0 {
+		s.grpcOptions = append(s.grpcOptions,
+			grpc.MaxConcurrentStreams(e.Limits.MaxConcurrentStreams))
+	}
+	if e.Limits.MaxMessageSize > 0 {
+		s.grpcOptions = append(s.grpcOptions,
+			grpc.MaxMsgSize(e.Limits.MaxMessageSize))
+	}
+
+	if e.TLS.Cert != "" {
+		err := s.SetTLS(&TLSOptions{
+			CertFile:        e.TLS.Cert,
+			KeyFile:         e.TLS.Key,
+			CAFile:          e.TLS.ClientCA,
+			AllowedSubjects: e.TLS.AllowedSubjects,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to set up tls :: %v", err)
+		}
+	}
+	if e.Auth.SecretFile != "" {
+		if err := s.SetAuth(e.Auth.SecretFile, e.Auth.PolicyFile); err != nil {
+			return nil, fmt.Errorf("failed to set up authentication :: %v", err)
+		}
+	}
+	if e.Quotas.File != "" {
+		if err := s.SetQuotas(e.Quotas.File, e.quotaDB()); err != nil {
+			return nil, fmt.Errorf("failed to set up quotas :: %v", err)
+		}
+	}
+	if e.AuditLog.File != "" {
+		err := s.SetAuditLog(e.AuditLog.File, e.AuditLog.MaxSize,
+			e.AuditLog.MaxFiles)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open audit log :: %v", err)
+		}
+	}
+	s.SetSlowRequestThreshold(time.Duration(e.Metrics.SlowRequestThreshold))
+	if e.Metrics.Listen != "" {
+		if err := s.ServeMetrics(e.Metrics.Listen); err != nil {
+			return nil, fmt.Errorf("failed to serve metrics :: %v", err)
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,160 @@
+package samfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+const copyBufferSize = 1024 * 1024
+
+func (s *SamFSServer) CopyRange(ctx context.Context,
+	req *pb.CopyRangeRequest) (*pb.CopyRangeReply, error) {
+	glog.V(3).Infof(`received CopyRange request from "%s" to "%s"`,
+		req.SrcFileHandle.Path, req.DstFileHandle.Path)
+
+	//validate incoming file handles
+	err := s.verifyFileHandle(req.SrcFileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+	err = s.verifyFileHandle(req.DstFileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	//other clients may have buffered writes to either file
+	s.delegations.recallOthers(ctx, req.SrcFileHandle, req.ClientID)
+	s.delegations.recallOthers(ctx, req.DstFileHandle, req.ClientID)
+
+	srcPath := path.Join(s.rootDirectory, req.SrcFileHandle.Path)
+	src, err := os.Open(srcPath)
+	if err != nil {
+		glog.Errorf("could not open file %s :: %v\n", req.SrcFileHandle.Path, err)
+		return nil, err
+	}
+	defer src.Close()
+
+	dstPath := path.Join(s.rootDirectory, req.DstFileHandle.Path)
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY, defaultPermission)
+	if err != nil {
+		glog.Errorf("could not open file %s :: %v\n", req.DstFileHandle.Path, err)
+		return nil, err
+	}
+	defer dst.Close()
+
+	//never copy past the end of the source, that also lets a copy of a
+	//whole file be cloned even if its size is not block aligned
+	fi, err := src.Stat()
+	if err != nil {
+		glog.Errorf("could not stat file %s :: %v\n", req.SrcFileHandle.Path, err)
+		return nil, err
+	}
+	length := fi.Size() - req.SrcOffset
+	if req.Length > 0 && req.Length < length {
+		length = req.Length
+	}
+
+	unlock := s.lockGrowth(handleKey(req.DstFileHandle))
+	defer unlock()
+	settle, err := s.quotas.chargeGrowth(dstPath, req.DstFileHandle.Path,
+		req.DstOffset+length)
+	if err != nil {
+		glog.Errorf("not copying to %s :: %v\n", req.DstFileHandle.Path, err)
+		return nil, err
+	}
+	defer settle()
+
+	before := wccBefore(dstPath)
+	var n int64
+	var cloned bool
+	if length > 0 {
+		n, cloned, err = copyRange(src, req.SrcOffset, dst, req.DstOffset, length)
+		if err == syscall.EINVAL {
+			return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+		}
+		if err != nil {
+			glog.Errorf("failed to copy file %s to %s :: %v\n",
+				req.SrcFileHandle.Path, req.DstFileHandle.Path, err)
+			return nil, err
+		}
+	}
+	glog.V(3).Infof("copied %d bytes from %s to %s, cloned: %v", n,
+		req.SrcFileHandle.Path, req.DstFileHandle.Path, cloned)
+
+	//like writes, copies are synced on Stop unless committed before
+	s.dirty.add(req.DstFileHandle.Path)
+	s.notify(ctx, pb.WatchEventType_MODIFY, req.DstFileHandle.Path, "")
+
+	resp := &pb.CopyRangeReply{
+		Size:            n,
+		Cloned:          cloned,
+		ServerSessionID: s.sessionID,
+		Wcc:             wccData(before, dstPath),
+	}
+
+	return resp, nil
+}
+
+// overlapping returns whether a copy of length bytes from src to dst would
+// overwrite what it still has to read. copy_file_range(2) refuses such copies
+// within a file with EINVAL, and copyBuffered would corrupt them.
+func overlapping(src *os.File, srcOff int64, dst *os.File, dstOff int64,
+	length int64) bool {
+
+	if srcOff+length <= dstOff || dstOff+length <= srcOff {
+		return false
+	}
+	srcInfo, err := src.Stat()
+	if err != nil {
+		return false
+	}
+	dstInfo, err := dst.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(srcInfo, dstInfo)
+}
+
+// copyBuffered copies length bytes by reading them into memory, for when the
+// kernel can not do the copy for us. It stops early at the end of src.
+func copyBuffered(src *os.File, srcOff int64, dst *os.File, dstOff int64,
+	length int64) (int64, error) {
+
+	size := int64(copyBufferSize)
+	if length < size {
+		size = length
+	}
+	buf := make([]byte, size)
+
+	var copied int64
+	for copied < length {
+		want := length - copied
+		if want > size {
+			want = size
+		}
+		n, err := src.ReadAt(buf[:want], srcOff+copied)
+		if n > 0 {
+			if _, werr := dst.WriteAt(buf[:n], dstOff+copied); werr != nil {
+				return copied, werr
+			}
+			copied += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return copied, err
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,20 @@
+// +build darwin
+
+package samfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyRange copies length bytes from src to dst. osx has no
+// copy_file_range, so the data always goes through our memory.
+func copyRange(src *os.File, srcOff int64, dst *os.File, dstOff int64,
+	length int64) (int64, bool, error) {
+
+	if overlapping(src, srcOff, dst, dstOff, length) {
+		return 0, false, syscall.EINVAL
+	}
+	n, err := copyBuffered(src, srcOff, dst, dstOff, length)
+	return n, false, err
+}
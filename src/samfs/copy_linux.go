@@ -0,0 +1,93 @@
+// +build linux
+
+package samfs
+
+//#define _GNU_SOURCE
+//#include <stdint.h>
+//#include <errno.h>
+//#include <unistd.h>
+//#include <sys/ioctl.h>
+//#include <sys/syscall.h>
+//#include <linux/fs.h>
+//
+//int cloneRange(int srcfd, int64_t srcoff, int dstfd, int64_t dstoff,
+//               int64_t len) {
+//#ifdef FICLONERANGE
+//    struct file_clone_range r = {
+//        .src_fd = srcfd,
+//        .src_offset = srcoff,
+//        .src_length = len,
+//        .dest_offset = dstoff,
+//    };
+//    if (ioctl(dstfd, FICLONERANGE, &r) < 0) {
+//        return errno;
+//    }
+//    return 0;
+//#else
+//    return EOPNOTSUPP;
+//#endif
+//}
+//
+//int64_t copyFileRange(int srcfd, int64_t *srcoff, int dstfd,
+//                      int64_t *dstoff, int64_t len) {
+//#ifdef __NR_copy_file_range
+//    long n = syscall(__NR_copy_file_range, srcfd, srcoff, dstfd, dstoff,
+//                     (size_t)len, 0);
+//    if (n < 0) {
+//        return -errno;
+//    }
+//    return n;
+//#else
+//    return -ENOSYS;
+//#endif
+//}
+import "C"
+import (
+	"os"
+	"syscall"
+)
+
+// copyRange copies length bytes from src to dst. It shares the data through
+// a reflink when the filesystem supports it, otherwise the kernel copies it
+// with copy_file_range, and as a last resort we copy it ourselves.
+func copyRange(src *os.File, srcOff int64, dst *os.File, dstOff int64,
+	length int64) (int64, bool, error) {
+
+	if overlapping(src, srcOff, dst, dstOff, length) {
+		return 0, false, syscall.EINVAL
+	}
+	// cloning needs block aligned ranges, the filesystem tells us with
+	// EINVAL when they are not
+	errno := C.cloneRange(C.int(src.Fd()), C.int64_t(srcOff), C.int(dst.Fd()),
+		C.int64_t(dstOff), C.int64_t(length))
+	if errno == 0 {
+		return length, true, nil
+	}
+
+	var copied int64
+	for copied < length {
+		in := C.int64_t(srcOff + copied)
+		out := C.int64_t(dstOff + copied)
+		n := C.copyFileRange(C.int(src.Fd()), &in, C.int(dst.Fd()), &out,
+			C.int64_t(length-copied))
+		if n == 0 {
+			// end of src
+			return copied, false, nil
+		}
+		if n < 0 {
+			err := syscall.Errno(-n)
+			if copied == 0 && (err == syscall.ENOSYS || err == syscall.EXDEV ||
+				err == syscall.EINVAL || err == syscall.EOPNOTSUPP) {
+				break
+			}
+			return copied, false, err
+		}
+		copied += int64(n)
+	}
+	if copied == length {
+		return copied, false, nil
+	}
+
+	n, err := copyBuffered(src, srcOff, dst, dstOff, length)
+	return n, false, err
+}
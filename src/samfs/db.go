@@ -37,15 +37,14 @@ func (db *DB) readIntoMemory() error {
 		glog.Errorf("failed to open db file at path %s :: %v\n", db.filePath, err)
 		return err
 	}
+	defer fd.Close()
 
 	db.entries = make(map[string]int64) //reset in memory data structure
 
 	scanner := bufio.NewScanner(fd)
 	for scanner.Scan() {
 		line := scanner.Text()
-		fmt.Printf("line: %s\n", line)
 		tokens := strings.Split(line, "|")
-		fmt.Printf("tokens: %v\n", tokens)
 
 		num, err := strconv.ParseInt(tokens[1], 10, 64)
 		if err != nil {
@@ -154,3 +153,13 @@ func (db *DB) Increment(path string) (int64, error) {
 
 	return num, nil
 }
+
+//Set updates path in memory only, call Flush to persist it.
+func (db *DB) Set(path string, num int64) {
+	db.entries[strings.TrimSpace(path)] = num
+}
+
+//Flush persists all entries to disk.
+func (db *DB) Flush() error {
+	return db.writeToDisk()
+}
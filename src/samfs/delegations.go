@@ -0,0 +1,413 @@
+package samfs
+
+import (
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// how long a delegation holder gets to flush its data after a recall before
+// the delegation is revoked anyway
+const defaultRecallTimeout = 10 * time.Second
+
+// errDelegationRevoked refuses data written back from a delegation that was
+// revoked, it would land on top of what others wrote since.
+var errDelegationRevoked = grpc.Errorf(codes.Aborted,
+	"delegation was revoked")
+
+type delegation struct {
+	holder   int64
+	write    bool
+	returned chan struct{}
+}
+
+// callbackQueue holds the recalls for a client's callback stream.
+type callbackQueue struct {
+	recalls chan *pb.CallbackRequest
+	// closed to end the stream, so that the client drops its delegations
+	revoked chan struct{}
+}
+
+type openFile struct {
+	fileHandle *pb.FileHandle
+	opens      map[int64]int //clientID -> number of opens
+	deleg      *delegation
+}
+
+type delegationManager struct {
+	sync.Mutex
+	files map[fileKey]*openFile
+	// recalls queued for clients that have a callback stream open
+	callbacks map[int64]*callbackQueue
+	// clients whose delegation on a file was revoked without them returning
+	// it, their delegated writes to the file are refused
+	fenced map[fileKey]map[int64]bool
+
+	recallTimeout time.Duration
+	// set while the server hands its state over to an upgraded one; clients
+	// keep their opens when their callback stream ends
+	frozen bool
+}
+
+func newDelegationManager() *delegationManager {
+	return &delegationManager{
+		files:         make(map[fileKey]*openFile),
+		callbacks:     make(map[int64]*callbackQueue),
+		fenced:        make(map[fileKey]map[int64]bool),
+		recallTimeout: defaultRecallTimeout,
+	}
+}
+
+func (m *delegationManager) register(clientID int64) *callbackQueue {
+	q := &callbackQueue{
+		recalls: make(chan *pb.CallbackRequest, 16),
+		revoked: make(chan struct{}),
+	}
+	m.Lock()
+	m.callbacks[clientID] = q
+	m.Unlock()
+	return q
+}
+
+// unregister forgets everything a client had open, it can no longer be
+// reached to recall delegations.
+func (m *delegationManager) unregister(clientID int64, q *callbackQueue) {
+	m.Lock()
+	defer m.Unlock()
+	if m.frozen || m.callbacks[clientID] != q {
+		// client already reconnected on a new stream
+		return
+	}
+	m.forget(clientID)
+}
+
+// evict forgets everything a client had open whether or not its callback
+// stream is still open.
+func (m *delegationManager) evict(clientID int64) {
+	m.Lock()
+	defer m.Unlock()
+	m.forget(clientID)
+	for key := range m.fenced {
+		m.unfence(key, clientID)
+	}
+}
+
+// forget must be called with m locked.
+func (m *delegationManager) forget(clientID int64) {
+	delete(m.callbacks, clientID)
+	for key, f := range m.files {
+		delete(f.opens, clientID)
+		if f.deleg != nil && f.deleg.holder == clientID {
+			close(f.deleg.returned)
+			f.deleg = nil
+		}
+		if len(f.opens) == 0 && f.deleg == nil {
+			delete(m.files, key)
+		}
+	}
+}
+
+// recall asks the holder of a delegation on key to give it back, and waits
+// until it does, the recall times out or ctx is done. Must be called with m
+// locked, it is unlocked while waiting.
+func (m *delegationManager) recall(ctx context.Context, key fileKey) {
+	f, ok := m.files[key]
+	if !ok || f.deleg == nil {
+		return
+	}
+	d := f.deleg
+
+	glog.V(2).Infof("recalling delegation on %s from client %d",
+		f.fileHandle.Path, d.holder)
+	q, ok := m.callbacks[d.holder]
+	if ok {
+		select {
+		case q.recalls <- &pb.CallbackRequest{Recall: f.fileHandle}:
+		default:
+			glog.Warningf("callback queue of client %d is full", d.holder)
+			ok = false
+		}
+	}
+
+	if ok {
+		timeout := m.recallTimeout
+		m.Unlock()
+		select {
+		case <-d.returned:
+		case <-time.After(timeout):
+			glog.Warningf("client %d did not return delegation on %s in time",
+				d.holder, f.fileHandle.Path)
+		case <-ctx.Done():
+		}
+		m.Lock()
+	}
+
+	if f.deleg == d {
+		glog.Warningf("revoking delegation on %s from client %d",
+			f.fileHandle.Path, d.holder)
+		close(d.returned)
+		f.deleg = nil
+		m.fence(key, d.holder)
+		if q, ok := m.callbacks[d.holder]; ok {
+			select {
+			case <-q.revoked:
+			default:
+				close(q.revoked)
+			}
+		}
+	}
+}
+
+// fence must be called with m locked.
+func (m *delegationManager) fence(key fileKey, clientID int64) {
+	if m.fenced[key] == nil {
+		m.fenced[key] = make(map[int64]bool)
+	}
+	m.fenced[key][clientID] = true
+}
+
+// unfence must be called with m locked.
+func (m *delegationManager) unfence(key fileKey, clientID int64) {
+	delete(m.fenced[key], clientID)
+	if len(m.fenced[key]) == 0 {
+		delete(m.fenced, key)
+	}
+}
+
+// checkDelegated refuses data written back from a revoked delegation. The
+// client drops the delegation when refused, so the fence is lifted.
+func (m *delegationManager) checkDelegated(req *pb.WriteRequest) error {
+	if !req.Delegated {
+		return nil
+	}
+	key := handleKey(req.FileHandle)
+	m.Lock()
+	defer m.Unlock()
+	if !m.fenced[key][req.ClientID] {
+		return nil
+	}
+	m.unfence(key, req.ClientID)
+	glog.Warningf("refusing write to %s from revoked delegation of client %d",
+		req.FileHandle.Path, req.ClientID)
+	return errDelegationRevoked
+}
+
+func (m *delegationManager) recallKey(ctx context.Context, key fileKey) {
+	m.Lock()
+	m.recall(ctx, key)
+	m.Unlock()
+}
+
+// recallConflicting recalls a delegation on key unless clientID holds it.
+// Must be called with m locked.
+func (m *delegationManager) recallConflicting(ctx context.Context, key fileKey,
+	clientID int64) {
+
+	f, ok := m.files[key]
+	if ok && f.deleg != nil && f.deleg.holder != clientID {
+		m.recall(ctx, key)
+	}
+}
+
+func (m *delegationManager) recallOthers(ctx context.Context,
+	fileHandle *pb.FileHandle, clientID int64) {
+
+	m.Lock()
+	m.recallConflicting(ctx, handleKey(fileHandle), clientID)
+	m.Unlock()
+}
+
+// open records that clientID opened the file, recalling delegations held by
+// other clients. A delegation is granted if no other client has the file
+// open and the client can be reached for recalls.
+func (m *delegationManager) open(ctx context.Context, fileHandle *pb.FileHandle,
+	clientID int64, write bool) pb.DelegationType {
+
+	key := handleKey(fileHandle)
+	m.Lock()
+	defer m.Unlock()
+
+	m.recallConflicting(ctx, key, clientID)
+
+	// the file may have been forgotten while we were waiting for the recall
+	f, ok := m.files[key]
+	if !ok {
+		f = &openFile{
+			fileHandle: fileHandle,
+			opens:      make(map[int64]int),
+		}
+		m.files[key] = f
+	}
+	f.opens[clientID]++
+
+	_, reachable := m.callbacks[clientID]
+	if reachable && len(f.opens) == 1 {
+		if f.deleg == nil {
+			m.unfence(key, clientID)
+			f.deleg = &delegation{
+				holder:   clientID,
+				returned: make(chan struct{}),
+			}
+		}
+		if write {
+			f.deleg.write = true
+		}
+	}
+
+	if f.deleg == nil || f.deleg.holder != clientID {
+		return pb.DelegationType_NO_DELEGATION
+	}
+	if f.deleg.write {
+		return pb.DelegationType_WRITE_DELEGATION
+	}
+	return pb.DelegationType_READ_DELEGATION
+}
+
+// close drops one open of the file by clientID. The client flushes its
+// delegated state before closing, so the delegation goes away with the last
+// open.
+func (m *delegationManager) close(fileHandle *pb.FileHandle, clientID int64) {
+	key := handleKey(fileHandle)
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.files[key]
+	if !ok {
+		return
+	}
+	if f.opens[clientID] > 1 {
+		f.opens[clientID]--
+		return
+	}
+	delete(f.opens, clientID)
+	if f.deleg != nil && f.deleg.holder == clientID {
+		close(f.deleg.returned)
+		f.deleg = nil
+	}
+	if len(f.opens) == 0 {
+		delete(m.files, key)
+	}
+}
+
+func (m *delegationManager) returned(fileHandle *pb.FileHandle, clientID int64) {
+	m.Lock()
+	defer m.Unlock()
+
+	f, ok := m.files[handleKey(fileHandle)]
+	if !ok || f.deleg == nil || f.deleg.holder != clientID {
+		return
+	}
+	glog.V(2).Infof("client %d returned delegation on %s", clientID,
+		fileHandle.Path)
+	close(f.deleg.returned)
+	f.deleg = nil
+}
+
+// recallPath recalls the delegation on whatever file is currently at filePath,
+// before it gets removed, renamed over or truncated.
+func (s *SamFSServer) recallPath(ctx context.Context, filePath string) {
+	inum, gnum, err := GetInodeAndGenerationNumbers(filePath)
+	if err != nil {
+		return
+	}
+	s.delegations.recallKey(ctx, fileKey{inum, gnum})
+}
+
+func (s *SamFSServer) Open(ctx context.Context,
+	req *pb.OpenRequest) (*pb.OpenReply, error) {
+	glog.V(3).Infof(`received Open request for "%s" from client %d`,
+		req.FileHandle.Path, req.ClientID)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	deleg := s.delegations.open(ctx, req.FileHandle, req.ClientID, req.Write)
+
+	// attributes are fetched after any recall so that they include the data
+	// flushed by the previous holder
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	resp := &pb.OpenReply{
+		Delegation:      deleg,
+		Attr:            wccData(nil, filePath).After,
+		ServerSessionID: s.sessionID,
+	}
+
+	return resp, nil
+}
+
+func (s *SamFSServer) Close(ctx context.Context,
+	req *pb.OpenRequest) (*pb.StatusReply, error) {
+	glog.V(3).Infof(`received Close request for "%s" from client %d`,
+		req.FileHandle.Path, req.ClientID)
+
+	s.delegations.close(req.FileHandle, req.ClientID)
+
+	resp := &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+	}
+
+	return resp, nil
+}
+
+func (s *SamFSServer) Callback(stream pb.NFS_CallbackServer) error {
+	msg, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	clientID := msg.ClientID
+	glog.V(2).Infof("client %d opened callback stream", clientID)
+
+	if err := s.clients.addClientID(stream.Context(), clientID); err != nil {
+		glog.Warningf("refusing callback stream of client %d :: %v",
+			clientID, err)
+		return err
+	}
+	q := s.delegations.register(clientID)
+	defer s.delegations.unregister(clientID, q)
+
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			msg, err := stream.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if msg.Returned != nil {
+				s.delegations.returned(msg.Returned, clientID)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case req := <-q.recalls:
+			if err := stream.Send(req); err != nil {
+				glog.Warningf("failed to send recall to client %d :: %v",
+					clientID, err)
+				return err
+			}
+		case <-q.revoked:
+			glog.Warningf("ending callback stream of client %d, a delegation "+
+				"was revoked from it", clientID)
+			return errDelegationRevoked
+		case err := <-errc:
+			glog.V(2).Infof("client %d closed callback stream :: %v", clientID,
+				err)
+			return nil
+		case <-stream.Context().Done():
+			return nil
+		}
+	}
+}
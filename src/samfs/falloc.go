@@ -0,0 +1,88 @@
+package samfs
+
+import (
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func (s *SamFSServer) Allocate(ctx context.Context,
+	req *pb.AllocateRequest) (*pb.StatusReply, error) {
+	glog.V(3).Infof(`received Allocate request for "%s" off: %d, len: %d`,
+		req.FileHandle.Path, req.Offset, req.Length)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	//punching holes must not be undone by another client's cached writes
+	s.delegations.recallOthers(ctx, req.FileHandle, req.ClientID)
+
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	fd, err := os.OpenFile(filePath, os.O_WRONLY, defaultPermission)
+	if err != nil {
+		glog.Errorf("could not open file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+	defer fd.Close()
+
+	//space preallocated past the end of the file counts even if the size is
+	//kept
+	newSize := req.Offset + req.Length
+	if req.PunchHole {
+		newSize = 0
+	}
+	unlock := s.lockGrowth(handleKey(req.FileHandle))
+	settle, err := s.quotas.chargeGrowth(filePath, req.FileHandle.Path, newSize)
+	if err != nil {
+		unlock()
+		glog.Errorf("not allocating file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+
+	before := wccBefore(filePath)
+	err = fallocate(fd, req)
+	settle()
+	unlock()
+	if err != nil {
+		glog.Errorf("failed to allocate file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, allocateError(err)
+	}
+
+	//like writes, allocations are synced on Stop unless committed before
+	s.dirty.add(req.FileHandle.Path)
+	s.notify(ctx, pb.WatchEventType_MODIFY, req.FileHandle.Path, "")
+
+	resp := &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+		Wcc:             wccData(before, filePath),
+	}
+
+	return resp, nil
+}
+
+// allocateError carries the reason fallocate failed back to the client, the
+// caller needs to tell an unsupported mode from a full disk.
+func allocateError(err error) error {
+	switch err {
+	case syscall.EOPNOTSUPP:
+		return grpc.Errorf(codes.Unimplemented, "%v", err)
+	case syscall.ENOSPC:
+		return grpc.Errorf(codes.ResourceExhausted, "%v", err)
+	case syscall.EINVAL:
+		return grpc.Errorf(codes.InvalidArgument, "%v", err)
+	case syscall.EFBIG:
+		return grpc.Errorf(codes.OutOfRange, "%v", err)
+	}
+	return err
+}
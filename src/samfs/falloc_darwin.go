@@ -0,0 +1,23 @@
+// +build darwin
+
+package samfs
+
+import (
+	"os"
+	"syscall"
+
+	pb "github.com/smihir/samfs/src/proto"
+)
+
+// from linux/falloc.h, the modes clients on linux ask for
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+)
+
+// fallocate is not implemented on osx, reserving space would need
+// F_PREALLOCATE and punching holes is not supported at all.
+func fallocate(fd *os.File, req *pb.AllocateRequest) error {
+	return syscall.EOPNOTSUPP
+}
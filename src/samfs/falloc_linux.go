@@ -0,0 +1,31 @@
+// +build linux
+
+package samfs
+
+import (
+	"os"
+
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/sys/unix"
+)
+
+// from linux/falloc.h
+const (
+	fallocKeepSize  = 0x01
+	fallocPunchHole = 0x02
+	fallocZeroRange = 0x10
+)
+
+func fallocate(fd *os.File, req *pb.AllocateRequest) error {
+	var mode uint32
+	if req.KeepSize {
+		mode |= fallocKeepSize
+	}
+	if req.PunchHole {
+		mode |= fallocPunchHole
+	}
+	if req.ZeroRange {
+		mode |= fallocZeroRange
+	}
+	return unix.Fallocate(int(fd.Fd()), mode, req.Offset, req.Length)
+}
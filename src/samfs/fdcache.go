@@ -0,0 +1,225 @@
+package samfs
+
+import (
+	"container/list"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+)
+
+const (
+	// files kept open by default
+	defaultFdCacheSize = 1024
+	// open files unused for this long are closed, so that files removed
+	// behind the server's back do not keep their space
+	fdIdleExpiry = time.Minute
+)
+
+// cachedFile is an open file of the export.
+type cachedFile struct {
+	*os.File
+	key fileKey
+	// cleaned path relative to the export the file was opened at
+	path     string
+	writable bool
+	lastUsed time.Time
+	// requests using the file; it is closed once it is evicted and unused
+	refs    int
+	evicted bool
+	elem    *list.Element
+}
+
+// fdCache keeps the files clients use open, so that requests on them do not
+// have to open the file and read its generation number every time.
+type fdCache struct {
+	sync.Mutex
+	capacity int
+	files    map[fileKey]*cachedFile
+	// most recently used first
+	lru *list.List
+
+	metrics *metrics
+}
+
+func newFdCache(capacity int, m *metrics) *fdCache {
+	return &fdCache{
+		capacity: capacity,
+		files:    make(map[fileKey]*cachedFile),
+		lru:      list.New(),
+		metrics:  m,
+	}
+}
+
+// lookup returns the cached file of fileHandle, if it is still at the path
+// of the handle. Holding the file open keeps its inode from being reused, so
+// a path that still leads to the inode leads to the same generation and the
+// handle does not need to be verified again.
+func (c *fdCache) lookup(root string, fileHandle *pb.FileHandle,
+	write bool) *cachedFile {
+
+	key := handleKey(fileHandle)
+	c.Lock()
+	f, ok := c.files[key]
+	if !ok || f.path != path.Clean(fileHandle.Path) || (write && !f.writable) {
+		c.Unlock()
+		return nil
+	}
+	f.refs++
+	f.lastUsed = time.Now()
+	c.lru.MoveToFront(f.elem)
+	c.Unlock()
+
+	var stat syscall.Stat_t
+	err := syscall.Stat(path.Join(root, fileHandle.Path), &stat)
+	if err == nil && stat.Ino == key.inodeNumber {
+		return f
+	}
+	// removed or replaced behind the server's back
+	c.Lock()
+	c.evict(f)
+	c.Unlock()
+	c.release(f)
+	return nil
+}
+
+// add caches f, which the caller is using, and evicts the least recently used
+// files if the cache is full.
+func (c *fdCache) add(f *cachedFile) {
+	c.Lock()
+	defer c.Unlock()
+	f.refs++
+	f.lastUsed = time.Now()
+	if c.capacity <= 0 {
+		f.evicted = true
+		return
+	}
+	if old, ok := c.files[f.key]; ok {
+		c.evict(old)
+	}
+	c.files[f.key] = f
+	f.elem = c.lru.PushFront(f)
+	atomic.AddInt64(&c.metrics.fdCacheOpen, 1)
+	for c.lru.Len() > c.capacity {
+		c.evict(c.lru.Back().Value.(*cachedFile))
+	}
+}
+
+// evict removes f from the cache and closes it unless it is in use. Must be
+// called with c locked.
+func (c *fdCache) evict(f *cachedFile) {
+	if f.evicted {
+		return
+	}
+	f.evicted = true
+	delete(c.files, f.key)
+	c.lru.Remove(f.elem)
+	atomic.AddInt64(&c.metrics.fdCacheOpen, -1)
+	atomic.AddUint64(&c.metrics.fdCacheEvictions, 1)
+	if f.refs == 0 {
+		f.Close()
+	}
+}
+
+// release is called by requests done with f.
+func (c *fdCache) release(f *cachedFile) {
+	c.Lock()
+	defer c.Unlock()
+	f.refs--
+	if f.evicted && f.refs == 0 {
+		f.Close()
+	}
+}
+
+// invalidate evicts the files at filePath, relative to the export, and below
+// it; they have been removed or renamed.
+func (c *fdCache) invalidate(filePath string) {
+	filePath = path.Clean(filePath)
+	c.Lock()
+	defer c.Unlock()
+	for _, f := range c.files {
+		if f.path == filePath || strings.HasPrefix(f.path, filePath+"/") {
+			c.evict(f)
+		}
+	}
+}
+
+// expire closes the files unused since before idle.
+func (c *fdCache) expire(idle time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	for e := c.lru.Back(); e != nil; {
+		f := e.Value.(*cachedFile)
+		if !f.lastUsed.Before(idle) {
+			break
+		}
+		e = e.Prev()
+		c.evict(f)
+	}
+}
+
+func (c *fdCache) setCapacity(capacity int) {
+	c.Lock()
+	defer c.Unlock()
+	c.capacity = capacity
+	for c.lru.Len() > capacity {
+		c.evict(c.lru.Back().Value.(*cachedFile))
+	}
+}
+
+func (c *fdCache) close() {
+	c.setCapacity(0)
+}
+
+// openHandle returns the open file of a verified file handle, writable if
+// write is set. It has to be released with s.fds.release.
+func (s *SamFSServer) openHandle(ctx context.Context,
+	fileHandle *pb.FileHandle, write bool) (*cachedFile, error) {
+
+	if f := s.fds.lookup(s.rootDirectory, fileHandle, write); f != nil {
+		atomic.AddUint64(&s.metrics.fdCacheHits, 1)
+		return f, nil
+	}
+	atomic.AddUint64(&s.metrics.fdCacheMisses, 1)
+
+	if err := s.verifyFileHandle(fileHandle); err != nil {
+		return nil, err
+	}
+	filePath := path.Join(s.rootDirectory, fileHandle.Path)
+	span := traceStart(ctx, "open")
+	fd, err := os.OpenFile(filePath, os.O_RDWR, 0)
+	writable := err == nil
+	if !write && err != nil {
+		// directories and files the server may only read
+		fd, err = os.Open(filePath)
+	}
+	span(err)
+	if err != nil {
+		glog.Errorf("could not open file %s :: %v\n", fileHandle.Path, err)
+		return nil, err
+	}
+
+	// the file may have been replaced since it was verified
+	var stat syscall.Stat_t
+	if err := syscall.Fstat(int(fd.Fd()), &stat); err != nil ||
+		stat.Ino != fileHandle.InodeNumber {
+		fd.Close()
+		return nil, s.verifyFileHandle(fileHandle)
+	}
+
+	f := &cachedFile{
+		File:     fd,
+		key:      handleKey(fileHandle),
+		path:     path.Clean(fileHandle.Path),
+		writable: writable,
+	}
+	s.fds.add(f)
+	return f, nil
+}
@@ -2,19 +2,23 @@ package samfs
 
 import (
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
 	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/nodefs"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type SamFsFileHandle struct {
-	at       int64
-	closed   bool
+	at     int64
+	closed bool
+	// flags the file was opened with
+	flags    uint32
 	fileData *SamFsFileData
 }
 
@@ -38,6 +42,17 @@ type SamFsFileData struct {
 	DCache   Cache
 	Dirty    bool
 	Attr     *fuse.Attr
+	// lock operations granted through this file, replayed to reclaim the
+	// locks after a server restart
+	Locks []*pb.LockRequest
+	// delegation held on the file, file data is cached in blocks while we
+	// have one
+	Deleg  pb.DelegationType
+	blocks map[int64]*dataBlock
+	size   int64
+	// closes not sent to the server yet, the last close keeps the file open
+	// until its delegated data is flushed
+	pendingCloses int
 }
 
 var _ nodefs.File = &SamFsFileHandle{}
@@ -79,6 +94,25 @@ func (cc *Cache) Invalidate() {
 	cc.numEntries = 0
 }
 
+func (c *SamFsFileHandle) readable() bool {
+	return c.flags&syscall.O_ACCMODE != syscall.O_WRONLY
+}
+
+func (c *SamFsFileHandle) writable() bool {
+	return c.flags&syscall.O_ACCMODE != syscall.O_RDONLY
+}
+
+// appending handles write to the end of the file as the server sees it.
+func (c *SamFsFileHandle) appending() bool {
+	return c.flags&syscall.O_APPEND != 0
+}
+
+// stable handles only return from writes once the data is on disk.
+func (c *SamFsFileHandle) stable() bool {
+	return c.flags&(syscall.O_SYNC|syscall.O_DSYNC) != 0 ||
+		c.fileData.Fs.options.sync
+}
+
 func (c *SamFsFileHandle) String() string {
 	glog.V(3).Info("String called")
 	return c.fileData.Name
@@ -98,37 +132,83 @@ func (c *SamFsFileHandle) Read(buf []byte, off int64) (fuse.ReadResult,
 	fuse.Status) {
 
 	glog.V(3).Infof("Read called on %s off: %d, size %d", c.fileData.Name, off, len(buf))
+	if !c.readable() {
+		return fuse.ReadResultData(nil), fuse.EBADF
+	}
 	name := c.fileData.Name
+	ctx, t := c.fileData.Fs.startOp("Read", name)
+	defer t.finish(nil)
+	if c.fileData.hasDelegation() {
+		data, err := c.fileData.readDelegated(ctx, buf, off)
+		if err != nil {
+			glog.Errorf(`failed to read from file "%s" :: %s`, name, err.Error())
+			return fuse.ReadResultData(nil), fuse.EIO
+		}
+		return fuse.ReadResultData(data), fuse.OK
+	}
+
 	fh := c.fileData.serverFh
-	resp, err := c.fileData.Fs.nfsClient.Read(context.Background(),
-		&pb.ReadRequest{
-			FileHandle: fh,
-			Offset:     off,
-			Size:       int64(len(buf)),
-		}, grpc.FailFast(false))
+	data, err := c.fileData.Fs.readSparse(ctx, fh, buf, off)
 	if err != nil {
 		glog.Errorf(`failed to write to file "%s" :: %s`, name, err.Error())
 		var nullData []byte
 		return fuse.ReadResultData(nullData), fuse.EIO
 	}
-	return fuse.ReadResultData(resp.Data), fuse.OK
+	return fuse.ReadResultData(data), fuse.OK
 }
 
 func (c *SamFsFileHandle) Write(data []byte, offset int64) (uint32,
 	fuse.Status) {
 
 	glog.V(3).Infof("Write called on %s", c.fileData.Name)
+	if !c.writable() {
+		return 0, fuse.EBADF
+	}
+	ctx, t := c.fileData.Fs.startOp("Write", c.fileData.Name)
+	defer t.finish(nil)
 
-	resp, err := c.write(data, offset)
+	if c.appending() {
+		return c.append(ctx, data)
+	}
+	if c.fileData.hasWriteDelegation() {
+		err := c.fileData.writeDelegated(ctx, data, offset)
+		if err != nil {
+			glog.Errorf(`failed to write to file "%s" :: %s`, c.fileData.Name,
+				err.Error())
+			return 0, fuse.EIO
+		}
+		if c.stable() {
+			if status := c.fsync(ctx); status != fuse.OK {
+				return 0, status
+			}
+		}
+		return uint32(len(data)), fuse.OK
+	}
+
+	resp, err := c.write(ctx, data, offset, c.stable())
 
 	if err != nil {
 		glog.Errorf(`failed to write to file "%s" :: %s`, c.fileData.Name,
 			err.Error())
-		return 0, fuse.EIO
+		return 0, ioStatus(err)
+	}
+	if c.fileData.Fs.applyWcc(c.fileData.Name, resp.Wcc) {
+		glog.Warningf(`file "%s" was changed by someone else`, c.fileData.Name)
 	}
+	c.fileData.wroteThrough(resp.Wcc)
+	if !c.stable() {
+		c.cacheWrite(data, offset, resp.ServerSessionID)
+	}
+	return uint32(len(data)), fuse.OK
+}
+
+// cacheWrite keeps an uncommitted write, to replay it if the server restarts
+// before it is committed.
+func (c *SamFsFileHandle) cacheWrite(data []byte, offset int64,
+	serverSessionID int64) {
 	if c.fileData.DCache.numEntries != 0 &&
 		c.fileData.DCache.entries[c.fileData.DCache.numEntries-1].ServerSessionID !=
-			resp.ServerSessionID {
+			serverSessionID {
 		glog.Warning("server state change detected")
 		c.fileData.Dirty = true
 	}
@@ -136,51 +216,129 @@ func (c *SamFsFileHandle) Write(data []byte, offset int64) (uint32,
 	c.fileData.DCache.AddEntry(&CacheEntry{
 		Data:            &data,
 		Offset:          offset,
-		ServerSessionID: resp.ServerSessionID,
+		ServerSessionID: serverSessionID,
 	})
 	c.fileData.Unlock()
-	return uint32(len(data)), fuse.OK
 }
 
 func (c *SamFsFileHandle) Flush() fuse.Status {
 	glog.V(3).Infof("Flush called on %s", c.fileData.Name)
-	if c.fileData.DCache.numEntries == 0 {
+	c.fileData.Lock()
+	dirty := c.fileData.hasDirtyBlocks()
+	c.fileData.Unlock()
+	// close(2) reports whether the data made it to the server
+	if c.fileData.DCache.numEntries == 0 && !dirty {
 		return fuse.OK
 	} else {
-		return c.Fsync(0)
+		ctx, t := c.fileData.Fs.startOp("Flush", c.fileData.Name)
+		defer t.finish(nil)
+		return c.fsync(ctx)
 	}
 }
 
 func (c *SamFsFileHandle) Allocate(off uint64, size uint64,
 	mode uint32) fuse.Status {
 
-	glog.V(3).Info("Allocate called")
+	glog.V(3).Infof("Allocate called on %s off: %d, size: %d, mode: %#x",
+		c.fileData.Name, off, size, mode)
+	if !c.writable() {
+		return fuse.EBADF
+	}
+	if mode&^(fallocKeepSize|fallocPunchHole|fallocZeroRange) != 0 {
+		return fuse.Status(syscall.EOPNOTSUPP)
+	}
+	ctx, t := c.fileData.Fs.startOp("Allocate", c.fileData.Name)
+	defer t.finish(nil)
+
+	// buffered writes would land on top of a punched or zeroed range
+	c.fileData.Lock()
+	err := c.fileData.flushDelegated(ctx)
+	c.fileData.Unlock()
+	if err != nil {
+		glog.Errorf(`failed to flush delegated data of "%s" :: %s`,
+			c.fileData.Name, err.Error())
+		return fuse.EIO
+	}
+
+	resp, err := c.fileData.Fs.nfsClient.Allocate(ctx,
+		&pb.AllocateRequest{
+			FileHandle: c.fileData.serverFh,
+			Offset:     int64(off),
+			Length:     int64(size),
+			KeepSize:   mode&fallocKeepSize != 0,
+			PunchHole:  mode&fallocPunchHole != 0,
+			ZeroRange:  mode&fallocZeroRange != 0,
+			ClientID:   c.fileData.Fs.clientID,
+		}, grpc.FailFast(false))
+	if err != nil {
+		glog.Errorf(`failed to allocate file "%s" :: %s`, c.fileData.Name,
+			err.Error())
+		if isQuotaError(err) {
+			return fuse.Status(syscall.EDQUOT)
+		}
+		switch grpc.Code(err) {
+		case codes.Unimplemented:
+			return fuse.Status(syscall.EOPNOTSUPP)
+		case codes.ResourceExhausted:
+			return fuse.Status(syscall.ENOSPC)
+		case codes.InvalidArgument:
+			return fuse.EINVAL
+		case codes.OutOfRange:
+			return fuse.Status(syscall.EFBIG)
+		}
+		return fuse.EIO
+	}
+
+	c.fileData.Fs.applyWcc(c.fileData.Name, resp.Wcc)
+	c.fileData.wroteThrough(resp.Wcc)
 	return fuse.OK
 }
 
 func (c *SamFsFileHandle) Release() {
 	glog.V(3).Infof("Release called on %s", c.fileData.Name)
+	ctx, t := c.fileData.Fs.startOp("Release", c.fileData.Name)
+	defer t.finish(nil)
 	if c.fileData.DCache.numEntries != 0 {
-		_ = c.Fsync(0)
+		_ = c.fsync(ctx)
 	}
 	c.fileData.Lock()
 	c.fileData.Refs--
+	refs := c.fileData.Refs
 	c.fileData.Unlock()
+	if refs == 0 {
+		c.fileData.releaseLocks(ctx)
+	}
+	// failures were reported by Flush already
+	_ = c.fileData.Fs.closeFileData(ctx, c.fileData, refs == 0)
 	c.closed = true
 	return
 }
 
 func (c *SamFsFileHandle) Fsync(flags int) fuse.Status {
 	glog.V(3).Infof("Fsync called %s", c.fileData.Name)
+	ctx, t := c.fileData.Fs.startOp("Fsync", c.fileData.Name)
+	defer t.finish(nil)
+	return c.fsync(ctx)
+}
+
+func (c *SamFsFileHandle) fsync(ctx context.Context) fuse.Status {
+	c.fileData.Lock()
+	err := c.fileData.flushDelegated(ctx)
+	c.fileData.Unlock()
+	if err != nil {
+		glog.Errorf(`failed to flush delegated data of "%s" :: %s`,
+			c.fileData.Name, err.Error())
+		return ioStatus(err)
+	}
+
 	if c.fileData.Dirty == true {
 		glog.Errorf("Fsync called on %s with dirty cache", c.fileData.Name)
 	}
 
 	fh := c.fileData.serverFh
 	var resp *pb.StatusReply
-	var err error
 	if c.fileData.Dirty != true {
-		resp, err = c.fileData.Fs.nfsClient.Commit(context.Background(),
+		resp, err = c.fileData.Fs.nfsClient.Commit(ctx,
 			&pb.CommitRequest{
 				FileHandle: fh,
 			}, grpc.FailFast(false))
@@ -198,7 +356,7 @@ func (c *SamFsFileHandle) Fsync(flags int) fuse.Status {
 		glog.Warning("server state change detected during fsync, replay all writes")
 
 		for _, de := range c.fileData.DCache.entries {
-			resp, err := c.write(*de.Data, de.Offset)
+			resp, err := c.write(ctx, *de.Data, de.Offset, false)
 			if err != nil {
 				glog.Errorf(`failed to write during recovery to file "%s" :: %s`,
 					c.fileData.Name, err.Error())
@@ -207,7 +365,7 @@ func (c *SamFsFileHandle) Fsync(flags int) fuse.Status {
 
 			de.ServerSessionID = resp.ServerSessionID
 		}
-		resp, err := c.fileData.Fs.nfsClient.Commit(context.Background(),
+		resp, err := c.fileData.Fs.nfsClient.Commit(ctx,
 			&pb.CommitRequest{
 				FileHandle: fh,
 			}, grpc.FailFast(false))
@@ -236,18 +394,22 @@ func (c *SamFsFileHandle) GetAttr(out *fuse.Attr) fuse.Status {
 
 	name := c.fileData.Name
 	fh := c.fileData.serverFh
-	resp, err := c.fileData.Fs.nfsClient.GetAttr(context.Background(),
-		&pb.FileHandleRequest{
-			FileHandle: fh,
-		}, grpc.FailFast(false))
-	if err != nil {
-		glog.Errorf(`failed to get attributes of file "%s" :: %s`, name, err.Error())
-		return fuse.EIO
-	}
-
-	fAttr := ProtoToFuseAttr(resp)
+	fAttr := c.fileData.Fs.getCachedAttr(name)
+	if fAttr == nil {
+		ctx, t := c.fileData.Fs.startOp("GetAttr", name)
+		defer t.finish(nil)
+		resp, err := c.fileData.Fs.nfsClient.GetAttr(ctx,
+			&pb.FileHandleRequest{
+				FileHandle: fh,
+			}, grpc.FailFast(false))
+		if err != nil {
+			glog.Errorf(`failed to get attributes of file "%s" :: %s`, name,
+				err.Error())
+			return fuse.EIO
+		}
 
-	fAttr.Owner = c.fileData.Fs.owner
+		fAttr = c.fileData.Fs.cacheAttr(name, resp)
+	}
 
 	// Have to copy these one by one as expected by the library
 	out.Ino = fAttr.Ino
@@ -264,6 +426,9 @@ func (c *SamFsFileHandle) GetAttr(out *fuse.Attr) fuse.Status {
 	out.Owner.Uid = fAttr.Owner.Uid
 	out.Owner.Gid = fAttr.Owner.Gid
 	out.Rdev = fAttr.Rdev
+	if size, ok := c.fileData.delegatedSize(); ok {
+		out.Size = size
+	}
 	//out.Blksize = fAttr.Blksize
 	//out.Padding = fAttr.Padding
 
@@ -280,8 +445,21 @@ func (c *SamFsFileHandle) SetInode(i *nodefs.Inode) {
 }
 
 func (c *SamFsFileHandle) Truncate(size uint64) fuse.Status {
-	glog.V(3).Info("Truncate called")
-	return fuse.OK
+	glog.V(3).Infof("Truncate called on %s size: %d", c.fileData.Name, size)
+	if !c.writable() {
+		return fuse.EBADF
+	}
+	ctx, t := c.fileData.Fs.startOp("Truncate", c.fileData.Name)
+	defer t.finish(nil)
+
+	// writes replayed after a server restart must not grow the file again
+	if c.fileData.DCache.numEntries != 0 || c.fileData.hasWriteDelegation() {
+		if status := c.fsync(ctx); status != fuse.OK {
+			return status
+		}
+	}
+	return c.fileData.Fs.truncate(ctx, c.fileData.Name, c.fileData.serverFh,
+		size)
 }
 
 func (c *SamFsFileHandle) Utimens(atime *time.Time,
@@ -291,21 +469,35 @@ func (c *SamFsFileHandle) Utimens(atime *time.Time,
 	return fuse.OK
 }
 
-func (c *SamFsFileHandle) write(data []byte, offset int64) (*pb.StatusReply,
-	error) {
+// write sends data to the server, which syncs it before replying if stable
+// is set.
+func (c *SamFsFileHandle) write(ctx context.Context, data []byte,
+	offset int64, stable bool) (*pb.StatusReply, error) {
 
 	glog.V(3).Infof("Write called on %s", c.fileData.Name)
 	fh := c.fileData.serverFh
 
 	c.fileData.Lock()
-	resp, err := c.fileData.Fs.nfsClient.Write(context.Background(),
-		&pb.WriteRequest{
-			FileHandle: fh,
-			Offset:     offset,
-			Size:       int64(len(data)),
-			Data:       data,
-		}, grpc.FailFast(false))
+	resp, err := c.fileData.Fs.writeChecked(ctx, &pb.WriteRequest{
+		FileHandle:   fh,
+		Offset:       offset,
+		Size:         int64(len(data)),
+		Data:         data,
+		ShouldCommit: stable,
+	})
 	c.fileData.Unlock()
 
 	return resp, err
 }
+
+func (f *SamFsFileData) hasDelegation() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.Deleg != pb.DelegationType_NO_DELEGATION
+}
+
+func (f *SamFsFileData) hasWriteDelegation() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.Deleg == pb.DelegationType_WRITE_DELEGATION
+}
@@ -0,0 +1,57 @@
+package samfs
+
+import (
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"golang.org/x/net/context"
+)
+
+// append writes data at the end of the file for a handle opened with
+// O_APPEND. The kernel computes the offset of such writes from the size it
+// last saw, which other clients may have moved since, so the server picks
+// the offset instead.
+func (c *SamFsFileHandle) append(ctx context.Context, data []byte) (uint32,
+	fuse.Status) {
+
+	if c.fileData.hasWriteDelegation() {
+		_, err := c.fileData.appendDelegated(ctx, data)
+		if err != nil {
+			glog.Errorf(`failed to append to file "%s" :: %s`, c.fileData.Name,
+				err.Error())
+			return 0, fuse.EIO
+		}
+		if c.stable() {
+			if status := c.fsync(ctx); status != fuse.OK {
+				return 0, status
+			}
+		}
+		return uint32(len(data)), fuse.OK
+	}
+
+	c.fileData.Lock()
+	resp, err := c.fileData.Fs.appendChecked(ctx, &pb.WriteRequest{
+		FileHandle:   c.fileData.serverFh,
+		Size:         int64(len(data)),
+		Data:         data,
+		ShouldCommit: c.stable(),
+	})
+	c.fileData.Unlock()
+	if err != nil {
+		glog.Errorf(`failed to append to file "%s" :: %s`, c.fileData.Name,
+			err.Error())
+		return 0, ioStatus(err)
+	}
+	glog.V(3).Infof(`appended %d bytes to "%s" at %d`, len(data),
+		c.fileData.Name, resp.Offset)
+	if c.fileData.Fs.applyWcc(c.fileData.Name, resp.Wcc) {
+		glog.V(2).Infof(`file "%s" was appended to by someone else`,
+			c.fileData.Name)
+	}
+	c.fileData.wroteThrough(resp.Wcc)
+	// replayed as a plain write at the offset the server picked
+	if !c.stable() {
+		c.cacheWrite(data, resp.Offset, resp.ServerSessionID)
+	}
+	return uint32(len(data)), fuse.OK
+}
@@ -0,0 +1,83 @@
+package samfs
+
+import (
+	"math"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/nodefs"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// CopyFileRange copies length bytes from this file into outFile on the
+// server, without moving the data through the client. A copy of a whole
+// file, as done by cp(1), is cloned when the server's filesystem supports
+// reflinks. Copies to files of other mounts fail with EXDEV, which has the
+// kernel copy through Read and Write.
+func (c *SamFsFileHandle) CopyFileRange(off uint64, outFile nodefs.File,
+	outOff uint64, length uint64, flags uint64) (uint32, fuse.Status) {
+
+	out, ok := outFile.(*SamFsFileHandle)
+	if !ok || out.fileData.Fs != c.fileData.Fs {
+		return 0, fuse.Status(syscall.EXDEV)
+	}
+	if length == 0 {
+		// a length of 0 has the server copy up to the end of the source
+		return 0, fuse.OK
+	}
+	glog.V(3).Infof("CopyFileRange called from %s to %s", c.fileData.Name,
+		out.fileData.Name)
+	ctx, t := c.fileData.Fs.startOp("CopyFileRange",
+		c.fileData.Name+" "+out.fileData.Name)
+	defer t.finish(nil)
+
+	// the server has to see everything we buffered for both files
+	for _, fdata := range []*SamFsFileData{c.fileData, out.fileData} {
+		fdata.Lock()
+		err := fdata.flushDelegated(ctx)
+		fdata.Unlock()
+		if err != nil {
+			glog.Errorf(`failed to flush delegated data of "%s" :: %s`,
+				fdata.Name, err.Error())
+			return 0, fuse.EIO
+		}
+	}
+
+	if length > math.MaxUint32 {
+		length = math.MaxUint32
+	}
+	fs := c.fileData.Fs
+	resp, err := fs.nfsClient.CopyRange(ctx,
+		&pb.CopyRangeRequest{
+			SrcFileHandle: c.fileData.serverFh,
+			SrcOffset:     int64(off),
+			DstFileHandle: out.fileData.serverFh,
+			DstOffset:     int64(outOff),
+			Length:        int64(length),
+			ClientID:      fs.clientID,
+		}, grpc.FailFast(false))
+	if grpc.Code(err) == codes.InvalidArgument {
+		// overlapping ranges within the file
+		return 0, fuse.EINVAL
+	}
+	if err != nil {
+		glog.Errorf(`failed to copy "%s" to "%s" :: %s`, c.fileData.Name,
+			out.fileData.Name, err.Error())
+		return 0, ioStatus(err)
+	}
+
+	if fs.applyWcc(out.fileData.Name, resp.Wcc) {
+		glog.Warningf(`file "%s" was changed by someone else`,
+			out.fileData.Name)
+	}
+	out.fileData.wroteThrough(resp.Wcc)
+	if resp.Cloned {
+		glog.V(2).Infof(`cloned %d bytes of "%s" into "%s"`, resp.Size,
+			c.fileData.Name, out.fileData.Name)
+	}
+
+	return uint32(resp.Size), fuse.OK
+}
@@ -0,0 +1,561 @@
+package samfs
+
+import (
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// granularity at which file data is cached while holding a delegation
+const delegBlockSize = 64 * 1024
+
+// errSessionChanged is returned when the server keeps restarting while
+// delegated data is written back to it.
+var errSessionChanged = errors.New("server restarted while flushing data")
+
+type dataBlock struct {
+	data  []byte
+	dirty bool
+}
+
+type blockIndexes []int64
+
+func (b blockIndexes) Len() int           { return len(b) }
+func (b blockIndexes) Less(i, j int) bool { return b[i] < b[j] }
+func (b blockIndexes) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+
+// openFileData returns the shared data of an open file, opening it on the
+// server so that we get a delegation if nobody else is using it.
+func (c *SamFs) openFileData(ctx context.Context, name string,
+	fh *pb.FileHandle, write bool) (*SamFsFileData, fuse.Status) {
+
+	c.cacheLock.Lock()
+	fdata, ok := c.fileCache[name]
+	if !ok || fdata.serverFh.InodeNumber != fh.InodeNumber ||
+		fdata.serverFh.GenerationNumber != fh.GenerationNumber {
+		fdata = NewFileData(name, c, fh)
+		c.fileCache[name] = fdata
+	}
+	c.cacheLock.Unlock()
+
+	// data left over by a close that failed to flush it has to reach the
+	// server before the delegation is given up or replaced
+	fdata.Lock()
+	err := fdata.flushDelegated(ctx)
+	fdata.Unlock()
+	if err != nil {
+		glog.Errorf(`failed to flush delegated data of "%s" :: %s`, name,
+			err.Error())
+		return nil, fuse.EIO
+	}
+
+	seq := c.recallSeq()
+	resp, err := c.nfsClient.Open(ctx, &pb.OpenRequest{
+		FileHandle: fh,
+		ClientID:   c.clientID,
+		Write:      write,
+	}, grpc.FailFast(false))
+	if err != nil {
+		glog.Errorf(`failed to open file "%s" :: %s`, name, err.Error())
+		return nil, fuse.EIO
+	}
+
+	deleg := resp.Delegation
+	if c.recalledSince(seq, fh) {
+		// the delegation was recalled before we even learned about it
+		deleg = pb.DelegationType_NO_DELEGATION
+	}
+	if resp.Attr != nil {
+		c.cacheAttr(name, resp.Attr)
+	}
+
+	fdata.Lock()
+	if fdata.Deleg == pb.DelegationType_NO_DELEGATION && resp.Attr != nil {
+		fdata.size = int64(resp.Attr.Size)
+	}
+	if deleg != pb.DelegationType_NO_DELEGATION {
+		glog.V(2).Infof(`got delegation %v on "%s"`, deleg, name)
+	}
+	fdata.Deleg = deleg
+	fdata.Unlock()
+
+	return fdata, fuse.OK
+}
+
+// closeFileData gives up one open of fdata, flushing delegated data and
+// forgetting the file when it was the last one. If the data cannot be
+// flushed the file stays open on the server, which keeps the delegation
+// ours, and the data is flushed again when the file is reopened or the
+// delegation recalled.
+func (c *SamFs) closeFileData(ctx context.Context, fdata *SamFsFileData,
+	last bool) error {
+	fdata.Lock()
+	if !last {
+		fdata.pendingCloses++
+		fdata.Unlock()
+		return c.closePending(ctx, fdata)
+	}
+	err := fdata.flushDelegated(ctx)
+	fdata.pendingCloses++
+	if err != nil {
+		fdata.Unlock()
+		glog.Errorf(`failed to flush delegated data of "%s" :: %s`,
+			fdata.Name, err.Error())
+		return err
+	}
+	fdata.Deleg = pb.DelegationType_NO_DELEGATION
+	fdata.blocks = nil
+	fdata.Unlock()
+
+	c.cacheLock.Lock()
+	if c.fileCache[fdata.Name] == fdata {
+		delete(c.fileCache, fdata.Name)
+	}
+	c.cacheLock.Unlock()
+	return c.closePending(ctx, fdata)
+}
+
+// closePending closes the opens of fdata that were given up, once its data
+// is flushed.
+func (c *SamFs) closePending(ctx context.Context, fdata *SamFsFileData) error {
+	fdata.Lock()
+	if fdata.hasDirtyBlocks() {
+		fdata.Unlock()
+		return nil
+	}
+	closes := fdata.pendingCloses
+	fdata.pendingCloses = 0
+	fdata.Unlock()
+
+	for ; closes > 0; closes-- {
+		_, err := c.nfsClient.Close(ctx, &pb.OpenRequest{
+			FileHandle: fdata.serverFh,
+			ClientID:   c.clientID,
+		}, grpc.FailFast(false))
+		if err != nil {
+			glog.Errorf(`failed to close file "%s" :: %s`, fdata.Name,
+				err.Error())
+			return err
+		}
+	}
+	return nil
+}
+
+// delegatedSize returns the size of name if we hold a write delegation on it,
+// in which case the server does not know about our buffered writes.
+func (c *SamFs) delegatedSize(name string) (uint64, bool) {
+	c.cacheLock.RLock()
+	fdata, ok := c.fileCache[name]
+	c.cacheLock.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	return fdata.delegatedSize()
+}
+
+func (c *SamFs) recallSeq() uint64 {
+	c.recallLock.Lock()
+	defer c.recallLock.Unlock()
+	return c.recallCount
+}
+
+func (c *SamFs) recalledSince(seq uint64, fh *pb.FileHandle) bool {
+	c.recallLock.Lock()
+	defer c.recallLock.Unlock()
+	s, ok := c.recalled[fh.InodeNumber]
+	if ok {
+		delete(c.recalled, fh.InodeNumber)
+	}
+	return ok && s > seq
+}
+
+// runCallbacks keeps a callback stream open to the server until ctx is done,
+// so that the server can recall our delegations.
+func (c *SamFs) runCallbacks(ctx context.Context) {
+	for {
+		stream, err := c.nfsClient.Callback(ctx, grpc.FailFast(false))
+		if err == nil {
+			err = c.serveCallbacks(stream)
+		}
+
+		// the server forgets our delegations along with the stream
+		c.dropDelegations()
+		if ctx.Err() != nil {
+			return
+		}
+		glog.Warningf("callback stream broke, reconnecting :: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *SamFs) serveCallbacks(stream pb.NFS_CallbackClient) error {
+	err := stream.Send(&pb.CallbackMessage{ClientID: c.clientID})
+	if err != nil {
+		return err
+	}
+
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.Recall == nil {
+			continue
+		}
+
+		if err := c.recallDelegation(req.Recall); err != nil {
+			// the server revokes the delegation when the recall times out
+			continue
+		}
+		err = stream.Send(&pb.CallbackMessage{
+			ClientID: c.clientID,
+			Returned: req.Recall,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// recallDelegation returns the delegation on fh, it fails if the data
+// buffered under it could not be flushed.
+func (c *SamFs) recallDelegation(fh *pb.FileHandle) error {
+	glog.V(2).Infof("delegation on %s recalled", fh.Path)
+	c.recallLock.Lock()
+	c.recallCount++
+	if len(c.recalled) > 1024 {
+		c.recalled = make(map[uint64]uint64)
+	}
+	c.recalled[fh.InodeNumber] = c.recallCount
+	c.recallLock.Unlock()
+
+	c.cacheLock.RLock()
+	var files []*SamFsFileData
+	for _, fdata := range c.fileCache {
+		if fdata.serverFh.InodeNumber == fh.InodeNumber &&
+			fdata.serverFh.GenerationNumber == fh.GenerationNumber {
+			files = append(files, fdata)
+		}
+	}
+	c.cacheLock.RUnlock()
+
+	var err error
+	for _, fdata := range files {
+		if rerr := c.returnDelegation(fdata); rerr != nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// dropDelegations returns all delegations after the server forgot about
+// them, those of files that cannot be flushed are kept until they can.
+func (c *SamFs) dropDelegations() {
+	c.cacheLock.RLock()
+	var files []*SamFsFileData
+	for _, fdata := range c.fileCache {
+		files = append(files, fdata)
+	}
+	c.cacheLock.RUnlock()
+
+	for _, fdata := range files {
+		c.returnDelegation(fdata)
+	}
+}
+
+// dropReadDelegations stops serving files read under a delegation from the
+// local cache, when their data may have changed without a recall.
+func (c *SamFs) dropReadDelegations() {
+	c.cacheLock.RLock()
+	var files []*SamFsFileData
+	for _, fdata := range c.fileCache {
+		files = append(files, fdata)
+	}
+	c.cacheLock.RUnlock()
+
+	for _, fdata := range files {
+		c.dropReadDelegation(fdata)
+	}
+}
+
+// dropReadDelegation returns the delegation on fdata if it is one to read.
+func (c *SamFs) dropReadDelegation(fdata *SamFsFileData) {
+	fdata.Lock()
+	read := fdata.Deleg == pb.DelegationType_READ_DELEGATION
+	fdata.Unlock()
+	if read {
+		c.returnDelegation(fdata)
+	}
+}
+
+// returnDelegation writes back everything buffered under the delegation and
+// stops serving the file from the local cache. The delegation is kept if the
+// data cannot be written back, so that it is not lost.
+func (c *SamFs) returnDelegation(fdata *SamFsFileData) error {
+	ctx := context.Background()
+	fdata.Lock()
+	if fdata.Deleg == pb.DelegationType_NO_DELEGATION {
+		fdata.Unlock()
+		return nil
+	}
+
+	err := fdata.flushDelegated(ctx)
+	if err != nil {
+		fdata.Unlock()
+		glog.Errorf(`failed to flush "%s" on delegation return :: %s`,
+			fdata.Name, err.Error())
+		return err
+	}
+	fdata.Deleg = pb.DelegationType_NO_DELEGATION
+	fdata.blocks = nil
+	last := fdata.Refs == 0
+	fdata.Unlock()
+	c.invalidateAttr(fdata.Name)
+
+	if last {
+		// closed while its data could not be flushed
+		c.cacheLock.Lock()
+		if c.fileCache[fdata.Name] == fdata {
+			delete(c.fileCache, fdata.Name)
+		}
+		c.cacheLock.Unlock()
+	}
+	return c.closePending(ctx, fdata)
+}
+
+// wroteThrough keeps the cache of a read delegation coherent with a write
+// that went straight to the server.
+func (f *SamFsFileData) wroteThrough(wcc *pb.WccData) {
+	f.Lock()
+	defer f.Unlock()
+	f.blocks = nil
+	if wcc != nil && wcc.After != nil {
+		f.size = int64(wcc.After.Size)
+	}
+}
+
+func (f *SamFsFileData) delegatedSize() (uint64, bool) {
+	f.Lock()
+	defer f.Unlock()
+	if f.Deleg != pb.DelegationType_WRITE_DELEGATION {
+		return 0, false
+	}
+	return uint64(f.size), true
+}
+
+// getBlock returns the cached block idx, fetching it from the server if
+// needed. Must be called with f locked.
+func (f *SamFsFileData) getBlock(ctx context.Context,
+	idx int64) (*dataBlock, error) {
+	if b, ok := f.blocks[idx]; ok {
+		return b, nil
+	}
+	if f.blocks == nil {
+		f.blocks = make(map[int64]*dataBlock)
+	}
+
+	b := &dataBlock{}
+	if idx*delegBlockSize < f.size {
+		data, err := f.Fs.readSparse(ctx, f.serverFh,
+			make([]byte, delegBlockSize), idx*delegBlockSize)
+		if err != nil {
+			return nil, err
+		}
+		b.data = data
+	}
+	f.blocks[idx] = b
+	return b, nil
+}
+
+// readDelegated serves a read from the local cache.
+func (f *SamFsFileData) readDelegated(ctx context.Context, buf []byte,
+	off int64) ([]byte, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if off >= f.size {
+		return buf[:0], nil
+	}
+	end := off + int64(len(buf))
+	if end > f.size {
+		end = f.size
+	}
+
+	for pos := off; pos < end; {
+		idx := pos / delegBlockSize
+		b, err := f.getBlock(ctx, idx)
+		if err != nil {
+			return nil, err
+		}
+
+		bOff := pos - idx*delegBlockSize
+		n := delegBlockSize - bOff
+		if n > end-pos {
+			n = end - pos
+		}
+		dest := buf[pos-off : pos-off+n]
+		copied := 0
+		if bOff < int64(len(b.data)) {
+			copied = copy(dest, b.data[bOff:])
+		}
+		// holes past the data we got from the server read back as zeros
+		for i := copied; i < len(dest); i++ {
+			dest[i] = 0
+		}
+		pos += n
+	}
+
+	return buf[:end-off], nil
+}
+
+// writeDelegated buffers a write in the local cache, it reaches the server
+// on fsync, close or when the delegation is recalled.
+func (f *SamFsFileData) writeDelegated(ctx context.Context, data []byte,
+	off int64) error {
+	f.Lock()
+	defer f.Unlock()
+	return f.writeBlocks(ctx, data, off)
+}
+
+// appendDelegated buffers data at the end of the file, which no one else
+// can move while we hold the write delegation, and returns where it went.
+func (f *SamFsFileData) appendDelegated(ctx context.Context,
+	data []byte) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+	off := f.size
+	return off, f.writeBlocks(ctx, data, off)
+}
+
+// writeBlocks must be called with f locked.
+func (f *SamFsFileData) writeBlocks(ctx context.Context, data []byte,
+	off int64) error {
+	end := off + int64(len(data))
+	for pos := off; pos < end; {
+		idx := pos / delegBlockSize
+		b, err := f.getBlock(ctx, idx)
+		if err != nil {
+			return err
+		}
+
+		bOff := pos - idx*delegBlockSize
+		n := delegBlockSize - bOff
+		if n > end-pos {
+			n = end - pos
+		}
+		if need := bOff + n; int64(len(b.data)) < need {
+			grown := make([]byte, need)
+			copy(grown, b.data)
+			b.data = grown
+		}
+		copy(b.data[bOff:bOff+n], data[pos-off:pos-off+n])
+		b.dirty = true
+		pos += n
+	}
+
+	if end > f.size {
+		f.size = end
+	}
+	return nil
+}
+
+// hasDirtyBlocks must be called with f locked.
+func (f *SamFsFileData) hasDirtyBlocks() bool {
+	for _, b := range f.blocks {
+		if b.dirty {
+			return true
+		}
+	}
+	return false
+}
+
+// flushDelegated writes dirty cached blocks back to the server and commits
+// them. The blocks stay dirty until they are all written and committed by
+// the same server session, so that a restart in between does not lose them.
+// Must be called with f locked.
+func (f *SamFsFileData) flushDelegated(ctx context.Context) error {
+	var dirty []int64
+	for idx, b := range f.blocks {
+		if b.dirty {
+			dirty = append(dirty, idx)
+		}
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	sort.Sort(blockIndexes(dirty))
+
+	for i := 0; ; i++ {
+		stable, err := f.writeBlocksBack(ctx, dirty)
+		if grpc.Code(err) == codes.Aborted {
+			// the server gave the file to someone else meanwhile, our data
+			// would overwrite theirs
+			glog.Errorf(`delegation on "%s" was revoked, dropping its data`,
+				f.Name)
+			f.Deleg = pb.DelegationType_NO_DELEGATION
+			f.blocks = nil
+			f.Fs.invalidateAttr(f.Name)
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if stable {
+			break
+		}
+		if i == 1 {
+			glog.Error("recursive crash during flush of delegated data")
+			return errSessionChanged
+		}
+		glog.Warning("server state change detected during flush, " +
+			"rewriting delegated data")
+	}
+
+	for _, idx := range dirty {
+		f.blocks[idx].dirty = false
+	}
+	return nil
+}
+
+// writeBlocksBack writes the blocks at dirty and commits them. It returns
+// whether they were all written to the server session that committed them.
+// Must be called with f locked.
+func (f *SamFsFileData) writeBlocksBack(ctx context.Context,
+	dirty []int64) (bool, error) {
+	var session int64
+	changed := false
+	for i, idx := range dirty {
+		b := f.blocks[idx]
+		resp, err := f.Fs.writeChecked(ctx, &pb.WriteRequest{
+			FileHandle: f.serverFh,
+			Offset:     idx * delegBlockSize,
+			Size:       int64(len(b.data)),
+			Data:       b.data,
+			ClientID:   f.Fs.clientID,
+			Delegated:  true,
+		})
+		if err != nil {
+			return false, err
+		}
+		f.Fs.applyWcc(f.Name, resp.Wcc)
+		if i == 0 {
+			session = resp.ServerSessionID
+		}
+		changed = changed || resp.ServerSessionID != session
+	}
+
+	resp, err := f.Fs.nfsClient.Commit(ctx, &pb.CommitRequest{
+		FileHandle: f.serverFh,
+	}, grpc.FailFast(false))
+	if err != nil {
+		return false, err
+	}
+	return !changed && resp.ServerSessionID == session, nil
+}
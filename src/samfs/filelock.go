@@ -0,0 +1,295 @@
+package samfs
+
+import (
+	"math"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func lockTypeToProto(typ uint32) pb.LockType {
+	switch typ {
+	case syscall.F_RDLCK:
+		return pb.LockType_READ_LOCK
+	case syscall.F_WRLCK:
+		return pb.LockType_WRITE_LOCK
+	default:
+		return pb.LockType_UNLOCK
+	}
+}
+
+func protoToLockType(typ pb.LockType) uint32 {
+	switch typ {
+	case pb.LockType_READ_LOCK:
+		return syscall.F_RDLCK
+	case pb.LockType_WRITE_LOCK:
+		return syscall.F_WRLCK
+	default:
+		return syscall.F_UNLCK
+	}
+}
+
+// lockEndToProto turns the end of a lock as the kernel sends it into the
+// proto's, where the kernel's OFFSET_MAX for "up to EOF" is max uint64.
+func lockEndToProto(end uint64) uint64 {
+	if end >= math.MaxInt64 {
+		return math.MaxUint64
+	}
+	return end
+}
+
+func protoToLockEnd(end uint64) uint64 {
+	if end >= math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return end
+}
+
+func (c *SamFsFileHandle) lockRequest(owner uint64, lk *fuse.FileLock,
+	flags uint32) *pb.LockRequest {
+
+	return &pb.LockRequest{
+		FileHandle: c.fileData.serverFh,
+		Lock: &pb.FileLock{
+			ClientID: c.fileData.Fs.clientID,
+			Owner:    owner,
+			Start:    lk.Start,
+			End:      lockEndToProto(lk.End),
+			Type:     lockTypeToProto(lk.Typ),
+			Pid:      lk.Pid,
+		},
+		Flock: flags&fuse.FUSE_LK_FLOCK != 0,
+	}
+}
+
+// GetLk, SetLk and SetLkw take fcntl(2) and flock(2) locks on the server,
+// so that they hold against processes on other clients too.
+func (c *SamFsFileHandle) GetLk(owner uint64, lk *fuse.FileLock, flags uint32,
+	out *fuse.FileLock) fuse.Status {
+
+	glog.V(3).Infof("GetLk called on %s", c.fileData.Name)
+	ctx, t := c.fileData.Fs.startOp("GetLk", c.fileData.Name)
+	defer t.finish(nil)
+	resp, err := c.fileData.Fs.nfsClient.TestLock(ctx,
+		c.lockRequest(owner, lk, flags), grpc.FailFast(false))
+	if err != nil {
+		glog.Errorf(`failed to test lock on file "%s" :: %s`, c.fileData.Name,
+			err.Error())
+		return fuse.EIO
+	}
+
+	if resp.Granted {
+		out.Typ = syscall.F_UNLCK
+		return fuse.OK
+	}
+	out.Start = resp.Conflict.Start
+	out.End = protoToLockEnd(resp.Conflict.End)
+	out.Typ = protoToLockType(resp.Conflict.Type)
+	out.Pid = resp.Conflict.Pid
+	return fuse.OK
+}
+
+func (c *SamFsFileHandle) SetLk(owner uint64, lk *fuse.FileLock,
+	flags uint32) fuse.Status {
+
+	glog.V(3).Infof("SetLk called on %s", c.fileData.Name)
+	return c.setLk(owner, lk, flags, false)
+}
+
+func (c *SamFsFileHandle) SetLkw(owner uint64, lk *fuse.FileLock,
+	flags uint32) fuse.Status {
+
+	glog.V(3).Infof("SetLkw called on %s", c.fileData.Name)
+	return c.setLk(owner, lk, flags, true)
+}
+
+func (c *SamFsFileHandle) setLk(owner uint64, lk *fuse.FileLock, flags uint32,
+	block bool) fuse.Status {
+
+	fs := c.fileData.Fs
+	ctx, t := fs.startOp("SetLk", c.fileData.Name)
+	defer t.finish(nil)
+	req := c.lockRequest(owner, lk, flags)
+
+	var err error
+	resp := &pb.LockReply{}
+	if req.Lock.Type == pb.LockType_UNLOCK {
+		_, err = fs.nfsClient.Unlock(ctx, req,
+			grpc.FailFast(false))
+		resp.Granted = true
+	} else {
+		req.Block = block
+		resp, err = fs.lock(ctx, req)
+	}
+	if err != nil {
+		glog.Errorf(`failed to lock file "%s" :: %s`, c.fileData.Name,
+			err.Error())
+		return fuse.EIO
+	}
+	if !resp.Granted {
+		return fuse.Status(syscall.EAGAIN)
+	}
+
+	c.fileData.recordLock(req)
+	return fuse.OK
+}
+
+// lock acquires a lock, reclaiming our old locks first if the server tells us
+// it restarted and is waiting for clients to do so.
+func (c *SamFs) lock(ctx context.Context,
+	req *pb.LockRequest) (*pb.LockReply, error) {
+	for {
+		resp, err := c.nfsClient.Lock(ctx, req,
+			grpc.FailFast(false))
+		if err == nil {
+			c.checkLockSession(resp.ServerSessionID)
+			return resp, nil
+		}
+		if grpc.Code(err) != codes.Unavailable ||
+			grpc.ErrorDesc(err) != grpc.ErrorDesc(errLockGrace) {
+			return nil, err
+		}
+
+		glog.V(2).Info("server is in lock grace period, reclaiming locks")
+		c.reclaimLocks()
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *SamFs) checkLockSession(sessionID int64) {
+	c.lockLock.Lock()
+	defer c.lockLock.Unlock()
+	if c.lockSessionID != 0 && c.lockSessionID != sessionID &&
+		len(c.lockedFiles) != 0 {
+		glog.Errorf("server restarted without us reclaiming locks, " +
+			"locks held by this client are lost")
+	}
+	c.lockSessionID = sessionID
+}
+
+// reclaimLocks replays every lock operation on files we still hold locks on,
+// in the order they were originally granted.
+func (c *SamFs) reclaimLocks() {
+	c.lockLock.Lock()
+	defer c.lockLock.Unlock()
+
+	first := true
+	for fdata := range c.lockedFiles {
+		fdata.Lock()
+		for _, l := range fdata.Locks {
+			req := *l
+			req.Reclaim = true
+			var resp *pb.LockReply
+			var err error
+			if req.Lock.Type == pb.LockType_UNLOCK {
+				resp, err = c.nfsClient.Unlock(context.Background(), &req,
+					grpc.FailFast(false))
+			} else {
+				resp, err = c.nfsClient.Lock(context.Background(), &req,
+					grpc.FailFast(false))
+			}
+			if err != nil {
+				glog.Errorf(`failed to reclaim lock on "%s" :: %s`, fdata.Name,
+					err.Error())
+				continue
+			}
+			if first && resp.ServerSessionID == c.lockSessionID {
+				// already reclaimed with this server instance
+				fdata.Unlock()
+				return
+			}
+			first = false
+			c.lockSessionID = resp.ServerSessionID
+			if !resp.Granted {
+				glog.Errorf(`lost lock on "%s" during reclaim`, fdata.Name)
+			}
+		}
+		fdata.Unlock()
+	}
+}
+
+// recordLock remembers a granted lock operation so that it can be replayed
+// after a server restart.
+func (f *SamFsFileData) recordLock(req *pb.LockRequest) {
+	c := f.Fs
+	r := *req
+	r.Block = false
+	r.Reclaim = false
+
+	c.lockLock.Lock()
+	defer c.lockLock.Unlock()
+	f.Lock()
+	defer f.Unlock()
+
+	// unlocking the whole file makes all earlier operations of the owner moot
+	if r.Lock.Type == pb.LockType_UNLOCK && r.Lock.Start == 0 &&
+		r.Lock.End == math.MaxUint64 {
+		var locks []*pb.LockRequest
+		for _, l := range f.Locks {
+			if l.Lock.Owner != r.Lock.Owner || l.Flock != r.Flock {
+				locks = append(locks, l)
+			}
+		}
+		f.Locks = locks
+	} else {
+		f.Locks = append(f.Locks, &r)
+	}
+
+	if len(f.Locks) == 0 {
+		delete(c.lockedFiles, f)
+	} else {
+		c.lockedFiles[f] = true
+	}
+}
+
+// releaseLocks drops every lock still held through f, called when the file is
+// closed for good.
+func (f *SamFsFileData) releaseLocks(ctx context.Context) {
+	c := f.Fs
+	c.lockLock.Lock()
+	_, ok := c.lockedFiles[f]
+	delete(c.lockedFiles, f)
+	c.lockLock.Unlock()
+	if !ok {
+		return
+	}
+
+	f.Lock()
+	locks := f.Locks
+	f.Locks = nil
+	f.Unlock()
+
+	type ownerKind struct {
+		owner uint64
+		flock bool
+	}
+	seen := make(map[ownerKind]bool)
+	for _, l := range locks {
+		k := ownerKind{l.Lock.Owner, l.Flock}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		_, err := c.nfsClient.Unlock(ctx, &pb.LockRequest{
+			FileHandle: f.serverFh,
+			Lock: &pb.FileLock{
+				ClientID: c.clientID,
+				Owner:    l.Lock.Owner,
+				Start:    0,
+				End:      math.MaxUint64,
+				Type:     pb.LockType_UNLOCK,
+			},
+			Flock: l.Flock,
+		}, grpc.FailFast(false))
+		if err != nil {
+			glog.Errorf(`failed to release locks on "%s" :: %s`, f.Name,
+				err.Error())
+		}
+	}
+}
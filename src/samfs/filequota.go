@@ -0,0 +1,43 @@
+package samfs
+
+import (
+	"syscall"
+
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func isQuotaError(err error) bool {
+	return grpc.Code(err) == codes.ResourceExhausted &&
+		grpc.ErrorDesc(err) == grpc.ErrorDesc(errQuota)
+}
+
+func isReadOnlyError(err error) bool {
+	desc := grpc.ErrorDesc(err)
+	return grpc.Code(err) == codes.PermissionDenied &&
+		(desc == grpc.ErrorDesc(errReadOnly) ||
+			desc == grpc.ErrorDesc(errExportReadOnly))
+}
+
+// ioStatus turns the error of a failed request that adds data or files into
+// the status reported to the kernel.
+func ioStatus(err error) fuse.Status {
+	if isQuotaError(err) {
+		return fuse.Status(syscall.EDQUOT)
+	}
+	if isReadOnlyError(err) {
+		return fuse.EROFS
+	}
+	return fuse.EIO
+}
+
+// callerOwner is who files created on behalf of fContext belong to, and whose
+// quota they count against.
+func callerOwner(fContext *fuse.Context) *pb.FileOwner {
+	if fContext == nil {
+		return nil
+	}
+	return &pb.FileOwner{Uid: fContext.Uid, Gid: fContext.Gid}
+}
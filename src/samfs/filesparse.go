@@ -0,0 +1,114 @@
+package samfs
+
+import (
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var errBadHoles = grpc.Errorf(codes.DataLoss,
+	"holes in read reply do not fit its data")
+
+// readSparse reads from the server without having holes sent as zeros, and
+// expands the reply into buf.
+func (c *SamFs) readSparse(ctx context.Context, fh *pb.FileHandle,
+	buf []byte, off int64) ([]byte, error) {
+
+	resp, err := c.readChecked(ctx, &pb.ReadRequest{
+		FileHandle: fh,
+		Offset:     off,
+		Size:       int64(len(buf)),
+		Sparse:     true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !holesFit(resp, off, int64(len(buf))) {
+		return nil, errBadHoles
+	}
+	if len(resp.Holes) == 0 {
+		return resp.Data, nil
+	}
+
+	out := buf[:resp.Size]
+	pos, n := off, 0
+	for _, h := range resp.Holes {
+		n += copy(out[pos-off:h.Offset-off], resp.Data[n:])
+		hole := out[h.Offset-off : h.Offset-off+h.Length]
+		for i := range hole {
+			hole[i] = 0
+		}
+		pos = h.Offset + h.Length
+	}
+	copy(out[pos-off:], resp.Data[n:])
+	return out, nil
+}
+
+// holesFit returns whether the holes of a sparse read reply for size bytes at
+// off are in order, within the reply and leave room for exactly its data.
+func holesFit(resp *pb.ReadReply, off int64, size int64) bool {
+	if resp.Size < 0 || resp.Size > size {
+		return false
+	}
+	pos, end, holeBytes := off, off+resp.Size, int64(0)
+	for _, h := range resp.Holes {
+		if h.Offset < pos || h.Length < 0 || h.Length > end-h.Offset {
+			return false
+		}
+		pos = h.Offset + h.Length
+		holeBytes += h.Length
+	}
+	return int64(len(resp.Data)) == resp.Size-holeBytes
+}
+
+// Lseek finds the next data or hole at or after off, for SEEK_DATA and
+// SEEK_HOLE.
+func (c *SamFsFileHandle) Lseek(off uint64, whence uint32) (uint64,
+	fuse.Status) {
+
+	glog.V(3).Infof("Lseek called on %s off: %d, whence: %d", c.fileData.Name,
+		off, whence)
+	ctx, t := c.fileData.Fs.startOp("Lseek", c.fileData.Name)
+	defer t.finish(nil)
+
+	req := &pb.SeekRequest{
+		FileHandle: c.fileData.serverFh,
+		Offset:     int64(off),
+	}
+	switch whence {
+	case seekData:
+		req.Whence = pb.SeekWhence_SEEK_DATA
+	case seekHole:
+		req.Whence = pb.SeekWhence_SEEK_HOLE
+	default:
+		// the kernel handles the other kinds of seek itself
+		return 0, fuse.EINVAL
+	}
+
+	// the server only knows about holes in data it has seen
+	c.fileData.Lock()
+	err := c.fileData.flushDelegated(ctx)
+	c.fileData.Unlock()
+	if err != nil {
+		glog.Errorf(`failed to flush delegated data of "%s" :: %s`,
+			c.fileData.Name, err.Error())
+		return 0, fuse.EIO
+	}
+
+	resp, err := c.fileData.Fs.nfsClient.Seek(ctx, req,
+		grpc.FailFast(false))
+	if grpc.Code(err) == codes.OutOfRange {
+		return 0, fuse.Status(syscall.ENXIO)
+	}
+	if err != nil {
+		glog.Errorf(`failed to seek in file "%s" :: %s`, c.fileData.Name,
+			err.Error())
+		return 0, fuse.EIO
+	}
+	return uint64(resp.Offset), fuse.OK
+}
@@ -1,24 +1,46 @@
 package samfs
 
 import (
+	"math/rand"
 	"os/user"
+	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
-	"github.com/hanwen/go-fuse/fuse"
-	"github.com/hanwen/go-fuse/fuse/nodefs"
-	"github.com/hanwen/go-fuse/fuse/pathfs"
 	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/nodefs"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/pathfs"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 )
 
+// attributes returned by the server are trusted for this long before being
+// fetched again, mutating replies refresh them in place
+const attrCacheTimeout = 3 * time.Second
+
+type attrCacheEntry struct {
+	attr    *fuse.Attr
+	expires time.Time
+}
+
 type SamFsOptions struct {
 	server string
 	port   string
+	// checksum used on read and write data, "none", "crc32c" or "sha256"
+	checksum string
+	// compress read and write data if the server allows it
+	compression bool
+	// nil connects in plaintext
+	tls *TLSOptions
+	// bearer token sent with every request, none if empty
+	token string
+	// every write is stable, as if the files were opened with O_SYNC
+	sync bool
 }
 
 type SamFs struct {
@@ -26,6 +48,7 @@ type SamFs struct {
 	Mount     string
 	cacheLock sync.RWMutex
 	fileCache map[string]*SamFsFileData
+	attrCache map[string]*attrCacheEntry
 	options   *SamFsOptions
 
 	nfsClient  pb.NFSClient
@@ -34,15 +57,50 @@ type SamFs struct {
 	rootfh pb.FileHandle
 
 	owner fuse.Owner
+
+	//clientID is randomly generated every time the client starts;
+	//the server uses it to tell lock owners of different clients apart
+	clientID      int64
+	lockLock      sync.Mutex
+	lockedFiles   map[*SamFsFileData]bool
+	lockSessionID int64
+
+	// recalls seen so far, to catch recalls racing with the open that
+	// granted the delegation
+	recallLock  sync.Mutex
+	recallCount uint64
+	recalled    map[uint64]uint64
+
+	pathFs *pathfs.PathNodeFs
+	// stops the callback and watch streams
+	streamsCancel context.CancelFunc
+
+	checksumType pb.ChecksumType
+	// reads and writes whose data got corrupted on the way
+	checksumErrors uint64
+	// codec for read and write data agreed on with the server
+	compression pb.Compression
+
+	// FUSE operations traced so far, and the log of slow ones
+	opCount uint64
+	slowLog *slowLog
 }
 
 func NewSamFs(opts *SamFsOptions) (*SamFs, error) {
 	samFs := &SamFs{
-		options:   opts,
-		fileCache: make(map[string]*SamFsFileData),
+		options:     opts,
+		fileCache:   make(map[string]*SamFsFileData),
+		attrCache:   make(map[string]*attrCacheEntry),
+		lockedFiles: make(map[*SamFsFileData]bool),
+		recalled:    make(map[uint64]uint64),
+		slowLog:     newSlowLog("client"),
 	}
-	conn, err := grpc.DialContext(context.Background(), opts.server+":"+opts.port,
-		grpc.WithInsecure(), grpc.WithBackoffMaxDelay(120*time.Second))
+	checksumType, err := parseChecksumType(opts.checksum)
+	if err != nil {
+		return nil, err
+	}
+	samFs.checksumType = checksumType
+	conn, err := Dial(opts.server, opts.port, opts.tls, opts.token)
 	if err != nil {
 		return nil, err
 	}
@@ -65,13 +123,17 @@ func NewSamFs(opts *SamFsOptions) (*SamFs, error) {
 	samFs.owner.Gid = uint32(gid)
 	glog.Infof("running samfs with uid: %d, gid: %d", uid, gid)
 
+	rand.Seed(time.Now().UnixNano())
+	samFs.clientID = rand.Int63()
+
 	return samFs, nil
 }
 
 func (c *SamFs) SetDebug(debug bool) {
 }
 
-func (c *SamFs) getFileHandle(name string) (*pb.FileHandle, fuse.Status) {
+func (c *SamFs) getFileHandle(ctx context.Context,
+	name string) (*pb.FileHandle, fuse.Status) {
 
 	if name == "" {
 		return &c.rootfh, fuse.OK
@@ -80,7 +142,7 @@ func (c *SamFs) getFileHandle(name string) (*pb.FileHandle, fuse.Status) {
 
 	path := strings.Split(name, "/")
 	for _, fname := range path {
-		resp, err := c.nfsClient.Lookup(context.Background(), &pb.LocalDirectoryRequest{
+		resp, err := c.nfsClient.Lookup(ctx, &pb.LocalDirectoryRequest{
 			DirectoryFileHandle: parentFh,
 			Name:                fname,
 		}, grpc.FailFast(false))
@@ -99,7 +161,8 @@ func (c *SamFs) getFileHandle(name string) (*pb.FileHandle, fuse.Status) {
 	return parentFh, fuse.OK
 }
 
-func (c *SamFs) getParentHandle(name string) (*pb.FileHandle, fuse.Status) {
+func (c *SamFs) getParentHandle(ctx context.Context,
+	name string) (*pb.FileHandle, fuse.Status) {
 
 	if name == "" {
 		// there is no parent of root as far as samfs is concerned
@@ -119,7 +182,107 @@ func (c *SamFs) getParentHandle(name string) (*pb.FileHandle, fuse.Status) {
 	parentPath := strings.TrimSuffix(name, "/"+myName)
 	glog.V(3).Infof("getParentHandle: name %s, parentPath %s", name, parentPath)
 
-	return c.getFileHandle(parentPath)
+	return c.getFileHandle(ctx, parentPath)
+}
+
+func parentName(name string) string {
+	dir := path.Dir(name)
+	if dir == "." {
+		return ""
+	}
+	return dir
+}
+
+// getCachedAttr returns a copy of the cached attributes of name, or nil if
+// they are missing or expired.
+func (c *SamFs) getCachedAttr(name string) *fuse.Attr {
+	c.cacheLock.RLock()
+	defer c.cacheLock.RUnlock()
+	e, ok := c.attrCache[name]
+	if !ok || time.Now().After(e.expires) {
+		return nil
+	}
+	attr := *e.attr
+	return &attr
+}
+
+func (c *SamFs) cacheAttr(name string, protoAttr *pb.GetAttrReply) *fuse.Attr {
+	fAttr := ProtoToFuseAttr(protoAttr)
+	fAttr.Owner = c.owner
+
+	c.cacheLock.Lock()
+	c.attrCache[name] = &attrCacheEntry{
+		attr:    fAttr,
+		expires: time.Now().Add(attrCacheTimeout),
+	}
+	c.cacheLock.Unlock()
+	return fAttr
+}
+
+// invalidateAttr drops cached attributes of name and everything below it.
+func (c *SamFs) invalidateAttr(name string) {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	delete(c.attrCache, name)
+	prefix := name + "/"
+	for n := range c.attrCache {
+		if name == "" || strings.HasPrefix(n, prefix) {
+			delete(c.attrCache, n)
+		}
+	}
+}
+
+// applyWcc updates the cached attributes of name with the weak cache
+// consistency data returned by a mutating request. It returns true if the
+// pre-operation attributes do not match what we had cached, i.e. the object
+// was changed by someone else since we last looked at it, in which case the
+// data cached for it is dropped too.
+func (c *SamFs) applyWcc(name string, wcc *pb.WccData) bool {
+	if wcc == nil {
+		c.invalidateAttr(name)
+		return false
+	}
+
+	changed := false
+	c.cacheLock.RLock()
+	e, ok := c.attrCache[name]
+	if ok && wcc.Before != nil {
+		changed = e.attr.Size != wcc.Before.Size ||
+			e.attr.Mtime != wcc.Before.Mtime ||
+			e.attr.Mtimensec != wcc.Before.Mtimensec ||
+			e.attr.Ctime != wcc.Before.Ctime ||
+			e.attr.Ctimensec != wcc.Before.Ctimensec
+	}
+	c.cacheLock.RUnlock()
+
+	if changed {
+		glog.V(2).Infof(`"%s" was modified by another client`, name)
+		// in the background, the caller may be handling a request on the
+		// file or hold its lock
+		go c.dropCachedData(name)
+	}
+
+	if wcc.After == nil {
+		c.invalidateAttr(name)
+	} else {
+		c.cacheAttr(name, wcc.After)
+	}
+	return changed
+}
+
+// dropCachedData makes the kernel drop the data it cached for name, and
+// stops serving it from the cache of a read delegation.
+func (c *SamFs) dropCachedData(name string) {
+	c.cacheLock.RLock()
+	fdata, ok := c.fileCache[name]
+	c.cacheLock.RUnlock()
+	if ok {
+		c.dropReadDelegation(fdata)
+	}
+	if c.pathFs == nil {
+		return
+	}
+	c.pathFs.FileNotify(name, 0, 0)
 }
 
 // Attributes.  This function is the main entry point, through
@@ -132,11 +295,20 @@ func (c *SamFs) GetAttr(name string, fContext *fuse.Context) (*fuse.Attr,
 	fuse.Status) {
 
 	glog.V(3).Infof(`GetAttr called on "%s"`, name)
-	fh, fhErr := c.getFileHandle(name)
+	if fAttr := c.getCachedAttr(name); fAttr != nil {
+		if size, ok := c.delegatedSize(name); ok {
+			fAttr.Size = size
+		}
+		return fAttr, fuse.OK
+	}
+
+	ctx, t := c.startOp("GetAttr", name)
+	defer t.finish(nil)
+	fh, fhErr := c.getFileHandle(ctx, name)
 	if fhErr != fuse.OK {
 		return nil, fhErr
 	}
-	resp, err := c.nfsClient.GetAttr(context.Background(), &pb.FileHandleRequest{
+	resp, err := c.nfsClient.GetAttr(ctx, &pb.FileHandleRequest{
 		FileHandle: fh,
 	}, grpc.FailFast(false))
 	if err != nil {
@@ -144,8 +316,10 @@ func (c *SamFs) GetAttr(name string, fContext *fuse.Context) (*fuse.Attr,
 		return nil, fuse.EIO
 	}
 
-	fAttr := ProtoToFuseAttr(resp)
-	fAttr.Owner = c.owner
+	fAttr := c.cacheAttr(name, resp)
+	if size, ok := c.delegatedSize(name); ok {
+		fAttr.Size = size
+	}
 
 	return fAttr, fuse.OK
 }
@@ -154,7 +328,48 @@ func (c *SamFs) Truncate(path string, size uint64,
 	fContext *fuse.Context) fuse.Status {
 
 	glog.V(3).Infof("Truncate called on  %s", path)
-	return fuse.EINVAL
+	ctx, t := c.startOp("Truncate", path)
+	defer t.finish(nil)
+	fh, fhErr := c.getFileHandle(ctx, path)
+	if fhErr != fuse.OK {
+		return fhErr
+	}
+	return c.truncate(ctx, path, fh, size)
+}
+
+// truncate sets the size of the file at name on the server, and drops what
+// is cached of it.
+func (c *SamFs) truncate(ctx context.Context, name string, fh *pb.FileHandle,
+	size uint64) fuse.Status {
+	c.cacheLock.RLock()
+	fdata, cached := c.fileCache[name]
+	c.cacheLock.RUnlock()
+	if cached {
+		// delegated writes below the new size have to survive it
+		fdata.Lock()
+		err := fdata.flushDelegated(ctx)
+		fdata.Unlock()
+		if err != nil {
+			glog.Errorf(`failed to flush delegated data of "%s" :: %s`, name,
+				err.Error())
+			return ioStatus(err)
+		}
+	}
+
+	resp, err := c.nfsClient.Truncate(ctx, &pb.TruncateRequest{
+		FileHandle: fh,
+		Size:       int64(size),
+		ClientID:   c.clientID,
+	}, grpc.FailFast(false))
+	if err != nil {
+		glog.Errorf(`failed to truncate "%s" :: %s`, name, err.Error())
+		return ioStatus(err)
+	}
+	c.applyWcc(name, resp.Wcc)
+	if cached {
+		fdata.wroteThrough(resp.Wcc)
+	}
+	return fuse.OK
 }
 
 func (c *SamFs) Utimens(name string, atime *time.Time, mtime *time.Time,
@@ -194,22 +409,27 @@ func (c *SamFs) Link(orig string, newName string,
 
 func (c *SamFs) Rmdir(path string, fContext *fuse.Context) fuse.Status {
 	glog.V(3).Infof("Rmdir called %s", path)
+	ctx, t := c.startOp("Rmdir", path)
+	defer t.finish(nil)
 
-	fh, fhErr := c.getParentHandle(path)
+	fh, fhErr := c.getParentHandle(ctx, path)
 	if fhErr != fuse.OK {
 		return fhErr
 	}
 
 	splitPath := strings.Split(path, "/")
 	name := splitPath[len(splitPath)-1]
-	_, err := c.nfsClient.Rmdir(context.Background(), &pb.LocalDirectoryRequest{
+	resp, err := c.nfsClient.Rmdir(ctx, &pb.LocalDirectoryRequest{
 		DirectoryFileHandle: fh,
 		Name:                name,
 	}, grpc.FailFast(false))
 	if err != nil {
 		glog.Errorf(`failed to remove directory "%s" :: %s`, path, err.Error())
+		c.invalidateAttr(path)
 		return fuse.EIO
 	}
+	c.applyWcc(path, resp.Wcc)
+	c.applyWcc(parentName(path), resp.DirWcc)
 	return fuse.OK
 }
 
@@ -217,21 +437,26 @@ func (c *SamFs) Mkdir(path string, mode uint32,
 	fContext *fuse.Context) fuse.Status {
 
 	glog.V(3).Infof("Mkdir called for %s", path)
-	fh, fhErr := c.getParentHandle(path)
+	ctx, t := c.startOp("Mkdir", path)
+	defer t.finish(nil)
+	fh, fhErr := c.getParentHandle(ctx, path)
 	if fhErr != fuse.OK {
 		return fhErr
 	}
 
 	splitPath := strings.Split(path, "/")
 	name := splitPath[len(splitPath)-1]
-	_, err := c.nfsClient.Mkdir(context.Background(), &pb.LocalDirectoryRequest{
+	resp, err := c.nfsClient.Mkdir(ctx, &pb.LocalDirectoryRequest{
 		DirectoryFileHandle: fh,
 		Name:                name,
+		Owner:               callerOwner(fContext),
 	}, grpc.FailFast(false))
 	if err != nil {
 		glog.Errorf(`failed to create directory "%s" :: %s`, path, err.Error())
-		return fuse.EIO
+		return ioStatus(err)
 	}
+	c.applyWcc(path, resp.Wcc)
+	c.applyWcc(parentName(path), resp.DirWcc)
 	return fuse.OK
 }
 
@@ -239,12 +464,14 @@ func (c *SamFs) Rename(oldName string, newName string,
 	fContext *fuse.Context) fuse.Status {
 
 	glog.V(3).Info("Rename called from %s to %s", oldName, newName)
-	fromFh, fromFhErr := c.getParentHandle(oldName)
+	ctx, t := c.startOp("Rename", oldName+" "+newName)
+	defer t.finish(nil)
+	fromFh, fromFhErr := c.getParentHandle(ctx, oldName)
 	if fromFhErr != fuse.OK {
 		return fromFhErr
 	}
 
-	toFh, toFhErr := c.getParentHandle(newName)
+	toFh, toFhErr := c.getParentHandle(ctx, newName)
 	if toFhErr != fuse.OK {
 		return toFhErr
 	}
@@ -255,38 +482,62 @@ func (c *SamFs) Rename(oldName string, newName string,
 	nSplitPath := strings.Split(newName, "/")
 	nName := nSplitPath[len(nSplitPath)-1]
 
-	_, err := c.nfsClient.Rename(context.Background(), &pb.RenameRequest{
+	resp, err := c.nfsClient.Rename(ctx, &pb.RenameRequest{
 		FromDirHandle: fromFh,
 		FromName:      oName,
 		ToDirHandle:   toFh,
 		ToName:        nName,
 	}, grpc.FailFast(false))
 
+	c.invalidateAttr(oldName)
+	c.invalidateAttr(newName)
 	if err != nil {
 		glog.Errorf("failed to rename from %s to %s :: %s", oName, nName, err.Error())
-		return fuse.EIO
+		return ioStatus(err)
 	}
+	c.applyWcc(newName, resp.Wcc)
+	c.applyWcc(parentName(oldName), resp.DirWcc)
+	c.applyWcc(parentName(newName), resp.ToDirWcc)
+
+	// open files follow the rename
+	c.cacheLock.Lock()
+	if fdata, ok := c.fileCache[oldName]; ok {
+		delete(c.fileCache, oldName)
+		fdata.Lock()
+		fdata.Name = newName
+		fh := *fdata.serverFh
+		fh.Path = path.Join(c.rootfh.Path, newName)
+		fdata.serverFh = &fh
+		fdata.Unlock()
+		c.fileCache[newName] = fdata
+	}
+	c.cacheLock.Unlock()
 	return fuse.OK
 }
 
 func (c *SamFs) Unlink(name string, fContext *fuse.Context) fuse.Status {
 	glog.V(3).Infof("Unlink called on %s", name)
+	ctx, t := c.startOp("Unlink", name)
+	defer t.finish(nil)
 
-	fh, fhErr := c.getParentHandle(name)
+	fh, fhErr := c.getParentHandle(ctx, name)
 	if fhErr != fuse.OK {
 		return fhErr
 	}
 
 	splitPath := strings.Split(name, "/")
 	justName := splitPath[len(splitPath)-1]
-	_, err := c.nfsClient.Remove(context.Background(), &pb.LocalDirectoryRequest{
+	resp, err := c.nfsClient.Remove(ctx, &pb.LocalDirectoryRequest{
 		DirectoryFileHandle: fh,
 		Name:                justName,
 	}, grpc.FailFast(false))
 	if err != nil {
 		glog.Errorf(`failed to remove file "%s" :: %s`, name, err.Error())
+		c.invalidateAttr(name)
 		return fuse.EIO
 	}
+	c.applyWcc(name, resp.Wcc)
+	c.applyWcc(parentName(name), resp.DirWcc)
 	return fuse.OK
 }
 
@@ -318,18 +569,33 @@ func (c *SamFs) ListXAttr(name string, fContext *fuse.Context) ([]string,
 	return []string{}, fuse.OK
 }
 
-func (c *SamFs) OnMount(nodefs *pathfs.PathNodeFs) {
+func (c *SamFs) OnMount(pathFs *pathfs.PathNodeFs) {
 	glog.V(3).Info("OnMount called")
-	resp, err := c.nfsClient.Mount(context.Background(), &pb.MountRequest{}, grpc.FailFast(false))
+	mReq := &pb.MountRequest{}
+	if c.options.compression {
+		mReq.Compression = pb.Compression_FLATE
+	}
+	resp, err := c.nfsClient.Mount(context.Background(), mReq, grpc.FailFast(false))
 	if err != nil {
 		glog.Fatalf("failed to mount the remote filesystem :: %s", err.Error())
 		c.clientConn.Close()
 		return
 	}
 	c.rootfh = *resp.FileHandle
+	c.compression = resp.Compression
+	glog.Infof("using %v for read and write data", c.compression)
+	c.pathFs = pathFs
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.streamsCancel = cancel
+	go c.runCallbacks(ctx)
+	go c.runWatch(ctx)
 }
 
 func (c *SamFs) OnUnmount() {
+	if c.streamsCancel != nil {
+		c.streamsCancel()
+	}
 	c.clientConn.Close()
 	glog.V(3).Info("unmount okay")
 }
@@ -338,13 +604,20 @@ func (c *SamFs) Open(name string, flags uint32,
 	fContext *fuse.Context) (nodefs.File, fuse.Status) {
 
 	glog.V(3).Infof("Open called on %s", name)
-	fh, fhErr := c.getFileHandle(name)
+	ctx, t := c.startOp("Open", name)
+	defer t.finish(nil)
+	fh, fhErr := c.getFileHandle(ctx, name)
 	if fhErr != fuse.OK {
 		glog.Errorf(`failed to open file "%s"`, name)
 		return nil, fhErr
 	}
-	fdata := NewFileData(name, c, fh)
+	write := flags&syscall.O_ACCMODE != syscall.O_RDONLY
+	fdata, status := c.openFileData(ctx, name, fh, write)
+	if status != fuse.OK {
+		return nil, status
+	}
 	fsFh := NewFileHandle(fdata)
+	fsFh.flags = flags
 	return &nodefs.WithFlags{
 		File: fsFh,
 		// NOTE(mihir): if there is some problem wrt fuse, uncomment the
@@ -357,11 +630,13 @@ func (c *SamFs) OpenDir(name string, fContext *fuse.Context) ([]fuse.DirEntry,
 	fuse.Status) {
 
 	glog.V(3).Infof(`OpenDir called on "%s"`, name)
-	fh, fhErr := c.getFileHandle(name)
+	ctx, t := c.startOp("OpenDir", name)
+	defer t.finish(nil)
+	fh, fhErr := c.getFileHandle(ctx, name)
 	if fhErr != fuse.OK {
 		return nil, fhErr
 	}
-	resp, err := c.nfsClient.Readdir(context.Background(), &pb.FileHandleRequest{
+	resp, err := c.nfsClient.Readdir(ctx, &pb.FileHandleRequest{
 		FileHandle: fh,
 	}, grpc.FailFast(false))
 	if err != nil {
@@ -381,7 +656,9 @@ func (c *SamFs) Create(name string, flags uint32, mode uint32,
 	fContext *fuse.Context) (nodefs.File, fuse.Status) {
 
 	glog.V(3).Infof("Create called %s", name)
-	fh, fhErr := c.getParentHandle(name)
+	ctx, t := c.startOp("Create", name)
+	defer t.finish(nil)
+	fh, fhErr := c.getParentHandle(ctx, name)
 	if fhErr != fuse.OK {
 		glog.Errorf(`failed to create file "%s"`, name)
 		return nil, fhErr
@@ -389,16 +666,23 @@ func (c *SamFs) Create(name string, flags uint32, mode uint32,
 
 	splitPath := strings.Split(name, "/")
 	justName := splitPath[len(splitPath)-1]
-	resp, err := c.nfsClient.Create(context.Background(), &pb.LocalDirectoryRequest{
+	resp, err := c.nfsClient.Create(ctx, &pb.LocalDirectoryRequest{
 		DirectoryFileHandle: fh,
 		Name:                justName,
+		Owner:               callerOwner(fContext),
 	}, grpc.FailFast(false))
 	if err != nil {
 		glog.Errorf(`failed to create file "%s" :: %s`, name, err.Error())
-		return nil, fuse.EIO
+		return nil, ioStatus(err)
+	}
+	c.applyWcc(name, resp.Wcc)
+	c.applyWcc(parentName(name), resp.DirWcc)
+	fdata, status := c.openFileData(ctx, name, resp.FileHandle, true)
+	if status != fuse.OK {
+		return nil, status
 	}
-	fdata := NewFileData(name, c, resp.FileHandle)
 	fsFh := NewFileHandle(fdata)
+	fsFh.flags = flags
 	return fsFh, fuse.OK
 }
 
@@ -418,5 +702,23 @@ func (c *SamFs) Readlink(name string, fContext *fuse.Context) (string,
 
 func (c *SamFs) StatFs(name string) *fuse.StatfsOut {
 	glog.V(3).Info("StatFs called")
-	return &fuse.StatfsOut{}
+	ctx, t := c.startOp("StatFs", name)
+	defer t.finish(nil)
+	resp, err := c.nfsClient.StatFs(ctx, &pb.StatFsRequest{
+		Path: path.Join(c.rootfh.Path, name),
+	}, grpc.FailFast(false))
+	if err != nil {
+		glog.Errorf(`failed to statfs "%s" :: %s`, name, err.Error())
+		return nil
+	}
+	return &fuse.StatfsOut{
+		Blocks:  resp.Blocks,
+		Bfree:   resp.Bfree,
+		Bavail:  resp.Bavail,
+		Files:   resp.Files,
+		Ffree:   resp.Ffree,
+		Bsize:   resp.Bsize,
+		NameLen: resp.NameLen,
+		Frsize:  resp.Frsize,
+	}
 }
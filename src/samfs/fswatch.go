@@ -0,0 +1,118 @@
+package samfs
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse/nodefs"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// runWatch follows changes made on the server by others until ctx is done,
+// and makes the kernel forget what it cached about the changed files.
+func (c *SamFs) runWatch(ctx context.Context) {
+	for {
+		stream, err := c.nfsClient.Watch(ctx, &pb.WatchRequest{
+			FileHandle: &c.rootfh,
+			Recursive:  true,
+		}, grpc.FailFast(false))
+		if err == nil {
+			err = c.serveWatch(stream)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// we may have missed events while reconnecting
+		c.notifyAll()
+		glog.Warningf("watch stream broke, reconnecting :: %v", err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *SamFs) serveWatch(stream pb.NFS_WatchClient) error {
+	for {
+		ev, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		glog.V(3).Infof("watch event %v on %s %s", ev.Type, ev.Path, ev.ToPath)
+
+		switch ev.Type {
+		case pb.WatchEventType_MODIFY:
+			c.notifyModify(c.fuseName(ev.Path))
+		case pb.WatchEventType_RENAME:
+			c.notifyEntry(c.fuseName(ev.Path))
+			c.notifyEntry(c.fuseName(ev.ToPath))
+		case pb.WatchEventType_OVERFLOW:
+			c.notifyAll()
+		case pb.WatchEventType_CREATE:
+			c.notifyCreate(c.fuseName(ev.Path))
+		default:
+			c.notifyEntry(c.fuseName(ev.Path))
+		}
+	}
+}
+
+// fuseName turns a path relative to the exported root into the name
+// pathfs uses for it.
+func (c *SamFs) fuseName(fsPath string) string {
+	rel := strings.TrimPrefix(path.Clean(fsPath), path.Clean(c.rootfh.Path))
+	return strings.TrimPrefix(rel, "/")
+}
+
+// notifyEntry makes the kernel look up name again, it was created, removed or
+// renamed.
+func (c *SamFs) notifyEntry(name string) {
+	c.invalidateAttr(name)
+	c.invalidateAttr(parentName(name))
+	if c.pathFs == nil || name == "" {
+		return
+	}
+	c.pathFs.EntryNotify(parentName(name), path.Base(name))
+}
+
+// notifyCreate makes the kernel read the directory name was created in again.
+// Names that do not exist are not cached, so name itself needs nothing; having
+// the kernel forget it races with lookups of files we created ourselves, and
+// pathfs loses track of the directories among them.
+func (c *SamFs) notifyCreate(name string) {
+	c.invalidateAttr(name)
+	c.invalidateAttr(parentName(name))
+	if c.pathFs == nil || name == "" {
+		return
+	}
+	c.pathFs.FileNotify(parentName(name), 0, 0)
+}
+
+// notifyModify makes the kernel drop cached data and attributes of name, and
+// stops serving it from the cache of a read delegation. The server does not
+// recall delegations for changes made on its disk.
+func (c *SamFs) notifyModify(name string) {
+	c.invalidateAttr(name)
+	c.dropCachedData(name)
+}
+
+// notifyAll makes the kernel drop the entries, attributes and data it cached
+// for the whole mount, events were lost and anything may have changed.
+func (c *SamFs) notifyAll() {
+	c.invalidateAttr("")
+	c.dropReadDelegations()
+	if c.pathFs == nil {
+		return
+	}
+	conn := c.pathFs.Connector()
+	var walk func(dir *nodefs.Inode)
+	walk = func(dir *nodefs.Inode) {
+		conn.FileNotify(dir, 0, 0)
+		for name, child := range dir.Children() {
+			walk(child)
+			conn.EntryNotify(dir, name)
+		}
+	}
+	walk(c.pathFs.Root().Inode())
+}
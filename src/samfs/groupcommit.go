@@ -0,0 +1,173 @@
+package samfs
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/golang/glog"
+)
+
+// directory syncs in one batch at which a syncfs of their filesystems is
+// cheaper than an fsync of each
+const syncFsThreshold = 8
+
+// commitBatch is one sync that every request that joined it waits for.
+type commitBatch struct {
+	done chan struct{}
+	err  error
+	// the file to sync, open for as long as a request in the batch waits
+	file *os.File
+	// or the directories to sync, and how syncing each of them failed
+	dirs map[string]error
+}
+
+// commitQueue runs the batches of a file, or of the directories, one at a
+// time. Requests that arrive while a batch runs join the next one, since
+// the running one may have started before their data was written.
+type commitQueue struct {
+	running bool
+	next    *commitBatch
+	sync    func(*commitBatch) error
+	// called once the queue has nothing left to run
+	idle func()
+}
+
+// committer coalesces the syncs of concurrent requests, so that a file
+// written by many clients, or a directory changed by many, is synced once
+// for all of them rather than once for each.
+type committer struct {
+	sync.Mutex
+	files map[fileKey]*commitQueue
+	dirs  *commitQueue
+
+	metrics *metrics
+}
+
+func newCommitter(m *metrics) *committer {
+	c := &committer{
+		files:   make(map[fileKey]*commitQueue),
+		metrics: m,
+	}
+	c.dirs = &commitQueue{sync: c.syncDirs}
+	return c
+}
+
+// wait adds a request to the next batch of q and returns the batch once it
+// is synced. Must be called with c locked, returns with c unlocked.
+func (c *committer) wait(q *commitQueue,
+	join func(*commitBatch)) *commitBatch {
+	atomic.AddUint64(&c.metrics.commitRequests, 1)
+	if q.next == nil {
+		q.next = &commitBatch{done: make(chan struct{})}
+	}
+	b := q.next
+	join(b)
+	if !q.running {
+		c.start(q)
+	}
+	c.Unlock()
+	<-b.done
+	return b
+}
+
+// start runs the next batch of q. Must be called with c locked.
+func (c *committer) start(q *commitQueue) {
+	b := q.next
+	q.next = nil
+	q.running = true
+	go func() {
+		atomic.AddUint64(&c.metrics.commitSyncs, 1)
+		err := q.sync(b)
+		c.Lock()
+		defer c.Unlock()
+		b.err = err
+		close(b.done)
+		q.running = false
+		if q.next != nil {
+			c.start(q)
+		} else if q.idle != nil {
+			q.idle()
+		}
+	}()
+}
+
+// syncFile makes the data written to f durable.
+func (c *committer) syncFile(f *cachedFile) error {
+	c.Lock()
+	q, ok := c.files[f.key]
+	if !ok {
+		q = &commitQueue{sync: func(b *commitBatch) error {
+			return b.file.Sync()
+		}}
+		q.idle = func() { delete(c.files, f.key) }
+		c.files[f.key] = q
+	}
+	b := c.wait(q, func(b *commitBatch) {
+		if b.file == nil {
+			b.file = f.File
+		}
+	})
+	return b.err
+}
+
+// syncDir makes the entries of the directories at dirPaths durable.
+func (c *committer) syncDir(dirPaths ...string) error {
+	c.Lock()
+	b := c.wait(c.dirs, func(b *commitBatch) {
+		if b.dirs == nil {
+			b.dirs = make(map[string]error)
+		}
+		for _, dirPath := range dirPaths {
+			b.dirs[dirPath] = nil
+		}
+	})
+	if b.err != nil {
+		return b.err
+	}
+	// directories of other requests failing is none of the caller's business
+	for _, dirPath := range dirPaths {
+		if err := b.dirs[dirPath]; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDirs fsyncs the directories of a batch, or syncs their filesystems as
+// a whole if there are many of them and the platform can.
+func (c *committer) syncDirs(b *commitBatch) error {
+	if !haveSyncFs || len(b.dirs) < syncFsThreshold {
+		for dirPath := range b.dirs {
+			b.dirs[dirPath] = flush(dirPath)
+		}
+		return nil
+	}
+
+	// a directory of every filesystem the batch touches
+	devices := make(map[uint64]string)
+	for dirPath := range b.dirs {
+		var stat syscall.Stat_t
+		if err := syscall.Stat(dirPath, &stat); err != nil {
+			glog.Errorf("failed to stat directory %s :: %v\n", dirPath, err)
+			return err
+		}
+		devices[uint64(stat.Dev)] = dirPath
+	}
+	for _, dirPath := range devices {
+		fd, err := os.Open(dirPath)
+		if err != nil {
+			glog.Errorf("failed to open directory %s :: %v\n", dirPath, err)
+			return err
+		}
+		err = syncFs(fd)
+		fd.Close()
+		if err != nil {
+			glog.Errorf("could not syncfs the filesystem of %s :: %v\n", dirPath,
+				err)
+			return err
+		}
+	}
+	return nil
+}
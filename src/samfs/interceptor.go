@@ -0,0 +1,101 @@
+package samfs
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// unaryInterceptor runs before every handler and rejects requests from
+// clients that may not make them. Changes, and attempts to make them, are
+// recorded in the audit log, and every call in the metrics and a trace.
+// Calls to the NFS service are tracked per client.
+func (s *SamFSServer) unaryInterceptor(ctx context.Context, req interface{},
+	info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{},
+	err error) {
+
+	ctx, t := s.startTrace(ctx, info.FullMethod)
+	done := s.metrics.begin(info.FullMethod)
+	defer func() {
+		done(req, resp, err)
+		t.finish(err)
+		s.audit.record(ctx, info.FullMethod, req, resp, err)
+	}()
+	if err = s.authorizePeer(ctx); err != nil {
+		return nil, err
+	}
+	if info.FullMethod == healthCheckMethod {
+		// probes do not carry tokens
+		return handler(ctx, req)
+	}
+	authCtx, err := s.authenticate(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	ctx = authCtx
+	if strings.HasPrefix(info.FullMethod, adminMethodPrefix) {
+		if err = s.authorizeAdmin(ctx, info.FullMethod); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+
+	if s.isDraining() {
+		return nil, errDraining
+	}
+	if s.isReadOnly() && isMutation(info.FullMethod, req) {
+		return nil, errExportReadOnly
+	}
+	call, err := s.clients.begin(ctx, req, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer s.clients.end(call)
+	release, err := s.scheduler.admit(ctx, peerAddress(ctx), req)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return handler(ctx, req)
+}
+
+func (s *SamFSServer) streamInterceptor(srv interface{},
+	stream grpc.ServerStream, info *grpc.StreamServerInfo,
+	handler grpc.StreamHandler) (err error) {
+
+	done := s.metrics.begin(info.FullMethod)
+	defer func() {
+		done(nil, nil, err)
+	}()
+	if err = s.authorizePeer(stream.Context()); err != nil {
+		return err
+	}
+	ctx, err := s.authenticate(stream.Context(), info.FullMethod, nil)
+	if err != nil {
+		return err
+	}
+	if s.isDraining() {
+		return errDraining
+	}
+	// eviction and draining end streams by cancelling their context
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	call, err := s.clients.begin(ctx, nil, cancel)
+	if err != nil {
+		return err
+	}
+	defer s.clients.end(call)
+	return handler(srv, &serverStream{stream, ctx})
+}
+
+// serverStream hands a context carrying what the interceptors learned about
+// the client to stream handlers.
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
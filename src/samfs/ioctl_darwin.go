@@ -3,8 +3,8 @@
 package samfs
 
 import (
-	"github.com/hanwen/go-fuse/fuse"
 	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 	"syscall"
 )
 
@@ -32,6 +32,16 @@ func StatToProtoAttr(stat *syscall.Stat_t) *pb.GetAttrReply {
 	}
 }
 
+func StatToWccAttr(stat *syscall.Stat_t) *pb.WccAttr {
+	return &pb.WccAttr{
+		Size:      uint64(stat.Size),
+		Mtime:     uint64(stat.Mtimespec.Sec),
+		Mtimensec: uint32(stat.Mtimespec.Nsec),
+		Ctime:     uint64(stat.Ctimespec.Sec),
+		Ctimensec: uint32(stat.Ctimespec.Nsec),
+	}
+}
+
 func ProtoToFuseAttr(protoAttr *pb.GetAttrReply) *fuse.Attr {
 	return &fuse.Attr{
 		Ino:       protoAttr.Ino,
@@ -21,8 +21,8 @@ package samfs
 //}
 import "C"
 import (
-	"github.com/hanwen/go-fuse/fuse"
 	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 	"syscall"
 )
 
@@ -66,6 +66,16 @@ func StatToProtoAttr(stat *syscall.Stat_t) *pb.GetAttrReply {
 	}
 }
 
+func StatToWccAttr(stat *syscall.Stat_t) *pb.WccAttr {
+	return &pb.WccAttr{
+		Size:      uint64(stat.Size),
+		Mtime:     uint64(stat.Mtim.Sec),
+		Mtimensec: uint32(stat.Mtim.Nsec),
+		Ctime:     uint64(stat.Ctim.Sec),
+		Ctimensec: uint32(stat.Ctim.Nsec),
+	}
+}
+
 func ProtoToFuseAttr(protoAttr *pb.GetAttrReply) *fuse.Attr {
 	return &fuse.Attr{
 		Ino:       protoAttr.Ino,
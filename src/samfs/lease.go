@@ -0,0 +1,56 @@
+package samfs
+
+import (
+	"net"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// a client holds its locks for as long as it keeps a request or stream open
+// or has been idle for less than this long; samfsc keeps its callback stream
+// open for as long as it is mounted
+const lockLease = 90 * time.Second
+
+// connections of hosts that went away without closing them are noticed
+// after about this long, ending their streams
+const tcpKeepAlivePeriod = 30 * time.Second
+
+// expireLockLeases releases the locks of clients whose lease lapsed, so that
+// a client that died does not keep others from locking the files for good.
+func (s *SamFSServer) expireLockLeases(now time.Time) {
+	idle := now.Add(-lockLease)
+	if s.locks.created.After(idle) {
+		return
+	}
+	active := s.clients.active(idle)
+	for id := range s.locks.holders() {
+		if active[id] {
+			continue
+		}
+		n := s.locks.releaseClient(id)
+		glog.Warningf("lease of client %d lapsed, released its %d locks", id, n)
+	}
+}
+
+// keepAliveListener turns on TCP keepalives for the connections it accepts.
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func keepAlive(lis net.Listener) net.Listener {
+	if tcp, ok := lis.(*net.TCPListener); ok {
+		return keepAliveListener{tcp}
+	}
+	return lis
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	conn.SetKeepAlive(true)
+	conn.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	return conn, nil
+}
@@ -0,0 +1,359 @@
+package samfs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// clients get this long after a server restart to reclaim the locks they
+// were holding before new locks are handed out
+const defaultLockGracePeriod = 45 * time.Second
+
+var (
+	errLockGrace   = grpc.Errorf(codes.Unavailable, "server is in lock grace period")
+	errLockReclaim = grpc.Errorf(codes.FailedPrecondition,
+		"lock reclaim after grace period")
+	errNoLock = grpc.Errorf(codes.InvalidArgument, "lock request without a lock")
+)
+
+type lockOwner struct {
+	clientID int64
+	owner    uint64
+}
+
+type heldLock struct {
+	lockOwner
+	start     uint64
+	end       uint64
+	exclusive bool
+	flock     bool
+	pid       uint32
+}
+
+func (l *heldLock) overlaps(start, end uint64) bool {
+	return l.start <= end && start <= l.end
+}
+
+func (l *heldLock) toProto() *pb.FileLock {
+	lockType := pb.LockType_READ_LOCK
+	if l.exclusive {
+		lockType = pb.LockType_WRITE_LOCK
+	}
+	return &pb.FileLock{
+		ClientID: l.clientID,
+		Owner:    l.owner,
+		Start:    l.start,
+		End:      l.end,
+		Type:     lockType,
+		Pid:      l.pid,
+	}
+}
+
+type lockManager struct {
+	sync.Mutex
+	files map[fileKey][]*heldLock
+	// closed and replaced every time locks on a file are released, so that
+	// blocked lockers can retry
+	waiters map[fileKey]chan struct{}
+
+	gracePeriod time.Duration
+	graceEnd    time.Time
+	// leases run from here, clients reconnecting after a restart get a
+	// whole lease to come back
+	created time.Time
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		files:       make(map[fileKey][]*heldLock),
+		waiters:     make(map[fileKey]chan struct{}),
+		gracePeriod: defaultLockGracePeriod,
+		created:     time.Now(),
+	}
+}
+
+func (m *lockManager) startGrace() {
+	m.Lock()
+	end := time.Now().Add(m.gracePeriod)
+	m.graceEnd = end
+	m.Unlock()
+	glog.Infof("lock grace period ends at %v", end)
+}
+
+func (m *lockManager) inGrace() bool {
+	m.Lock()
+	defer m.Unlock()
+	return time.Now().Before(m.graceEnd)
+}
+
+// conflict returns a lock held by someone else that prevents l from being
+// granted. Must be called with m locked.
+func (m *lockManager) conflict(key fileKey, l *heldLock) *heldLock {
+	for _, h := range m.files[key] {
+		if h.lockOwner == l.lockOwner || h.flock != l.flock {
+			continue
+		}
+		if h.overlaps(l.start, l.end) && (h.exclusive || l.exclusive) {
+			return h
+		}
+	}
+	return nil
+}
+
+// release drops the part of the locks of owner overlapping [start, end],
+// splitting locks that only partially overlap. Must be called with m locked.
+func (m *lockManager) release(key fileKey, owner lockOwner, flock bool,
+	start, end uint64) {
+
+	var remaining []*heldLock
+	released := false
+	for _, h := range m.files[key] {
+		if h.lockOwner != owner || h.flock != flock || !h.overlaps(start, end) {
+			remaining = append(remaining, h)
+			continue
+		}
+		released = true
+		if h.start < start {
+			left := *h
+			left.end = start - 1
+			remaining = append(remaining, &left)
+		}
+		if h.end > end {
+			right := *h
+			right.start = end + 1
+			remaining = append(remaining, &right)
+		}
+	}
+
+	if len(remaining) == 0 {
+		delete(m.files, key)
+	} else {
+		m.files[key] = remaining
+	}
+
+	if released {
+		if ch, ok := m.waiters[key]; ok {
+			close(ch)
+			delete(m.waiters, key)
+		}
+	}
+}
+
+// releaseClient drops every lock held by clientID and returns how many it
+// dropped.
+func (m *lockManager) releaseClient(clientID int64) int {
+	m.Lock()
+	defer m.Unlock()
+	released := 0
+	for key, locks := range m.files {
+		var remaining []*heldLock
+		for _, h := range locks {
+			if h.clientID != clientID {
+				remaining = append(remaining, h)
+			}
+		}
+		if len(remaining) == len(locks) {
+			continue
+		}
+		released += len(locks) - len(remaining)
+		if len(remaining) == 0 {
+			delete(m.files, key)
+		} else {
+			m.files[key] = remaining
+		}
+		if ch, ok := m.waiters[key]; ok {
+			close(ch)
+			delete(m.waiters, key)
+		}
+	}
+	return released
+}
+
+// holders returns the client ids holding locks.
+func (m *lockManager) holders() map[int64]bool {
+	m.Lock()
+	defer m.Unlock()
+	ids := make(map[int64]bool)
+	for _, locks := range m.files {
+		for _, h := range locks {
+			ids[h.clientID] = true
+		}
+	}
+	return ids
+}
+
+func (m *lockManager) waitChan(key fileKey) chan struct{} {
+	ch, ok := m.waiters[key]
+	if !ok {
+		ch = make(chan struct{})
+		m.waiters[key] = ch
+	}
+	return ch
+}
+
+// test returns the lock conflicting with l, or nil if l could be granted.
+func (m *lockManager) test(key fileKey, l *heldLock) *heldLock {
+	m.Lock()
+	defer m.Unlock()
+	return m.conflict(key, l)
+}
+
+// lock grants l, replacing whatever the same owner held in that range. If
+// block is set it waits until conflicting locks are released or ctx is done,
+// otherwise the conflicting lock is returned.
+func (m *lockManager) lock(ctx context.Context, key fileKey, l *heldLock,
+	block bool) (*heldLock, error) {
+
+	m.Lock()
+	defer m.Unlock()
+	for {
+		c := m.conflict(key, l)
+		if c == nil {
+			break
+		}
+		if !block {
+			return c, nil
+		}
+
+		ch := m.waitChan(key)
+		m.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			m.Lock()
+			return nil, ctx.Err()
+		}
+		m.Lock()
+	}
+
+	m.release(key, l.lockOwner, l.flock, l.start, l.end)
+	m.files[key] = append(m.files[key], l)
+	return nil, nil
+}
+
+func (m *lockManager) unlock(key fileKey, owner lockOwner, flock bool,
+	start, end uint64) {
+
+	m.Lock()
+	m.release(key, owner, flock, start, end)
+	m.Unlock()
+}
+
+func lockRequestToHeldLock(req *pb.LockRequest) *heldLock {
+	return &heldLock{
+		lockOwner: lockOwner{
+			clientID: req.Lock.ClientID,
+			owner:    req.Lock.Owner,
+		},
+		start:     req.Lock.Start,
+		end:       req.Lock.End,
+		exclusive: req.Lock.Type == pb.LockType_WRITE_LOCK,
+		flock:     req.Flock,
+		pid:       req.Lock.Pid,
+	}
+}
+
+func (s *SamFSServer) TestLock(ctx context.Context,
+	req *pb.LockRequest) (*pb.LockReply, error) {
+	if req.Lock == nil {
+		return nil, errNoLock
+	}
+	glog.V(3).Infof(`received TestLock request for "%s"`, req.FileHandle.Path)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	key := handleKey(req.FileHandle)
+	resp := &pb.LockReply{
+		Granted:         true,
+		ServerSessionID: s.sessionID,
+	}
+	if c := s.locks.test(key, lockRequestToHeldLock(req)); c != nil {
+		resp.Granted = false
+		resp.Conflict = c.toProto()
+	}
+
+	return resp, nil
+}
+
+func (s *SamFSServer) Lock(ctx context.Context,
+	req *pb.LockRequest) (*pb.LockReply, error) {
+	if req.Lock == nil {
+		return nil, errNoLock
+	}
+	glog.V(3).Infof(`received Lock request for "%s" from client %d`,
+		req.FileHandle.Path, req.Lock.ClientID)
+
+	//new locks have to wait until clients had a chance to reclaim theirs
+	if req.Reclaim && !s.locks.inGrace() {
+		return nil, errLockReclaim
+	}
+	if !req.Reclaim && s.locks.inGrace() {
+		return nil, errLockGrace
+	}
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	key := handleKey(req.FileHandle)
+	c, err := s.locks.lock(ctx, key, lockRequestToHeldLock(req), req.Block)
+	if err != nil {
+		glog.V(3).Infof(`gave up waiting for lock on "%s" :: %v`,
+			req.FileHandle.Path, err)
+		return nil, err
+	}
+
+	resp := &pb.LockReply{
+		Granted:         c == nil,
+		ServerSessionID: s.sessionID,
+	}
+	if c != nil {
+		resp.Conflict = c.toProto()
+	}
+
+	return resp, nil
+}
+
+func (s *SamFSServer) Unlock(ctx context.Context,
+	req *pb.LockRequest) (*pb.LockReply, error) {
+	if req.Lock == nil {
+		return nil, errNoLock
+	}
+	glog.V(3).Infof(`received Unlock request for "%s" from client %d`,
+		req.FileHandle.Path, req.Lock.ClientID)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	key := handleKey(req.FileHandle)
+	owner := lockOwner{
+		clientID: req.Lock.ClientID,
+		owner:    req.Lock.Owner,
+	}
+	s.locks.unlock(key, owner, req.Flock, req.Lock.Start, req.Lock.End)
+
+	resp := &pb.LockReply{
+		Granted:         true,
+		ServerSessionID: s.sessionID,
+	}
+
+	return resp, nil
+}
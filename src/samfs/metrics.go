@@ -0,0 +1,343 @@
+package samfs
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the buckets of the RPC
+// latency histograms.
+var latencyBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1,
+	.25, .5, 1, 2.5, 5, 10}
+
+type rpcMetrics struct {
+	requests uint64
+	inFlight int64
+	errors   [codes.Unauthenticated + 1]uint64
+	// buckets[i] counts requests that took at most latencyBuckets[i] and
+	// longer than the bucket before; the last one counts the rest
+	buckets       []uint64
+	durationNanos uint64
+}
+
+// metrics counts what the server does. Everything is updated atomically
+// from the request handlers and read when the metrics are scraped.
+type metrics struct {
+	sync.RWMutex
+	rpcs map[string]*rpcMetrics
+
+	bytesRead    uint64
+	bytesWritten uint64
+	//writes whose data did not match the client's checksums
+	checksumErrors uint64
+	//read and write data before and after compression
+	compressedRawBytes  uint64
+	compressedWireBytes uint64
+	//requests refused by the scheduler, by reason
+	throttled [throttleReasons]uint64
+	//requests waiting for a worker, requests being handled, and the time
+	//requests spent waiting
+	queued         int64
+	busyWorkers    int64
+	queueWaitNanos uint64
+	//requests that found their file open or had to open it, files closed to
+	//make room or because they changed, and files open
+	fdCacheHits      uint64
+	fdCacheMisses    uint64
+	fdCacheEvictions uint64
+	fdCacheOpen      int64
+	//requests that needed data synced, and the syncs done for them
+	commitRequests uint64
+	commitSyncs    uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{rpcs: make(map[string]*rpcMetrics)}
+}
+
+func (m *metrics) rpc(method string) *rpcMetrics {
+	m.RLock()
+	r, ok := m.rpcs[method]
+	m.RUnlock()
+	if ok {
+		return r
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if r, ok = m.rpcs[method]; !ok {
+		r = &rpcMetrics{buckets: make([]uint64, len(latencyBuckets)+1)}
+		m.rpcs[method] = r
+	}
+	return r
+}
+
+// begin counts a call to method as in flight. The returned func must be
+// called with the outcome when the call is done.
+func (m *metrics) begin(method string) func(req interface{},
+	resp interface{}, err error) {
+	r := m.rpc(path.Base(method))
+	atomic.AddUint64(&r.requests, 1)
+	atomic.AddInt64(&r.inFlight, 1)
+	start := time.Now()
+
+	return func(req interface{}, resp interface{}, err error) {
+		d := time.Since(start)
+		atomic.AddInt64(&r.inFlight, -1)
+		atomic.AddUint64(&r.durationNanos, uint64(d))
+		i := sort.SearchFloat64s(latencyBuckets, d.Seconds())
+		atomic.AddUint64(&r.buckets[i], 1)
+		if err != nil {
+			code := grpc.Code(err)
+			if int(code) >= len(r.errors) {
+				code = codes.Unknown
+			}
+			atomic.AddUint64(&r.errors[code], 1)
+			return
+		}
+
+		if reply, ok := resp.(*pb.ReadReply); ok && reply != nil {
+			atomic.AddUint64(&m.bytesRead, uint64(reply.Size))
+		}
+		if write, ok := req.(*pb.WriteRequest); ok {
+			atomic.AddUint64(&m.bytesWritten, uint64(write.Size))
+		}
+	}
+}
+
+func (m *metrics) countCompression(raw int, wire int) {
+	atomic.AddUint64(&m.compressedRawBytes, uint64(raw))
+	atomic.AddUint64(&m.compressedWireBytes, uint64(wire))
+}
+
+func metricHeader(w io.Writer, name string, typ string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// write writes the metrics in the Prometheus text format.
+func (m *metrics) write(w io.Writer) {
+	m.RLock()
+	methods := make([]string, 0, len(m.rpcs))
+	rpcs := make(map[string]*rpcMetrics, len(m.rpcs))
+	for method, r := range m.rpcs {
+		methods = append(methods, method)
+		rpcs[method] = r
+	}
+	m.RUnlock()
+	sort.Strings(methods)
+
+	metricHeader(w, "samfs_rpc_requests_total", "counter",
+		"RPCs received.")
+	for _, method := range methods {
+		fmt.Fprintf(w, "samfs_rpc_requests_total{method=%q} %d\n", method,
+			atomic.LoadUint64(&rpcs[method].requests))
+	}
+	metricHeader(w, "samfs_rpc_in_flight", "gauge",
+		"RPCs being handled.")
+	for _, method := range methods {
+		fmt.Fprintf(w, "samfs_rpc_in_flight{method=%q} %d\n", method,
+			atomic.LoadInt64(&rpcs[method].inFlight))
+	}
+	metricHeader(w, "samfs_rpc_errors_total", "counter",
+		"RPCs that failed, by status code.")
+	for _, method := range methods {
+		r := rpcs[method]
+		for code := range r.errors {
+			if n := atomic.LoadUint64(&r.errors[code]); n > 0 {
+				fmt.Fprintf(w, "samfs_rpc_errors_total{method=%q,code=%q} %d\n",
+					method, codes.Code(code).String(), n)
+			}
+		}
+	}
+	metricHeader(w, "samfs_rpc_duration_seconds", "histogram",
+		"Time taken to handle RPCs.")
+	for _, method := range methods {
+		r := rpcs[method]
+		var count uint64
+		for i := range r.buckets {
+			count += atomic.LoadUint64(&r.buckets[i])
+			le := "+Inf"
+			if i < len(latencyBuckets) {
+				le = formatFloat(latencyBuckets[i])
+			}
+			fmt.Fprintf(w, "samfs_rpc_duration_seconds_bucket{method=%q,le=%q} %d\n",
+				method, le, count)
+		}
+		sum := time.Duration(atomic.LoadUint64(&r.durationNanos)).Seconds()
+		fmt.Fprintf(w, "samfs_rpc_duration_seconds_sum{method=%q} %s\n",
+			method, formatFloat(sum))
+		fmt.Fprintf(w, "samfs_rpc_duration_seconds_count{method=%q} %d\n",
+			method, count)
+	}
+
+	counters := []struct {
+		name  string
+		help  string
+		value *uint64
+	}{
+		{"samfs_read_bytes_total", "File data read by clients.",
+			&m.bytesRead},
+		{"samfs_written_bytes_total", "File data written by clients.",
+			&m.bytesWritten},
+		{"samfs_checksum_errors_total",
+			"Writes whose data did not match the client's checksums.",
+			&m.checksumErrors},
+		{"samfs_compression_raw_bytes_total",
+			"Read and write data before compression.", &m.compressedRawBytes},
+		{"samfs_compression_wire_bytes_total",
+			"Read and write data after compression.", &m.compressedWireBytes},
+		{"samfs_fd_cache_hits_total",
+			"Requests that found their file open.", &m.fdCacheHits},
+		{"samfs_fd_cache_misses_total",
+			"Requests that had to open their file.", &m.fdCacheMisses},
+		{"samfs_fd_cache_evictions_total",
+			"Open files closed to make room, or as changed or idle.",
+			&m.fdCacheEvictions},
+		{"samfs_commit_requests_total",
+			"Requests that waited for files or directories to be synced.",
+			&m.commitRequests},
+		{"samfs_commit_syncs_total",
+			"Syncs done for them, each covering every request waiting.",
+			&m.commitSyncs},
+	}
+	for _, c := range counters {
+		metricHeader(w, c.name, "counter", c.help)
+		fmt.Fprintf(w, "%s %d\n", c.name, atomic.LoadUint64(c.value))
+	}
+	metricHeader(w, "samfs_fd_cache_open_files", "gauge",
+		"Files the server keeps open.")
+	fmt.Fprintf(w, "samfs_fd_cache_open_files %d\n",
+		atomic.LoadInt64(&m.fdCacheOpen))
+	m.writeSchedulerMetrics(w)
+
+	writeRuntimeMetrics(w)
+}
+
+func (m *metrics) writeSchedulerMetrics(w io.Writer) {
+	metricHeader(w, "samfs_throttled_total", "counter",
+		"Requests refused for going over a rate limit, by reason.")
+	for reason, name := range throttleReasonNames {
+		fmt.Fprintf(w, "samfs_throttled_total{reason=%q} %d\n", name,
+			atomic.LoadUint64(&m.throttled[reason]))
+	}
+	metricHeader(w, "samfs_scheduler_queued", "gauge",
+		"Requests waiting for a worker.")
+	fmt.Fprintf(w, "samfs_scheduler_queued %d\n", atomic.LoadInt64(&m.queued))
+	metricHeader(w, "samfs_scheduler_busy_workers", "gauge",
+		"Requests being handled by a worker.")
+	fmt.Fprintf(w, "samfs_scheduler_busy_workers %d\n",
+		atomic.LoadInt64(&m.busyWorkers))
+	metricHeader(w, "samfs_scheduler_wait_seconds_total", "counter",
+		"Time requests spent waiting for a worker.")
+	fmt.Fprintf(w, "samfs_scheduler_wait_seconds_total %s\n",
+		formatFloat(time.Duration(atomic.LoadUint64(&m.queueWaitNanos)).Seconds()))
+}
+
+func writeRuntimeMetrics(w io.Writer) {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	metricHeader(w, "go_info", "gauge", "Version of Go the server was built with.")
+	fmt.Fprintf(w, "go_info{version=%q} 1\n", runtime.Version())
+	metricHeader(w, "go_goroutines", "gauge", "Goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+
+	gauges := []struct {
+		name  string
+		typ   string
+		help  string
+		value uint64
+	}{
+		{"go_memstats_alloc_bytes", "gauge",
+			"Bytes allocated and still in use.", stats.Alloc},
+		{"go_memstats_alloc_bytes_total", "counter",
+			"Bytes allocated, even if freed.", stats.TotalAlloc},
+		{"go_memstats_sys_bytes", "gauge",
+			"Bytes obtained from the system.", stats.Sys},
+		{"go_memstats_heap_inuse_bytes", "gauge",
+			"Bytes in heap spans in use.", stats.HeapInuse},
+		{"go_memstats_heap_objects", "gauge",
+			"Objects allocated on the heap.", stats.HeapObjects},
+		{"go_memstats_mallocs_total", "counter",
+			"Heap objects allocated.", stats.Mallocs},
+		{"go_memstats_frees_total", "counter",
+			"Heap objects freed.", stats.Frees},
+		{"go_gc_cycles_total", "counter",
+			"Garbage collections completed.", uint64(stats.NumGC)},
+	}
+	for _, g := range gauges {
+		metricHeader(w, g.name, g.typ, g.help)
+		fmt.Fprintf(w, "%s %d\n", g.name, g.value)
+	}
+	metricHeader(w, "go_gc_pause_seconds_total", "counter",
+		"Time the world was stopped for garbage collection.")
+	fmt.Fprintf(w, "go_gc_pause_seconds_total %s\n",
+		formatFloat(time.Duration(stats.PauseTotalNs).Seconds()))
+}
+
+func registerPprof(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+func (s *SamFSServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.write(w)
+}
+
+// ServeMetrics serves the server's metrics in the Prometheus text format at
+// /metrics, request traces at /debug/requests, the slow request log settings
+// at /debug/slowlog and the Go profiler at /debug/pprof/, over http on addr.
+func (s *SamFSServer) ServeMetrics(addr string) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	s.setMetricsListener(lis)
+	return nil
+}
+
+// setMetricsListener serves metrics on lis instead of the listener they
+// were served on, nil stops serving them.
+func (s *SamFSServer) setMetricsListener(lis net.Listener) {
+	s.settingsLock.Lock()
+	old := s.metricsListener
+	s.metricsListener = lis
+	s.settingsLock.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	if lis == nil {
+		return
+	}
+
+	mux := debugHandler(s.slowLog)
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	go func() {
+		err := http.Serve(lis, mux)
+		glog.V(2).Infof("stopped serving metrics on %s :: %v", lis.Addr(), err)
+	}()
+}
@@ -0,0 +1,719 @@
+package samfs
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// marks a usage database that can be trusted: it was filled by scanning the
+// export and the server that used it last stopped cleanly
+const quotaScannedKey = "scanned"
+
+// errQuota is told apart from other ResourceExhausted errors by its
+// description, clients report it as EDQUOT.
+var errQuota = grpc.Errorf(codes.ResourceExhausted, "disk quota exceeded")
+
+// quotaLimit is a limit from the quota file, 0 means unlimited.
+type quotaLimit struct {
+	bytes  int64
+	inodes int64
+}
+
+type quotaUsage struct {
+	bytes  int64
+	inodes int64
+}
+
+// quotaManager tracks the bytes and inodes used by every uid and below every
+// directory tree with a quota, and refuses changes that go over a limit.
+// Usage is persisted in a DB so that the export is only scanned once.
+type quotaManager struct {
+	sync.Mutex
+	root string
+	// limits by uid and by directory relative to the export
+	uids map[uint32]quotaLimit
+	dirs map[string]quotaLimit
+	// usage by "uid:<uid>" or "dir:<directory>"
+	usage map[string]*quotaUsage
+	db    *DB
+	dirty bool
+	// usage was computed by scanning the export since it was loaded
+	scanned bool
+}
+
+func uidKey(uid uint32) string {
+	return "uid:" + strconv.FormatUint(uint64(uid), 10)
+}
+
+func dirKey(dir string) string {
+	return "dir:" + dir
+}
+
+// parseQuotaSize parses a byte count with an optional K, M, G or T suffix.
+func parseQuotaSize(s string) (int64, error) {
+	mult := int64(1)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	case "T":
+		mult = 1 << 40
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad size %q", s)
+	}
+	return n * mult, nil
+}
+
+// loadQuotas reads limits from file, one per line:
+//   uid <uid> <bytes> <inodes>
+//   dir <directory relative to the export> <bytes> <inodes>
+// A limit of 0 means unlimited.
+func loadQuotas(file string) (map[uint32]quotaLimit, map[string]quotaLimit,
+	error) {
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	uids := make(map[uint32]quotaLimit)
+	dirs := make(map[string]quotaLimit)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 4 {
+			return nil, nil, fmt.Errorf("%s:%d: expected kind, target, bytes "+
+				"and inodes", file, line)
+		}
+		bytes, err := parseQuotaSize(fields[2])
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		inodes, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil || inodes < 0 {
+			return nil, nil, fmt.Errorf("%s:%d: bad inode count %q", file, line,
+				fields[3])
+		}
+		limit := quotaLimit{bytes: bytes, inodes: inodes}
+
+		switch fields[0] {
+		case "uid":
+			uid, err := strconv.ParseUint(fields[1], 10, 32)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: bad uid %q", file, line,
+					fields[1])
+			}
+			uids[uint32(uid)] = limit
+		case "dir":
+			dirs[path.Clean("/"+fields[1])] = limit
+		default:
+			return nil, nil, fmt.Errorf("%s:%d: kind must be uid or dir, not %q",
+				file, line, fields[0])
+		}
+	}
+	return uids, dirs, scanner.Err()
+}
+
+func newQuotaManager(root string, quotaFile string,
+	dbFile string) (*quotaManager, error) {
+
+	uids, dirs, err := loadQuotas(quotaFile)
+	if err != nil {
+		return nil, err
+	}
+	warnUidLimits(uids)
+	db, err := NewDB(dbFile)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &quotaManager{
+		root:  root,
+		uids:  uids,
+		dirs:  dirs,
+		usage: make(map[string]*quotaUsage),
+		db:    db,
+	}
+	// a database left behind by a crash is rescanned by begin
+	rescan := false
+	for dir := range dirs {
+		// a tree added to the quota file since the last scan
+		if db.Lookup(dirKey(dir)+":inodes") < 0 {
+			rescan = true
+		}
+	}
+	if rescan {
+		err = q.scan()
+	} else {
+		q.load()
+	}
+	return q, err
+}
+
+func (q *quotaManager) load() {
+	for key, num := range q.db.entries {
+		i := strings.LastIndex(key, ":")
+		if i < 0 {
+			continue
+		}
+		u := q.get(key[:i])
+		switch key[i+1:] {
+		case "bytes":
+			u.bytes = num
+		case "inodes":
+			u.inodes = num
+		}
+	}
+}
+
+// scan computes usage from scratch by walking the export.
+func (q *quotaManager) scan() error {
+	glog.Infof("scanning %s for quota usage", q.root)
+	q.usage = make(map[string]*quotaUsage)
+	for dir := range q.dirs {
+		q.get(dirKey(dir))
+	}
+
+	err := q.walk("/", func(uid uint32, rel string, u quotaUsage) {
+		for _, key := range q.keys(uid, rel) {
+			q.get(key).add(u, 1)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	q.dirty = true
+	q.scanned = true
+	return q.flushLocked(false)
+}
+
+// walk calls fn with the usage of every file below dir, counting hard
+// linked files once.
+func (q *quotaManager) walk(dir string,
+	fn func(uid uint32, rel string, u quotaUsage)) error {
+
+	seen := make(map[uint64]bool)
+	top := path.Join(q.root, dir)
+	return filepath.Walk(top, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == q.root {
+			return nil
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return nil
+		}
+		if st.Nlink > 1 && !info.IsDir() {
+			if seen[uint64(st.Ino)] {
+				return nil
+			}
+			seen[uint64(st.Ino)] = true
+		}
+		rel := "/" + strings.TrimPrefix(strings.TrimPrefix(p, q.root), "/")
+		fn(st.Uid, rel, fileUsage(info))
+		return nil
+	})
+}
+
+func fileUsage(info os.FileInfo) quotaUsage {
+	u := quotaUsage{inodes: 1}
+	if info.Mode().IsRegular() {
+		u.bytes = fileBytes(info)
+	}
+	return u
+}
+
+// fileBytes is what a file is charged for: its size, plus the space
+// allocated past the end of it with FALLOC_FL_KEEP_SIZE.
+func fileBytes(info os.FileInfo) int64 {
+	size := info.Size()
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Blksize <= 0 {
+		return size
+	}
+	blk := int64(st.Blksize)
+	if past := st.Blocks*512 - (size+blk-1)/blk*blk; past > 0 {
+		return size + past
+	}
+	return size
+}
+
+func (u *quotaUsage) add(delta quotaUsage, sign int64) {
+	u.bytes += sign * delta.bytes
+	u.inodes += sign * delta.inodes
+}
+
+func (u quotaUsage) neg() quotaUsage {
+	return quotaUsage{bytes: -u.bytes, inodes: -u.inodes}
+}
+
+// get returns the usage for key, creating it if needed. Must be called with
+// q locked.
+func (q *quotaManager) get(key string) *quotaUsage {
+	u, ok := q.usage[key]
+	if !ok {
+		u = &quotaUsage{}
+		q.usage[key] = u
+	}
+	return u
+}
+
+// keys returns the usage keys a file owned by uid at rel counts against. The
+// top directory of a tree does not count against its own quota.
+func (q *quotaManager) keys(uid uint32, rel string) []string {
+	keys := []string{uidKey(uid)}
+	for dir := range q.dirs {
+		if dir == "/" || strings.HasPrefix(rel, dir+"/") {
+			keys = append(keys, dirKey(dir))
+		}
+	}
+	return keys
+}
+
+func (q *quotaManager) limit(key string) quotaLimit {
+	if strings.HasPrefix(key, "dir:") {
+		return q.dirs[strings.TrimPrefix(key, "dir:")]
+	}
+	uid, _ := strconv.ParseUint(strings.TrimPrefix(key, "uid:"), 10, 32)
+	return q.uids[uint32(uid)]
+}
+
+// check returns errQuota if adding delta to keys goes over a limit. Must be
+// called with q locked.
+func (q *quotaManager) check(keys []string, delta quotaUsage) error {
+	for _, key := range keys {
+		u := q.get(key)
+		l := q.limit(key)
+		if (l.bytes > 0 && delta.bytes > 0 && u.bytes+delta.bytes > l.bytes) ||
+			(l.inodes > 0 && delta.inodes > 0 &&
+				u.inodes+delta.inodes > l.inodes) {
+			glog.V(2).Infof("%s over quota adding %+v to %+v, limit %+v", key,
+				delta, *u, l)
+			return errQuota
+		}
+	}
+	return nil
+}
+
+// charge adds delta to the usage of a file owned by uid at rel. Increases
+// that go over a limit are refused with errQuota, decreases always succeed.
+func (q *quotaManager) charge(uid uint32, rel string, delta quotaUsage) error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	keys := q.keys(uid, rel)
+	if err := q.check(keys, delta); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		q.get(key).add(delta, 1)
+	}
+	q.dirty = true
+	return nil
+}
+
+// record adds delta to the usage of a file owned by uid at rel without
+// checking the limits, the space is already used.
+func (q *quotaManager) record(uid uint32, rel string, delta quotaUsage) {
+	q.Lock()
+	defer q.Unlock()
+	for _, key := range q.keys(uid, rel) {
+		q.get(key).add(delta, 1)
+	}
+	q.dirty = true
+}
+
+// fileOwner returns the owner and usage of filePath, and false if it does
+// not exist.
+func fileOwner(filePath string) (uint32, quotaUsage, bool) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return 0, quotaUsage{}, false
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, quotaUsage{}, false
+	}
+	u := fileUsage(info)
+	if st.Nlink > 1 && !info.IsDir() {
+		// still charged through its other links
+		u = quotaUsage{}
+	}
+	return st.Uid, u, true
+}
+
+// newFileOwner is the uid files created for owner belong to: the caller's if
+// the server may give files away, which takes root, and the server's
+// otherwise. owner may be nil. A server that is not root therefore charges
+// every new file to itself, and only its directory limits and the limit of
+// its own uid mean anything for them.
+func newFileOwner(owner *pb.FileOwner) uint32 {
+	if owner != nil && os.Geteuid() == 0 {
+		return owner.Uid
+	}
+	return uint32(os.Geteuid())
+}
+
+// chownNew gives a file the server just created to the caller that asked for
+// it, as far as newFileOwner charged it.
+func chownNew(filePath string, owner *pb.FileOwner) error {
+	if owner == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	return os.Lchown(filePath, int(owner.Uid), int(owner.Gid))
+}
+
+// lockGrowth serializes the changes of size of a file while quotas are
+// enforced, so that each change is charged from the size the one before it
+// left. Appends and truncations take the same lock whether or not quotas are
+// enforced. The returned func unlocks it.
+func (s *SamFSServer) lockGrowth(key fileKey) func() {
+	if s.quotas == nil {
+		return func() {}
+	}
+	return s.appends.lock(key)
+}
+
+// chargeGrowth charges the owner of filePath for growing it to newSize. The
+// returned function corrects the charge once the file has its final size,
+// and has to be called even if growing it failed. Callers hold the lock of
+// lockGrowth on the file until then.
+func (q *quotaManager) chargeGrowth(filePath string, rel string,
+	newSize int64) (func(), error) {
+
+	if q == nil {
+		return func() {}, nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return func() {}, nil
+	}
+	st, _ := info.Sys().(*syscall.Stat_t)
+	if st == nil {
+		return func() {}, nil
+	}
+
+	growth := newSize - fileBytes(info)
+	if growth < 0 {
+		growth = 0
+	}
+	if err := q.charge(st.Uid, rel, quotaUsage{bytes: growth}); err != nil {
+		return nil, err
+	}
+	return func() {
+		after := fileBytes(info)
+		if fi, err := os.Stat(filePath); err == nil {
+			after = fileBytes(fi)
+		}
+		// the file may also have shrunk or grown other than predicted
+		q.record(st.Uid, rel,
+			quotaUsage{bytes: after - fileBytes(info) - growth})
+	}, nil
+}
+
+// treeUsage returns the usage of filePath and, for directories, everything
+// below it, by owner.
+func (q *quotaManager) treeUsage(rel string) map[uint32]quotaUsage {
+	usage := make(map[uint32]quotaUsage)
+	q.walk(rel, func(uid uint32, _ string, u quotaUsage) {
+		total := usage[uid]
+		total.add(u, 1)
+		usage[uid] = total
+	})
+	return usage
+}
+
+// rename moves the usage of everything at from to to, when they are below
+// different trees. It has to be called before renaming, the returned
+// function undoes it if renaming fails.
+func (q *quotaManager) rename(from string, to string) (func(), error) {
+	if q == nil {
+		return func() {}, nil
+	}
+	q.Lock()
+	differ := false
+	for dir := range q.dirs {
+		if strings.HasPrefix(from, dir+"/") != strings.HasPrefix(to, dir+"/") {
+			differ = true
+		}
+	}
+	q.Unlock()
+	if !differ {
+		return func() {}, nil
+	}
+
+	usage := q.treeUsage(from)
+	q.Lock()
+	defer q.Unlock()
+	for uid, u := range usage {
+		if err := q.check(q.keys(uid, to), u); err != nil {
+			return nil, err
+		}
+	}
+	q.move(usage, from, to)
+	return func() {
+		q.Lock()
+		q.move(usage, to, from)
+		q.Unlock()
+	}, nil
+}
+
+// move moves usage from the keys of from to those of to. Must be called with
+// q locked.
+func (q *quotaManager) move(usage map[uint32]quotaUsage, from string,
+	to string) {
+
+	for uid, u := range usage {
+		for _, key := range q.keys(uid, from) {
+			q.get(key).add(u, -1)
+		}
+		for _, key := range q.keys(uid, to) {
+			q.get(key).add(u, 1)
+		}
+	}
+	q.dirty = true
+}
+
+func (q *quotaManager) flush() error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	return q.flushLocked(false)
+}
+
+// begin is called when the server starts serving. Usage left behind by a
+// server that did not stop cleanly is rebuilt by scanning the export, unless
+// resumed is set: the server takes over from the one it upgrades, which
+// persisted its usage on the way out. Until close, the database is marked
+// as not to be trusted.
+func (q *quotaManager) begin(resumed bool) error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	if !resumed && !q.scanned && q.db.Lookup(quotaScannedKey) != 1 {
+		glog.Warningf("quota usage in %s is not up to date", q.db.filePath)
+		if err := q.scan(); err != nil {
+			return err
+		}
+	}
+	q.db.Set(quotaScannedKey, 0)
+	return q.db.Flush()
+}
+
+// close persists usage and marks it as up to date.
+func (q *quotaManager) close() error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.dirty = true
+	return q.flushLocked(true)
+}
+
+func (q *quotaManager) flushLocked(clean bool) error {
+	if !q.dirty {
+		return nil
+	}
+	for key, u := range q.usage {
+		q.db.Set(key+":bytes", u.bytes)
+		q.db.Set(key+":inodes", u.inodes)
+	}
+	if clean {
+		q.db.Set(quotaScannedKey, 1)
+	}
+	if err := q.db.Flush(); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *quotaManager) report(key string) *pb.QuotaUsage {
+	u := q.get(key)
+	l := q.limit(key)
+	kind := key[:strings.Index(key, ":")]
+	return &pb.QuotaUsage{
+		Kind:        kind,
+		Target:      strings.TrimPrefix(key, kind+":"),
+		BytesUsed:   u.bytes,
+		BytesLimit:  l.bytes,
+		InodesUsed:  u.inodes,
+		InodesLimit: l.inodes,
+	}
+}
+
+// applying returns the keys whose limits apply to new files at rel.
+func (q *quotaManager) applying(rel string, uid int64) []string {
+	var keys []string
+	if uid >= 0 {
+		keys = append(keys, uidKey(uint32(uid)))
+	}
+	for dir := range q.dirs {
+		if dir == "/" || rel == dir || strings.HasPrefix(rel, dir+"/") {
+			keys = append(keys, dirKey(dir))
+		}
+	}
+	return keys
+}
+
+func (s *SamFSServer) GetQuota(ctx context.Context,
+	req *pb.GetQuotaRequest) (*pb.GetQuotaReply, error) {
+	glog.V(3).Infof(`received GetQuota request for "%s" uid %d`, req.Path,
+		req.Uid)
+
+	q := s.quotas
+	if q == nil {
+		return &pb.GetQuotaReply{}, nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	var keys []string
+	if req.All {
+		for key := range q.usage {
+			keys = append(keys, key)
+		}
+	} else {
+		keys = q.applying(path.Clean("/"+req.Path), req.Uid)
+	}
+	sort.Strings(keys)
+
+	resp := &pb.GetQuotaReply{}
+	for _, key := range keys {
+		resp.Quotas = append(resp.Quotas, q.report(key))
+	}
+	return resp, nil
+}
+
+func (s *SamFSServer) StatFs(ctx context.Context,
+	req *pb.StatFsRequest) (*pb.StatFsReply, error) {
+	glog.V(3).Infof(`received StatFs request for "%s"`, req.Path)
+
+	resp, err := statFs(s.rootDirectory)
+	if err != nil {
+		glog.Errorf("failed to statfs %s :: %v", s.rootDirectory, err)
+		return nil, err
+	}
+
+	q := s.quotas
+	if q == nil {
+		return resp, nil
+	}
+	q.Lock()
+	defer q.Unlock()
+
+	// the tightest limit on new files is what the caller can use
+	bsize := uint64(resp.Bsize)
+	for _, key := range q.applying(path.Clean("/"+req.Path),
+		int64(newFileOwner(nil))) {
+		u := q.get(key)
+		l := q.limit(key)
+		if l.bytes > 0 {
+			blocks := uint64(l.bytes) / bsize
+			free := uint64(0)
+			if u.bytes < l.bytes {
+				free = uint64(l.bytes-u.bytes) / bsize
+			}
+			resp.Blocks = minUint64(resp.Blocks, blocks)
+			resp.Bfree = minUint64(resp.Bfree, free)
+			resp.Bavail = minUint64(resp.Bavail, free)
+		}
+		if l.inodes > 0 {
+			free := uint64(0)
+			if u.inodes < l.inodes {
+				free = uint64(l.inodes - u.inodes)
+			}
+			resp.Files = minUint64(resp.Files, uint64(l.inodes))
+			resp.Ffree = minUint64(resp.Ffree, free)
+		}
+	}
+	return resp, nil
+}
+
+func minUint64(a uint64, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// setLimits replaces the limits, rescanning the export if a directory tree
+// got a quota its usage is not known for.
+func (q *quotaManager) setLimits(uids map[uint32]quotaLimit,
+	dirs map[string]quotaLimit) error {
+	warnUidLimits(uids)
+	q.Lock()
+	defer q.Unlock()
+	rescan := false
+	for dir := range dirs {
+		if _, ok := q.usage[dirKey(dir)]; !ok {
+			rescan = true
+		}
+	}
+	q.uids = uids
+	q.dirs = dirs
+	if !rescan {
+		return nil
+	}
+	return q.scan()
+}
+
+// warnUidLimits warns about the limits of uids other than the server's when
+// it is not root: files it creates are never charged to them.
+func warnUidLimits(uids map[uint32]quotaLimit) {
+	euid := uint32(os.Geteuid())
+	if euid == 0 {
+		return
+	}
+	for uid := range uids {
+		if uid != euid {
+			glog.Warningf("server is not root, new files are charged to uid "+
+				"%d and not to uid %d", euid, uid)
+		}
+	}
+}
+
+// SetQuotas enforces the limits in quotaFile, keeping usage in dbFile. It has
+// to be called before Run.
+func (s *SamFSServer) SetQuotas(quotaFile string, dbFile string) error {
+	q, err := newQuotaManager(s.rootDirectory, quotaFile, dbFile)
+	if err != nil {
+		return err
+	}
+	s.quotas = q
+	return nil
+}
@@ -0,0 +1,339 @@
+package samfs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+var errThrottled = grpc.Errorf(codes.ResourceExhausted,
+	"request throttled, retry later")
+
+func isThrottledError(err error) bool {
+	return grpc.Code(err) == codes.ResourceExhausted &&
+		grpc.ErrorDesc(err) == grpc.ErrorDesc(errThrottled)
+}
+
+// why a request was throttled, for the metrics
+const (
+	throttledClientOps = iota
+	throttledClientBytes
+	throttledExportOps
+	throttledExportBytes
+	throttledQueueFull
+	throttleReasons
+)
+
+var throttleReasonNames = [throttleReasons]string{
+	"client_ops", "client_bytes", "export_ops", "export_bytes", "queue_full",
+}
+
+// rateLimits are per second, 0 means unlimited.
+type rateLimits struct {
+	ops   float64
+	bytes int64
+}
+
+// schedulerLimits configure a scheduler, 0 means unlimited.
+type schedulerLimits struct {
+	client rateLimits
+	export rateLimits
+	// requests handled at once
+	workers int
+	// requests of a client waiting for a worker
+	maxQueued int
+}
+
+// tokenBucket lets through rate units a second, with bursts of up to a
+// second's worth. Requests larger than that are let through once the bucket
+// is full and leave it in debt, so that they are delayed rather than refused
+// forever.
+type tokenBucket struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	return &tokenBucket{rate: rate, tokens: rate, last: now}
+}
+
+// ready returns whether n units can be taken.
+func (b *tokenBucket) ready(now time.Time, n float64) bool {
+	if b == nil {
+		return true
+	}
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+	if n > b.rate {
+		n = b.rate
+	}
+	return b.tokens >= n
+}
+
+func (b *tokenBucket) take(n float64) {
+	if b != nil {
+		b.tokens -= n
+	}
+}
+
+// waiter is a request waiting for a worker.
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// clientQueue holds the rate limits and the requests waiting for a worker of
+// one client.
+type clientQueue struct {
+	ops      *tokenBucket
+	bytes    *tokenBucket
+	metadata []*waiter
+	bulk     []*waiter
+	lastSeen time.Time
+}
+
+func (q *clientQueue) queued() int {
+	return len(q.metadata) + len(q.bulk)
+}
+
+// scheduler limits the requests of every client and of the export as a
+// whole, and hands out a bounded number of workers, taking turns between
+// clients and serving metadata requests before bulk I/O.
+type scheduler struct {
+	sync.Mutex
+	limits  schedulerLimits
+	ops     *tokenBucket
+	bytes   *tokenBucket
+	clients map[string]*clientQueue
+	// clients with waiting requests, in the order they take turns
+	waiting []*clientQueue
+	next    int
+	busy    int
+
+	metrics *metrics
+}
+
+func newScheduler(m *metrics) *scheduler {
+	return &scheduler{
+		clients: make(map[string]*clientQueue),
+		metrics: m,
+	}
+}
+
+// setLimits applies new limits, rate limits start out full.
+func (s *scheduler) setLimits(limits schedulerLimits) {
+	now := time.Now()
+	s.Lock()
+	defer s.Unlock()
+	s.limits = limits
+	s.ops = newTokenBucket(limits.export.ops, now)
+	s.bytes = newTokenBucket(float64(limits.export.bytes), now)
+	for _, q := range s.clients {
+		q.ops = newTokenBucket(limits.client.ops, now)
+		q.bytes = newTokenBucket(float64(limits.client.bytes), now)
+	}
+	s.dispatch()
+}
+
+// requestCost returns whether req is bulk I/O, and how many bytes it moves.
+func requestCost(req interface{}) (bool, int64) {
+	switch req := req.(type) {
+	case *pb.ReadRequest:
+		return true, req.Size
+	case *pb.WriteRequest:
+		return true, req.Size
+	case *pb.CopyRangeRequest:
+		return true, req.Length
+	case *pb.AllocateRequest:
+		return true, 0
+	}
+	return false, 0
+}
+
+func (s *scheduler) throttle(reason int) error {
+	atomic.AddUint64(&s.metrics.throttled[reason], 1)
+	return errThrottled
+}
+
+// admit waits for a worker to handle req of the client at address, or
+// refuses it if the client or the export is over its rate limits. The
+// returned func must be called once the request is handled.
+func (s *scheduler) admit(ctx context.Context, address string,
+	req interface{}) (func(), error) {
+
+	bulk, bytes := requestCost(req)
+	now := time.Now()
+	s.Lock()
+	q, ok := s.clients[address]
+	if !ok {
+		q = &clientQueue{
+			ops:   newTokenBucket(s.limits.client.ops, now),
+			bytes: newTokenBucket(float64(s.limits.client.bytes), now),
+		}
+		s.clients[address] = q
+	}
+	q.lastSeen = now
+
+	reason := -1
+	switch {
+	case !q.ops.ready(now, 1):
+		reason = throttledClientOps
+	case !q.bytes.ready(now, float64(bytes)):
+		reason = throttledClientBytes
+	case !s.ops.ready(now, 1):
+		reason = throttledExportOps
+	case !s.bytes.ready(now, float64(bytes)):
+		reason = throttledExportBytes
+	case s.limits.maxQueued > 0 && q.queued() >= s.limits.maxQueued:
+		reason = throttledQueueFull
+	}
+	if reason >= 0 {
+		s.Unlock()
+		return nil, s.throttle(reason)
+	}
+	q.ops.take(1)
+	q.bytes.take(float64(bytes))
+	s.ops.take(1)
+	s.bytes.take(float64(bytes))
+
+	if s.limits.workers == 0 || (s.busy < s.limits.workers &&
+		len(s.waiting) == 0) {
+		s.addBusy(1)
+		s.Unlock()
+		return s.release, nil
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	if q.queued() == 0 {
+		s.waiting = append(s.waiting, q)
+	}
+	if bulk {
+		q.bulk = append(q.bulk, w)
+	} else {
+		q.metadata = append(q.metadata, w)
+	}
+	atomic.AddInt64(&s.metrics.queued, 1)
+	s.Unlock()
+
+	select {
+	case <-w.ready:
+	case <-ctx.Done():
+		s.Lock()
+		if !w.granted {
+			s.cancel(q, w)
+			s.Unlock()
+			return nil, ctx.Err()
+		}
+		s.Unlock()
+	}
+	atomic.AddUint64(&s.metrics.queueWaitNanos, uint64(time.Since(now)))
+	return s.release, nil
+}
+
+// addBusy must be called with s locked.
+func (s *scheduler) addBusy(delta int) {
+	s.busy += delta
+	atomic.StoreInt64(&s.metrics.busyWorkers, int64(s.busy))
+}
+
+func (s *scheduler) release() {
+	s.Lock()
+	defer s.Unlock()
+	s.addBusy(-1)
+	s.dispatch()
+}
+
+// dispatch hands free workers to waiting requests. Must be called with s
+// locked.
+func (s *scheduler) dispatch() {
+	for len(s.waiting) > 0 && (s.limits.workers == 0 ||
+		s.busy < s.limits.workers) {
+		w := s.nextWaiter()
+		w.granted = true
+		close(w.ready)
+		s.addBusy(1)
+		atomic.AddInt64(&s.metrics.queued, -1)
+	}
+}
+
+// nextWaiter takes the next request to handle: the first metadata request
+// of the next client that has one, or else its first bulk request. Must be
+// called with s locked and clients waiting.
+func (s *scheduler) nextWaiter() *waiter {
+	for _, bulk := range []bool{false, true} {
+		for i := range s.waiting {
+			k := (s.next + i) % len(s.waiting)
+			q := s.waiting[k]
+			queue := &q.metadata
+			if bulk {
+				queue = &q.bulk
+			}
+			if len(*queue) == 0 {
+				continue
+			}
+			w := (*queue)[0]
+			*queue = (*queue)[1:]
+			s.next = k + 1
+			if q.queued() == 0 {
+				s.removeWaiting(k)
+			}
+			if s.next >= len(s.waiting) {
+				s.next = 0
+			}
+			return w
+		}
+	}
+	return nil
+}
+
+func (s *scheduler) removeWaiting(k int) {
+	s.waiting = append(s.waiting[:k], s.waiting[k+1:]...)
+	if s.next > k {
+		s.next--
+	}
+}
+
+// cancel forgets w, whose request gave up waiting. Must be called with s
+// locked.
+func (s *scheduler) cancel(q *clientQueue, w *waiter) {
+	for _, queue := range []*[]*waiter{&q.metadata, &q.bulk} {
+		for i, other := range *queue {
+			if other == w {
+				*queue = append((*queue)[:i], (*queue)[i+1:]...)
+				break
+			}
+		}
+	}
+	if q.queued() == 0 {
+		for k, other := range s.waiting {
+			if other == q {
+				s.removeWaiting(k)
+				break
+			}
+		}
+	}
+	atomic.AddInt64(&s.metrics.queued, -1)
+}
+
+// expire forgets clients that have been idle since before idle.
+func (s *scheduler) expire(idle time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	for address, q := range s.clients {
+		if q.queued() == 0 && q.lastSeen.Before(idle) {
+			delete(s.clients, address)
+		}
+	}
+}
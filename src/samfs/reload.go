@@ -0,0 +1,384 @@
+package samfs
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// how long clients of an export removed by a reload get to finish their
+// requests
+const removedExportDrainTimeout = time.Minute
+
+// ServerGroup runs a server for every export in a config, and applies
+// changes to the config while they run.
+type ServerGroup struct {
+	// returns the config to run, read again on every reload
+	load func() (*Config, error)
+	wg   sync.WaitGroup
+
+	sync.Mutex
+	// by listen address, which identifies an export across reloads
+	exports map[string]*groupExport
+}
+
+type groupExport struct {
+	config ExportConfig
+	server *SamFSServer
+}
+
+func NewServerGroup(load func() (*Config, error)) *ServerGroup {
+	return &ServerGroup{
+		load:    load,
+		exports: make(map[string]*groupExport),
+	}
+}
+
+// start creates a server for the export and listens on its address, or
+// takes lis over if it is not nil, without serving yet.
+func (g *ServerGroup) start(e *ExportConfig,
+	lis net.Listener) (*SamFSServer, error) {
+	s, err := e.NewServer()
+	if err != nil {
+		return nil, err
+	}
+	if lis == nil {
+		lis, err = net.Listen("tcp", e.Listen)
+	}
+	if err != nil {
+		s.discard()
+		return nil, err
+	}
+	s.listener = lis
+	s.reload = g.Reload
+	return s, nil
+}
+
+func (g *ServerGroup) run(s *SamFSServer) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		s.Run()
+		// waits for a Stop that made Run return to finish
+		s.Stop()
+	}()
+}
+
+// Start serves every export of the config, or none of them if one cannot
+// be served. When the process was started by an Upgrade, the exports take
+// over the listeners and sessions of the server being upgraded.
+func (g *ServerGroup) Start() error {
+	g.Lock()
+	defer g.Unlock()
+	inherited, err := inheritedListeners()
+	if err != nil {
+		return err
+	}
+	cfg, err := g.load()
+	if err != nil {
+		return err
+	}
+	var started []*groupExport
+	for i := range cfg.Exports {
+		e := &cfg.Exports[i]
+		s, err := g.start(e, inherited[e.Listen])
+		delete(inherited, e.Listen)
+		if err != nil {
+			for _, export := range started {
+				export.server.discard()
+			}
+			return fmt.Errorf("exports[%d]: %v", i, err)
+		}
+		started = append(started, &groupExport{*e, s})
+	}
+	for listen, lis := range inherited {
+		glog.Infof("export on %s is no longer in the config", listen)
+		lis.Close()
+	}
+	if inherited != nil {
+		g.takeOver(started)
+	}
+	for _, export := range started {
+		g.exports[export.config.Listen] = export
+		g.run(export.server)
+	}
+	return nil
+}
+
+// Wait returns once every server has stopped.
+func (g *ServerGroup) Wait() {
+	g.wg.Wait()
+}
+
+// Reload reads the config again and applies it: new exports are served,
+// removed ones drained and the others changed in place, keeping their
+// clients, sessions and file handles. Nothing changes if the config is
+// invalid or any part of it cannot be applied.
+func (g *ServerGroup) Reload() error {
+	g.Lock()
+	defer g.Unlock()
+	cfg, err := g.load()
+	if err != nil {
+		glog.Errorf("config not reloaded :: %v", err)
+		return err
+	}
+
+	var plans []*reloadPlan
+	var added []*groupExport
+	abort := func(err error) error {
+		for _, p := range plans {
+			p.rollback()
+		}
+		for _, export := range added {
+			export.server.discard()
+		}
+		glog.Errorf("config not reloaded :: %v", err)
+		return err
+	}
+	kept := make(map[string]bool)
+	for i := range cfg.Exports {
+		e := &cfg.Exports[i]
+		where := fmt.Sprintf("exports[%d]", i)
+		if export, ok := g.exports[e.Listen]; ok {
+			kept[e.Listen] = true
+			p, err := export.server.prepareReload(&export.config, e, where)
+			if err != nil {
+				return abort(err)
+			}
+			plans = append(plans, p)
+			continue
+		}
+		s, err := g.start(e, nil)
+		if err != nil {
+			return abort(fmt.Errorf("%s: %v", where, err))
+		}
+		added = append(added, &groupExport{*e, s})
+	}
+
+	for _, p := range plans {
+		p.commit()
+	}
+	for _, e := range cfg.Exports {
+		if export, ok := g.exports[e.Listen]; ok {
+			export.config = e
+		}
+	}
+	for listen, export := range g.exports {
+		if kept[listen] {
+			continue
+		}
+		glog.Infof("export %s on %s removed from the config, draining it",
+			export.config.Root, listen)
+		delete(g.exports, listen)
+		go export.server.drain(context.Background(), removedExportDrainTimeout)
+	}
+	for _, export := range added {
+		glog.Infof("export %s added on %s", export.config.Root,
+			export.config.Listen)
+		g.exports[export.config.Listen] = export
+		g.run(export.server)
+	}
+	glog.Infof("config reloaded")
+	return nil
+}
+
+// reloadPlan holds what a reload changes on a server, prepared in full
+// before anything is changed.
+type reloadPlan struct {
+	commits   []func()
+	rollbacks []func()
+}
+
+func (p *reloadPlan) commit() {
+	for _, commit := range p.commits {
+		commit()
+	}
+}
+
+func (p *reloadPlan) rollback() {
+	for _, rollback := range p.rollbacks {
+		rollback()
+	}
+}
+
+// restartRequired returns the first setting that differs between old and e
+// and cannot be changed on a running server.
+func restartRequired(old *ExportConfig, e *ExportConfig) string {
+	switch {
+	case old.Root != e.Root:
+		return "root"
+	case old.FlushInterval != e.FlushInterval:
+		return "flushInterval"
+	case (old.TLS.Cert == "") != (e.TLS.Cert == ""):
+		return "tls.cert"
+	case old.quotaDB() != e.quotaDB():
+		return "quotas"
+	case (old.AuditLog.File == "") != (e.AuditLog.File == ""):
+		return "auditLog.file"
+	case old.Limits.MaxConcurrentStreams != e.Limits.MaxConcurrentStreams:
+		return "limits.maxConcurrentStreams"
+	case old.Limits.MaxMessageSize != e.Limits.MaxMessageSize:
+		return "limits.maxMessageSize"
+	}
+	return ""
+}
+
+// prepareReload loads everything the server needs to go from old to e, and
+// returns how to switch to it.
+func (s *SamFSServer) prepareReload(old *ExportConfig, e *ExportConfig,
+	where string) (*reloadPlan, error) {
+	if setting := restartRequired(old, e); setting != "" {
+		return nil, fmt.Errorf("%s.%s: cannot change without restarting "+
+			"samfs-server", where, setting)
+	}
+
+	p := &reloadPlan{}
+	fail := func(setting string, err error) (*reloadPlan, error) {
+		p.rollback()
+		return nil, fmt.Errorf("%s.%s: %v", where, setting, err)
+	}
+
+	if e.TLS.Cert != "" {
+		creds, err := (&TLSOptions{
+			CertFile: e.TLS.Cert,
+			KeyFile:  e.TLS.Key,
+			CAFile:   e.TLS.ClientCA,
+		}).serverCredentials()
+		if err != nil {
+			return fail("tls", err)
+		}
+		subjects := subjectSet(e.TLS.AllowedSubjects)
+		p.commits = append(p.commits, func() {
+			s.creds.set(creds)
+			s.settingsLock.Lock()
+			s.allowedSubjects = subjects
+			s.settingsLock.Unlock()
+		})
+	}
+
+	var secret []byte
+	var policy map[string]access
+	var owners map[string]*pb.FileOwner
+	if e.Auth.SecretFile != "" {
+		var err error
+		if secret, err = LoadSecret(e.Auth.SecretFile); err != nil {
+			return fail("auth.secretFile", err)
+		}
+		policy, owners, err = loadPolicy(e.Auth.PolicyFile)
+		if err != nil {
+			return fail("auth.policyFile", err)
+		}
+	}
+	p.commits = append(p.commits, func() {
+		s.setAuth(secret, policy, owners)
+	})
+
+	if e.Quotas.File != "" {
+		uids, dirs, err := loadQuotas(e.Quotas.File)
+		if err != nil {
+			return fail("quotas.file", err)
+		}
+		p.commits = append(p.commits, func() {
+			if err := s.quotas.setLimits(uids, dirs); err != nil {
+				glog.Errorf("failed to rescan quota usage :: %v", err)
+			}
+		})
+	}
+
+	if e.AuditLog != old.AuditLog && e.AuditLog.File != "" {
+		settings := &auditSettings{
+			file:     e.AuditLog.File,
+			maxSize:  e.AuditLog.MaxSize,
+			maxFiles: e.AuditLog.MaxFiles,
+		}
+		if e.AuditLog.File != old.AuditLog.File {
+			fd, size, err := openAuditFile(e.AuditLog.File, os.O_APPEND)
+			if err != nil {
+				return fail("auditLog.file", err)
+			}
+			settings.fd = fd
+			settings.size = size
+			p.rollbacks = append(p.rollbacks, func() { fd.Close() })
+		}
+		p.commits = append(p.commits, func() { s.audit.update(settings) })
+	}
+
+	if e.Metrics.Listen != old.Metrics.Listen {
+		var lis net.Listener
+		if e.Metrics.Listen != "" {
+			var err error
+			if lis, err = net.Listen("tcp", e.Metrics.Listen); err != nil {
+				return fail("metrics.listen", err)
+			}
+			p.rollbacks = append(p.rollbacks, func() { lis.Close() })
+		}
+		p.commits = append(p.commits, func() { s.setMetricsListener(lis) })
+	}
+
+	p.commits = append(p.commits, func() {
+		s.SetCompression(e.Compression)
+		s.settingsLock.Lock()
+		s.createMode = os.FileMode(e.CreateMode)
+		s.settingsLock.Unlock()
+		// an admin may have changed it since, only a change in the config
+		// overrides that
+		if e.ReadOnly != old.ReadOnly {
+			var readOnly int32
+			if e.ReadOnly {
+				readOnly = 1
+			}
+			atomic.StoreInt32(&s.readOnly, readOnly)
+		}
+		s.locks.Lock()
+		s.locks.gracePeriod = time.Duration(e.Limits.LockGracePeriod)
+		s.locks.Unlock()
+		s.delegations.Lock()
+		s.delegations.recallTimeout = time.Duration(e.Limits.RecallTimeout)
+		s.delegations.Unlock()
+		s.SetSlowRequestThreshold(time.Duration(
+			e.Metrics.SlowRequestThreshold))
+		s.scheduler.setLimits(e.schedulerLimits())
+		s.fds.setCapacity(e.Limits.FdCacheSize)
+	})
+	return p, nil
+}
+
+// discard releases what a server that never ran holds.
+func (s *SamFSServer) discard() {
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.setMetricsListener(nil)
+	s.audit.Close()
+	if err := s.quotas.flush(); err != nil {
+		glog.Errorf("failed to persist quota usage :: %v", err)
+	}
+}
+
+// Reload re-reads the config of the server group the server belongs to and
+// applies it.
+func (s *SamFSServer) Reload(ctx context.Context,
+	req *pb.ReloadRequest) (*pb.StatusReply, error) {
+	if s.reload == nil {
+		return nil, grpc.Errorf(codes.FailedPrecondition,
+			"server was not started from a config file")
+	}
+	glog.Infof("reloading config for %s", identityFromContext(ctx))
+	if err := s.reload(); err != nil {
+		return nil, grpc.Errorf(codes.InvalidArgument, "%v", err)
+	}
+
+	return &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+	}, nil
+}
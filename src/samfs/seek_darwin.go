@@ -0,0 +1,9 @@
+// +build darwin
+
+package samfs
+
+// lseek(2) whence values, not in the syscall package
+const (
+	seekData = 4
+	seekHole = 3
+)
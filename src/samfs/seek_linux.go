@@ -0,0 +1,9 @@
+// +build linux
+
+package samfs
+
+// lseek(2) whence values, not in the syscall package
+const (
+	seekData = 3
+	seekHole = 4
+)
@@ -8,6 +8,8 @@ import (
 	"net"
 	"os"
 	"path"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -22,38 +24,92 @@ const (
 	defaultPermission os.FileMode = 0766
 )
 
-type serverInfo struct {
-	commitCount  uint64
-	createCount  uint64
-	lookupCount  uint64
-	mkdirCount   uint64
-	mountCount   uint64
-	readCount    uint64
-	readDirCount uint64
-	removeCount  uint64
-	renameCount  uint64
-	writeCount   uint64
-	getAttrCount uint64
-	rmDirCount   uint64
-}
-
 type SamFSServer struct {
 	rootDirectory  string
 	rootFileHandle *pb.FileHandle
 
-	port       string
+	listenAddress string
+	//opened before Run when the server is started by a ServerGroup
+	listener   net.Listener
 	grpcServer *grpc.Server
+	//set from the limits in the config
+	grpcOptions []grpc.ServerOption
 
 	//sessionID is randomly generated every time server starts;
 	//it is used to detect server crashes
 	sessionID int64
 
-	info *serverInfo
-	tick *time.Ticker
+	locks       *lockManager
+	delegations *delegationManager
+	watches     *watchHub
+	fsWatcher   *fsWatcher
+
+	//guards the settings below, which a reload may change
+	settingsLock sync.RWMutex
+	//whether clients may compress read and write data
+	compression bool
+	//permissions of the files and directories clients create
+	createMode os.FileMode
+
+	//transport security, nil for plaintext connections
+	creds *reloadableCreds
+	//common names of client certificates allowed to use the export
+	allowedSubjects map[string]bool
+
+	//tokens are not required if authSecret is nil
+	authSecret []byte
+	authPolicy map[string]access
+	//who the files each identity creates belong to
+	authOwners map[string]*pb.FileOwner
+
+	//nil if no quotas are enforced
+	quotas *quotaManager
+	//nil if changes are not audited
+	audit *auditLog
+	//files with writes not yet synced to disk, synced on Stop
+	dirty *dirtyFiles
+	//files kept open for the requests on them
+	fds *fdCache
+	//syncs files and directories for concurrent requests at once
+	commits *committer
+	appends *appendLocks
+
+	//clients using the export, for the Admin service
+	clients *clientRegistry
+	//rate limits and fair queueing of client requests
+	scheduler *scheduler
+	//set by the Admin service, accessed atomically
+	readOnly int32
+	draining int32
+	started  time.Time
+	stopOnce sync.Once
+	//reloads the config of the ServerGroup running the server, nil if it
+	//was not started from a config
+	reload func() error
+
+	metrics *metrics
+	//serves metrics over http, nil if they are not served; guarded by
+	//settingsLock
+	metricsListener net.Listener
+	slowLog         *slowLog
+	//how often quota usage is persisted and idle clients forgotten
+	flushInterval time.Duration
+	tick          *time.Ticker
 }
 
 var _ pb.NFSServer = &SamFSServer{}
 
+//fileKey identifies a file independent of its path, so that per file state
+//follows the file across renames
+type fileKey struct {
+	inodeNumber      uint64
+	generationNumber uint32
+}
+
+func handleKey(fileHandle *pb.FileHandle) fileKey {
+	return fileKey{fileHandle.InodeNumber, fileHandle.GenerationNumber}
+}
+
 func NewServer(rootDirectory string, port string) (*SamFSServer, error) {
 	inum, gnum, err := GetInodeAndGenerationNumbers(rootDirectory)
 	if err != nil {
@@ -71,50 +127,136 @@ func NewServer(rootDirectory string, port string) (*SamFSServer, error) {
 	s := &SamFSServer{
 		rootDirectory:  rootDirectory,
 		rootFileHandle: rootFileHandle,
-		// TODO(mihir): make port number configurable
-		port: ":" + port,
-		tick: time.NewTicker(10 * time.Second),
-		info: &serverInfo{},
-	}
-	go func() {
-		for _ = range s.tick.C {
-			glog.Infof("%+v", s.info)
-		}
-	}()
+		//other addresses can be set through ExportConfig
+		listenAddress: ":" + port,
+		flushInterval: defaultFlushInterval,
+		metrics:       newMetrics(),
+		clients:       newClientRegistry(),
+		dirty:         newDirtyFiles(),
+		slowLog:       newSlowLog("server"),
+		locks:         newLockManager(),
+		delegations:   newDelegationManager(),
+		watches:       newWatchHub(),
+		compression:   true,
+		createMode:    defaultPermission,
+	}
+
+	s.scheduler = newScheduler(s.metrics)
+	s.fds = newFdCache(defaultFdCacheSize, s.metrics)
+	s.commits = newCommitter(s.metrics)
+	s.appends = newAppendLocks()
 
 	return s, nil
 }
 
 //TODO (arman): run() and stop() where stop closes database
 func (s *SamFSServer) Run() error {
-	lis, err := net.Listen("tcp", s.port)
-	if err != nil {
-		glog.Fatalf("falied to listen on port :: %s(err=%s)", s.port, err.Error())
-		return err
+	lis := s.listener
+	if lis == nil {
+		var err error
+		lis, err = net.Listen("tcp", s.listenAddress)
+		if err != nil {
+			glog.Fatalf("falied to listen on port :: %s(err=%s)", s.listenAddress,
+				err.Error())
+			return err
+		}
 	}
 
 	rand.Seed(time.Now().UnixNano())
-	s.sessionID = rand.Int63()
-	glog.Infof("starting new server with sessionID %d", s.sessionID)
+	//quota usage left behind by a crash is rebuilt, a server that was
+	//upgraded persisted its usage before handing over
+	if err := s.quotas.begin(s.sessionID != 0); err != nil {
+		glog.Errorf("failed to rebuild quota usage :: %v", err)
+	}
+	//a server taking over from the one it upgrades keeps its session, so
+	//that clients see no restart
+	if s.sessionID == 0 {
+		s.sessionID = rand.Int63()
+		s.started = time.Now()
+		glog.Infof("starting new server with sessionID %d", s.sessionID)
+		s.locks.startGrace()
+	} else {
+		glog.Infof("resuming sessionID %d of the upgraded server", s.sessionID)
+	}
+
+	w, err := newFsWatcher(s.rootDirectory, s.watches)
+	if err != nil {
+		glog.Warningf("not watching %s for local changes :: %v", s.rootDirectory,
+			err)
+	}
+	s.fsWatcher = w
+
+	s.tick = time.NewTicker(s.flushInterval)
+	go func() {
+		for now := range s.tick.C {
+			s.expireLockLeases(now)
+			s.clients.expire(now.Add(-clientIdleExpiry))
+			s.scheduler.expire(now.Add(-clientIdleExpiry))
+			s.fds.expire(now.Add(-fdIdleExpiry))
+			if err := s.quotas.flush(); err != nil {
+				glog.Errorf("failed to persist quota usage :: %v", err)
+			}
+		}
+	}()
 
-	gs := grpc.NewServer()
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(s.unaryInterceptor),
+		grpc.StreamInterceptor(s.streamInterceptor),
+	}
+	opts = append(opts, s.grpcOptions...)
+	if s.creds != nil {
+		opts = append(opts, grpc.Creds(s.creds))
+	} else {
+		glog.Warning("serving without tls, data travels in plaintext")
+	}
+	gs := grpc.NewServer(opts...)
 	pb.RegisterNFSServer(gs, s)
+	pb.RegisterAdminServer(gs, s)
+	pb.RegisterHealthServer(gs, s)
 	s.grpcServer = gs
-	return gs.Serve(lis)
+	return gs.Serve(keepAlive(lis))
 }
 
+//Stop may be called more than once, e.g. by a drain and by the owner
 func (s *SamFSServer) Stop() error {
-	s.grpcServer.GracefulStop()
-	s.tick.Stop()
+	s.stopOnce.Do(func() {
+		//waits for the requests in flight, clients get a GOAWAY and reconnect
+		if s.grpcServer != nil {
+			s.grpcServer.GracefulStop()
+		}
+		if s.tick != nil {
+			s.tick.Stop()
+		}
+		if failed := s.dirty.sync(s.rootDirectory); failed > 0 {
+			glog.Errorf("%d files could not be synced, clients replay their "+
+				"writes", failed)
+		}
+		s.fds.close()
+		if err := s.quotas.close(); err != nil {
+			glog.Errorf("failed to persist quota usage :: %v", err)
+		}
+		if s.fsWatcher != nil {
+			s.fsWatcher.Close()
+		}
+		s.audit.Close()
+		s.setMetricsListener(nil)
+	})
 	return nil
 }
 
+func (s *SamFSServer) fileMode() os.FileMode {
+	s.settingsLock.RLock()
+	defer s.settingsLock.RUnlock()
+	return s.createMode
+}
+
 func (s *SamFSServer) Mount(ctx context.Context,
 	req *pb.MountRequest) (*pb.FileHandleReply, error) {
 	glog.V(3).Info("recevied mount request")
 
 	resp := &pb.FileHandleReply{
-		FileHandle: s.rootFileHandle,
+		FileHandle:  s.rootFileHandle,
+		Compression: s.negotiateCompression(req.Compression),
 	}
 
 	return resp, nil
@@ -123,7 +265,6 @@ func (s *SamFSServer) Mount(ctx context.Context,
 func (s *SamFSServer) Lookup(ctx context.Context,
 	req *pb.LocalDirectoryRequest) (*pb.FileHandleReply, error) {
 	glog.V(3).Infof(`received lookup request for "%s"`, req.Name)
-	s.info.lookupCount++
 
 	//validate incoming directory file handle
 	err := s.verifyFileHandle(req.DirectoryFileHandle)
@@ -135,7 +276,9 @@ func (s *SamFSServer) Lookup(ctx context.Context,
 	//get info about file being looked up
 	directoryPath := path.Join(s.rootDirectory, req.DirectoryFileHandle.Path)
 	filePath := path.Join(directoryPath, req.Name)
+	span := traceStart(ctx, "stat")
 	inum, gnum, err := GetInodeAndGenerationNumbers(filePath)
+	span(err)
 	if err != nil {
 		glog.V(3).Infof("failed to get inode and generation number for %s :: %v\n",
 			filePath, err)
@@ -159,34 +302,22 @@ func (s *SamFSServer) Lookup(ctx context.Context,
 func (s *SamFSServer) GetAttr(ctx context.Context,
 	req *pb.FileHandleRequest) (*pb.GetAttrReply, error) {
 	glog.V(3).Infof(`received GetAttr request for "%s"`, req.FileHandle.Path)
-	s.info.getAttrCount++
 
-	//validate incoming file handle
-	err := s.verifyFileHandle(req.FileHandle)
+	//validate incoming file handle and get the open file
+	fd, err := s.openHandle(ctx, req.FileHandle, false)
 	if err != nil {
-		glog.Errorf(err.Error())
 		return nil, err
 	}
+	defer s.fds.release(fd)
 
-	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
-	fd, oErr := syscall.Open(filePath, syscall.O_RDONLY, 0)
-	defer func() {
-		e := syscall.Close(fd)
-		if e != nil {
-			glog.Errorf("unable to close file %s :: %s", filePath,
-				e.Error())
-		}
-	}()
-
-	if oErr != nil {
-		glog.Errorf("could not get open file %s :: %v", filePath, oErr)
-		return nil, oErr
-	}
 	var stat syscall.Stat_t
-	fsErr := syscall.Fstat(fd, &stat)
+	span := traceStart(ctx, "fstat")
+	fsErr := syscall.Fstat(int(fd.Fd()), &stat)
+	span(fsErr)
 	if fsErr != nil {
-		glog.Errorf("could not get stat on file %s :: %v", filePath, fsErr)
-		return nil, err
+		glog.Errorf("could not get stat on file %s :: %v", req.FileHandle.Path,
+			fsErr)
+		return nil, fsErr
 	}
 
 	attr := StatToProtoAttr(&stat)
@@ -198,7 +329,6 @@ func (s *SamFSServer) Readdir(ctx context.Context,
 	req *pb.FileHandleRequest) (*pb.ReaddirReply, error) {
 	glog.V(3).Infof("received Readdir request root: %s, path: %s", s.rootDirectory,
 		req.FileHandle.Path)
-	s.info.readDirCount++
 
 	//validate incoming file handle
 	err := s.verifyFileHandle(req.FileHandle)
@@ -208,14 +338,18 @@ func (s *SamFSServer) Readdir(ctx context.Context,
 	}
 
 	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	span := traceStart(ctx, "open")
 	fd, err := os.Open(filePath)
+	span(err)
 	if err != nil {
 		glog.Errorf("could not get open file %s :: %v", filePath, err)
 		return nil, err
 	}
 	defer fd.Close()
 
+	span = traceStart(ctx, "readdir")
 	entries, err := fd.Readdir(0)
+	span(err)
 	if err != nil {
 		glog.Errorf("could not readdir file %s :: %v", filePath, err)
 		return nil, err
@@ -239,22 +373,25 @@ func (s *SamFSServer) Readdir(ctx context.Context,
 func (s *SamFSServer) Read(ctx context.Context,
 	req *pb.ReadRequest) (*pb.ReadReply, error) {
 	glog.V(3).Info("received read request")
-	s.info.readCount++
 
-	//validate incoming file handle
-	err := s.verifyFileHandle(req.FileHandle)
+	//validate incoming file handle and get the open file
+	fd, err := s.openHandle(ctx, req.FileHandle, false)
 	if err != nil {
-		glog.Errorf(err.Error())
 		return nil, err
 	}
+	defer s.fds.release(fd)
 
-	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
-	fd, err := os.Open(filePath)
-	if err != nil {
-		glog.Errorf("could not open file %s :: %v\n", req.FileHandle.Path, err)
-		return nil, err
+	if req.Sparse {
+		span := traceStart(ctx, "sparse read")
+		resp, err := readSparse(fd.File, req)
+		span(err)
+		if err != nil {
+			return nil, err
+		}
+		addChecksums(req, resp)
+		s.compressReply(req, resp)
+		return resp, nil
 	}
-	defer fd.Close()
 
 	data := make([]byte, req.Size, req.Size)
 	if data == nil {
@@ -263,7 +400,9 @@ func (s *SamFSServer) Read(ctx context.Context,
 		return nil, errors.New(errStr)
 	}
 
+	span := traceStart(ctx, "pread")
 	n, err := fd.ReadAt(data, req.Offset)
+	span(err)
 	if err != nil && err != io.EOF {
 		glog.Errorf("failed to read file %s :: %v\n", req.FileHandle.Path, err)
 		return nil, err
@@ -273,6 +412,8 @@ func (s *SamFSServer) Read(ctx context.Context,
 		Data: data[:n],
 		Size: int64(n),
 	}
+	addChecksums(req, resp)
+	s.compressReply(req, resp)
 
 	return resp, nil
 }
@@ -280,73 +421,130 @@ func (s *SamFSServer) Read(ctx context.Context,
 func (s *SamFSServer) Write(ctx context.Context,
 	req *pb.WriteRequest) (*pb.StatusReply, error) {
 	glog.V(3).Info("recevied write request")
-	s.info.writeCount++
 
-	//validate incoming file handle
-	err := s.verifyFileHandle(req.FileHandle)
+	//validate incoming file handle and get the open file
+	fd, err := s.openHandle(ctx, req.FileHandle, true)
 	if err != nil {
-		glog.Errorf(err.Error())
 		return nil, err
 	}
+	defer s.fds.release(fd)
 
 	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
-	fd, err := os.OpenFile(filePath, os.O_WRONLY, defaultPermission)
+	err = s.delegations.checkDelegated(req)
 	if err != nil {
-		glog.Errorf("could not open file %s :: %v\n", req.FileHandle.Path, err)
 		return nil, err
 	}
-	defer fd.Close()
+	err = s.checkWrite(req)
+	if err != nil {
+		return nil, err
+	}
+	unlock := s.lockGrowth(fd.key)
+	before, err := s.writeAt(ctx, fd, req)
+	unlock()
+	if err != nil {
+		return nil, err
+	}
+	err = s.finishWrite(ctx, fd, req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+		Wcc:             wccData(before, filePath),
+	}
+
+	return resp, nil
+}
 
+//checkWrite decompresses the data of a write and verifies its checksums;
+//corrupted data must not reach the disk, the client retries the write
+func (s *SamFSServer) checkWrite(req *pb.WriteRequest) error {
+	err := s.decompressWrite(req)
+	if err != nil {
+		atomic.AddUint64(&s.metrics.checksumErrors, 1)
+		glog.Errorf("failed to decompress write to file %s :: %v\n",
+			req.FileHandle.Path, err)
+		return err
+	}
+	if !verifyChecksums(req.ChecksumType, req.Data[:req.Size], req.Checksums) {
+		atomic.AddUint64(&s.metrics.checksumErrors, 1)
+		glog.Errorf("checksum mismatch writing file %s at %d\n",
+			req.FileHandle.Path, req.Offset)
+		return errChecksum
+	}
+	return nil
+}
+
+//writeAt writes the data of a checked write to fd at req.Offset and returns
+//the attributes the file had before. Callers hold the lock of lockGrowth or
+//of appends on the file.
+func (s *SamFSServer) writeAt(ctx context.Context, fd *cachedFile,
+	req *pb.WriteRequest) (*pb.WccAttr, error) {
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	settle, err := s.quotas.chargeGrowth(filePath, req.FileHandle.Path,
+		req.Offset+req.Size)
+	if err != nil {
+		glog.Errorf("not writing file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+
+	before := wccBefore(filePath)
+	span := traceStart(ctx, "pwrite")
 	_, err = fd.WriteAt(req.Data[:req.Size], req.Offset)
+	span(err)
+	settle()
 	if err != nil {
 		glog.Errorf("failed to write file %s :: %v\n", req.FileHandle.Path, err)
 		return nil, err
 	}
+	return before, nil
+}
 
+//finishWrite syncs a written file if the client asked for it, or else
+//remembers to sync it on Stop, and tells watchers about the change
+func (s *SamFSServer) finishWrite(ctx context.Context, fd *cachedFile,
+	req *pb.WriteRequest) error {
 	if req.ShouldCommit {
 		glog.V(3).Infof("syncing file %s write in write()", req.FileHandle.Path)
-		err = fd.Sync()
+		span := traceStart(ctx, "fsync")
+		err := s.commits.syncFile(fd)
+		span(err)
 		if err != nil {
 			glog.Errorf("could not perform fsync on file %s :: %v\n",
 				req.FileHandle.Path, err)
-			return nil, err
+			return err
 		}
+		s.dirty.remove(req.FileHandle.Path)
+	} else {
+		s.dirty.add(req.FileHandle.Path)
 	}
 
-	resp := &pb.StatusReply{
-		Success:         true,
-		ServerSessionID: s.sessionID,
-	}
-
-	return resp, nil
+	s.notify(ctx, pb.WatchEventType_MODIFY, req.FileHandle.Path, "")
+	return nil
 }
 
 func (s *SamFSServer) Commit(ctx context.Context,
 	req *pb.CommitRequest) (*pb.StatusReply, error) {
 	glog.V(3).Info("recevied commit request")
-	s.info.commitCount++
 
-	//validate incoming file handle
-	err := s.verifyFileHandle(req.FileHandle)
+	//validate incoming file handle and get the open file
+	fd, err := s.openHandle(ctx, req.FileHandle, true)
 	if err != nil {
-		glog.Errorf(err.Error())
 		return nil, err
 	}
+	defer s.fds.release(fd)
 
-	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
-	fd, err := os.OpenFile(filePath, os.O_WRONLY, defaultPermission)
-	if err != nil {
-		glog.Errorf("could not open file %s :: %v\n", req.FileHandle.Path, err)
-		return nil, err
-	}
-	defer fd.Close()
-
-	err = fd.Sync()
+	span := traceStart(ctx, "fsync")
+	err = s.commits.syncFile(fd)
+	span(err)
 	if err != nil {
 		glog.Errorf("could not perform fsync on file %s :: %v\n",
 			req.FileHandle.Path, err)
 		return nil, err
 	}
+	s.dirty.remove(req.FileHandle.Path)
 
 	resp := &pb.StatusReply{
 		Success:         true,
@@ -360,7 +558,6 @@ func (s *SamFSServer) Create(ctx context.Context,
 	req *pb.LocalDirectoryRequest) (*pb.FileHandleReply, error) {
 	glog.V(3).Infof("recevied create request root: %s, path: %s", s.rootDirectory,
 		req.DirectoryFileHandle.Path)
-	s.info.createCount++
 
 	//validate incoming directory file handle
 	err := s.verifyFileHandle(req.DirectoryFileHandle)
@@ -371,14 +568,47 @@ func (s *SamFSServer) Create(ctx context.Context,
 
 	directoryPath := path.Join(s.rootDirectory, req.DirectoryFileHandle.Path)
 	filePath := path.Join(directoryPath, req.Name)
-	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0766)
+	dirBefore := wccBefore(directoryPath)
+	before := wccBefore(filePath)
+	if before != nil {
+		s.recallPath(ctx, filePath)
+	}
+
+	fsFilePath := path.Join(req.DirectoryFileHandle.Path, req.Name)
+	owner := s.creator(ctx, req.Owner)
+	uid, usage, exists := fileOwner(filePath)
+	if !exists {
+		uid, usage = newFileOwner(owner), quotaUsage{inodes: 1}
+		err = s.quotas.charge(uid, fsFilePath, usage)
+		if err != nil {
+			glog.Errorf("not creating file %s :: %v\n", fsFilePath, err)
+			return nil, err
+		}
+	}
+	span := traceStart(ctx, "creat")
+	file, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_TRUNC,
+		s.fileMode())
+	span(err)
 	if err != nil {
 		glog.Errorf("Failed to create file at path %s :: %v\n", filePath, err)
+		if !exists {
+			s.quotas.charge(uid, fsFilePath, quotaUsage{inodes: -1})
+		}
 		return nil, err
 	}
 	file.Close()
+	if exists {
+		//truncated
+		s.quotas.charge(uid, fsFilePath, quotaUsage{bytes: -usage.bytes})
+	} else if err := chownNew(filePath, owner); err != nil {
+		glog.Errorf("failed to give file %s to its creator :: %v\n", filePath,
+			err)
+		os.Remove(filePath)
+		s.quotas.charge(uid, fsFilePath, quotaUsage{inodes: -1})
+		return nil, err
+	}
 
-	err = flush(directoryPath)
+	err = s.commits.syncDir(directoryPath)
 	if err != nil {
 		glog.Warningf("failed to flush parent directory on Create :: %v\n", err)
 	}
@@ -395,15 +625,17 @@ func (s *SamFSServer) Create(ctx context.Context,
 		return nil, err
 	}
 
-	fsFilePath := path.Join(req.DirectoryFileHandle.Path, req.Name)
 	fileHandle := &pb.FileHandle{
 		Path:             fsFilePath,
 		InodeNumber:      inum,
 		GenerationNumber: gnum,
 	}
+	s.notify(ctx, pb.WatchEventType_CREATE, fsFilePath, "")
 
 	resp := &pb.FileHandleReply{
 		FileHandle: fileHandle,
+		Wcc:        wccData(before, filePath),
+		DirWcc:     wccData(dirBefore, directoryPath),
 	}
 
 	return resp, nil
@@ -412,14 +644,12 @@ func (s *SamFSServer) Create(ctx context.Context,
 func (s *SamFSServer) Remove(ctx context.Context,
 	req *pb.LocalDirectoryRequest) (*pb.StatusReply, error) {
 	glog.V(3).Info("recevied remove request")
-	s.info.removeCount++
 	return s.remove(ctx, req)
 }
 
 func (s *SamFSServer) Mkdir(ctx context.Context,
 	req *pb.LocalDirectoryRequest) (*pb.FileHandleReply, error) {
 	glog.V(3).Info("recevied mkdir request")
-	s.info.mkdirCount++
 
 	//validate incoming directory file handle
 	err := s.verifyFileHandle(req.DirectoryFileHandle)
@@ -430,13 +660,32 @@ func (s *SamFSServer) Mkdir(ctx context.Context,
 
 	directoryPath := path.Join(s.rootDirectory, req.DirectoryFileHandle.Path)
 	filePath := path.Join(directoryPath, req.Name)
-	err = os.Mkdir(filePath, defaultPermission)
+	dirBefore := wccBefore(directoryPath)
+	fsFilePath := path.Join(req.DirectoryFileHandle.Path, req.Name)
+	owner := s.creator(ctx, req.Owner)
+	uid := newFileOwner(owner)
+	err = s.quotas.charge(uid, fsFilePath, quotaUsage{inodes: 1})
+	if err != nil {
+		glog.Errorf("not making directory %s :: %v\n", fsFilePath, err)
+		return nil, err
+	}
+	span := traceStart(ctx, "mkdir")
+	err = os.Mkdir(filePath, s.fileMode())
+	span(err)
 	if err != nil {
 		glog.Errorf("Failed to make directory at path %s :: %v\n", filePath, err)
+		s.quotas.charge(uid, fsFilePath, quotaUsage{inodes: -1})
+		return nil, err
+	}
+	if err := chownNew(filePath, owner); err != nil {
+		glog.Errorf("failed to give directory %s to its creator :: %v\n",
+			filePath, err)
+		os.Remove(filePath)
+		s.quotas.charge(uid, fsFilePath, quotaUsage{inodes: -1})
 		return nil, err
 	}
 
-	err = flush(directoryPath)
+	err = s.commits.syncDir(directoryPath)
 	if err != nil {
 		glog.Warningf("failed to flush parent directory on Rmdir :: %v\n", err)
 	}
@@ -453,15 +702,17 @@ func (s *SamFSServer) Mkdir(ctx context.Context,
 		return nil, err
 	}
 
-	fsFilePath := path.Join(req.DirectoryFileHandle.Path, req.Name)
 	fileHandle := &pb.FileHandle{
 		Path:             fsFilePath,
 		InodeNumber:      inum,
 		GenerationNumber: gnum,
 	}
+	s.notify(ctx, pb.WatchEventType_CREATE, fsFilePath, "")
 
 	resp := &pb.FileHandleReply{
 		FileHandle: fileHandle,
+		Wcc:        wccData(nil, filePath),
+		DirWcc:     wccData(dirBefore, directoryPath),
 	}
 
 	return resp, nil
@@ -470,14 +721,12 @@ func (s *SamFSServer) Mkdir(ctx context.Context,
 func (s *SamFSServer) Rmdir(ctx context.Context,
 	req *pb.LocalDirectoryRequest) (*pb.StatusReply, error) {
 	glog.V(3).Info("recevied Rmdir request")
-	s.info.rmDirCount++
 	return s.remove(ctx, req)
 }
 
 func (s *SamFSServer) Rename(ctx context.Context,
 	req *pb.RenameRequest) (*pb.StatusReply, error) {
 	glog.V(3).Info("received Rename request from %s to %s", req.FromName, req.ToName)
-	s.info.renameCount++
 	//validating incoming directory file handle
 	fromErr := s.verifyFileHandle(req.FromDirHandle)
 	if fromErr != nil {
@@ -496,18 +745,43 @@ func (s *SamFSServer) Rename(ctx context.Context,
 	toDirPath := path.Join(s.rootDirectory, req.ToDirHandle.Path)
 	toFilePath := path.Join(toDirPath, req.ToName)
 
+	s.recallPath(ctx, fromFilePath)
+	s.recallPath(ctx, toFilePath)
+
+	fromName := path.Join(req.FromDirHandle.Path, req.FromName)
+	toName := path.Join(req.ToDirHandle.Path, req.ToName)
+	undo, err := s.quotas.rename(fromName, toName)
+	if err != nil {
+		glog.Errorf("not renaming %s to %s :: %v", fromName, toName, err)
+		return nil, err
+	}
+	replacedUid, replaced, _ := fileOwner(toFilePath)
+
+	before := wccBefore(fromFilePath)
+	fromDirBefore := wccBefore(fromDirPath)
+	toDirBefore := wccBefore(toDirPath)
+	span := traceStart(ctx, "rename")
 	renErr := os.Rename(fromFilePath, toFilePath)
+	span(renErr)
 	if renErr != nil {
 		glog.Errorf(renErr.Error())
+		undo()
 		return nil, renErr
 	}
+	s.quotas.charge(replacedUid, toName, replaced.neg())
+	s.fds.invalidate(fromName)
+	s.fds.invalidate(toName)
 
-	err := flush(toFilePath)
+	err = s.commits.syncDir(fromDirPath, toDirPath)
 	if err != nil {
-		glog.Warningf("failed to flush file on rename :: %v", err)
+		glog.Warningf("failed to flush directories on rename :: %v", err)
 	}
+	s.notify(ctx, pb.WatchEventType_RENAME, fromName, toName)
 	resp := &pb.StatusReply{
-		Success: true,
+		Success:  true,
+		Wcc:      wccData(before, toFilePath),
+		DirWcc:   wccData(fromDirBefore, fromDirPath),
+		ToDirWcc: wccData(toDirBefore, toDirPath),
 	}
 
 	return resp, nil
@@ -526,20 +800,33 @@ func (s *SamFSServer) remove(ctx context.Context,
 
 	directoryPath := path.Join(s.rootDirectory, req.DirectoryFileHandle.Path)
 	filePath := path.Join(directoryPath, req.Name)
+	s.recallPath(ctx, filePath)
+	before := wccBefore(filePath)
+	dirBefore := wccBefore(directoryPath)
+	uid, usage, _ := fileOwner(filePath)
+	span := traceStart(ctx, "unlink")
 	err = os.Remove(filePath)
+	span(err)
 	if err != nil {
 		glog.Errorf("Failed to remove file/directory at path %s :: %v\n", filePath,
 			err)
 		return nil, err
 	}
+	s.quotas.charge(uid, path.Join(req.DirectoryFileHandle.Path, req.Name),
+		usage.neg())
+	s.fds.invalidate(path.Join(req.DirectoryFileHandle.Path, req.Name))
 
-	err = flush(directoryPath)
+	err = s.commits.syncDir(directoryPath)
 	if err != nil {
 		glog.Warningf("failed to flush parent directory on remove :: %v\n", err)
 	}
+	s.notify(ctx, pb.WatchEventType_REMOVE,
+		path.Join(req.DirectoryFileHandle.Path, req.Name), "")
 
 	resp := &pb.StatusReply{
 		Success: true,
+		Wcc:     wccData(before, filePath),
+		DirWcc:  wccData(dirBefore, directoryPath),
 	}
 
 	return resp, nil
@@ -579,3 +866,33 @@ func flush(path string) error {
 
 	return nil
 }
+
+//wccBefore captures the pre-operation attributes of the file at filePath.
+//It returns nil if the file does not exist (yet).
+func wccBefore(filePath string) *pb.WccAttr {
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filePath, &stat); err != nil {
+		return nil
+	}
+	return StatToWccAttr(&stat)
+}
+
+//wccData pairs the pre-operation attributes with the current attributes of
+//the file at filePath, After is nil if the file no longer exists.
+func wccData(before *pb.WccAttr, filePath string) *pb.WccData {
+	wcc := &pb.WccData{
+		Before: before,
+	}
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filePath, &stat); err != nil {
+		if err != syscall.ENOENT {
+			glog.Warningf("failed to get post-op attributes for %s :: %v\n",
+				filePath, err)
+		}
+		return wcc
+	}
+	wcc.After = StatToProtoAttr(&stat)
+
+	return wcc
+}
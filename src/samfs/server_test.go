@@ -1,19 +1,39 @@
 package samfs
 
 import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
 	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"math/rand"
+	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/golang/glog"
 	pb "github.com/smihir/samfs/src/proto"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 
 	//"github.com/golang/protobuf/proto"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type testContext struct {
@@ -29,6 +49,11 @@ var TestCtx *testContext
 
 func TestMain(m *testing.M) {
 	flag.Parse()
+	// TestUpgrade execs the test binary as the upgraded server
+	if os.Getenv(upgradeEnv) != "" {
+		runUpgradedServer()
+		return
+	}
 
 	// setup
 	wd, werr := os.Getwd()
@@ -78,6 +103,8 @@ func setup() (*testContext, error) {
 		ok = false
 		return nil, serr
 	}
+	// tests don't need to wait for clients to reclaim locks
+	s.locks.gracePeriod = 0
 	tCtx.Server = s
 
 	// run server
@@ -135,6 +162,17 @@ func TestSamfs(t *testing.T) {
 		}
 		innerFh = resp.FileHandle
 
+		// mkdir should return weak cache consistency data
+		if resp.Wcc == nil || resp.Wcc.After == nil ||
+			resp.Wcc.After.Ino != innerFh.InodeNumber {
+			t.Fatalf("mkdir did not return post-op attributes :: %v", resp.Wcc)
+		}
+		if resp.DirWcc == nil || resp.DirWcc.Before == nil ||
+			resp.DirWcc.After == nil {
+			t.Fatalf("mkdir did not return parent directory wcc data :: %v",
+				resp.DirWcc)
+		}
+
 		// check if directory is actually created
 		directoryPath := path.Join(md, "innerdir")
 		if _, err := os.Stat(directoryPath); os.IsNotExist(err) {
@@ -158,6 +196,49 @@ func TestSamfs(t *testing.T) {
 		}
 	})
 
+	t.Run("Wcc", func(t *testing.T) {
+		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+		req := &pb.LocalDirectoryRequest{
+			DirectoryFileHandle: innerFh,
+			Name:                "wccfile",
+		}
+		cResp, err := TestCtx.Client.Create(ctx, req)
+		if err != nil {
+			t.Fatalf("create failed with error :: %s", err.Error())
+		}
+		if cResp.Wcc.After == nil || cResp.Wcc.After.Size != 0 {
+			t.Fatalf("create returned bad post-op attributes :: %v", cResp.Wcc)
+		}
+
+		data := []byte("hello")
+		wResp, err := TestCtx.Client.Write(ctx, &pb.WriteRequest{
+			FileHandle: cResp.FileHandle,
+			Offset:     0,
+			Size:       int64(len(data)),
+			Data:       data,
+		})
+		if err != nil {
+			t.Fatalf("write failed with error :: %s", err.Error())
+		}
+		if wResp.Wcc.Before == nil || wResp.Wcc.Before.Size != 0 {
+			t.Fatalf("write returned bad pre-op attributes :: %v", wResp.Wcc)
+		}
+		if wResp.Wcc.After == nil || wResp.Wcc.After.Size != uint64(len(data)) {
+			t.Fatalf("write returned bad post-op attributes :: %v", wResp.Wcc)
+		}
+
+		rResp, err := TestCtx.Client.Remove(ctx, req)
+		if err != nil {
+			t.Fatalf("remove failed with error :: %s", err.Error())
+		}
+		if rResp.Wcc.Before == nil || rResp.Wcc.After != nil {
+			t.Fatalf("remove returned bad wcc data :: %v", rResp.Wcc)
+		}
+		if rResp.DirWcc.After == nil {
+			t.Fatalf("remove returned no parent directory attributes")
+		}
+	})
+
 	t.Run("Rmdir", func(t *testing.T) {
 		ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
 		// according to the spec. fh should be of parent of the sub-directory
@@ -183,3 +264,2948 @@ func TestSamfs(t *testing.T) {
 		}
 	})
 }
+
+func TestLocks(t *testing.T) {
+	ctx, _ := context.WithTimeout(context.Background(), 10*time.Second)
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "lockfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+
+	lockReq := func(clientID int64, start, end uint64,
+		lockType pb.LockType) *pb.LockRequest {
+		return &pb.LockRequest{
+			FileHandle: cResp.FileHandle,
+			Lock: &pb.FileLock{
+				ClientID: clientID,
+				Owner:    1,
+				Start:    start,
+				End:      end,
+				Type:     lockType,
+			},
+		}
+	}
+
+	resp, err := TestCtx.Client.Lock(ctx, lockReq(1, 0, 99, pb.LockType_WRITE_LOCK))
+	if err != nil || !resp.Granted {
+		t.Fatalf("failed to take write lock :: %v %v", resp, err)
+	}
+
+	resp, err = TestCtx.Client.TestLock(ctx, lockReq(2, 50, 50,
+		pb.LockType_READ_LOCK))
+	if err != nil || resp.Granted || resp.Conflict.ClientID != 1 {
+		t.Fatalf("expected conflict with client 1 :: %v %v", resp, err)
+	}
+
+	resp, err = TestCtx.Client.Lock(ctx, lockReq(2, 100, 199,
+		pb.LockType_WRITE_LOCK))
+	if err != nil || !resp.Granted {
+		t.Fatalf("failed to take non-overlapping write lock :: %v %v", resp, err)
+	}
+
+	// unlocking the middle of the range splits the lock
+	_, err = TestCtx.Client.Unlock(ctx, lockReq(1, 40, 59, pb.LockType_UNLOCK))
+	if err != nil {
+		t.Fatalf("unlock failed :: %v", err)
+	}
+	resp, err = TestCtx.Client.Lock(ctx, lockReq(2, 40, 59,
+		pb.LockType_READ_LOCK))
+	if err != nil || !resp.Granted {
+		t.Fatalf("failed to lock unlocked range :: %v %v", resp, err)
+	}
+
+	// a blocking lock is granted as soon as the conflicting lock goes away
+	done := make(chan *pb.LockReply)
+	go func() {
+		req := lockReq(2, 0, 9, pb.LockType_WRITE_LOCK)
+		req.Block = true
+		resp, err := TestCtx.Client.Lock(ctx, req)
+		if err != nil {
+			t.Errorf("blocking lock failed :: %v", err)
+		}
+		done <- resp
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("blocking lock granted while conflicting lock is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	_, err = TestCtx.Client.Unlock(ctx, lockReq(1, 0, 99, pb.LockType_UNLOCK))
+	if err != nil {
+		t.Fatalf("unlock failed :: %v", err)
+	}
+	if resp := <-done; resp == nil || !resp.Granted {
+		t.Fatalf("blocking lock was not granted :: %v", resp)
+	}
+
+	_, err = TestCtx.Client.Lock(ctx, &pb.LockRequest{FileHandle: cResp.FileHandle})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected a request without a lock to fail :: %v", err)
+	}
+}
+
+func TestLockLease(t *testing.T) {
+	s := &SamFSServer{locks: newLockManager(), clients: newClientRegistry()}
+	key := fileKey{1, 1}
+	for id := int64(1); id <= 3; id++ {
+		l := &heldLock{
+			lockOwner: lockOwner{id, 1},
+			start:     uint64(id) * 10,
+			end:       uint64(id)*10 + 9,
+			exclusive: true,
+		}
+		if _, err := s.locks.lock(context.Background(), key, l, false); err != nil {
+			t.Fatalf("failed to take lock :: %v", err)
+		}
+	}
+
+	// client 1 keeps its callback stream open, client 2 went away long ago
+	// and client 3 never came back after a restart
+	now := time.Now()
+	s.clients.clients["a"] = &connectedClient{
+		clientIDs: map[int64]bool{1: true},
+		lastSeen:  now.Add(-2 * lockLease),
+		calls:     map[*clientCall]bool{&clientCall{}: true},
+	}
+	s.clients.clients["b"] = &connectedClient{
+		clientIDs: map[int64]bool{2: true},
+		lastSeen:  now.Add(-2 * lockLease),
+		calls:     make(map[*clientCall]bool),
+	}
+
+	s.expireLockLeases(now)
+	if holders := s.locks.holders(); len(holders) != 3 {
+		t.Fatalf("locks released before clients had a lease :: %v", holders)
+	}
+
+	s.locks.created = now.Add(-2 * lockLease)
+	s.expireLockLeases(now)
+	holders := s.locks.holders()
+	if !holders[1] || holders[2] || holders[3] {
+		t.Fatalf("expected only client 1 to keep its locks :: %v", holders)
+	}
+}
+
+func TestDelegations(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "delegfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	fh := cResp.FileHandle
+
+	// client 1 can be called back, so it gets a delegation
+	stream, err := TestCtx.Client.Callback(ctx)
+	if err != nil {
+		t.Fatalf("failed to open callback stream :: %v", err)
+	}
+	if err := stream.Send(&pb.CallbackMessage{ClientID: 1}); err != nil {
+		t.Fatalf("failed to register callback stream :: %v", err)
+	}
+	var oResp *pb.OpenReply
+	for i := 0; i < 50; i++ {
+		oResp, err = TestCtx.Client.Open(ctx, &pb.OpenRequest{
+			FileHandle: fh,
+			ClientID:   1,
+			Write:      true,
+		})
+		if err != nil {
+			t.Fatalf("open failed :: %v", err)
+		}
+		if oResp.Delegation != pb.DelegationType_NO_DELEGATION {
+			break
+		}
+		// callback stream not registered yet
+		TestCtx.Client.Close(ctx, &pb.OpenRequest{FileHandle: fh, ClientID: 1})
+		time.Sleep(10 * time.Millisecond)
+	}
+	if oResp.Delegation != pb.DelegationType_WRITE_DELEGATION {
+		t.Fatalf("expected write delegation, got %v", oResp.Delegation)
+	}
+
+	// client 2 opening the file recalls client 1's delegation
+	done := make(chan *pb.OpenReply)
+	go func() {
+		resp, err := TestCtx.Client.Open(ctx, &pb.OpenRequest{
+			FileHandle: fh,
+			ClientID:   2,
+		})
+		if err != nil {
+			t.Errorf("open failed :: %v", err)
+		}
+		done <- resp
+	}()
+
+	recall, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("did not receive recall :: %v", err)
+	}
+	if recall.Recall.InodeNumber != fh.InodeNumber {
+		t.Fatalf("recall for the wrong file :: %v", recall.Recall)
+	}
+	select {
+	case <-done:
+		t.Fatalf("open completed before delegation was returned")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	err = stream.Send(&pb.CallbackMessage{ClientID: 1, Returned: recall.Recall})
+	if err != nil {
+		t.Fatalf("failed to return delegation :: %v", err)
+	}
+	if resp := <-done; resp == nil ||
+		resp.Delegation != pb.DelegationType_NO_DELEGATION {
+		t.Fatalf("no delegation expected with two clients :: %v", resp)
+	}
+
+	TestCtx.Client.Close(ctx, &pb.OpenRequest{FileHandle: fh, ClientID: 1})
+	TestCtx.Client.Close(ctx, &pb.OpenRequest{FileHandle: fh, ClientID: 2})
+	stream.CloseSend()
+}
+
+func TestRevokedDelegation(t *testing.T) {
+	ctx := context.Background()
+	m := newDelegationManager()
+	m.recallTimeout = 10 * time.Millisecond
+	fh := &pb.FileHandle{Path: "revoked", InodeNumber: 7, GenerationNumber: 1}
+	write := &pb.WriteRequest{FileHandle: fh, ClientID: 1, Delegated: true}
+
+	// client 1 never answers the recall caused by client 2
+	q := m.register(1)
+	if deleg := m.open(ctx, fh, 1, true); deleg != pb.DelegationType_WRITE_DELEGATION {
+		t.Fatalf("expected write delegation, got %v", deleg)
+	}
+	if err := m.checkDelegated(write); err != nil {
+		t.Fatalf("delegated write refused while delegation is held :: %v", err)
+	}
+	m.open(ctx, fh, 2, true)
+	select {
+	case <-q.revoked:
+	default:
+		t.Fatalf("callback stream of the revoked client not ended")
+	}
+
+	if err := m.checkDelegated(&pb.WriteRequest{FileHandle: fh,
+		ClientID: 1}); err != nil {
+		t.Fatalf("write through refused after delegation was revoked :: %v", err)
+	}
+	if err := m.checkDelegated(write); grpc.Code(err) != codes.Aborted {
+		t.Fatalf("expected delegated write to be refused, got %v", err)
+	}
+	// the client drops the delegation on the first refusal
+	if err := m.checkDelegated(write); err != nil {
+		t.Fatalf("fence not lifted after refusal :: %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+
+	// changes are not sent back to the connection that made them, so watch
+	// from a connection of our own
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:24100", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewNFSClient(conn).Watch(ctx, &pb.WatchRequest{
+		FileHandle: mResp.FileHandle,
+		Recursive:  true,
+	})
+	if err != nil {
+		t.Fatalf("failed to watch root :: %v", err)
+	}
+	// give the server a moment to register the watcher
+	time.Sleep(100 * time.Millisecond)
+
+	waitFor := func(eventType pb.WatchEventType, p string) {
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("watch stream failed waiting for %v on %s :: %v",
+					eventType, p, err)
+			}
+			if ev.Type == eventType && ev.Path == p {
+				return
+			}
+		}
+	}
+
+	// countModifies counts the MODIFY events of p up to its REMOVE
+	countModifies := func(p string) int {
+		modifies := 0
+		for {
+			ev, err := stream.Recv()
+			if err != nil {
+				t.Fatalf("watch stream failed waiting for REMOVE on %s :: %v",
+					p, err)
+			}
+			if ev.Path != p {
+				continue
+			}
+			if ev.Type == pb.WatchEventType_MODIFY {
+				modifies++
+			}
+			if ev.Type == pb.WatchEventType_REMOVE {
+				return modifies
+			}
+		}
+	}
+
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "watchfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	waitFor(pb.WatchEventType_CREATE, "/watchfile")
+
+	// changes made directly on the server's disk are picked up too
+	wd, _ := os.Getwd()
+	localPath := path.Join(wd, mountDir, "localfile")
+	if err := ioutil.WriteFile(localPath, []byte("local"), 0666); err != nil {
+		t.Fatalf("failed to write local file :: %v", err)
+	}
+	waitFor(pb.WatchEventType_CREATE, "/localfile")
+	// a change right after another one is sent when the window has passed
+	if err := ioutil.WriteFile(localPath, []byte("again"), 0666); err != nil {
+		t.Fatalf("failed to write local file :: %v", err)
+	}
+	time.Sleep(watchCoalesceWindow + 200*time.Millisecond)
+	if err := os.Remove(localPath); err != nil {
+		t.Fatalf("failed to remove local file :: %v", err)
+	}
+	if n := countModifies("/localfile"); n < 2 {
+		t.Fatalf("two local writes sent %d MODIFY events", n)
+	}
+
+	// a burst of writes is sent as its first and last MODIFY
+	for i := 0; i < 20; i++ {
+		_, err := TestCtx.Client.Write(ctx, &pb.WriteRequest{
+			FileHandle: cResp.FileHandle,
+			Offset:     int64(i),
+			Size:       1,
+			Data:       []byte{'w'},
+		})
+		if err != nil {
+			t.Fatalf("write failed with error :: %s", err.Error())
+		}
+	}
+	time.Sleep(watchCoalesceWindow + 200*time.Millisecond)
+
+	if _, err := TestCtx.Client.Remove(ctx, fReq); err != nil {
+		t.Fatalf("remove failed with error :: %s", err.Error())
+	}
+	if modifies := countModifies("/watchfile"); modifies < 2 || modifies > 3 {
+		t.Fatalf("burst of 20 writes sent %d MODIFY events", modifies)
+	}
+}
+
+func TestCopyRange(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+
+	var fhs []*pb.FileHandle
+	for _, name := range []string{"copysrc", "copydst"} {
+		fReq := &pb.LocalDirectoryRequest{
+			DirectoryFileHandle: mResp.FileHandle,
+			Name:                name,
+		}
+		cResp, err := TestCtx.Client.Create(ctx, fReq)
+		if err != nil {
+			t.Fatalf("create failed with error :: %s", err.Error())
+		}
+		defer TestCtx.Client.Remove(ctx, fReq)
+		fhs = append(fhs, cResp.FileHandle)
+	}
+	src, dst := fhs[0], fhs[1]
+
+	data := []byte("hello samfs copy")
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: src,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %s", err.Error())
+	}
+
+	check := func(want string) {
+		rResp, err := TestCtx.Client.Read(ctx, &pb.ReadRequest{
+			FileHandle: dst,
+			Size:       64,
+		})
+		if err != nil {
+			t.Fatalf("read failed with error :: %s", err.Error())
+		}
+		if string(rResp.Data) != want {
+			t.Fatalf("expected %q after copy, got %q", want, rResp.Data)
+		}
+	}
+
+	// a length of 0 copies the whole file
+	cResp, err := TestCtx.Client.CopyRange(ctx, &pb.CopyRangeRequest{
+		SrcFileHandle: src,
+		DstFileHandle: dst,
+	})
+	if err != nil {
+		t.Fatalf("copy failed with error :: %v", err)
+	}
+	if cResp.Size != int64(len(data)) {
+		t.Fatalf("expected %d bytes copied, got %d", len(data), cResp.Size)
+	}
+	if cResp.Wcc == nil || cResp.Wcc.Before.Size != 0 ||
+		cResp.Wcc.After.Size != uint64(len(data)) {
+		t.Fatalf("unexpected wcc data after copy :: %v", cResp.Wcc)
+	}
+	check(string(data))
+
+	// copies stop at the end of the source
+	cResp, err = TestCtx.Client.CopyRange(ctx, &pb.CopyRangeRequest{
+		SrcFileHandle: src,
+		SrcOffset:     6,
+		DstFileHandle: dst,
+		Length:        100,
+	})
+	if err != nil {
+		t.Fatalf("copy failed with error :: %v", err)
+	}
+	if cResp.Size != int64(len(data))-6 || cResp.Cloned {
+		t.Fatalf("unexpected partial copy result :: %v", cResp)
+	}
+	check("samfs copys copy")
+
+	// ranges overlapping within a file are refused rather than corrupted
+	_, err = TestCtx.Client.CopyRange(ctx, &pb.CopyRangeRequest{
+		SrcFileHandle: dst,
+		DstFileHandle: dst,
+		DstOffset:     4,
+		Length:        10,
+	})
+	if grpc.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected overlapping copy to fail, got %v", err)
+	}
+	check("samfs copys copy")
+}
+
+func TestAllocate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "allocfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	fh := cResp.FileHandle
+
+	allocate := func(req *pb.AllocateRequest) *pb.StatusReply {
+		req.FileHandle = fh
+		resp, err := TestCtx.Client.Allocate(ctx, req)
+		if grpc.Code(err) == codes.Unimplemented {
+			t.Skipf("backing filesystem does not support %v :: %v", req, err)
+		}
+		if err != nil {
+			t.Fatalf("allocate %v failed :: %v", req, err)
+		}
+		return resp
+	}
+
+	resp := allocate(&pb.AllocateRequest{Length: 8192})
+	if resp.Wcc == nil || resp.Wcc.After.Size != 8192 {
+		t.Fatalf("allocation did not extend the file :: %v", resp.Wcc)
+	}
+	resp = allocate(&pb.AllocateRequest{Offset: 8192, Length: 8192,
+		KeepSize: true})
+	if resp.Wcc.After.Size != 8192 {
+		t.Fatalf("allocation with keepSize changed the size :: %v", resp.Wcc)
+	}
+
+	data := bytes.Repeat([]byte{'x'}, 8192)
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %s", err.Error())
+	}
+	allocate(&pb.AllocateRequest{Length: 4096, KeepSize: true,
+		PunchHole: true})
+	rResp, err := TestCtx.Client.Read(ctx, &pb.ReadRequest{
+		FileHandle: fh,
+		Size:       8192,
+	})
+	if err != nil {
+		t.Fatalf("read failed with error :: %s", err.Error())
+	}
+	if !bytes.Equal(rResp.Data[:4096], make([]byte, 4096)) ||
+		!bytes.Equal(rResp.Data[4096:], data[4096:]) {
+		t.Fatalf("punched hole does not read back as zeros")
+	}
+
+	// linux refuses to punch a hole without keeping the size
+	_, err = TestCtx.Client.Allocate(ctx, &pb.AllocateRequest{
+		FileHandle: fh,
+		Length:     4096,
+		PunchHole:  true,
+	})
+	if grpc.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+}
+
+func TestSparse(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "sparsefile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	fh := cResp.FileHandle
+
+	// 1MB hole followed by a little data
+	const holeSize = 1024 * 1024
+	data := []byte("after the hole")
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: fh,
+		Offset:     holeSize,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %s", err.Error())
+	}
+
+	sResp, err := TestCtx.Client.Seek(ctx, &pb.SeekRequest{
+		FileHandle: fh,
+		Whence:     pb.SeekWhence_SEEK_DATA,
+	})
+	if err != nil {
+		t.Fatalf("seek failed with error :: %v", err)
+	}
+	if sResp.Offset == 0 {
+		t.Skip("backing filesystem does not report holes")
+	}
+	if sResp.Offset > holeSize {
+		t.Fatalf("expected data at or before %d, got %d", holeSize,
+			sResp.Offset)
+	}
+	_, err = TestCtx.Client.Seek(ctx, &pb.SeekRequest{
+		FileHandle: fh,
+		Offset:     holeSize + int64(len(data)),
+		Whence:     pb.SeekWhence_SEEK_DATA,
+	})
+	if grpc.Code(err) != codes.OutOfRange {
+		t.Fatalf("expected OutOfRange seeking past the data, got %v", err)
+	}
+
+	rResp, err := TestCtx.Client.Read(ctx, &pb.ReadRequest{
+		FileHandle: fh,
+		Size:       2 * holeSize,
+		Sparse:     true,
+	})
+	if err != nil {
+		t.Fatalf("read failed with error :: %s", err.Error())
+	}
+	if rResp.Size != holeSize+int64(len(data)) || len(rResp.Holes) == 0 ||
+		len(rResp.Data) >= holeSize {
+		t.Fatalf("expected the hole to be described, got size %d, %d holes "+
+			"and %d bytes", rResp.Size, len(rResp.Holes), len(rResp.Data))
+	}
+
+	c := &SamFs{nfsClient: TestCtx.Client}
+	buf, err := c.readSparse(ctx, fh, make([]byte, 2*holeSize), 0)
+	if err != nil {
+		t.Fatalf("sparse read failed with error :: %s", err.Error())
+	}
+	want := append(make([]byte, holeSize), data...)
+	if !bytes.Equal(buf, want) {
+		t.Fatalf("sparse read did not expand to the file contents")
+	}
+	if !holesFit(rResp, 0, 2*holeSize) {
+		t.Fatalf("holes of the server's reply do not fit :: %v", rResp.Holes)
+	}
+
+	// replies that would have the client write past its buffer are refused
+	hole := func(off, length int64) *pb.HoleRange {
+		return &pb.HoleRange{Offset: off, Length: length}
+	}
+	for _, bad := range []*pb.ReadReply{
+		{Size: 200, Data: make([]byte, 100), Holes: []*pb.HoleRange{hole(100, 100)}},
+		{Size: 50, Data: make([]byte, 40), Holes: []*pb.HoleRange{hole(0, 10)}},
+		{Size: 100, Data: make([]byte, 80), Holes: []*pb.HoleRange{hole(100, 20)}},
+		{Size: 100, Data: make([]byte, 30), Holes: []*pb.HoleRange{hole(20, 30)}},
+		{Size: 100, Data: make([]byte, 40), Holes: []*pb.HoleRange{hole(50, 30),
+			hole(20, 30)}},
+		{Size: 100, Data: make([]byte, 50), Holes: []*pb.HoleRange{hole(20, 30),
+			hole(40, 20)}},
+		{Size: 100, Data: make([]byte, 80), Holes: []*pb.HoleRange{hole(20, -10),
+			hole(50, 30)}},
+	} {
+		if holesFit(bad, 10, 100) {
+			t.Fatalf("bad holes were accepted :: size %d, %d bytes, %v",
+				bad.Size, len(bad.Data), bad.Holes)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "checksumfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	fh := cResp.FileHandle
+
+	// data spanning more than one chunk
+	data := bytes.Repeat([]byte("0123456789"), checksumChunkSize/5)
+	sums := computeChecksums(pb.ChecksumType_CRC32C, data)
+	if len(sums) != 2 {
+		t.Fatalf("expected 2 chunk checksums, got %d", len(sums))
+	}
+
+	corrupted := append([]byte{}, data...)
+	corrupted[checksumChunkSize+1] ^= 0xff
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle:   fh,
+		Size:         int64(len(corrupted)),
+		Data:         corrupted,
+		ChecksumType: pb.ChecksumType_CRC32C,
+		Checksums:    sums,
+	})
+	if grpc.Code(err) != codes.DataLoss {
+		t.Fatalf("expected DataLoss for corrupted write, got %v", err)
+	}
+
+	c := &SamFs{nfsClient: TestCtx.Client, checksumType: pb.ChecksumType_SHA256}
+	_, err = c.writeChecked(ctx, &pb.WriteRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %v", err)
+	}
+	rResp, err := c.readChecked(ctx, &pb.ReadRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+	})
+	if err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+	if rResp.ChecksumType != pb.ChecksumType_SHA256 || len(rResp.Checksums) != 2 {
+		t.Fatalf("read reply without checksums :: %v %d", rResp.ChecksumType,
+			len(rResp.Checksums))
+	}
+	if !bytes.Equal(rResp.Data, data) || c.checksumErrors != 0 {
+		t.Fatalf("read back different data, %d checksum errors",
+			c.checksumErrors)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{
+		RootDirectory: "/",
+		Compression:   pb.Compression_FLATE,
+	})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	if mResp.Compression != pb.Compression_FLATE {
+		t.Fatalf("server did not agree to compression :: %v",
+			mResp.Compression)
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "compressfile",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	fh := cResp.FileHandle
+
+	data := bytes.Repeat([]byte("id,name,value\n1,samfs,42\n"), 4096)
+	c := &SamFs{
+		nfsClient:    TestCtx.Client,
+		checksumType: pb.ChecksumType_CRC32C,
+		compression:  mResp.Compression,
+	}
+	wReq := &pb.WriteRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+		Data:       data,
+	}
+	if _, err := c.writeChecked(ctx, wReq); err != nil {
+		t.Fatalf("write failed with error :: %v", err)
+	}
+	if wReq.Compression != pb.Compression_FLATE ||
+		len(wReq.Data) >= len(data)/5 {
+		t.Fatalf("write was not compressed, sent %d of %d bytes",
+			len(wReq.Data), len(data))
+	}
+
+	rResp, err := TestCtx.Client.Read(ctx, &pb.ReadRequest{
+		FileHandle:  fh,
+		Size:        int64(len(data)),
+		Compression: pb.Compression_FLATE,
+	})
+	if err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+	if rResp.Compression != pb.Compression_FLATE {
+		t.Fatalf("read reply was not compressed")
+	}
+	got, err := c.readChecked(ctx, &pb.ReadRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+	})
+	if err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+	if !bytes.Equal(got.Data, data) {
+		t.Fatalf("read back different data")
+	}
+
+	// data inflating past the size of the write is refused
+	bomb, _ := compressData(pb.Compression_FLATE, make([]byte, 1<<20))
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle:  fh,
+		Size:        4096,
+		Data:        bomb,
+		Compression: pb.Compression_FLATE,
+	})
+	if grpc.Code(err) != codes.DataLoss {
+		t.Fatalf("expected oversized write data to be refused :: %v", err)
+	}
+	if _, err := decompressData(pb.Compression_FLATE, bomb, 4096); err == nil {
+		t.Fatalf("expected oversized reply data to be refused")
+	}
+
+	// data that does not compress is sent as is
+	random := make([]byte, 4096)
+	rand.Read(random)
+	if _, codec := compressData(pb.Compression_FLATE, random); codec !=
+		pb.Compression_NO_COMPRESSION {
+		t.Fatalf("random data should not be compressed")
+	}
+
+	TestCtx.Server.SetCompression(false)
+	defer TestCtx.Server.SetCompression(true)
+	mResp, err = TestCtx.Client.Mount(ctx, &pb.MountRequest{
+		RootDirectory: "/",
+		Compression:   pb.Compression_FLATE,
+	})
+	if err != nil || mResp.Compression != pb.Compression_NO_COMPRESSION {
+		t.Fatalf("compression should be off for the export :: %v %v", err,
+			mResp)
+	}
+}
+
+// writeTestCert writes a certificate for cn and its key as PEM files to dir,
+// signed by parent or self-signed if parent is nil.
+func writeTestCert(t *testing.T, dir string, cn string,
+	parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate,
+	*ecdsa.PrivateKey) {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key :: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(rand.Int63()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  parent == nil,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(crand.Reader, tmpl, parent,
+		&key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatalf("failed to create certificate :: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key :: %v", err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY",
+		Bytes: keyDer})
+	if err := ioutil.WriteFile(path.Join(dir, cn+".pem"), certPem,
+		0600); err != nil {
+		t.Fatalf("failed to write certificate :: %v", err)
+	}
+	if err := ioutil.WriteFile(path.Join(dir, cn+".key"), keyPem,
+		0600); err != nil {
+		t.Fatalf("failed to write key :: %v", err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse certificate :: %v", err)
+	}
+	return cert, key
+}
+
+func TestTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samfs-tls")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := writeTestCert(t, dir, "ca", nil, nil)
+	writeTestCert(t, dir, "server", ca, caKey)
+	writeTestCert(t, dir, "allowed", ca, caKey)
+	writeTestCert(t, dir, "other", ca, caKey)
+	file := func(name string) string {
+		return path.Join(dir, name)
+	}
+
+	wd, _ := os.Getwd()
+	s, err := NewServer(path.Join(wd, mountDir), "24101")
+	if err != nil {
+		t.Fatalf("failed to create server :: %v", err)
+	}
+	err = s.SetTLS(&TLSOptions{
+		CertFile:        file("server.pem"),
+		KeyFile:         file("server.key"),
+		CAFile:          file("ca.pem"),
+		AllowedSubjects: []string{"allowed"},
+	})
+	if err != nil {
+		t.Fatalf("failed to set up tls :: %v", err)
+	}
+	go s.Run()
+	defer s.Stop()
+
+	mount := func(security grpc.DialOption, timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		conn, err := grpc.DialContext(ctx, "127.0.0.1:24101", security)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_, err = pb.NewNFSClient(conn).Mount(ctx, &pb.MountRequest{},
+			grpc.FailFast(false))
+		return err
+	}
+	clientCreds := func(name string) grpc.DialOption {
+		creds, err := (&TLSOptions{
+			CertFile: file(name + ".pem"),
+			KeyFile:  file(name + ".key"),
+			CAFile:   file("ca.pem"),
+		}).clientCredentials()
+		if err != nil {
+			t.Fatalf("failed to load client credentials :: %v", err)
+		}
+		return grpc.WithTransportCredentials(creds)
+	}
+
+	if err := mount(clientCreds("allowed"), 5*time.Second); err != nil {
+		t.Fatalf("allowed client failed to mount :: %v", err)
+	}
+	if err := mount(clientCreds("other"), 5*time.Second); grpc.Code(err) !=
+		codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for other client, got %v", err)
+	}
+	// the handshake never completes, so the mount waits until the timeout
+	if err := mount(grpc.WithInsecure(), 500*time.Millisecond); err == nil {
+		t.Fatalf("plaintext client could mount a tls export")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	token := NewToken(secret, "alice", time.Time{})
+	if id, err := verifyToken(secret, token, time.Now()); err != nil ||
+		id != "alice" {
+		t.Fatalf("token did not verify :: %q %v", id, err)
+	}
+	if _, err := verifyToken([]byte("fedcba9876543210"), token,
+		time.Now()); err == nil {
+		t.Fatalf("token verified with the wrong secret")
+	}
+	expired := NewToken(secret, "alice", time.Now().Add(-time.Minute))
+	if _, err := verifyToken(secret, expired, time.Now()); err == nil {
+		t.Fatalf("expired token verified")
+	}
+
+	TestCtx.Server.authSecret = secret
+	TestCtx.Server.authPolicy = map[string]access{
+		"alice": readWrite,
+		"bob":   readOnly,
+	}
+	TestCtx.Server.authOwners = map[string]*pb.FileOwner{
+		"alice": {Uid: 4321, Gid: 4322},
+	}
+	defer func() {
+		TestCtx.Server.authSecret = nil
+		TestCtx.Server.authPolicy = nil
+		TestCtx.Server.authOwners = nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var conns []*grpc.ClientConn
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	client := func(identity string) pb.NFSClient {
+		opts := []grpc.DialOption{grpc.WithInsecure()}
+		if identity != "" {
+			opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{
+				NewToken(secret, identity, time.Time{})}))
+		}
+		conn, err := grpc.DialContext(ctx, "127.0.0.1:24100", opts...)
+		if err != nil {
+			t.Fatalf("failed to connect :: %v", err)
+		}
+		conns = append(conns, conn)
+		return pb.NewNFSClient(conn)
+	}
+	mount := func(c pb.NFSClient) (*pb.FileHandleReply, error) {
+		return c.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	}
+
+	if _, err := mount(client("")); grpc.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated without a token, got %v", err)
+	}
+	if _, err := mount(client("eve")); grpc.Code(err) !=
+		codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for eve, got %v", err)
+	}
+
+	alice := client("alice")
+	mResp, err := mount(alice)
+	if err != nil {
+		t.Fatalf("alice failed to mount :: %v", err)
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "authfile",
+		Owner:               &pb.FileOwner{Uid: 1234, Gid: 1234},
+	}
+	if _, err := alice.Create(ctx, fReq); err != nil {
+		t.Fatalf("alice failed to create a file :: %v", err)
+	}
+	defer alice.Remove(ctx, fReq)
+	// the policy decides who owns it, not the client
+	if os.Geteuid() == 0 {
+		info, err := os.Stat(path.Join(TestCtx.Server.rootDirectory,
+			"authfile"))
+		if err != nil {
+			t.Fatalf("stat failed :: %v", err)
+		}
+		if st := info.Sys().(*syscall.Stat_t); st.Uid != 4321 ||
+			st.Gid != 4322 {
+			t.Fatalf("file belongs to %d:%d, not to alice", st.Uid, st.Gid)
+		}
+	}
+
+	bob := client("bob")
+	if _, err := mount(bob); err != nil {
+		t.Fatalf("bob failed to mount :: %v", err)
+	}
+	if _, err := bob.Lookup(ctx, fReq); err != nil {
+		t.Fatalf("bob failed to look up a file :: %v", err)
+	}
+	if _, err := bob.Remove(ctx, fReq); grpc.Code(err) !=
+		codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for read-only remove, got %v",
+			err)
+	}
+
+	fResp, err := alice.Lookup(ctx, fReq)
+	if err != nil {
+		t.Fatalf("alice failed to look up a file :: %v", err)
+	}
+	lockReq := func(lockType pb.LockType) *pb.LockRequest {
+		return &pb.LockRequest{
+			FileHandle: fResp.FileHandle,
+			Lock: &pb.FileLock{
+				ClientID: 4100,
+				Owner:    1,
+				End:      99,
+				Type:     lockType,
+			},
+		}
+	}
+	if resp, err := alice.Lock(ctx, lockReq(pb.LockType_WRITE_LOCK)); err != nil ||
+		!resp.Granted {
+		t.Fatalf("alice failed to take a lock :: %v %v", resp, err)
+	}
+	if _, err := bob.Unlock(ctx, lockReq(pb.LockType_UNLOCK)); grpc.Code(err) !=
+		codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for bob releasing alice's lock, "+
+			"got %v", err)
+	}
+	if resp, err := bob.TestLock(ctx, &pb.LockRequest{
+		FileHandle: fResp.FileHandle,
+		Lock: &pb.FileLock{ClientID: 4101, Owner: 1, End: 99,
+			Type: pb.LockType_READ_LOCK},
+	}); err != nil || resp.Granted {
+		t.Fatalf("alice's lock did not survive bob's unlock :: %v %v", resp,
+			err)
+	}
+	if _, err := alice.Unlock(ctx, lockReq(pb.LockType_UNLOCK)); err != nil {
+		t.Fatalf("alice failed to release the lock :: %v", err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	dReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "quotadir",
+	}
+	dResp, err := TestCtx.Client.Mkdir(ctx, dReq)
+	if err != nil {
+		t.Fatalf("mkdir failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Rmdir(ctx, dReq)
+
+	dir, err := ioutil.TempDir("", "samfs-quota")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	quotaFile := path.Join(dir, "quotas")
+	err = ioutil.WriteFile(quotaFile, []byte("# test quotas\n"+
+		"dir /quotadir 10000 3\n"), 0600)
+	if err != nil {
+		t.Fatalf("failed to write quota file :: %v", err)
+	}
+	if err := TestCtx.Server.SetQuotas(quotaFile, path.Join(dir, "db")); err != nil {
+		t.Fatalf("failed to set up quotas :: %v", err)
+	}
+	defer func() {
+		TestCtx.Server.quotas = nil
+	}()
+
+	var files []*pb.LocalDirectoryRequest
+	create := func(name string) (*pb.FileHandleReply, error) {
+		fReq := &pb.LocalDirectoryRequest{
+			DirectoryFileHandle: dResp.FileHandle,
+			Name:                name,
+		}
+		resp, err := TestCtx.Client.Create(ctx, fReq)
+		if err == nil {
+			files = append(files, fReq)
+		}
+		return resp, err
+	}
+	defer func() {
+		for _, fReq := range files {
+			TestCtx.Client.Remove(ctx, fReq)
+		}
+	}()
+
+	cResp, err := create("a")
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	write := func(off int64, size int) error {
+		_, err := TestCtx.Client.Write(ctx, &pb.WriteRequest{
+			FileHandle: cResp.FileHandle,
+			Offset:     off,
+			Size:       int64(size),
+			Data:       make([]byte, size),
+		})
+		return err
+	}
+	if err := write(0, 8000); err != nil {
+		t.Fatalf("write within quota failed :: %v", err)
+	}
+	if err := write(8000, 4000); !isQuotaError(err) {
+		t.Fatalf("expected quota error writing past the limit, got %v", err)
+	}
+	// rewriting existing data does not use more space
+	if err := write(4000, 4000); err != nil {
+		t.Fatalf("overwrite within quota failed :: %v", err)
+	}
+	// preallocating past the end of the file does, even if it keeps the size
+	_, err = TestCtx.Client.Allocate(ctx, &pb.AllocateRequest{
+		FileHandle: cResp.FileHandle,
+		Offset:     8000,
+		Length:     1 << 20,
+		KeepSize:   true,
+	})
+	if !isQuotaError(err) {
+		t.Fatalf("expected quota error preallocating past the limit, got %v",
+			err)
+	}
+
+	for _, name := range []string{"b", "c"} {
+		if _, err := create(name); err != nil {
+			t.Fatalf("create within quota failed :: %v", err)
+		}
+	}
+	if _, err := create("d"); !isQuotaError(err) {
+		t.Fatalf("expected quota error creating a 4th file, got %v", err)
+	}
+
+	qResp, err := TestCtx.Client.GetQuota(ctx, &pb.GetQuotaRequest{
+		Path: "/quotadir/a",
+		Uid:  -1,
+	})
+	if err != nil {
+		t.Fatalf("get quota failed :: %v", err)
+	}
+	if len(qResp.Quotas) != 1 || qResp.Quotas[0].BytesUsed != 8000 ||
+		qResp.Quotas[0].InodesUsed != 3 {
+		t.Fatalf("unexpected quota usage :: %v", qResp.Quotas)
+	}
+
+	sResp, err := TestCtx.Client.StatFs(ctx, &pb.StatFsRequest{
+		Path: "/quotadir",
+	})
+	if err != nil {
+		t.Fatalf("statfs failed :: %v", err)
+	}
+	if sResp.Bavail*uint64(sResp.Bsize) > 2000 || sResp.Ffree != 0 {
+		t.Fatalf("statfs does not reflect the quota :: %v", sResp)
+	}
+
+	// usage survives a restart
+	if err := TestCtx.Server.quotas.flush(); err != nil {
+		t.Fatalf("failed to persist quota usage :: %v", err)
+	}
+	q, err := newQuotaManager(TestCtx.Server.rootDirectory, quotaFile,
+		path.Join(dir, "db"))
+	if err != nil {
+		t.Fatalf("failed to reload quotas :: %v", err)
+	}
+	if u := q.get(dirKey("/quotadir")); u.bytes != 8000 || u.inodes != 3 {
+		t.Fatalf("reloaded usage differs :: %+v", *u)
+	}
+
+	// usage left behind by a server that did not stop cleanly is rebuilt
+	q.db.Set(dirKey("/quotadir")+":bytes", 1)
+	q.db.Set(quotaScannedKey, 0)
+	if err := q.db.Flush(); err != nil {
+		t.Fatalf("failed to persist quota usage :: %v", err)
+	}
+	q, err = newQuotaManager(TestCtx.Server.rootDirectory, quotaFile,
+		path.Join(dir, "db"))
+	if err != nil {
+		t.Fatalf("failed to reload quotas :: %v", err)
+	}
+	if err := q.begin(false); err != nil {
+		t.Fatalf("failed to rebuild quota usage :: %v", err)
+	}
+	if u := q.get(dirKey("/quotadir")); u.bytes != 8000 || u.inodes != 3 {
+		t.Fatalf("usage was not rebuilt :: %+v", *u)
+	}
+	if err := q.close(); err != nil || q.db.Lookup(quotaScannedKey) != 1 {
+		t.Fatalf("usage not marked up to date on close :: %v", err)
+	}
+
+	if _, err := TestCtx.Client.Remove(ctx, files[0]); err != nil {
+		t.Fatalf("remove failed with error :: %v", err)
+	}
+	files = files[1:]
+	if u := TestCtx.Server.quotas.get(dirKey("/quotadir")); u.bytes != 0 ||
+		u.inodes != 2 {
+		t.Fatalf("remove was not refunded :: %+v", *u)
+	}
+
+	// files are charged to and owned by their creator if the server is root
+	if os.Geteuid() != 0 {
+		return
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: dResp.FileHandle,
+		Name:                "owned",
+		Owner:               &pb.FileOwner{Uid: 4321, Gid: 4321},
+	}
+	if _, err := TestCtx.Client.Create(ctx, fReq); err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	files = append(files, fReq)
+	info, err := os.Stat(path.Join(TestCtx.Server.rootDirectory, "quotadir",
+		"owned"))
+	if err != nil {
+		t.Fatalf("stat failed :: %v", err)
+	}
+	if st := info.Sys().(*syscall.Stat_t); st.Uid != 4321 || st.Gid != 4321 {
+		t.Fatalf("file belongs to %d:%d, not its creator", st.Uid, st.Gid)
+	}
+	if u := TestCtx.Server.quotas.get(uidKey(4321)); u.inodes != 1 {
+		t.Fatalf("creator was not charged :: %+v", *u)
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "samfs-audit")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "audit.log")
+	if err := TestCtx.Server.SetAuditLog(logFile, 0, 0); err != nil {
+		t.Fatalf("failed to open audit log :: %v", err)
+	}
+	defer func() {
+		TestCtx.Server.audit.Close()
+		TestCtx.Server.audit = nil
+	}()
+
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "audited",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	for i := 0; i < 3; i++ {
+		_, err := TestCtx.Client.Write(ctx, &pb.WriteRequest{
+			FileHandle: cResp.FileHandle,
+			Offset:     int64(i * 100),
+			Size:       100,
+			Data:       make([]byte, 100),
+		})
+		if err != nil {
+			t.Fatalf("write failed with error :: %s", err.Error())
+		}
+	}
+	_, err = TestCtx.Client.Commit(ctx, &pb.CommitRequest{
+		FileHandle: cResp.FileHandle,
+	})
+	if err != nil {
+		t.Fatalf("commit failed with error :: %s", err.Error())
+	}
+	_, err = TestCtx.Client.Rename(ctx, &pb.RenameRequest{
+		FromDirHandle: mResp.FileHandle,
+		FromName:      "audited",
+		ToDirHandle:   mResp.FileHandle,
+		ToName:        "audited2",
+	})
+	if err != nil {
+		t.Fatalf("rename failed with error :: %s", err.Error())
+	}
+	cReq.Name = "audited2"
+	if _, err := TestCtx.Client.Remove(ctx, cReq); err != nil {
+		t.Fatalf("remove failed with error :: %s", err.Error())
+	}
+	// a failed change is recorded too
+	TestCtx.Client.Remove(ctx, cReq)
+
+	TestCtx.Server.audit.Close()
+	TestCtx.Server.audit = nil
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatalf("failed to read audit log :: %v", err)
+	}
+	var recs []auditRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var rec auditRecord
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Fatalf("bad audit record %q :: %v", line, err)
+		}
+		if rec.Client == "" {
+			t.Fatalf("audit record without client address :: %q", line)
+		}
+		recs = append(recs, rec)
+	}
+
+	expected := []auditRecord{
+		{Op: "Create", Path: "/audited", Result: "OK"},
+		{Op: "Write", Path: "/audited", Result: "OK", Bytes: 300, Writes: 3},
+		{Op: "Rename", Path: "/audited", ToPath: "/audited2", Result: "OK"},
+		{Op: "Remove", Path: "/audited2", Result: "OK"},
+		{Op: "Remove", Path: "/audited2", Result: "Unknown"},
+	}
+	if len(recs) != len(expected) {
+		t.Fatalf("expected %d audit records, got %d :: %s", len(expected),
+			len(recs), data)
+	}
+	for i, e := range expected {
+		r := recs[i]
+		if r.Op != e.Op || r.Path != e.Path || r.ToPath != e.ToPath ||
+			r.Result != e.Result || r.Bytes != e.Bytes || r.Writes != e.Writes {
+			t.Fatalf("unexpected audit record %d :: %+v", i, r)
+		}
+	}
+	if recs[0].Inode != cResp.FileHandle.InodeNumber {
+		t.Fatalf("create record has the wrong handle :: %+v", recs[0])
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samfs-audit")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	logFile := path.Join(dir, "audit.log")
+	l, err := newAuditLog(logFile, 200, 2)
+	if err != nil {
+		t.Fatalf("failed to open audit log :: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		l.send(&auditRecord{Time: time.Now(), Op: "Remove", Result: "OK"})
+	}
+	l.Close()
+
+	for _, name := range []string{logFile, logFile + ".1", logFile + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("expected audit log %s :: %v", name, err)
+		}
+		if info.Size() > 200 {
+			t.Fatalf("audit log %s was not rotated, size %d", name, info.Size())
+		}
+	}
+	if _, err := os.Stat(logFile + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("kept more rotated audit logs than asked for")
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := TestCtx.Server.ServeMetrics("127.0.0.1:0"); err != nil {
+		t.Fatalf("failed to serve metrics :: %v", err)
+	}
+	addr := TestCtx.Server.metricsListener.Addr().String()
+	defer func() {
+		TestCtx.Server.metricsListener.Close()
+		TestCtx.Server.metricsListener = nil
+	}()
+
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %s", err.Error())
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "metered",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %s", err.Error())
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+
+	before := atomic.LoadUint64(&TestCtx.Server.metrics.bytesWritten)
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: cResp.FileHandle,
+		Size:       1000,
+		Data:       make([]byte, 1000),
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %s", err.Error())
+	}
+	if n := atomic.LoadUint64(&TestCtx.Server.metrics.bytesWritten); n-before != 1000 {
+		t.Fatalf("expected 1000 more bytes written, got %d", n-before)
+	}
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: &pb.FileHandle{Path: "/metered", InodeNumber: 1},
+	})
+	if err == nil {
+		t.Fatalf("write with a stale handle succeeded")
+	}
+
+	resp, err := http.Get("http://" + addr + "/metrics")
+	if err != nil {
+		t.Fatalf("failed to fetch metrics :: %v", err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatalf("failed to read metrics :: %v", err)
+	}
+	for _, want := range []string{
+		`samfs_rpc_requests_total{method="Write"} `,
+		`samfs_rpc_in_flight{method="Write"} 0`,
+		`samfs_rpc_errors_total{method="Write",code=`,
+		`samfs_rpc_duration_seconds_bucket{method="Write",le="+Inf"} `,
+		`samfs_rpc_duration_seconds_count{method="Create"} `,
+		"samfs_written_bytes_total ",
+		"go_goroutines ",
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Fatalf("metrics are missing %q :: %s", want, body)
+		}
+	}
+
+	resp, err = http.Get("http://" + addr + "/debug/pprof/")
+	if err != nil {
+		t.Fatalf("failed to fetch pprof index :: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("pprof index returned %s", resp.Status)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	conn, err := Dial("127.0.0.1", "24100", nil, "")
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	c := &SamFs{
+		nfsClient: pb.NewNFSClient(conn),
+		clientID:  42,
+		slowLog:   newSlowLog("client"),
+	}
+
+	// every request is slow
+	c.slowLog.setThreshold(time.Nanosecond)
+	TestCtx.Server.SetSlowRequestThreshold(time.Nanosecond)
+	defer TestCtx.Server.SetSlowRequestThreshold(0)
+
+	ctx, tr := c.startOp("GetAttr", "/")
+	_, err = c.nfsClient.GetAttr(ctx, &pb.FileHandleRequest{
+		FileHandle: TestCtx.Server.rootFileHandle,
+	}, grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("getattr failed with error :: %v", err)
+	}
+	tr.finish(nil)
+
+	clientLog := c.slowLog.entries()
+	if len(clientLog) != 1 || !strings.Contains(clientLog[0], tr.id) ||
+		!strings.Contains(clientLog[0], "[GetAttr ") {
+		t.Fatalf("expected the operation and its rpc in the slow log :: %q",
+			clientLog)
+	}
+
+	var serverEntry string
+	for _, entry := range TestCtx.Server.slowLog.entries() {
+		if strings.Contains(entry, " "+tr.id+" ") {
+			serverEntry = entry
+		}
+	}
+	if !strings.Contains(serverEntry, "GetAttr") ||
+		!strings.Contains(serverEntry, "open ") ||
+		!strings.Contains(serverEntry, "fstat ") {
+		t.Fatalf("expected the rpc and its syscalls under the client's request "+
+			"id %s in the server's slow log :: %q", tr.id,
+			TestCtx.Server.slowLog.entries())
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	admin := pb.NewAdminClient(TestCtx.ClientConn)
+
+	health, err := pb.NewHealthClient(TestCtx.ClientConn).Check(ctx,
+		&pb.HealthCheckRequest{Service: "messages.NFS"}, grpc.FailFast(false))
+	if err != nil || health.Status != pb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected server to be serving :: %v %v", health, err)
+	}
+
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:24100", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewNFSClient(conn)
+	mResp, err := client.Mount(ctx, &pb.MountRequest{RootDirectory: "/"})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "adminfile",
+	}
+	cResp, err := client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	lockReq := func(clientID int64) *pb.LockRequest {
+		return &pb.LockRequest{
+			FileHandle: cResp.FileHandle,
+			Lock: &pb.FileLock{
+				ClientID: clientID,
+				Owner:    1,
+				End:      99,
+				Type:     pb.LockType_WRITE_LOCK,
+			},
+		}
+	}
+	if resp, err := client.Lock(ctx, lockReq(41)); err != nil || !resp.Granted {
+		t.Fatalf("failed to take write lock :: %v %v", resp, err)
+	}
+
+	list, err := admin.ListClients(ctx, &pb.ListClientsRequest{})
+	if err != nil {
+		t.Fatalf("failed to list clients :: %v", err)
+	}
+	var info *pb.ClientInfo
+	for _, c := range list.Clients {
+		if len(c.ClientIDs) == 1 && c.ClientIDs[0] == 41 {
+			info = c
+		}
+	}
+	if info == nil || len(info.Mounts) != 1 || info.Mounts[0] != "/" ||
+		info.Requests != 3 || info.InFlight != 0 {
+		t.Fatalf("client missing from %v", list.Clients)
+	}
+
+	_, err = admin.SetReadOnly(ctx, &pb.SetReadOnlyRequest{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to make export read-only :: %v", err)
+	}
+	_, err = client.Remove(ctx, fReq)
+	admin.SetReadOnly(ctx, &pb.SetReadOnlyRequest{ReadOnly: false})
+	if !isReadOnlyError(err) {
+		t.Fatalf("expected read-only export to refuse remove, got %v", err)
+	}
+	if _, err := client.Lookup(ctx, fReq); err != nil {
+		t.Fatalf("lookup failed on read-only export :: %v", err)
+	}
+
+	stats, err := admin.GetStats(ctx, &pb.GetStatsRequest{})
+	if err != nil || stats.ReadOnly || stats.Clients < 1 ||
+		!strings.Contains(stats.Metrics, `method="Lock"`) {
+		t.Fatalf("unexpected stats :: %v %v", stats, err)
+	}
+
+	_, err = admin.EvictClient(ctx,
+		&pb.EvictClientRequest{Address: info.Address})
+	if err != nil {
+		t.Fatalf("failed to evict client :: %v", err)
+	}
+	if _, err := client.Lookup(ctx, fReq); grpc.ErrorDesc(err) !=
+		grpc.ErrorDesc(errEvicted) {
+		t.Fatalf("expected evicted client to be refused, got %v", err)
+	}
+	resp, err := TestCtx.Client.TestLock(ctx, lockReq(42))
+	if err != nil || !resp.Granted {
+		t.Fatalf("lock of evicted client was not released :: %v %v", resp, err)
+	}
+
+	// admin identities only when tokens are required
+	TestCtx.Server.authSecret = []byte("0123456789abcdef")
+	TestCtx.Server.authPolicy = map[string]access{"alice": readWrite}
+	aliceConn, err := grpc.DialContext(ctx, "127.0.0.1:24100",
+		grpc.WithInsecure(), grpc.WithPerRPCCredentials(tokenCredentials{
+			NewToken(TestCtx.Server.authSecret, "alice", time.Time{})}))
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer aliceConn.Close()
+	_, err = pb.NewAdminClient(aliceConn).GetStats(ctx, &pb.GetStatsRequest{})
+	TestCtx.Server.authSecret = nil
+	TestCtx.Server.authPolicy = nil
+	if grpc.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for non-admin, got %v", err)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	wd, _ := os.Getwd()
+	s, err := NewServer(path.Join(wd, mountDir), "24102")
+	if err != nil {
+		t.Fatalf("failed to create server :: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Run()
+	}()
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:24102", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewNFSClient(conn)
+	mResp, err := client.Mount(ctx, &pb.MountRequest{}, grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+
+	// streams do not hold up the drain
+	watch, err := client.Watch(ctx,
+		&pb.WatchRequest{FileHandle: mResp.FileHandle})
+	if err != nil {
+		t.Fatalf("failed to watch :: %v", err)
+	}
+	resp, err := pb.NewAdminClient(conn).Drain(ctx,
+		&pb.DrainRequest{TimeoutMillis: 5000})
+	if err != nil || resp.Abandoned != 0 {
+		t.Fatalf("drain failed :: %v %v", resp, err)
+	}
+	if _, err := watch.Recv(); err == nil {
+		t.Fatalf("watch stream survived the drain")
+	}
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		t.Fatalf("server did not stop after draining")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samfs-config")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	root := path.Join(wd, mountDir)
+
+	load := func(config string) (*Config, error) {
+		file := path.Join(dir, "config.json")
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatalf("failed to write config :: %v", err)
+		}
+		return LoadConfig(file)
+	}
+
+	cfg, err := load(`{"exports": [
+	  {"root": "` + root + `", "listen": "127.0.0.1:24103", "readOnly": true,
+	   "createMode": "0750", "limits": {"recallTimeout": "2s"}},
+	  {"root": "` + root + `", "compression": false}
+	]}`)
+	if err != nil {
+		t.Fatalf("failed to load config :: %v", err)
+	}
+	if len(cfg.Exports) != 2 || cfg.Exports[1].Listen != ":24100" ||
+		cfg.Exports[1].Compression || !cfg.Exports[0].Compression ||
+		cfg.Exports[0].AuditLog.MaxFiles != 10 {
+		t.Fatalf("defaults were not applied :: %+v", cfg.Exports)
+	}
+	s, err := cfg.Exports[0].NewServer()
+	if err != nil {
+		t.Fatalf("failed to create server :: %v", err)
+	}
+	if s.listenAddress != "127.0.0.1:24103" || !s.isReadOnly() ||
+		s.createMode != 0750 || s.delegations.recallTimeout != 2*time.Second {
+		t.Fatalf("config was not applied :: %+v", s)
+	}
+
+	for _, c := range []struct {
+		config string
+		err    string
+	}{
+		{`{"exports": [{"root": "` + root + `",` + "\n" + `"listen" ":1"}]}`,
+			"config.json:2:10: invalid character"},
+		{`{"exports": [{"root": "` + root + `", "tls": {"certFile": "x"}}]}`,
+			`exports[0].tls: unknown setting "certFile"`},
+		{`{"exports": [{"root": "` + root + `", "limits": {"maxMessageSize": "1M"}}]}`,
+			"exports[0].limits.maxMessageSize: expected int, not string"},
+		{`{"exports": [{"root": "` + root + `", "flushInterval": "10"}]}`,
+			`exports[0].flushInterval: invalid duration "10"`},
+		{`{"exports": [{"root": "` + root + `", "createMode": "0999"}]}`,
+			`exports[0].createMode: invalid mode "0999"`},
+		{`{"exports": []}`, "exports: at least one export is required"},
+		{`{"exports": [{"listen": ":1"}]}`, "exports[0].root: the directory"},
+		{`{"exports": [{"root": "` + root + `/missing"}]}`,
+			"exports[0].root: stat"},
+		{`{"exports": [{"root": "` + root + `", "auth": {"secretFile": "s"}}]}`,
+			"exports[0].auth.policyFile: required with auth.secretFile"},
+		{`{"exports": [{"root": "` + root + `"}, {"root": "` + root + `"}]}`,
+			`exports[1].listen: address ":24100" is already used by exports[0]`},
+	} {
+		if _, err := load(c.config); err == nil ||
+			!strings.Contains(err.Error(), c.err) {
+			t.Errorf("expected error %q for %s, got %v", c.err, c.config, err)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "samfs-reload")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory :: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	root := path.Join(wd, mountDir)
+	file := path.Join(dir, "config.json")
+	write := func(exports ...string) {
+		config := `{"exports": [` + strings.Join(exports, ",") + `]}`
+		if err := ioutil.WriteFile(file, []byte(config), 0600); err != nil {
+			t.Fatalf("failed to write config :: %v", err)
+		}
+	}
+	first := `{"root": "` + root + `", "listen": "127.0.0.1:24104"`
+	second := `{"root": "` + root + `", "listen": "127.0.0.1:24105"}`
+
+	write(first + `}`)
+	group := NewServerGroup(func() (*Config, error) { return LoadConfig(file) })
+	if err := group.Start(); err != nil {
+		t.Fatalf("failed to start :: %v", err)
+	}
+	s := group.exports["127.0.0.1:24104"].server
+	defer group.Wait()
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, "127.0.0.1:24104", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	mResp, err := pb.NewNFSClient(conn).Mount(ctx, &pb.MountRequest{},
+		grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+
+	// settings a running server cannot change reject the whole config
+	write(first+`, "compression": false}`,
+		`{"root": "`+root+`/missing", "listen": "127.0.0.1:24105"}`)
+	if err := group.Reload(); err == nil {
+		t.Fatalf("reloaded an invalid config")
+	}
+	write(first+`, "compression": false, "flushInterval": "1s"}`, second)
+	if err := group.Reload(); err == nil ||
+		!strings.Contains(err.Error(), "exports[0].flushInterval") {
+		t.Fatalf("expected flushInterval to require a restart, got %v", err)
+	}
+	if !s.compression || len(group.exports) != 1 {
+		t.Fatalf("rejected config was applied")
+	}
+
+	write(first+`, "compression": false, "readOnly": true, "createMode": "0700"}`,
+		second)
+	_, err = pb.NewAdminClient(conn).Reload(ctx, &pb.ReloadRequest{})
+	if err != nil {
+		t.Fatalf("reload failed :: %v", err)
+	}
+	if s.compression || !s.isReadOnly() || s.fileMode() != 0700 {
+		t.Fatalf("config was not applied :: %+v", s)
+	}
+	// handles from before the reload stay valid
+	if _, err := pb.NewNFSClient(conn).GetAttr(ctx,
+		&pb.FileHandleRequest{FileHandle: mResp.FileHandle}); err != nil {
+		t.Fatalf("getattr failed after reload :: %v", err)
+	}
+	added, ok := group.exports["127.0.0.1:24105"]
+	if !ok {
+		t.Fatalf("new export was not started")
+	}
+	conn2, err := grpc.DialContext(ctx, "127.0.0.1:24105", grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn2.Close()
+	health, err := pb.NewHealthClient(conn2).Check(ctx,
+		&pb.HealthCheckRequest{}, grpc.FailFast(false))
+	if err != nil || health.Status != pb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected new export to be serving :: %v %v", health, err)
+	}
+
+	// an admin's read-only setting survives reloads that do not change it
+	atomic.StoreInt32(&s.readOnly, 0)
+	write(first + `, "compression": false, "readOnly": true}`)
+	if err := group.Reload(); err != nil {
+		t.Fatalf("reload failed :: %v", err)
+	}
+	if s.isReadOnly() || s.fileMode() != defaultPermission {
+		t.Fatalf("config was not applied :: %+v", s)
+	}
+	for !added.server.isDraining() {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	wd, _ := os.Getwd()
+	root := path.Join(wd, mountDir)
+	group := NewServerGroup(func() (*Config, error) {
+		e := DefaultExportConfig()
+		e.Root = root
+		e.Listen = "127.0.0.1:24106"
+		return &Config{Exports: []ExportConfig{e}}, nil
+	})
+	if err := group.Start(); err != nil {
+		t.Fatalf("failed to start :: %v", err)
+	}
+	s := group.exports["127.0.0.1:24106"].server
+	defer s.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := Dial("127.0.0.1", "24106", nil, "")
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewNFSClient(conn)
+	mResp, err := client.Mount(ctx, &pb.MountRequest{}, grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "shutdownfile",
+	}
+	cResp, err := client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	data := []byte("unstable")
+	_, err = client.Write(ctx, &pb.WriteRequest{
+		FileHandle: cResp.FileHandle,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %v", err)
+	}
+	if !s.dirty.paths["/shutdownfile"] {
+		t.Fatalf("uncommitted write was not tracked :: %v", s.dirty.paths)
+	}
+	// and so are copies and allocations
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "shutdowncopy",
+	}
+	copyResp, err := client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+	_, err = client.CopyRange(ctx, &pb.CopyRangeRequest{
+		SrcFileHandle: cResp.FileHandle,
+		DstFileHandle: copyResp.FileHandle,
+	})
+	if err != nil {
+		t.Fatalf("copy failed with error :: %v", err)
+	}
+	if !s.dirty.paths["/shutdowncopy"] {
+		t.Fatalf("uncommitted copy was not tracked :: %v", s.dirty.paths)
+	}
+	_, err = client.Commit(ctx, &pb.CommitRequest{
+		FileHandle: copyResp.FileHandle,
+	})
+	if err != nil {
+		t.Fatalf("commit failed with error :: %v", err)
+	}
+	_, err = client.Allocate(ctx, &pb.AllocateRequest{
+		FileHandle: copyResp.FileHandle,
+		Length:     4096,
+	})
+	if err != nil {
+		t.Fatalf("allocate failed with error :: %v", err)
+	}
+	if !s.dirty.paths["/shutdowncopy"] {
+		t.Fatalf("uncommitted allocation was not tracked :: %v",
+			s.dirty.paths)
+	}
+
+	// clients pause while the server drains instead of failing
+	atomic.StoreInt32(&s.draining, 1)
+	shortCtx, shortCancel := context.WithTimeout(ctx, 250*time.Millisecond)
+	defer shortCancel()
+	_, err = client.GetAttr(shortCtx,
+		&pb.FileHandleRequest{FileHandle: cResp.FileHandle})
+	if !isDrainingError(err) {
+		t.Fatalf("expected the server to refuse requests, got %v", err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		atomic.StoreInt32(&s.draining, 0)
+	}()
+	_, err = client.GetAttr(ctx,
+		&pb.FileHandleRequest{FileHandle: cResp.FileHandle})
+	if err != nil {
+		t.Fatalf("request was not retried once the server resumed :: %v", err)
+	}
+
+	// files made read only after they were written are synced too
+	if err := os.Chmod(path.Join(wd, mountDir, "shutdownfile"), 0444); err != nil {
+		t.Fatalf("chmod failed :: %v", err)
+	}
+	group.Shutdown(5 * time.Second)
+	group.Wait()
+	if len(s.dirty.paths) != 0 {
+		t.Fatalf("dirty files were not synced :: %v", s.dirty.paths)
+	}
+	if !s.isDraining() {
+		t.Fatalf("server stopped without draining")
+	}
+}
+
+func upgradeTestConfig() (*Config, error) {
+	wd, _ := os.Getwd()
+	e := DefaultExportConfig()
+	e.Root = path.Join(wd, mountDir)
+	e.Listen = "127.0.0.1:24107"
+	e.Limits.LockGracePeriod = 0
+	return &Config{Exports: []ExportConfig{e}}, nil
+}
+
+func runUpgradedServer() {
+	group := NewServerGroup(upgradeTestConfig)
+	if err := group.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "upgraded server failed to start :: %v\n", err)
+		os.Exit(1)
+	}
+	// the test drains the server, but must not leave it behind if it fails
+	time.AfterFunc(time.Minute, func() { os.Exit(1) })
+	group.Wait()
+	glog.Flush()
+	os.Exit(0)
+}
+
+func TestUpgrade(t *testing.T) {
+	group := NewServerGroup(upgradeTestConfig)
+	if err := group.Start(); err != nil {
+		t.Fatalf("failed to start :: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	conn, err := Dial("127.0.0.1", "24107", nil, "")
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	client := pb.NewNFSClient(conn)
+	mResp, err := client.Mount(ctx, &pb.MountRequest{}, grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	fReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "upgradefile",
+	}
+	cResp, err := client.Create(ctx, fReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, fReq)
+	lockReq := &pb.LockRequest{
+		FileHandle: cResp.FileHandle,
+		Lock: &pb.FileLock{
+			ClientID: 1,
+			Owner:    1,
+			End:      99,
+			Type:     pb.LockType_WRITE_LOCK,
+		},
+	}
+	lResp, err := client.Lock(ctx, lockReq)
+	if err != nil || !lResp.Granted {
+		t.Fatalf("failed to take lock :: %v %v", lResp, err)
+	}
+	sessionID := lResp.ServerSessionID
+
+	// writers keep going through the upgrade without seeing a restart
+	stop := make(chan struct{})
+	errs := make(chan error, 4)
+	var writes uint64
+	for i := 0; i < 4; i++ {
+		go func(i int) {
+			data := []byte(fmt.Sprintf("writer %d", i))
+			for {
+				select {
+				case <-stop:
+					errs <- nil
+					return
+				default:
+				}
+				resp, err := client.Write(ctx, &pb.WriteRequest{
+					FileHandle: cResp.FileHandle,
+					Offset:     int64(i * len(data)),
+					Size:       int64(len(data)),
+					Data:       data,
+				}, grpc.FailFast(false))
+				if err == nil && resp.ServerSessionID != sessionID {
+					err = fmt.Errorf("session changed from %d to %d", sessionID,
+						resp.ServerSessionID)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				atomic.AddUint64(&writes, 1)
+			}
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := group.Upgrade([]string{os.Args[0]}, 5*time.Second); err != nil {
+		t.Fatalf("upgrade failed :: %v", err)
+	}
+	group.Wait()
+	before := atomic.LoadUint64(&writes)
+	for atomic.LoadUint64(&writes) < before+100 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	for i := 0; i < 4; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("write failed during the upgrade :: %v", err)
+		}
+	}
+
+	// the new server kept the lock
+	lockReq.Lock.ClientID = 2
+	lResp, err = client.TestLock(ctx, lockReq)
+	if err != nil || lResp.Granted || lResp.Conflict.ClientID != 1 {
+		t.Fatalf("lock was not handed over :: %v %v", lResp, err)
+	}
+	_, err = pb.NewAdminClient(conn).Drain(ctx,
+		&pb.DrainRequest{TimeoutMillis: 5000})
+	if err != nil {
+		t.Fatalf("failed to stop the upgraded server :: %v", err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	s := newScheduler(newMetrics())
+	s.setLimits(schedulerLimits{workers: 1, client: rateLimits{ops: 5}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	release, err := s.admit(ctx, "a", &pb.ReadRequest{Size: 1})
+	if err != nil {
+		t.Fatalf("admit failed :: %v", err)
+	}
+	// requests queue up behind the busy worker
+	granted := make(chan string, 4)
+	queue := func(address string, req interface{}, name string) {
+		go func() {
+			done, err := s.admit(ctx, address, req)
+			if err != nil {
+				granted <- err.Error()
+				return
+			}
+			granted <- name
+			done()
+		}()
+	}
+	waitQueued := func(n int64) {
+		for atomic.LoadInt64(&s.metrics.queued) != n {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	queue("a", &pb.WriteRequest{Size: 1}, "a write 1")
+	waitQueued(1)
+	queue("a", &pb.WriteRequest{Size: 1}, "a write 2")
+	waitQueued(2)
+	queue("b", &pb.ReadRequest{Size: 1}, "b read")
+	waitQueued(3)
+	queue("c", &pb.FileHandleRequest{}, "c getattr")
+	waitQueued(4)
+
+	// metadata goes first, then clients take turns
+	release()
+	for _, want := range []string{"c getattr", "a write 1", "b read",
+		"a write 2"} {
+		if got := <-granted; got != want {
+			t.Fatalf("expected %s to be handled next, got %s", want, got)
+		}
+	}
+
+	// a burst of a second's worth, then requests are throttled
+	for i := 0; i < 4; i++ {
+		done, err := s.admit(ctx, "b", &pb.FileHandleRequest{})
+		if err != nil {
+			t.Fatalf("admit %d failed :: %v", i, err)
+		}
+		done()
+	}
+	if _, err := s.admit(ctx, "b", &pb.FileHandleRequest{}); !isThrottledError(err) {
+		t.Fatalf("expected request to be throttled, got %v", err)
+	}
+	var metrics bytes.Buffer
+	s.metrics.write(&metrics)
+	if !strings.Contains(metrics.String(),
+		`samfs_throttled_total{reason="client_ops"} 1`) {
+		t.Fatalf("throttled request not in metrics :: %s", metrics.String())
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	req := &pb.FileHandleRequest{FileHandle: mResp.FileHandle}
+
+	TestCtx.Server.scheduler.setLimits(schedulerLimits{
+		export: rateLimits{ops: 1},
+	})
+	defer TestCtx.Server.scheduler.setLimits(schedulerLimits{})
+	if _, err := TestCtx.Client.GetAttr(ctx, req); err != nil {
+		t.Fatalf("getattr failed with error :: %v", err)
+	}
+	if _, err := TestCtx.Client.GetAttr(ctx, req); !isThrottledError(err) {
+		t.Fatalf("expected getattr to be throttled, got %v", err)
+	}
+
+	// samfs clients back off until the request gets through
+	conn, err := Dial("127.0.0.1", "24100", nil, "")
+	if err != nil {
+		t.Fatalf("failed to connect :: %v", err)
+	}
+	defer conn.Close()
+	if _, err := pb.NewNFSClient(conn).GetAttr(ctx, req); err != nil {
+		t.Fatalf("throttled getattr was not retried :: %v", err)
+	}
+}
+
+func TestFdCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	s := TestCtx.Server
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "fdcached",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	fh := cResp.FileHandle
+	data := []byte("cached")
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: fh,
+		Size:       int64(len(data)),
+		Data:       data,
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %v", err)
+	}
+	read := func(fh *pb.FileHandle) error {
+		resp, err := TestCtx.Client.Read(ctx,
+			&pb.ReadRequest{FileHandle: fh, Size: int64(len(data))})
+		if err == nil && string(resp.Data) != string(data) {
+			t.Fatalf("read %q, expected %q", resp.Data, data)
+		}
+		return err
+	}
+	hits := atomic.LoadUint64(&s.metrics.fdCacheHits)
+	if err := read(fh); err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+	if n := atomic.LoadUint64(&s.metrics.fdCacheHits); n != hits+1 {
+		t.Fatalf("read did not use the file opened by the write")
+	}
+
+	// renamed files are opened again at their new path
+	_, err = TestCtx.Client.Rename(ctx, &pb.RenameRequest{
+		FromDirHandle: mResp.FileHandle,
+		FromName:      "fdcached",
+		ToDirHandle:   mResp.FileHandle,
+		ToName:        "fdcached2",
+	})
+	if err != nil {
+		t.Fatalf("rename failed with error :: %v", err)
+	}
+	s.fds.Lock()
+	_, ok := s.fds.files[handleKey(fh)]
+	s.fds.Unlock()
+	if ok {
+		t.Fatalf("renamed file is still cached")
+	}
+	if err := read(fh); err == nil {
+		t.Fatalf("read with the handle of the old path succeeded")
+	}
+	cReq.Name = "fdcached2"
+	lResp, err := TestCtx.Client.Lookup(ctx, cReq)
+	if err != nil {
+		t.Fatalf("lookup failed with error :: %v", err)
+	}
+	if err := read(lResp.FileHandle); err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+
+	// a file replaced behind the server's back is not read through the
+	// cache
+	filePath := path.Join(s.rootDirectory, "fdcached2")
+	if err := os.Remove(filePath); err != nil {
+		t.Fatalf("failed to remove file :: %v", err)
+	}
+	if err := ioutil.WriteFile(filePath, data, 0644); err != nil {
+		t.Fatalf("failed to replace file :: %v", err)
+	}
+	if err := read(lResp.FileHandle); err == nil {
+		t.Fatalf("read with the handle of the replaced file succeeded")
+	}
+	lResp, err = TestCtx.Client.Lookup(ctx, cReq)
+	if err != nil {
+		t.Fatalf("lookup failed with error :: %v", err)
+	}
+	if err := read(lResp.FileHandle); err != nil {
+		t.Fatalf("read failed with error :: %v", err)
+	}
+
+	if _, err := TestCtx.Client.Remove(ctx, cReq); err != nil {
+		t.Fatalf("remove failed with error :: %v", err)
+	}
+	s.fds.Lock()
+	_, ok = s.fds.files[handleKey(lResp.FileHandle)]
+	s.fds.Unlock()
+	if ok {
+		t.Fatalf("removed file is still cached")
+	}
+
+	s.fds.setCapacity(0)
+	defer s.fds.setCapacity(defaultFdCacheSize)
+	if n := atomic.LoadInt64(&s.metrics.fdCacheOpen); n != 0 {
+		t.Fatalf("%d files still open with the cache disabled", n)
+	}
+}
+
+// BenchmarkRead reads a file over and over, with the open file cache and
+// without it.
+func BenchmarkRead(b *testing.B) {
+	ctx := context.Background()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{})
+	if err != nil {
+		b.Fatalf("mounting failed with error :: %v", err)
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "benchread",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		b.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: cResp.FileHandle,
+		Size:       4096,
+		Data:       make([]byte, 4096),
+	})
+	if err != nil {
+		b.Fatalf("write failed with error :: %v", err)
+	}
+
+	for _, bench := range []struct {
+		name     string
+		capacity int
+	}{{"cached", defaultFdCacheSize}, {"uncached", 0}} {
+		b.Run(bench.name, func(b *testing.B) {
+			TestCtx.Server.fds.setCapacity(bench.capacity)
+			defer TestCtx.Server.fds.setCapacity(defaultFdCacheSize)
+			req := &pb.ReadRequest{FileHandle: cResp.FileHandle, Size: 4096}
+			b.SetBytes(4096)
+			for i := 0; i < b.N; i++ {
+				if _, err := TestCtx.Client.Read(ctx, req); err != nil {
+					b.Fatalf("read failed with error :: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	m := newMetrics()
+	c := newCommitter(m)
+	release := make(chan struct{})
+	var syncs [][]string
+	var lock sync.Mutex
+	c.dirs.sync = func(b *commitBatch) error {
+		lock.Lock()
+		var dirs []string
+		for dirPath := range b.dirs {
+			dirs = append(dirs, dirPath)
+			if dirPath == "missing" {
+				b.dirs[dirPath] = os.ErrNotExist
+			}
+		}
+		first := len(syncs) == 0
+		syncs = append(syncs, dirs)
+		lock.Unlock()
+		if first {
+			<-release
+		}
+		return nil
+	}
+
+	errs := make(chan error, 6)
+	go func() { errs <- c.syncDir("first") }()
+	for atomic.LoadUint64(&m.commitSyncs) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	// requests arriving while a sync runs wait for the next one together
+	for _, dirPath := range []string{"a", "b", "b", "c", "missing"} {
+		go func(dirPath string) { errs <- c.syncDir(dirPath) }(dirPath)
+	}
+	for atomic.LoadUint64(&m.commitRequests) != 6 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	failed := 0
+	for i := 0; i < 6; i++ {
+		if err := <-errs; err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Fatalf("expected only the missing directory to fail, %d failed",
+			failed)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if len(syncs) != 2 || len(syncs[1]) != 4 {
+		t.Fatalf("expected a sync of 1 and a sync of 4 directories, got %v",
+			syncs)
+	}
+
+	// concurrent commits of a file share syncs and all succeed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{})
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "groupcommit",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+	s := TestCtx.Server
+	requests := atomic.LoadUint64(&s.metrics.commitRequests)
+	syncCount := atomic.LoadUint64(&s.metrics.commitSyncs)
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := TestCtx.Client.Write(ctx, &pb.WriteRequest{
+				FileHandle:   cResp.FileHandle,
+				Offset:       int64(i * 8),
+				Size:         8,
+				Data:         []byte("01234567"),
+				ShouldCommit: true,
+			})
+			if err != nil {
+				t.Errorf("committed write failed with error :: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	requests = atomic.LoadUint64(&s.metrics.commitRequests) - requests
+	syncCount = atomic.LoadUint64(&s.metrics.commitSyncs) - syncCount
+	if requests != 16 || syncCount > requests {
+		t.Fatalf("%d committed writes took %d syncs", requests, syncCount)
+	}
+	s.commits.Lock()
+	left := len(s.commits.files)
+	s.commits.Unlock()
+	if left != 0 {
+		t.Fatalf("%d files still queued for syncing", left)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{},
+		grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "appended",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+
+	// every writer appends its records without knowing where the end is
+	const writers, records, recordSize = 8, 10, 16
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	offsets := make(map[int64]string)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for r := 0; r < records; r++ {
+				record := fmt.Sprintf("writer %d rec %02d\n", w, r)[:recordSize]
+				resp, err := TestCtx.Client.Append(ctx, &pb.WriteRequest{
+					FileHandle: cResp.FileHandle,
+					Offset:     0,
+					Size:       recordSize,
+					Data:       []byte(record),
+				})
+				if err != nil {
+					t.Errorf("append failed with error :: %v", err)
+					return
+				}
+				lock.Lock()
+				offsets[resp.Offset] = record
+				lock.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	if len(offsets) != writers*records {
+		t.Fatalf("expected %d distinct offsets, got %d", writers*records,
+			len(offsets))
+	}
+
+	data, err := ioutil.ReadFile(path.Join(TestCtx.Server.rootDirectory,
+		"appended"))
+	if err != nil {
+		t.Fatalf("failed to read file :: %v", err)
+	}
+	if len(data) != writers*records*recordSize {
+		t.Fatalf("expected %d bytes, file has %d",
+			writers*records*recordSize, len(data))
+	}
+	for off, record := range offsets {
+		if got := string(data[off : off+recordSize]); got != record {
+			t.Fatalf("expected %q at %d, got %q", record, off, got)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	mResp, err := TestCtx.Client.Mount(ctx, &pb.MountRequest{},
+		grpc.FailFast(false))
+	if err != nil {
+		t.Fatalf("mounting failed with error :: %v", err)
+	}
+	cReq := &pb.LocalDirectoryRequest{
+		DirectoryFileHandle: mResp.FileHandle,
+		Name:                "truncated",
+	}
+	cResp, err := TestCtx.Client.Create(ctx, cReq)
+	if err != nil {
+		t.Fatalf("create failed with error :: %v", err)
+	}
+	defer TestCtx.Client.Remove(ctx, cReq)
+	_, err = TestCtx.Client.Write(ctx, &pb.WriteRequest{
+		FileHandle: cResp.FileHandle,
+		Size:       100,
+		Data:       bytes.Repeat([]byte("x"), 100),
+	})
+	if err != nil {
+		t.Fatalf("write failed with error :: %v", err)
+	}
+
+	for _, size := range []int64{10, 50} {
+		resp, err := TestCtx.Client.Truncate(ctx, &pb.TruncateRequest{
+			FileHandle: cResp.FileHandle,
+			Size:       size,
+		})
+		if err != nil {
+			t.Fatalf("truncate failed with error :: %v", err)
+		}
+		if resp.Wcc == nil || int64(resp.Wcc.After.Size) != size {
+			t.Fatalf("expected the size after truncating to be %d, got %v",
+				size, resp.Wcc)
+		}
+	}
+	// appends go where the truncation left the end of file
+	aResp, err := TestCtx.Client.Append(ctx, &pb.WriteRequest{
+		FileHandle: cResp.FileHandle,
+		Size:       1,
+		Data:       []byte("y"),
+	})
+	if err != nil {
+		t.Fatalf("append failed with error :: %v", err)
+	}
+	if aResp.Offset != 50 {
+		t.Fatalf("expected to append at 50, appended at %d", aResp.Offset)
+	}
+	data, err := ioutil.ReadFile(path.Join(TestCtx.Server.rootDirectory,
+		"truncated"))
+	if err != nil {
+		t.Fatalf("failed to read file :: %v", err)
+	}
+	want := append(bytes.Repeat([]byte("x"), 10), make([]byte, 40)...)
+	if want = append(want, 'y'); !bytes.Equal(data, want) {
+		t.Fatalf("expected %q, file has %q", want, data)
+	}
+}
+
+func TestOpenFlags(t *testing.T) {
+	fs := &SamFs{options: &SamFsOptions{}}
+	handle := func(flags uint32) *SamFsFileHandle {
+		return &SamFsFileHandle{
+			flags:    flags,
+			fileData: NewFileData("flags", fs, &pb.FileHandle{}),
+		}
+	}
+
+	if _, status := handle(syscall.O_WRONLY).Read(make([]byte, 1), 0); status != fuse.EBADF {
+		t.Fatalf("read through a write-only handle returned %v", status)
+	}
+	readOnly := handle(syscall.O_RDONLY)
+	if _, status := readOnly.Write([]byte("x"), 0); status != fuse.EBADF {
+		t.Fatalf("write through a read-only handle returned %v", status)
+	}
+	if status := readOnly.Truncate(0); status != fuse.EBADF {
+		t.Fatalf("truncate through a read-only handle returned %v", status)
+	}
+	if readOnly.stable() || !handle(syscall.O_RDWR|syscall.O_SYNC).stable() ||
+		!handle(syscall.O_WRONLY|syscall.O_DSYNC).stable() {
+		t.Fatalf("only O_SYNC and O_DSYNC handles should be stable")
+	}
+	fs.options.sync = true
+	if !handle(syscall.O_WRONLY).stable() {
+		t.Fatalf("handles of a sync mount should be stable")
+	}
+}
+
+// mountClient mounts the test server with a client of its own, and skips
+// the test where FUSE file systems cannot be mounted.
+func mountClient(t *testing.T) (string, *SamFSClient, func()) {
+	if _, err := exec.LookPath("fusermount"); err != nil {
+		t.Skip("fusermount not found, skipping test on a FUSE mount")
+	}
+	dir, err := ioutil.TempDir("", "samfs-mount")
+	if err != nil {
+		t.Fatalf("failed to create mount point :: %v", err)
+	}
+	server, port, checksum, compression := "127.0.0.1", "24100", "", false
+	client, err := NewClient(&server, &port, &dir, &checksum, &compression,
+		nil, "")
+	if err != nil {
+		os.Remove(dir)
+		t.Skipf("cannot mount FUSE file systems :: %v", err)
+	}
+	go client.Run()
+	if err := client.fuseServer.WaitMount(); err != nil {
+		t.Fatalf("mount did not come up :: %v", err)
+	}
+	return dir, client, func() {
+		if err := client.fuseServer.Unmount(); err != nil {
+			t.Errorf("failed to unmount %s :: %v", dir, err)
+		}
+		// the server stops gracefully only once the callback streams are gone
+		client.samFS.OnUnmount()
+		os.Remove(dir)
+	}
+}
+
+// openMounted opens a file on a mount of the test process itself without
+// os.OpenFile, which would have the runtime poll it and FUSE call the
+// process back while it waits.
+func openMounted(t *testing.T, name string, flags int) int {
+	fd, err := syscall.Open(name, flags, 0644)
+	if err != nil {
+		t.Fatalf("failed to open %s :: %v", name, err)
+	}
+	return fd
+}
+
+func TestFuseLocks(t *testing.T) {
+	dir1, _, unmount1 := mountClient(t)
+	defer unmount1()
+	dir2, client2, unmount2 := mountClient(t)
+	defer unmount2()
+
+	fd1 := openMounted(t, path.Join(dir1, "locked"), syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(path.Join(dir1, "locked"))
+	defer syscall.Close(fd1)
+	fd2 := openMounted(t, path.Join(dir2, "locked"), syscall.O_RDWR)
+	defer syscall.Close(fd2)
+
+	// fcntl locks of one client hold against the other
+	lk := &syscall.Flock_t{Type: syscall.F_WRLCK, Start: 0, Len: 10}
+	if err := syscall.FcntlFlock(uintptr(fd1), syscall.F_SETLK, lk); err != nil {
+		t.Fatalf("failed to lock file :: %v", err)
+	}
+	lk2 := &syscall.Flock_t{Type: syscall.F_WRLCK, Start: 5, Len: 10}
+	if err := syscall.FcntlFlock(uintptr(fd2), syscall.F_SETLK, lk2); err != syscall.EAGAIN {
+		t.Fatalf("expected conflicting lock to fail with EAGAIN, got %v", err)
+	}
+	if err := syscall.FcntlFlock(uintptr(fd2), syscall.F_GETLK, lk2); err != nil ||
+		lk2.Type != syscall.F_WRLCK || lk2.Start != 0 || lk2.Len != 10 {
+		t.Fatalf("expected F_GETLK to report the conflict, got %+v :: %v",
+			lk2, err)
+	}
+	lk.Type = syscall.F_UNLCK
+	if err := syscall.FcntlFlock(uintptr(fd1), syscall.F_SETLK, lk); err != nil {
+		t.Fatalf("failed to unlock file :: %v", err)
+	}
+	lk2 = &syscall.Flock_t{Type: syscall.F_WRLCK, Start: 5, Len: 10}
+	if err := syscall.FcntlFlock(uintptr(fd2), syscall.F_SETLK, lk2); err != nil {
+		t.Fatalf("lock not granted after unlock :: %v", err)
+	}
+
+	// and so do flock locks
+	if err := syscall.Flock(fd2, syscall.LOCK_EX); err != nil {
+		t.Fatalf("failed to flock file :: %v", err)
+	}
+	err := syscall.Flock(fd1, syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != syscall.EWOULDBLOCK {
+		t.Fatalf("expected conflicting flock to fail, got %v", err)
+	}
+	if err := syscall.Flock(fd2, syscall.LOCK_UN); err != nil {
+		t.Fatalf("failed to unlock file :: %v", err)
+	}
+	if err := syscall.Flock(fd1, syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		t.Fatalf("flock not granted after unlock :: %v", err)
+	}
+
+	// unlocking the whole file leaves nothing to reclaim
+	lk2 = &syscall.Flock_t{Type: syscall.F_UNLCK, Start: 0, Len: 0}
+	if err := syscall.FcntlFlock(uintptr(fd2), syscall.F_SETLK, lk2); err != nil {
+		t.Fatalf("failed to unlock file :: %v", err)
+	}
+	fs := client2.samFS
+	fs.cacheLock.RLock()
+	fdata := fs.fileCache["locked"]
+	fs.cacheLock.RUnlock()
+	fdata.Lock()
+	locks := fdata.Locks
+	fdata.Unlock()
+	if len(locks) != 0 {
+		t.Fatalf("expected no locks to reclaim after unlock, got %v", locks)
+	}
+}
+
+func TestFuseSeek(t *testing.T) {
+	dir, _, unmount := mountClient(t)
+	defer unmount()
+
+	name := path.Join(dir, "sparse")
+	fd := openMounted(t, name, syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(name)
+	defer syscall.Close(fd)
+
+	const holeSize = 1 << 20
+	data := bytes.Repeat([]byte("samfs"), 1000)
+	if _, err := syscall.Pwrite(fd, data, holeSize); err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+
+	// SEEK_DATA and SEEK_HOLE find the hole the server has in the file
+	off, err := syscall.Seek(fd, 0, seekData)
+	if err != nil || off != holeSize {
+		t.Fatalf("expected data at %d, got %d :: %v", holeSize, off, err)
+	}
+	off, err = syscall.Seek(fd, holeSize, seekHole)
+	if err != nil || off != holeSize+int64(len(data)) {
+		t.Fatalf("expected hole at the end of file, got %d :: %v", off, err)
+	}
+	if _, err := syscall.Seek(fd, 2*holeSize, seekData); err != syscall.ENXIO {
+		t.Fatalf("expected ENXIO seeking data past the end, got %v", err)
+	}
+}
+
+func TestFuseCopyRange(t *testing.T) {
+	dir, _, unmount := mountClient(t)
+	defer unmount()
+
+	srcName, dstName := path.Join(dir, "copysrc"), path.Join(dir, "copydst")
+	src := os.NewFile(uintptr(openMounted(t, srcName,
+		syscall.O_RDWR|syscall.O_CREAT)), srcName)
+	defer syscall.Unlink(srcName)
+	defer src.Close()
+	dst := os.NewFile(uintptr(openMounted(t, dstName,
+		syscall.O_RDWR|syscall.O_CREAT)), dstName)
+	defer syscall.Unlink(dstName)
+	defer dst.Close()
+
+	data := bytes.Repeat([]byte("copy me over "), 1000)
+	if _, err := syscall.Pwrite(int(src.Fd()), data, 0); err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+
+	// copy_file_range(2) on the mount becomes a CopyRange request
+	copies := &TestCtx.Server.metrics.rpc("CopyRange").requests
+	before := atomic.LoadUint64(copies)
+	n, _, err := copyRange(src, 100, dst, 0, 5000)
+	if err != nil || n != 5000 {
+		t.Fatalf("copied %d bytes :: %v", n, err)
+	}
+	if atomic.LoadUint64(copies) == before {
+		t.Fatalf("copy was not sent to the server")
+	}
+
+	got := make([]byte, 5000)
+	if _, err := syscall.Pread(int(dst.Fd()), got, 0); err != nil {
+		t.Fatalf("read failed :: %v", err)
+	}
+	if !bytes.Equal(got, data[100:5100]) {
+		t.Fatalf("copy differs from the source")
+	}
+}
+
+func TestFuseWcc(t *testing.T) {
+	dir, client, unmount := mountClient(t)
+	defer unmount()
+
+	name := path.Join(dir, "wcc")
+	fd := openMounted(t, name, syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(name)
+	_, err := syscall.Pwrite(fd, []byte("before"), 0)
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+	// let the watch event of the write pass, it would drop the delegation
+	time.Sleep(watchCoalesceWindow + 500*time.Millisecond)
+	// read under a delegation, which keeps the data in the client
+	fd = openMounted(t, name, syscall.O_RDONLY)
+	defer syscall.Close(fd)
+	buf := make([]byte, 6)
+	if _, err := syscall.Pread(fd, buf, 0); err != nil {
+		t.Fatalf("read failed :: %v", err)
+	}
+
+	// pre-operation attributes that differ from the cached ones mean
+	// someone else changed the file, so its cached data is dropped
+	fs := client.samFS
+	fs.cacheLock.RLock()
+	fdata := fs.fileCache["wcc"]
+	fs.cacheLock.RUnlock()
+	if fdata == nil {
+		t.Fatalf("file is not cached")
+	}
+	fdata.Lock()
+	deleg := fdata.Deleg
+	fdata.Unlock()
+	if deleg != pb.DelegationType_READ_DELEGATION {
+		t.Fatalf("expected a read delegation, got %v", deleg)
+	}
+	fs.cacheAttr("wcc", &pb.GetAttrReply{Size: 6})
+	if !fs.applyWcc("wcc", &pb.WccData{
+		Before: &pb.WccAttr{Size: 7},
+		After:  &pb.GetAttrReply{Size: 7},
+	}) {
+		t.Fatalf("change by someone else was not detected")
+	}
+	deadline := time.Now().Add(watchCoalesceWindow / 2)
+	for {
+		fdata.Lock()
+		deleg = fdata.Deleg
+		fdata.Unlock()
+		if deleg != pb.DelegationType_READ_DELEGATION {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("read delegation was kept after a change")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestFuseOpenTrunc(t *testing.T) {
+	dir, _, unmount := mountClient(t)
+	defer unmount()
+
+	name := path.Join(dir, "trunc")
+	fd := openMounted(t, name, syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(name)
+	if _, err := syscall.Write(fd, []byte("truncated on open")); err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+	syscall.Close(fd)
+
+	// the kernel truncates with a SETATTR before opening, which becomes a
+	// Truncate request
+	truncates := &TestCtx.Server.metrics.rpc("Truncate").requests
+	before := atomic.LoadUint64(truncates)
+	fd = openMounted(t, name, syscall.O_WRONLY|syscall.O_TRUNC)
+	syscall.Close(fd)
+	if atomic.LoadUint64(truncates) == before {
+		t.Fatalf("truncation was not sent to the server")
+	}
+	info, err := os.Stat(path.Join(TestCtx.Server.rootDirectory, "trunc"))
+	if err != nil || info.Size() != 0 {
+		t.Fatalf("file was not truncated on the server :: %v %v", info, err)
+	}
+}
+
+func TestFuseWatchOverflow(t *testing.T) {
+	dir, _, unmount := mountClient(t)
+	defer unmount()
+
+	sub := path.Join(dir, "overflowdir")
+	if err := syscall.Mkdir(sub, 0755); err != nil {
+		t.Fatalf("mkdir failed :: %v", err)
+	}
+	defer syscall.Rmdir(sub)
+	name := path.Join(sub, "f")
+	fd := openMounted(t, name, syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(name)
+	_, err := syscall.Pwrite(fd, []byte("before"), 0)
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+	fd = openMounted(t, name, syscall.O_RDONLY)
+	defer syscall.Close(fd)
+	buf := make([]byte, 6)
+	if _, err := syscall.Pread(fd, buf, 0); err != nil {
+		t.Fatalf("read failed :: %v", err)
+	}
+
+	wd, _ := os.Getwd()
+	localPath := path.Join(wd, mountDir, "overflowdir", "f")
+	if err := ioutil.WriteFile(localPath, []byte("after!"), 0666); err != nil {
+		t.Fatalf("failed to write local file :: %v", err)
+	}
+	// the mount forgets everything it cached when its watch overflows
+	hub := TestCtx.Server.watches
+	hub.Lock()
+	for w := range hub.watchers {
+		select {
+		case w.overflow <- struct{}{}:
+		default:
+		}
+	}
+	hub.Unlock()
+	time.Sleep(200 * time.Millisecond)
+
+	var st syscall.Stat_t
+	if err := syscall.Stat(name, &st); err != nil || st.Size != 6 {
+		t.Fatalf("stat after overflow returned size %d :: %v", st.Size, err)
+	}
+	if _, err := syscall.Pread(fd, buf, 0); err != nil {
+		t.Fatalf("read failed :: %v", err)
+	}
+	if string(buf) != "after!" {
+		t.Fatalf("read %q after overflow, want %q", buf, "after!")
+	}
+}
+
+func TestFuseWatchModify(t *testing.T) {
+	dir, _, unmount := mountClient(t)
+	defer unmount()
+
+	name := path.Join(dir, "modified")
+	fd := openMounted(t, name, syscall.O_RDWR|syscall.O_CREAT)
+	defer syscall.Unlink(name)
+	_, err := syscall.Pwrite(fd, []byte("before"), 0)
+	syscall.Close(fd)
+	if err != nil {
+		t.Fatalf("write failed :: %v", err)
+	}
+	// read under a delegation, which keeps the data in the client
+	fd = openMounted(t, name, syscall.O_RDONLY)
+	defer syscall.Close(fd)
+	buf := make([]byte, 6)
+	if _, err := syscall.Pread(fd, buf, 0); err != nil {
+		t.Fatalf("read failed :: %v", err)
+	}
+
+	// a change made on the server's disk reaches the client through its watch
+	wd, _ := os.Getwd()
+	localPath := path.Join(wd, mountDir, "modified")
+	if err := ioutil.WriteFile(localPath, []byte("after!"), 0666); err != nil {
+		t.Fatalf("failed to write local file :: %v", err)
+	}
+	deadline := time.Now().Add(watchCoalesceWindow + 2*time.Second)
+	for {
+		if _, err := syscall.Pread(fd, buf, 0); err != nil {
+			t.Fatalf("read failed :: %v", err)
+		}
+		if string(buf) == "after!" {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still read %q after a change on the server", buf)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,128 @@
+package samfs
+
+import (
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// how long clients wait before retrying a request refused by a draining or
+// throttling server, at most
+const maxRetryBackoff = 5 * time.Second
+
+// dirtyFiles tracks the files written without being committed, which a
+// stopping server syncs so that clients do not have to replay their writes.
+type dirtyFiles struct {
+	sync.Mutex
+	paths map[string]bool
+}
+
+func newDirtyFiles() *dirtyFiles {
+	return &dirtyFiles{paths: make(map[string]bool)}
+}
+
+func (d *dirtyFiles) add(filePath string) {
+	d.Lock()
+	d.paths[filePath] = true
+	d.Unlock()
+}
+
+func (d *dirtyFiles) remove(filePath string) {
+	d.Lock()
+	delete(d.paths, filePath)
+	d.Unlock()
+}
+
+// sync fsyncs every dirty file and returns how many could not be; files
+// removed or renamed since they were written are skipped. They are opened
+// read only, fsync does not need more and they may have been made read only
+// since.
+func (d *dirtyFiles) sync(root string) int {
+	d.Lock()
+	defer d.Unlock()
+	failed := 0
+	for filePath := range d.paths {
+		fd, err := os.Open(path.Join(root, filePath))
+		if os.IsNotExist(err) {
+			delete(d.paths, filePath)
+			continue
+		}
+		if err == nil {
+			err = fd.Sync()
+			fd.Close()
+		}
+		if err != nil {
+			glog.Errorf("could not perform fsync on file %s :: %v\n", filePath,
+				err)
+			failed++
+			continue
+		}
+		delete(d.paths, filePath)
+	}
+	return failed
+}
+
+// Shutdown drains every server of the group, giving requests in flight
+// until timeout to finish. Wait returns once they have stopped.
+func (g *ServerGroup) Shutdown(timeout time.Duration) {
+	g.Lock()
+	defer g.Unlock()
+	var wg sync.WaitGroup
+	for _, export := range g.exports {
+		wg.Add(1)
+		go func(export *groupExport) {
+			defer wg.Done()
+			abandoned, err := export.server.drain(context.Background(), timeout)
+			if err != nil {
+				// already draining, e.g. on a request of an admin
+				glog.V(2).Infof("not draining %s :: %v", export.config.Listen, err)
+				return
+			}
+			glog.Infof("export %s on %s drained, %d requests abandoned",
+				export.config.Root, export.config.Listen, abandoned)
+		}(export)
+	}
+	wg.Wait()
+}
+
+func isDrainingError(err error) bool {
+	return grpc.Code(err) == codes.Unavailable &&
+		grpc.ErrorDesc(err) == grpc.ErrorDesc(errDraining)
+}
+
+// retryRefusedCall retries requests a draining server refused until the
+// server, or its replacement, accepts them, so that clients pause during a
+// restart instead of failing, and backs off on requests a busy server
+// throttled. Both are refused before being handled, which makes retrying
+// safe.
+func retryRefusedCall(ctx context.Context, method string, req,
+	reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+
+	backoff := 100 * time.Millisecond
+	for {
+		err := traceClientCall(ctx, method, req, reply, cc, invoker, opts...)
+		if isThrottledError(err) {
+			glog.V(2).Infof("throttled, retrying %s in %v", method, backoff)
+		} else if isDrainingError(err) {
+			glog.Warningf("server is draining, retrying %s in %v", method,
+				backoff)
+		} else {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package samfs
+
+import (
+	"io"
+	"os"
+	"path"
+	"syscall"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// errNoData is returned by Seek when there is no data, or no hole, at or
+// after the offset, lseek(2) reports it as ENXIO.
+var errNoData = grpc.Errorf(codes.OutOfRange, "no data or hole past offset")
+
+func (s *SamFSServer) Seek(ctx context.Context,
+	req *pb.SeekRequest) (*pb.SeekReply, error) {
+	glog.V(3).Infof(`received Seek request for "%s" off: %d, whence: %v`,
+		req.FileHandle.Path, req.Offset, req.Whence)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return nil, err
+	}
+
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	fd, err := os.Open(filePath)
+	if err != nil {
+		glog.Errorf("could not open file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+	defer fd.Close()
+
+	whence := seekData
+	if req.Whence == pb.SeekWhence_SEEK_HOLE {
+		whence = seekHole
+	}
+	off, err := fd.Seek(req.Offset, whence)
+	if isNoData(err) {
+		return nil, errNoData
+	}
+	if err != nil {
+		glog.Errorf("failed to seek file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+
+	return &pb.SeekReply{Offset: off}, nil
+}
+
+func isNoData(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENXIO
+}
+
+// findHoles returns the holes of fd between off and end. Filesystems that
+// can not tell us about holes report none.
+func findHoles(fd *os.File, off int64, end int64) []*pb.HoleRange {
+	var holes []*pb.HoleRange
+	for pos := off; pos < end; {
+		data, err := fd.Seek(pos, seekData)
+		if isNoData(err) {
+			data = end
+		} else if err != nil {
+			return holes
+		}
+		if data > end {
+			data = end
+		}
+		if data > pos {
+			holes = append(holes, &pb.HoleRange{Offset: pos, Length: data - pos})
+		}
+		if data >= end {
+			break
+		}
+
+		pos, err = fd.Seek(data, seekHole)
+		if err != nil {
+			break
+		}
+	}
+	return holes
+}
+
+// readSparse reads the data of fd around its holes, so that they don't
+// have to be sent as zeros.
+func readSparse(fd *os.File, req *pb.ReadRequest) (*pb.ReadReply, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		glog.Errorf("could not stat file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+	end := req.Offset + req.Size
+	if end > fi.Size() {
+		end = fi.Size()
+	}
+	if end <= req.Offset {
+		return &pb.ReadReply{}, nil
+	}
+
+	holes := findHoles(fd, req.Offset, end)
+	holeBytes := int64(0)
+	for _, h := range holes {
+		holeBytes += h.Length
+	}
+
+	data := make([]byte, end-req.Offset-holeBytes)
+	size := end - req.Offset
+	pos, n := req.Offset, 0
+	for i := 0; i <= len(holes); i++ {
+		segEnd := end
+		if i < len(holes) {
+			segEnd = holes[i].Offset
+		}
+		if segEnd > pos {
+			m, err := fd.ReadAt(data[n:int64(n)+segEnd-pos], pos)
+			n += m
+			if err == io.EOF {
+				// the file shrank under us
+				size = pos + int64(m) - req.Offset
+				holes = holes[:i]
+				break
+			}
+			if err != nil {
+				glog.Errorf("failed to read file %s :: %v\n",
+					req.FileHandle.Path, err)
+				return nil, err
+			}
+		}
+		if i < len(holes) {
+			pos = holes[i].Offset + holes[i].Length
+		}
+	}
+
+	return &pb.ReadReply{
+		Data:  data[:n],
+		Size:  size,
+		Holes: holes,
+	}, nil
+}
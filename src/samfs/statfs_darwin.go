@@ -0,0 +1,26 @@
+// +build darwin
+
+package samfs
+
+import (
+	"syscall"
+
+	pb "github.com/smihir/samfs/src/proto"
+)
+
+func statFs(dir string) (*pb.StatFsReply, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return nil, err
+	}
+	return &pb.StatFsReply{
+		Blocks:  st.Blocks,
+		Bfree:   st.Bfree,
+		Bavail:  st.Bavail,
+		Files:   st.Files,
+		Ffree:   st.Ffree,
+		Bsize:   st.Bsize,
+		NameLen: 255,
+		Frsize:  st.Bsize,
+	}, nil
+}
@@ -0,0 +1,15 @@
+// +build darwin
+
+package samfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// there is no syncfs(2), directories are synced one by one
+const haveSyncFs = false
+
+func syncFs(f *os.File) error {
+	return syscall.ENOTSUP
+}
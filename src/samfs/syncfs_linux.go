@@ -0,0 +1,20 @@
+// +build linux
+
+package samfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+const haveSyncFs = true
+
+// syncFs flushes the filesystem f is on, with syncfs(2).
+func syncFs(f *os.File) error {
+	_, _, errno := unix.Syscall(unix.SYS_SYNCFS, f.Fd(), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package samfs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+)
+
+// TLSOptions configures transport security between samfsc and
+// samfs-server. Certificates and keys are PEM files.
+type TLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// on the server, the CA client certificates must be signed by, setting it
+	// turns on mutual TLS; on the client, the CA that signed the server
+	// certificate, the system roots are used if empty
+	CAFile string
+	// name the server certificate is checked against, defaults to the
+	// address the client dials
+	ServerName string
+	// common names of the client certificates allowed to use the export, any
+	// client with a valid certificate if empty
+	AllowedSubjects []string
+}
+
+var errNotAllowed = grpc.Errorf(codes.PermissionDenied,
+	"client certificate not allowed")
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func (o *TLSOptions) serverCredentials() (credentials.TransportCredentials,
+	error) {
+
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("server needs a certificate and a key for tls")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if len(o.AllowedSubjects) > 0 {
+		return nil, errors.New("allowed subjects need a client CA")
+	}
+	return credentials.NewTLS(config), nil
+}
+
+func (o *TLSOptions) clientCredentials() (credentials.TransportCredentials,
+	error) {
+
+	config := &tls.Config{ServerName: o.ServerName}
+	if o.CAFile != "" {
+		pool, err := loadCertPool(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// SetTLS makes the server accept only TLS connections. It has to be called
+// before Run.
+func (s *SamFSServer) SetTLS(opts *TLSOptions) error {
+	creds, err := opts.serverCredentials()
+	if err != nil {
+		return err
+	}
+	s.creds = &reloadableCreds{creds: creds}
+	s.settingsLock.Lock()
+	s.allowedSubjects = subjectSet(opts.AllowedSubjects)
+	s.settingsLock.Unlock()
+	return nil
+}
+
+func subjectSet(subjects []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, subject := range subjects {
+		set[subject] = true
+	}
+	return set
+}
+
+// reloadableCreds hands new connections to the credentials last set, so
+// that certificates can be replaced without restarting the server;
+// established connections keep the ones they were made with.
+type reloadableCreds struct {
+	sync.RWMutex
+	creds credentials.TransportCredentials
+}
+
+func (c *reloadableCreds) current() credentials.TransportCredentials {
+	c.RLock()
+	defer c.RUnlock()
+	return c.creds
+}
+
+func (c *reloadableCreds) set(creds credentials.TransportCredentials) {
+	c.Lock()
+	c.creds = creds
+	c.Unlock()
+}
+
+func (c *reloadableCreds) ClientHandshake(ctx context.Context, addr string,
+	rawConn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return c.current().ClientHandshake(ctx, addr, rawConn)
+}
+
+func (c *reloadableCreds) ServerHandshake(rawConn net.Conn) (net.Conn,
+	credentials.AuthInfo, error) {
+	return c.current().ServerHandshake(rawConn)
+}
+
+func (c *reloadableCreds) Info() credentials.ProtocolInfo {
+	return c.current().Info()
+}
+
+func (c *reloadableCreds) Clone() credentials.TransportCredentials {
+	return &reloadableCreds{creds: c.current().Clone()}
+}
+
+func (c *reloadableCreds) OverrideServerName(name string) error {
+	return c.current().OverrideServerName(name)
+}
+
+// authorizePeer checks the client certificate of the connection in ctx
+// against the subjects allowed to use the export.
+func (s *SamFSServer) authorizePeer(ctx context.Context) error {
+	s.settingsLock.RLock()
+	allowed := s.allowedSubjects
+	s.settingsLock.RUnlock()
+	if len(allowed) == 0 {
+		return nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return errNotAllowed
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return errNotAllowed
+	}
+	subject := info.State.PeerCertificates[0].Subject.CommonName
+	if !allowed[subject] {
+		glog.Warningf("rejecting client %s with certificate for %q", p.Addr,
+			subject)
+		return errNotAllowed
+	}
+	return nil
+}
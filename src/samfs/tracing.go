@@ -0,0 +1,262 @@
+package samfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"golang.org/x/net/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+)
+
+// requestIDHeader is the metadata key the client sends the id of the FUSE
+// operation an RPC is made for in.
+const requestIDHeader = "samfs-request-id"
+
+// slow requests kept to be shown at /debug/slowlog
+const slowLogLength = 64
+
+// requestTrace follows one FUSE operation through the RPCs it makes on the
+// client, or one RPC through the file system calls it makes on the server.
+// Traces show up at /debug/requests, and in the slow request log if they
+// take longer than its threshold.
+type requestTrace struct {
+	id    string
+	title string
+	tr    trace.Trace
+	start time.Time
+	slow  *slowLog
+
+	sync.Mutex
+	spans []traceSpan
+}
+
+type traceSpan struct {
+	name string
+	took time.Duration
+	err  error
+}
+
+type traceKey struct{}
+
+func newRequestTrace(family string, id string, title string,
+	slow *slowLog) *requestTrace {
+	tr := trace.New(family, title)
+	tr.LazyPrintf("request %s", id)
+	return &requestTrace{
+		id:    id,
+		title: title,
+		tr:    tr,
+		start: time.Now(),
+		slow:  slow,
+	}
+}
+
+// traceFromContext returns the trace of the request ctx belongs to, nil if
+// it is not traced.
+func traceFromContext(ctx context.Context) *requestTrace {
+	t, _ := ctx.Value(traceKey{}).(*requestTrace)
+	return t
+}
+
+// traceStart starts a span of the request ctx belongs to; call the returned
+// func with the outcome when it is done.
+func traceStart(ctx context.Context, name string) func(error) {
+	t := traceFromContext(ctx)
+	if t == nil {
+		return func(error) {}
+	}
+	start := time.Now()
+	return func(err error) {
+		t.span(name, time.Since(start), err)
+	}
+}
+
+func (t *requestTrace) span(name string, took time.Duration, err error) {
+	if err != nil {
+		t.tr.LazyPrintf("%s took %v :: %v", name, took, err)
+		// a missing file, or the end of one, is an answer and not a failure
+		if err != io.EOF && !os.IsNotExist(err) &&
+			grpc.Code(err) != codes.NotFound {
+			t.tr.SetError()
+		}
+	} else {
+		t.tr.LazyPrintf("%s took %v", name, took)
+	}
+	t.Lock()
+	t.spans = append(t.spans, traceSpan{name, took, err})
+	t.Unlock()
+}
+
+// finish ends the trace, err is the outcome of the whole request.
+func (t *requestTrace) finish(err error) {
+	if t == nil {
+		return
+	}
+	took := time.Since(t.start)
+	if err != nil {
+		t.tr.LazyPrintf("failed :: %v", err)
+		t.tr.SetError()
+	}
+	t.tr.Finish()
+	t.slow.check(t, took, err)
+}
+
+// slowLog logs requests that take at least threshold along with where the
+// time went. It is off while the threshold is 0, and can be turned on and
+// off at runtime through its http handler.
+type slowLog struct {
+	side      string
+	threshold int64
+
+	sync.Mutex
+	recent []string
+}
+
+func newSlowLog(side string) *slowLog {
+	return &slowLog{side: side}
+}
+
+func (l *slowLog) setThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&l.threshold, int64(threshold))
+	if threshold > 0 {
+		glog.Infof("logging %s requests slower than %v", l.side, threshold)
+	}
+}
+
+func (l *slowLog) check(t *requestTrace, took time.Duration, err error) {
+	if l == nil {
+		return
+	}
+	threshold := time.Duration(atomic.LoadInt64(&l.threshold))
+	if threshold <= 0 || took < threshold {
+		return
+	}
+
+	var spans bytes.Buffer
+	t.Lock()
+	for i, s := range t.spans {
+		if i > 0 {
+			spans.WriteString(", ")
+		}
+		fmt.Fprintf(&spans, "%s %v", s.name, s.took)
+		if s.err != nil {
+			fmt.Fprintf(&spans, " (%v)", s.err)
+		}
+	}
+	t.Unlock()
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	entry := fmt.Sprintf("%s %s %s took %v, %s [%s]",
+		t.start.Format(time.RFC3339Nano), t.id, t.title, took, result,
+		spans.String())
+	glog.Warningf("slow %s request %s", l.side, entry)
+
+	l.Lock()
+	l.recent = append(l.recent, entry)
+	if len(l.recent) > slowLogLength {
+		l.recent = l.recent[len(l.recent)-slowLogLength:]
+	}
+	l.Unlock()
+}
+
+func (l *slowLog) entries() []string {
+	l.Lock()
+	defer l.Unlock()
+	return append([]string(nil), l.recent...)
+}
+
+// ServeHTTP shows the threshold and the latest slow requests, and sets the
+// threshold from the threshold parameter, e.g.
+// /debug/slowlog?threshold=200ms; 0 turns the log off.
+func (l *slowLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if allowed, _ := trace.AuthRequest(r); !allowed {
+		http.Error(w, "not allowed", http.StatusUnauthorized)
+		return
+	}
+	if v := r.FormValue("threshold"); v != "" {
+		threshold, err := time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		l.setThreshold(threshold)
+	}
+	fmt.Fprintf(w, "threshold %v\n",
+		time.Duration(atomic.LoadInt64(&l.threshold)))
+	for _, entry := range l.entries() {
+		fmt.Fprintln(w, entry)
+	}
+}
+
+// debugHandler serves request traces, the slow request log settings and the
+// Go profiler.
+func debugHandler(slow *slowLog) *http.ServeMux {
+	mux := http.NewServeMux()
+	// x/net/trace registers its pages on the default mux
+	mux.Handle("/debug/requests", http.DefaultServeMux)
+	mux.Handle("/debug/events", http.DefaultServeMux)
+	mux.Handle("/debug/slowlog", slow)
+	registerPprof(mux)
+	return mux
+}
+
+// SetSlowRequestThreshold logs RPCs that take at least threshold, 0 turns
+// the log off.
+func (s *SamFSServer) SetSlowRequestThreshold(threshold time.Duration) {
+	s.slowLog.setThreshold(threshold)
+}
+
+// startOp traces a FUSE operation; RPCs made with the returned context carry
+// its id to the server.
+func (c *SamFs) startOp(op string, name string) (context.Context,
+	*requestTrace) {
+	id := fmt.Sprintf("%08x-%d", uint32(c.clientID),
+		atomic.AddUint64(&c.opCount, 1))
+	t := newRequestTrace("samfs.FUSE", id, op+" "+name, c.slowLog)
+	return context.WithValue(context.Background(), traceKey{}, t), t
+}
+
+// traceClientCall sends the id of the traced FUSE operation along with an
+// RPC and records how long the RPC took.
+func traceClientCall(ctx context.Context, method string, req interface{},
+	reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption) error {
+	t := traceFromContext(ctx)
+	if t == nil {
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+
+	ctx = metadata.NewContext(ctx, metadata.Pairs(requestIDHeader, t.id))
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	t.span(path.Base(method), time.Since(start), err)
+	return err
+}
+
+// startTrace traces an RPC on the server under the id the client sent,
+// or a new one for clients that do not send any.
+func (s *SamFSServer) startTrace(ctx context.Context,
+	method string) (context.Context, *requestTrace) {
+	var id string
+	if md, ok := metadata.FromContext(ctx); ok && len(md[requestIDHeader]) > 0 {
+		id = md[requestIDHeader][0]
+	} else {
+		id = fmt.Sprintf("server-%08x", rand.Uint32())
+	}
+	t := newRequestTrace("samfs.RPC", id, path.Base(method), s.slowLog)
+	return context.WithValue(ctx, traceKey{}, t), t
+}
@@ -0,0 +1,67 @@
+package samfs
+
+import (
+	"path"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+)
+
+// Truncate sets the size of a file, for O_TRUNC opens and truncate(2). Like
+// the other changes to metadata, it is synced before the reply.
+func (s *SamFSServer) Truncate(ctx context.Context,
+	req *pb.TruncateRequest) (*pb.StatusReply, error) {
+	glog.V(3).Infof(`received Truncate request for "%s" size: %d`,
+		req.FileHandle.Path, req.Size)
+
+	//validate incoming file handle and get the open file
+	fd, err := s.openHandle(ctx, req.FileHandle, true)
+	if err != nil {
+		return nil, err
+	}
+	defer s.fds.release(fd)
+
+	//cached writes of other clients must not undo the truncation
+	s.delegations.recallOthers(ctx, req.FileHandle, req.ClientID)
+
+	filePath := path.Join(s.rootDirectory, req.FileHandle.Path)
+	//appends must not leave a hole where the end of file was
+	unlock := s.appends.lock(fd.key)
+	settle, err := s.quotas.chargeGrowth(filePath, req.FileHandle.Path,
+		req.Size)
+	if err != nil {
+		unlock()
+		glog.Errorf("not truncating file %s :: %v\n", req.FileHandle.Path, err)
+		return nil, err
+	}
+	before := wccBefore(filePath)
+	span := traceStart(ctx, "ftruncate")
+	err = fd.Truncate(req.Size)
+	span(err)
+	settle()
+	unlock()
+	if err != nil {
+		glog.Errorf("failed to truncate file %s :: %v\n", req.FileHandle.Path,
+			err)
+		return nil, err
+	}
+
+	span = traceStart(ctx, "fsync")
+	err = s.commits.syncFile(fd)
+	span(err)
+	if err != nil {
+		glog.Errorf("could not perform fsync on file %s :: %v\n",
+			req.FileHandle.Path, err)
+		return nil, err
+	}
+	s.notify(ctx, pb.WatchEventType_MODIFY, req.FileHandle.Path, "")
+
+	resp := &pb.StatusReply{
+		Success:         true,
+		ServerSessionID: s.sessionID,
+		Wcc:             wccData(before, filePath),
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,380 @@
+package samfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+)
+
+// An upgrade starts the new binary with the files below and the listen
+// addresses of the inherited listeners, in order, in upgradeEnv. The new
+// server reports on upgradeReadyFd once its config is loaded, then reads the
+// state of the old one from upgradeStateFd before serving.
+const (
+	upgradeEnv        = "SAMFS_UPGRADE_LISTENERS"
+	upgradeStateFd    = 3
+	upgradeReadyFd    = 4
+	upgradeListenerFd = 5
+)
+
+// how long the new binary gets to load its config and set up the exports
+const upgradeReadyTimeout = time.Minute
+
+// upgradeState is what a server hands over to the binary replacing it, by
+// listen address.
+type upgradeState struct {
+	Exports map[string]*exportState `json:"exports"`
+}
+
+type exportState struct {
+	SessionID int64        `json:"sessionID"`
+	Started   time.Time    `json:"started"`
+	ReadOnly  bool         `json:"readOnly"`
+	GraceEnd  time.Time    `json:"graceEnd"`
+	Locks     []lockState  `json:"locks"`
+	Opens     []openState  `json:"opens"`
+	Fenced    []fenceState `json:"fenced"`
+}
+
+type lockState struct {
+	InodeNumber      uint64 `json:"inodeNumber"`
+	GenerationNumber uint32 `json:"generationNumber"`
+	ClientID         int64  `json:"clientID"`
+	Owner            uint64 `json:"owner"`
+	Start            uint64 `json:"start"`
+	End              uint64 `json:"end"`
+	Exclusive        bool   `json:"exclusive"`
+	Flock            bool   `json:"flock"`
+	Pid              uint32 `json:"pid"`
+}
+
+// openState records the opens of a file by a client; delegations are not
+// handed over, clients return them when their callback stream ends.
+type openState struct {
+	FileHandle *pb.FileHandle `json:"fileHandle"`
+	ClientID   int64          `json:"clientID"`
+	Opens      int            `json:"opens"`
+}
+
+// fenceState records a delegation that was revoked from a client.
+type fenceState struct {
+	InodeNumber      uint64 `json:"inodeNumber"`
+	GenerationNumber uint32 `json:"generationNumber"`
+	ClientID         int64  `json:"clientID"`
+}
+
+func (m *lockManager) snapshot() []lockState {
+	m.Lock()
+	defer m.Unlock()
+	var locks []lockState
+	for key, held := range m.files {
+		for _, l := range held {
+			locks = append(locks, lockState{
+				InodeNumber:      key.inodeNumber,
+				GenerationNumber: key.generationNumber,
+				ClientID:         l.clientID,
+				Owner:            l.owner,
+				Start:            l.start,
+				End:              l.end,
+				Exclusive:        l.exclusive,
+				Flock:            l.flock,
+				Pid:              l.pid,
+			})
+		}
+	}
+	return locks
+}
+
+func (m *lockManager) restore(locks []lockState, graceEnd time.Time) {
+	m.Lock()
+	defer m.Unlock()
+	for _, l := range locks {
+		key := fileKey{l.InodeNumber, l.GenerationNumber}
+		m.files[key] = append(m.files[key], &heldLock{
+			lockOwner: lockOwner{l.ClientID, l.Owner},
+			start:     l.Start,
+			end:       l.End,
+			exclusive: l.Exclusive,
+			flock:     l.Flock,
+			pid:       l.Pid,
+		})
+	}
+	m.graceEnd = graceEnd
+}
+
+func (m *delegationManager) snapshot() []openState {
+	m.Lock()
+	defer m.Unlock()
+	var opens []openState
+	for _, f := range m.files {
+		for clientID, n := range f.opens {
+			opens = append(opens, openState{f.fileHandle, clientID, n})
+		}
+	}
+	return opens
+}
+
+func (m *delegationManager) restore(opens []openState) {
+	m.Lock()
+	defer m.Unlock()
+	for _, o := range opens {
+		key := handleKey(o.FileHandle)
+		f, ok := m.files[key]
+		if !ok {
+			f = &openFile{
+				fileHandle: o.FileHandle,
+				opens:      make(map[int64]int),
+			}
+			m.files[key] = f
+		}
+		f.opens[o.ClientID] += o.Opens
+	}
+}
+
+func (m *delegationManager) snapshotFences() []fenceState {
+	m.Lock()
+	defer m.Unlock()
+	var fences []fenceState
+	for key, clients := range m.fenced {
+		for clientID := range clients {
+			fences = append(fences, fenceState{key.inodeNumber,
+				key.generationNumber, clientID})
+		}
+	}
+	return fences
+}
+
+func (m *delegationManager) restoreFences(fences []fenceState) {
+	m.Lock()
+	defer m.Unlock()
+	for _, f := range fences {
+		m.fence(fileKey{f.InodeNumber, f.GenerationNumber}, f.ClientID)
+	}
+}
+
+// reload reads the usage persisted by the server that was upgraded.
+func (q *quotaManager) reload() error {
+	if q == nil {
+		return nil
+	}
+	q.Lock()
+	defer q.Unlock()
+	if err := q.db.readIntoMemory(); err != nil {
+		return err
+	}
+	q.usage = make(map[string]*quotaUsage)
+	q.load()
+	return nil
+}
+
+// handoff stops the server for an upgrade: new requests are refused, which
+// clients retry, and once the requests in flight are done, or timeout has
+// passed, the server stops and returns its state.
+func (s *SamFSServer) handoff(timeout time.Duration) *exportState {
+	atomic.StoreInt32(&s.draining, 1)
+	s.delegations.Lock()
+	s.delegations.frozen = true
+	s.delegations.Unlock()
+	if inFlight := s.quiesce(context.Background(), timeout); inFlight > 0 {
+		s.grpcServer.Stop()
+	}
+	s.Stop()
+
+	s.locks.Lock()
+	graceEnd := s.locks.graceEnd
+	s.locks.Unlock()
+	return &exportState{
+		SessionID: s.sessionID,
+		Started:   s.started,
+		ReadOnly:  s.isReadOnly(),
+		GraceEnd:  graceEnd,
+		Locks:     s.locks.snapshot(),
+		Opens:     s.delegations.snapshot(),
+		Fenced:    s.delegations.snapshotFences(),
+	}
+}
+
+// takeOver makes a server that has not run yet carry on the session of the
+// server it upgrades.
+func (s *SamFSServer) takeOver(state *exportState) error {
+	if err := s.quotas.reload(); err != nil {
+		return err
+	}
+	s.sessionID = state.SessionID
+	s.started = state.Started
+	var readOnly int32
+	if state.ReadOnly {
+		readOnly = 1
+	}
+	atomic.StoreInt32(&s.readOnly, readOnly)
+	s.locks.restore(state.Locks, state.GraceEnd)
+	s.delegations.restore(state.Opens)
+	s.delegations.restoreFences(state.Fenced)
+	glog.Infof("took over session %d with %d locks and %d opens",
+		s.sessionID, len(state.Locks), len(state.Opens))
+	return nil
+}
+
+// Upgrade replaces the running binary with the one argv starts, without
+// clients noticing: the new process gets the listening sockets of the
+// exports it still serves and, once it has loaded its config, the sessions,
+// locks and opens of the servers, which stop. Clients pause until it serves.
+// The servers keep running if the new process fails to start.
+func (g *ServerGroup) Upgrade(argv []string, timeout time.Duration) error {
+	g.Lock()
+	defer g.Unlock()
+
+	var addresses []string
+	for listen := range g.exports {
+		addresses = append(addresses, listen)
+	}
+	sort.Strings(addresses)
+	stateR, stateW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer stateW.Close()
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		stateR.Close()
+		return err
+	}
+	defer readyR.Close()
+	inherited := []*os.File{stateR, readyW}
+	defer func() {
+		for _, f := range inherited {
+			f.Close()
+		}
+	}()
+	for _, listen := range addresses {
+		lis, ok := g.exports[listen].server.listener.(*net.TCPListener)
+		if !ok {
+			return fmt.Errorf("cannot hand over the listener of %s", listen)
+		}
+		f, err := lis.File()
+		if err != nil {
+			return err
+		}
+		inherited = append(inherited, f)
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(),
+		upgradeEnv+"="+strings.Join(addresses, ","))
+	cmd.ExtraFiles = inherited
+	err = cmd.Start()
+	// the new process holds its own copies, and reading readiness has to
+	// fail if it exits
+	for _, f := range inherited {
+		f.Close()
+	}
+	inherited = nil
+	if err != nil {
+		return err
+	}
+	glog.Infof("started %s as pid %d, waiting for it to be ready", argv[0],
+		cmd.Process.Pid)
+
+	ready := make(chan error, 1)
+	go func() {
+		_, err := readyR.Read(make([]byte, 1))
+		ready <- err
+	}()
+	select {
+	case err = <-ready:
+	case <-time.After(upgradeReadyTimeout):
+		err = fmt.Errorf("timed out")
+	}
+	if err != nil {
+		cmd.Process.Kill()
+		go cmd.Wait()
+		return fmt.Errorf("new server did not get ready :: %v", err)
+	}
+
+	state := &upgradeState{Exports: make(map[string]*exportState)}
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for listen, export := range g.exports {
+		wg.Add(1)
+		go func(listen string, s *SamFSServer) {
+			defer wg.Done()
+			es := s.handoff(timeout)
+			lock.Lock()
+			state.Exports[listen] = es
+			lock.Unlock()
+		}(listen, export.server)
+	}
+	wg.Wait()
+	if err := json.NewEncoder(stateW).Encode(state); err != nil {
+		// the new server starts new sessions
+		glog.Errorf("failed to hand over state :: %v", err)
+	}
+	glog.Infof("handed over to pid %d", cmd.Process.Pid)
+	cmd.Process.Release()
+	return nil
+}
+
+// inheritedListeners returns the listeners handed over by the server being
+// upgraded, by listen address, if the process was started by an upgrade.
+func inheritedListeners() (map[string]net.Listener, error) {
+	env := os.Getenv(upgradeEnv)
+	if env == "" {
+		return nil, nil
+	}
+	os.Unsetenv(upgradeEnv)
+	listeners := make(map[string]net.Listener)
+	for i, listen := range strings.Split(env, ",") {
+		f := os.NewFile(uintptr(upgradeListenerFd+i), listen)
+		lis, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited listener for %s :: %v", listen, err)
+		}
+		listeners[listen] = lis
+	}
+	return listeners, nil
+}
+
+// takeOver tells the upgraded binary that the exports are ready and takes
+// over its state; exports it did not serve start new sessions.
+func (g *ServerGroup) takeOver(exports []*groupExport) {
+	ready := os.NewFile(upgradeReadyFd, "upgrade-ready")
+	_, err := ready.Write([]byte{1})
+	ready.Close()
+	if err != nil {
+		glog.Errorf("failed to report readiness to the upgraded server :: %v",
+			err)
+	}
+
+	stateFile := os.NewFile(upgradeStateFd, "upgrade-state")
+	defer stateFile.Close()
+	state := &upgradeState{}
+	if err := json.NewDecoder(stateFile).Decode(state); err != nil {
+		glog.Errorf("upgraded server did not hand over its state, starting "+
+			"new sessions :: %v", err)
+		return
+	}
+	for _, export := range exports {
+		es, ok := state.Exports[export.config.Listen]
+		if !ok {
+			continue
+		}
+		if err := export.server.takeOver(es); err != nil {
+			glog.Errorf("failed to take over %s, starting a new session :: %v",
+				export.config.Listen, err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package samfs
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	watchQueueLength = 256
+	// events for a path within this long of a previous event for it are
+	// treated as duplicates
+	watchCoalesceWindow = time.Second
+)
+
+type watcher struct {
+	path      string
+	recursive bool
+	// address of the client connection that asked for the events, changes it
+	// made itself are not sent back to it
+	peer     string
+	events   chan *pb.WatchEvent
+	overflow chan struct{}
+}
+
+func (w *watcher) matches(p string) bool {
+	if p == "" {
+		return false
+	}
+	if p == w.path || path.Dir(p) == w.path {
+		return true
+	}
+	if !w.recursive {
+		return false
+	}
+	return w.path == "/" || strings.HasPrefix(p, w.path+"/")
+}
+
+type watchHub struct {
+	sync.Mutex
+	watchers map[*watcher]bool
+	// last time an event of some type was published for a path
+	recent map[string]time.Time
+	// coalesced events still to be sent
+	pending map[string]*pendingEvent
+}
+
+type pendingEvent struct {
+	ev *pb.WatchEvent
+	// client that caused the event, empty if several did or it came from
+	// inotify
+	origin string
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[*watcher]bool),
+		recent:   make(map[string]time.Time),
+		pending:  make(map[string]*pendingEvent),
+	}
+}
+
+func (h *watchHub) add(w *watcher) {
+	h.Lock()
+	h.watchers[w] = true
+	h.Unlock()
+}
+
+func (h *watchHub) remove(w *watcher) {
+	h.Lock()
+	delete(h.watchers, w)
+	h.Unlock()
+}
+
+// touch records an event of eventType for p and returns whether another one
+// was seen recently. Must be called with h locked.
+func (h *watchHub) touch(eventType pb.WatchEventType, p string,
+	now time.Time) bool {
+
+	key := eventType.String() + ":" + p
+	last, ok := h.recent[key]
+	h.recent[key] = now
+	if len(h.recent) > 4096 {
+		for k, t := range h.recent {
+			if now.Sub(t) > watchCoalesceWindow {
+				delete(h.recent, k)
+			}
+		}
+	}
+	return ok && now.Sub(last) < watchCoalesceWindow
+}
+
+// publish sends ev to every interested watcher. origin is the address of the
+// client that caused the event, empty if it was not caused by a request.
+func (h *watchHub) publish(ev *pb.WatchEvent, origin string) {
+	h.Lock()
+	defer h.Unlock()
+
+	now := time.Now()
+	recent := h.touch(ev.Type, ev.Path, now)
+	if ev.ToPath != "" {
+		recent = h.touch(ev.Type, ev.ToPath, now) && recent
+	}
+	// changes we made ourselves show up again on inotify, a single large
+	// write is reported many times and clients write files in many requests.
+	// Only the first event of a burst is sent at once, what came after it is
+	// sent once the window has passed.
+	if recent && (origin == "" || ev.Type == pb.WatchEventType_MODIFY) {
+		h.deferEvent(ev, origin)
+		return
+	}
+	h.send(ev, origin)
+}
+
+// deferEvent has ev sent at the end of the coalescing window, unless the same
+// event is already waiting. Must be called with h locked.
+func (h *watchHub) deferEvent(ev *pb.WatchEvent, origin string) {
+	key := ev.Type.String() + ":" + ev.Path + ":" + ev.ToPath
+	if p, ok := h.pending[key]; ok {
+		if p.origin != origin {
+			// caused by several clients, all of them need to hear of it
+			p.origin = ""
+		}
+		return
+	}
+	h.pending[key] = &pendingEvent{ev: ev, origin: origin}
+
+	time.AfterFunc(watchCoalesceWindow, func() {
+		h.Lock()
+		defer h.Unlock()
+		p := h.pending[key]
+		delete(h.pending, key)
+		h.send(p.ev, p.origin)
+	})
+}
+
+// send queues ev for every interested watcher other than the one of origin.
+// Must be called with h locked.
+func (h *watchHub) send(ev *pb.WatchEvent, origin string) {
+	for w := range h.watchers {
+		if origin != "" && origin == w.peer {
+			continue
+		}
+		if !w.matches(ev.Path) && !w.matches(ev.ToPath) {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			select {
+			case w.overflow <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func peerAddress(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	return p.Addr.String()
+}
+
+// notify publishes a change made by the request in ctx.
+func (s *SamFSServer) notify(ctx context.Context, eventType pb.WatchEventType,
+	fsPath string, toPath string) {
+
+	s.watches.publish(&pb.WatchEvent{
+		Type:   eventType,
+		Path:   fsPath,
+		ToPath: toPath,
+	}, peerAddress(ctx))
+}
+
+func (s *SamFSServer) Watch(req *pb.WatchRequest,
+	stream pb.NFS_WatchServer) error {
+	glog.V(3).Infof(`received Watch request for "%s"`, req.FileHandle.Path)
+
+	//validate incoming file handle
+	err := s.verifyFileHandle(req.FileHandle)
+	if err != nil {
+		glog.Errorf("%v", err)
+		return err
+	}
+
+	w := &watcher{
+		path:      path.Clean(req.FileHandle.Path),
+		recursive: req.Recursive,
+		peer:      peerAddress(stream.Context()),
+		events:    make(chan *pb.WatchEvent, watchQueueLength),
+		overflow:  make(chan struct{}, 1),
+	}
+	s.watches.add(w)
+	defer s.watches.remove(w)
+
+	for {
+		var ev *pb.WatchEvent
+		select {
+		case ev = <-w.events:
+		case <-w.overflow:
+			ev = &pb.WatchEvent{
+				Type: pb.WatchEventType_OVERFLOW,
+				Path: w.path,
+			}
+		case <-stream.Context().Done():
+			return nil
+		}
+
+		if err := stream.Send(ev); err != nil {
+			glog.V(2).Infof("failed to send watch event :: %v", err)
+			return err
+		}
+	}
+}
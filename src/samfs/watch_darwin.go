@@ -0,0 +1,15 @@
+// +build darwin
+
+package samfs
+
+// fsWatcher is not implemented on osx, clients only get to see changes made
+// through samfs.
+type fsWatcher struct{}
+
+func newFsWatcher(root string, hub *watchHub) (*fsWatcher, error) {
+	return &fsWatcher{}, nil
+}
+
+func (w *fsWatcher) Close() error {
+	return nil
+}
@@ -0,0 +1,188 @@
+// +build linux
+
+package samfs
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/golang/glog"
+	pb "github.com/smihir/samfs/src/proto"
+	"golang.org/x/sys/unix"
+)
+
+const inotifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_MOVED_FROM |
+	unix.IN_MOVED_TO | unix.IN_MODIFY | unix.IN_ATTRIB
+
+// fsWatcher turns inotify events on the exported directory tree into watch
+// events, so that changes made directly on the server show up on clients.
+type fsWatcher struct {
+	sync.Mutex
+	file *os.File
+	fd   int
+	root string
+	hub  *watchHub
+	// watch descriptor -> directory path relative to root
+	dirs map[int]string
+}
+
+func newFsWatcher(root string, hub *watchHub) (*fsWatcher, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &fsWatcher{
+		file: os.NewFile(uintptr(fd), "inotify"),
+		fd:   fd,
+		root: root,
+		hub:  hub,
+		dirs: make(map[int]string),
+	}
+	w.addTree("/")
+	go w.run()
+
+	return w, nil
+}
+
+func (w *fsWatcher) Close() error {
+	return w.file.Close()
+}
+
+// addTree watches dir and every directory below it.
+func (w *fsWatcher) addTree(dir string) {
+	err := filepath.Walk(path.Join(w.root, dir),
+		func(p string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				return nil
+			}
+			wd, err := unix.InotifyAddWatch(w.fd, p, inotifyMask)
+			if err != nil {
+				glog.Warningf("failed to watch directory %s :: %v", p, err)
+				return nil
+			}
+			rel := "/" + strings.TrimPrefix(strings.TrimPrefix(p, w.root), "/")
+			w.Lock()
+			w.dirs[wd] = rel
+			w.Unlock()
+			return nil
+		})
+	if err != nil {
+		glog.Warningf("failed to watch directory tree %s :: %v", dir, err)
+	}
+}
+
+// moved updates the paths of watched directories after a rename.
+func (w *fsWatcher) moved(from, to string) {
+	w.Lock()
+	defer w.Unlock()
+	for wd, dir := range w.dirs {
+		if dir == from {
+			w.dirs[wd] = to
+		} else if strings.HasPrefix(dir, from+"/") {
+			w.dirs[wd] = to + strings.TrimPrefix(dir, from)
+		}
+	}
+}
+
+func (w *fsWatcher) run() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			glog.V(2).Infof("stopped watching %s :: %v", w.root, err)
+			return
+		}
+
+		// a rename is reported as a MOVED_FROM/MOVED_TO pair with the same
+		// cookie; a move out of the tree only has the first half
+		var movedFrom string
+		var cookie uint32
+		flushMove := func() {
+			if movedFrom != "" {
+				w.hub.publish(&pb.WatchEvent{
+					Type: pb.WatchEventType_REMOVE,
+					Path: movedFrom,
+				}, "")
+				movedFrom = ""
+			}
+		}
+
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			ev := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			nameBytes := buf[off+unix.SizeofInotifyEvent : off+
+				unix.SizeofInotifyEvent+int(ev.Len)]
+			off += unix.SizeofInotifyEvent + int(ev.Len)
+
+			if ev.Mask&unix.IN_Q_OVERFLOW != 0 {
+				flushMove()
+				w.hub.publish(&pb.WatchEvent{
+					Type: pb.WatchEventType_OVERFLOW,
+					Path: "/",
+				}, "")
+				continue
+			}
+
+			w.Lock()
+			dir, ok := w.dirs[int(ev.Wd)]
+			if ev.Mask&unix.IN_IGNORED != 0 {
+				delete(w.dirs, int(ev.Wd))
+			}
+			w.Unlock()
+			if !ok {
+				continue
+			}
+			name := strings.TrimRight(string(nameBytes), "\x00")
+			p := path.Join(dir, name)
+			isDir := ev.Mask&unix.IN_ISDIR != 0
+
+			if ev.Mask&unix.IN_MOVED_TO != 0 && movedFrom != "" &&
+				ev.Cookie == cookie {
+				if isDir {
+					w.moved(movedFrom, p)
+				}
+				w.hub.publish(&pb.WatchEvent{
+					Type:   pb.WatchEventType_RENAME,
+					Path:   movedFrom,
+					ToPath: p,
+				}, "")
+				movedFrom = ""
+				continue
+			}
+			flushMove()
+
+			switch {
+			case ev.Mask&unix.IN_MOVED_FROM != 0:
+				movedFrom = p
+				cookie = ev.Cookie
+			case ev.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0:
+				if isDir {
+					w.addTree(p)
+				}
+				w.hub.publish(&pb.WatchEvent{
+					Type: pb.WatchEventType_CREATE,
+					Path: p,
+				}, "")
+			case ev.Mask&unix.IN_DELETE != 0:
+				w.hub.publish(&pb.WatchEvent{
+					Type: pb.WatchEventType_REMOVE,
+					Path: p,
+				}, "")
+			case ev.Mask&(unix.IN_MODIFY|unix.IN_ATTRIB) != 0:
+				w.hub.publish(&pb.WatchEvent{
+					Type: pb.WatchEventType_MODIFY,
+					Path: p,
+				}, "")
+			}
+		}
+		flushMove()
+	}
+}
@@ -72,6 +72,10 @@ type MountOptions struct {
 
 	// If set, print debugging information.
 	Debug bool
+
+	// If set, the kernel forwards fcntl(2) and flock(2) locks to the file
+	// system instead of handling them locally.
+	EnableLocks bool
 }
 
 // RawFileSystem is an interface close to the FUSE wire protocol.
@@ -125,6 +129,20 @@ type RawFileSystem interface {
 	Fsync(input *FsyncIn) (code Status)
 	Fallocate(input *FallocateIn) (code Status)
 
+	// File locking, only called if MountOptions.EnableLocks is set.
+	GetLk(input *LkIn, out *LkOut) (code Status)
+	SetLk(input *LkIn) (code Status)
+	SetLkw(input *LkIn) (code Status)
+
+	// Lseek finds data or holes for SEEK_DATA and SEEK_HOLE; the
+	// kernel handles other kinds of seek itself.
+	Lseek(input *LseekIn, out *LseekOut) (code Status)
+
+	// CopyFileRange copies data between two open files without
+	// passing it through the kernel; if it fails with ENOSYS,
+	// EOPNOTSUPP or EXDEV the kernel copies through Read and Write.
+	CopyFileRange(input *CopyFileRangeIn, out *WriteOut) (code Status)
+
 	// Directory handling
 	OpenDir(input *OpenIn, out *OpenOut) (status Status)
 	ReadDir(input *ReadIn, out *DirEntryList) Status
@@ -150,3 +150,23 @@ func (fs *defaultRawFileSystem) FsyncDir(input *FsyncIn) (code Status) {
 func (fs *defaultRawFileSystem) Fallocate(in *FallocateIn) (code Status) {
 	return ENOSYS
 }
+
+func (fs *defaultRawFileSystem) GetLk(in *LkIn, out *LkOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetLk(in *LkIn) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) SetLkw(in *LkIn) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) Lseek(in *LseekIn, out *LseekOut) (code Status) {
+	return ENOSYS
+}
+
+func (fs *defaultRawFileSystem) CopyFileRange(in *CopyFileRangeIn, out *WriteOut) (code Status) {
+	return ENOSYS
+}
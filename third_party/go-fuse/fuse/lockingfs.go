@@ -204,6 +204,32 @@ func (fs *lockingRawFileSystem) Fallocate(in *FallocateIn) (code Status) {
 	return fs.RawFS.Fallocate(in)
 }
 
+func (fs *lockingRawFileSystem) GetLk(in *LkIn, out *LkOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.GetLk(in, out)
+}
+
+func (fs *lockingRawFileSystem) SetLk(in *LkIn) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.SetLk(in)
+}
+
+// SetLkw waits for the lock without holding the file system lock, so that
+// the holder of the lock can release it.
+func (fs *lockingRawFileSystem) SetLkw(in *LkIn) (code Status) {
+	return fs.RawFS.SetLkw(in)
+}
+
+func (fs *lockingRawFileSystem) Lseek(in *LseekIn, out *LseekOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.Lseek(in, out)
+}
+
+func (fs *lockingRawFileSystem) CopyFileRange(in *CopyFileRangeIn, out *WriteOut) (code Status) {
+	defer fs.locked()()
+	return fs.RawFS.CopyFileRange(in, out)
+}
+
 func (fs *lockingRawFileSystem) String() string {
 	defer fs.locked()()
 	return fmt.Sprintf("Locked(%s)", fs.RawFS.String())
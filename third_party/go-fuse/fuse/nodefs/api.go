@@ -12,7 +12,7 @@ package nodefs
 import (
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 // The Node interface implements the user-defined file system
@@ -150,6 +150,23 @@ type File interface {
 	Chmod(perms uint32) fuse.Status
 	Utimens(atime *time.Time, mtime *time.Time) fuse.Status
 	Allocate(off uint64, size uint64, mode uint32) (code fuse.Status)
+
+	// File locking, only called if fuse.MountOptions.EnableLocks is
+	// set. The owner identifies the process or the open file (for
+	// flock(2), flagged in flags) holding the lock.
+	GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status)
+	SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status)
+	SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status)
+
+	// Lseek returns where the next data (SEEK_DATA) or hole
+	// (SEEK_HOLE) at or after off starts.
+	Lseek(off uint64, whence uint32) (uint64, fuse.Status)
+
+	// CopyFileRange copies len bytes at off to out at outOff, and
+	// returns how many it copied. out may belong to another file
+	// system mounted by the same connector; EXDEV has the kernel copy
+	// through Read and Write instead.
+	CopyFileRange(off uint64, out File, outOff uint64, len uint64, flags uint64) (uint32, fuse.Status)
 }
 
 // Wrap a File return in this to set FUSE flags.  Also used internally
@@ -7,7 +7,7 @@ package nodefs
 import (
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 type defaultFile struct{}
@@ -72,3 +72,23 @@ func (f *defaultFile) Chmod(perms uint32) fuse.Status {
 func (f *defaultFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.Status) {
 	return fuse.ENOSYS
 }
+
+func (f *defaultFile) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *defaultFile) Lseek(off uint64, whence uint32) (uint64, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+
+func (f *defaultFile) CopyFileRange(off uint64, out File, outOff uint64, len uint64, flags uint64) (uint32, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
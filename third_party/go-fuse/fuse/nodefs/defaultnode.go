@@ -7,7 +7,7 @@ package nodefs
 import (
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 // NewDefaultNode returns an implementation of Node that returns
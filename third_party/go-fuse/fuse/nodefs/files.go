@@ -10,7 +10,7 @@ import (
 	"sync"
 	"syscall"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 // DataFile is for implementing read-only filesystems.  This
@@ -220,6 +220,28 @@ type readOnlyFile struct {
 	File
 }
 
+func (f *loopbackFile) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *loopbackFile) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *loopbackFile) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	return fuse.ENOSYS
+}
+
+func (f *loopbackFile) Lseek(off uint64, whence uint32) (uint64, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+
+func (f *loopbackFile) CopyFileRange(off uint64, out File, outOff uint64, len uint64, flags uint64) (uint32, fuse.Status) {
+	return 0, fuse.ENOSYS
+}
+
+////////////////////////////////////////////////////////////////
+
 func (f *readOnlyFile) InnerFile() File {
 	return f.File
 }
@@ -14,7 +14,7 @@ import (
 	"strings"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 // Returns the RawFileSystem so it can be mounted.
@@ -465,6 +465,63 @@ func (c *rawBridge) StatFs(header *fuse.InHeader, out *fuse.StatfsOut) fuse.Stat
 	return fuse.OK
 }
 
+func (c *rawBridge) GetLk(input *fuse.LkIn, out *fuse.LkOut) fuse.Status {
+	node := c.toInode(input.NodeId)
+	opened := node.mount.getOpenedFile(input.Fh)
+
+	if opened != nil {
+		return opened.WithFlags.File.GetLk(input.Owner, &input.Lk, input.LkFlags, &out.Lk)
+	}
+	return fuse.EBADF
+}
+
+func (c *rawBridge) SetLk(input *fuse.LkIn) fuse.Status {
+	node := c.toInode(input.NodeId)
+	opened := node.mount.getOpenedFile(input.Fh)
+
+	if opened != nil {
+		return opened.WithFlags.File.SetLk(input.Owner, &input.Lk, input.LkFlags)
+	}
+	return fuse.EBADF
+}
+
+func (c *rawBridge) SetLkw(input *fuse.LkIn) fuse.Status {
+	node := c.toInode(input.NodeId)
+	opened := node.mount.getOpenedFile(input.Fh)
+
+	if opened != nil {
+		return opened.WithFlags.File.SetLkw(input.Owner, &input.Lk, input.LkFlags)
+	}
+	return fuse.EBADF
+}
+
+func (c *rawBridge) Lseek(input *fuse.LseekIn, out *fuse.LseekOut) fuse.Status {
+	node := c.toInode(input.NodeId)
+	opened := node.mount.getOpenedFile(input.Fh)
+
+	if opened != nil {
+		off, code := opened.WithFlags.File.Lseek(input.Offset, input.Whence)
+		out.Offset = off
+		return code
+	}
+	return fuse.EBADF
+}
+
+func (c *rawBridge) CopyFileRange(input *fuse.CopyFileRangeIn, out *fuse.WriteOut) fuse.Status {
+	node := c.toInode(input.NodeId)
+	opened := node.mount.getOpenedFile(input.FhIn)
+	outNode := c.toInode(input.NodeIdOut)
+	outOpened := outNode.mount.getOpenedFile(input.FhOut)
+
+	if opened != nil && outOpened != nil {
+		n, code := opened.WithFlags.File.CopyFileRange(input.OffIn,
+			outOpened.WithFlags.File, input.OffOut, input.Len, input.Flags)
+		out.Size = n
+		return code
+	}
+	return fuse.EBADF
+}
+
 func (c *rawBridge) Flush(input *fuse.FlushIn) fuse.Status {
 	node := c.toInode(input.NodeId)
 	opened := node.mount.getOpenedFile(input.Fh)
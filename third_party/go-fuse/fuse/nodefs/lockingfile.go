@@ -9,7 +9,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/hanwen/go-fuse/fuse"
+	"github.com/smihir/samfs/third_party/go-fuse/fuse"
 )
 
 type lockingFile struct {
@@ -101,3 +101,36 @@ func (f *lockingFile) Allocate(off uint64, size uint64, mode uint32) (code fuse.
 	defer f.mu.Unlock()
 	return f.file.Allocate(off, size, mode)
 }
+
+func (f *lockingFile) GetLk(owner uint64, lk *fuse.FileLock, flags uint32, out *fuse.FileLock) (code fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.GetLk(owner, lk, flags, out)
+}
+
+func (f *lockingFile) SetLk(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.SetLk(owner, lk, flags)
+}
+
+func (f *lockingFile) Lseek(off uint64, whence uint32) (uint64, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Lseek(off, whence)
+}
+
+func (f *lockingFile) CopyFileRange(off uint64, out File, outOff uint64, len uint64, flags uint64) (uint32, fuse.Status) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if l, ok := out.(*lockingFile); ok {
+		out = l.file
+	}
+	return f.file.CopyFileRange(off, out, outOff, len, flags)
+}
+
+// SetLkw does not hold the lock while waiting, so that the holder of the
+// file lock can release it.
+func (f *lockingFile) SetLkw(owner uint64, lk *fuse.FileLock, flags uint32) (code fuse.Status) {
+	return f.file.SetLkw(owner, lk, flags)
+}
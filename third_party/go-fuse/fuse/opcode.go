@@ -56,6 +56,8 @@ const (
 	_OP_FALLOCATE    = int32(43) // protocol version 19.
 	_OP_READDIRPLUS  = int32(44) // protocol version 21.
 	_OP_FUSE_RENAME2 = int32(45) // protocol version 23.
+	_OP_LSEEK        = int32(46) // protocol version 24.
+	_OP_COPY_RANGE   = int32(47) // COPY_FILE_RANGE, protocol version 28.
 
 	// The following entries don't have to be compatible across Go-FUSE versions.
 	_OP_NOTIFY_ENTRY  = int32(100)
@@ -84,6 +86,9 @@ func doInit(server *Server, req *request) {
 	server.kernelSettings = *input
 	server.kernelSettings.Flags = input.Flags & (CAP_ASYNC_READ | CAP_BIG_WRITES | CAP_FILE_OPS |
 		CAP_AUTO_INVAL_DATA | CAP_READDIRPLUS | CAP_NO_OPEN_SUPPORT)
+	if server.opts.EnableLocks {
+		server.kernelSettings.Flags |= input.Flags & (CAP_POSIX_LOCKS | CAP_FLOCK_LOCKS)
+	}
 
 	if input.Minor >= 13 {
 		server.setSplice()
@@ -386,6 +391,26 @@ func doFallocate(server *Server, req *request) {
 	req.status = server.fileSystem.Fallocate((*FallocateIn)(req.inData))
 }
 
+func doGetLk(server *Server, req *request) {
+	req.status = server.fileSystem.GetLk((*LkIn)(req.inData), (*LkOut)(req.outData))
+}
+
+func doSetLk(server *Server, req *request) {
+	req.status = server.fileSystem.SetLk((*LkIn)(req.inData))
+}
+
+func doSetLkw(server *Server, req *request) {
+	req.status = server.fileSystem.SetLkw((*LkIn)(req.inData))
+}
+
+func doLseek(server *Server, req *request) {
+	req.status = server.fileSystem.Lseek((*LseekIn)(req.inData), (*LseekOut)(req.outData))
+}
+
+func doCopyFileRange(server *Server, req *request) {
+	req.status = server.fileSystem.CopyFileRange((*CopyFileRangeIn)(req.inData), (*WriteOut)(req.outData))
+}
+
 ////////////////////////////////////////////////////////////////
 
 type operationFunc func(*Server, *request)
@@ -461,6 +486,11 @@ func init() {
 		_OP_POLL:         unsafe.Sizeof(_PollIn{}),
 		_OP_FALLOCATE:    unsafe.Sizeof(FallocateIn{}),
 		_OP_READDIRPLUS:  unsafe.Sizeof(ReadIn{}),
+		_OP_GETLK:        unsafe.Sizeof(LkIn{}),
+		_OP_SETLK:        unsafe.Sizeof(LkIn{}),
+		_OP_SETLKW:       unsafe.Sizeof(LkIn{}),
+		_OP_LSEEK:        unsafe.Sizeof(LseekIn{}),
+		_OP_COPY_RANGE:   unsafe.Sizeof(CopyFileRangeIn{}),
 	} {
 		operationHandlers[op].InputSize = sz
 	}
@@ -487,6 +517,9 @@ func init() {
 		_OP_NOTIFY_ENTRY:  unsafe.Sizeof(NotifyInvalEntryOut{}),
 		_OP_NOTIFY_INODE:  unsafe.Sizeof(NotifyInvalInodeOut{}),
 		_OP_NOTIFY_DELETE: unsafe.Sizeof(NotifyInvalDeleteOut{}),
+		_OP_GETLK:         unsafe.Sizeof(LkOut{}),
+		_OP_LSEEK:         unsafe.Sizeof(LseekOut{}),
+		_OP_COPY_RANGE:    unsafe.Sizeof(WriteOut{}),
 	} {
 		operationHandlers[op].OutputSize = sz
 	}
@@ -536,6 +569,8 @@ func init() {
 		_OP_NOTIFY_DELETE: "NOTIFY_DELETE",
 		_OP_FALLOCATE:     "FALLOCATE",
 		_OP_READDIRPLUS:   "READDIRPLUS",
+		_OP_LSEEK:         "LSEEK",
+		_OP_COPY_RANGE:    "COPY_FILE_RANGE",
 	} {
 		operationHandlers[op].Name = v
 	}
@@ -576,6 +611,11 @@ func init() {
 		_OP_DESTROY:      doDestroy,
 		_OP_FALLOCATE:    doFallocate,
 		_OP_READDIRPLUS:  doReadDirPlus,
+		_OP_GETLK:        doGetLk,
+		_OP_SETLK:        doSetLk,
+		_OP_SETLKW:       doSetLkw,
+		_OP_LSEEK:        doLseek,
+		_OP_COPY_RANGE:   doCopyFileRange,
 	} {
 		operationHandlers[op].Func = v
 	}
@@ -596,6 +636,9 @@ func init() {
 		_OP_NOTIFY_DELETE: func(ptr unsafe.Pointer) interface{} { return (*NotifyInvalDeleteOut)(ptr) },
 		_OP_STATFS:        func(ptr unsafe.Pointer) interface{} { return (*StatfsOut)(ptr) },
 		_OP_SYMLINK:       func(ptr unsafe.Pointer) interface{} { return (*EntryOut)(ptr) },
+		_OP_GETLK:         func(ptr unsafe.Pointer) interface{} { return (*LkOut)(ptr) },
+		_OP_LSEEK:         func(ptr unsafe.Pointer) interface{} { return (*LseekOut)(ptr) },
+		_OP_COPY_RANGE:    func(ptr unsafe.Pointer) interface{} { return (*WriteOut)(ptr) },
 	} {
 		operationHandlers[op].DecodeOut = f
 	}
@@ -624,6 +667,11 @@ func init() {
 		_OP_FALLOCATE:    func(ptr unsafe.Pointer) interface{} { return (*FallocateIn)(ptr) },
 		_OP_READDIRPLUS:  func(ptr unsafe.Pointer) interface{} { return (*ReadIn)(ptr) },
 		_OP_RENAME:       func(ptr unsafe.Pointer) interface{} { return (*RenameIn)(ptr) },
+		_OP_GETLK:        func(ptr unsafe.Pointer) interface{} { return (*LkIn)(ptr) },
+		_OP_SETLK:        func(ptr unsafe.Pointer) interface{} { return (*LkIn)(ptr) },
+		_OP_SETLKW:       func(ptr unsafe.Pointer) interface{} { return (*LkIn)(ptr) },
+		_OP_LSEEK:        func(ptr unsafe.Pointer) interface{} { return (*LseekIn)(ptr) },
+		_OP_COPY_RANGE:   func(ptr unsafe.Pointer) interface{} { return (*CopyFileRangeIn)(ptr) },
 	} {
 		operationHandlers[op].DecodeIn = f
 	}
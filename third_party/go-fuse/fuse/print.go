@@ -234,6 +234,29 @@ func (f *FallocateIn) string() string {
 		f.Fh, f.Offset, f.Length, f.Mode)
 }
 
+func (f *LkIn) string() string {
+	return fmt.Sprintf("{Fh %d owner %x [%d,%d] typ %d pid %d flags %x}",
+		f.Fh, f.Owner, f.Lk.Start, f.Lk.End, f.Lk.Typ, f.Lk.Pid, f.LkFlags)
+}
+
+func (f *LkOut) string() string {
+	return fmt.Sprintf("{[%d,%d] typ %d pid %d}",
+		f.Lk.Start, f.Lk.End, f.Lk.Typ, f.Lk.Pid)
+}
+
+func (f *LseekIn) string() string {
+	return fmt.Sprintf("{Fh %d off %d whence %d}", f.Fh, f.Offset, f.Whence)
+}
+
+func (f *LseekOut) string() string {
+	return fmt.Sprintf("{off %d}", f.Offset)
+}
+
+func (f *CopyFileRangeIn) string() string {
+	return fmt.Sprintf("{Fh %d off %d => i%d Fh %d off %d len %d flags %x}",
+		f.FhIn, f.OffIn, f.NodeIdOut, f.FhOut, f.OffOut, f.Len, f.Flags)
+}
+
 func (f *LinkIn) string() string {
 	return fmt.Sprintf("{Oldnodeid: %d}", f.Oldnodeid)
 }
@@ -426,6 +426,56 @@ const (
 	WRITE_LOCKOWNER = (1 << 1)
 )
 
+// FileLock describes a byte range lock, as struct fuse_file_lock.
+type FileLock struct {
+	Start uint64
+	End   uint64
+	Typ   uint32
+	Pid   uint32
+}
+
+// LkIn is the input of GETLK, SETLK and SETLKW.
+type LkIn struct {
+	InHeader
+	Fh      uint64
+	Owner   uint64
+	Lk      FileLock
+	LkFlags uint32
+	Padding uint32
+}
+
+// LkOut is the output of GETLK.
+type LkOut struct {
+	Lk FileLock
+}
+
+// LseekIn is the input of LSEEK.
+type LseekIn struct {
+	InHeader
+	Fh      uint64
+	Offset  uint64
+	Whence  uint32
+	Padding uint32
+}
+
+// LseekOut is the output of LSEEK.
+type LseekOut struct {
+	Offset uint64
+}
+
+// CopyFileRangeIn is the input of COPY_FILE_RANGE, its output is a
+// WriteOut.
+type CopyFileRangeIn struct {
+	InHeader
+	FhIn      uint64
+	OffIn     uint64
+	NodeIdOut uint64
+	FhOut     uint64
+	OffOut    uint64
+	Len       uint64
+	Flags     uint64
+}
+
 type FallocateIn struct {
 	InHeader
 	Fh      uint64
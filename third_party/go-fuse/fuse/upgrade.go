@@ -322,3 +322,48 @@ func (fs *wrappingFS) Fallocate(in *FallocateIn) (code Status) {
 	}
 	return ENOSYS
 }
+
+func (fs *wrappingFS) GetLk(in *LkIn, out *LkOut) (code Status) {
+	if s, ok := fs.fs.(interface {
+		GetLk(in *LkIn, out *LkOut) (code Status)
+	}); ok {
+		return s.GetLk(in, out)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) SetLk(in *LkIn) (code Status) {
+	if s, ok := fs.fs.(interface {
+		SetLk(in *LkIn) (code Status)
+	}); ok {
+		return s.SetLk(in)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) SetLkw(in *LkIn) (code Status) {
+	if s, ok := fs.fs.(interface {
+		SetLkw(in *LkIn) (code Status)
+	}); ok {
+		return s.SetLkw(in)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) Lseek(in *LseekIn, out *LseekOut) (code Status) {
+	if s, ok := fs.fs.(interface {
+		Lseek(in *LseekIn, out *LseekOut) (code Status)
+	}); ok {
+		return s.Lseek(in, out)
+	}
+	return ENOSYS
+}
+
+func (fs *wrappingFS) CopyFileRange(in *CopyFileRangeIn, out *WriteOut) (code Status) {
+	if s, ok := fs.fs.(interface {
+		CopyFileRange(in *CopyFileRangeIn, out *WriteOut) (code Status)
+	}); ok {
+		return s.CopyFileRange(in, out)
+	}
+	return ENOSYS
+}